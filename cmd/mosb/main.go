@@ -26,6 +26,7 @@ func main() {
 			Usage: "display additional debug information",
 		},
 	}
+	app.Flags = append(app.Flags, mosconfig.RegistryFlags...)
 
 	app.Before = func(c *cli.Context) error {
 		if c.Bool("debug") {
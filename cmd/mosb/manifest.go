@@ -19,6 +19,14 @@ var manifestCmd = cli.Command{
 					Usage: "project (specified as \"keyset:project\") for which to sign the manifest",
 					Value: "",
 				},
+				cli.StringFlag{
+					Name:  "key",
+					Usage: "private key file or PKCS#11 URI (pkcs11:token=...;object=...) with which to sign the manifest, instead of the project's",
+				},
+				cli.StringFlag{
+					Name:  "cert",
+					Usage: "certificate for --key, instead of the project's",
+				},
 				cli.StringFlag{
 					Name:  "repo",
 					Usage: "address:port for the OCI repository to write to, e.g. 10.0.2.2:5000",
@@ -37,15 +45,48 @@ var manifestCmd = cli.Command{
 					Usage: "Password to authenticate to OCI repository.  Taken from stdin if user but no password is provided",
 					Value: "",
 				},
+				cli.StringFlag{
+					Name:  "token",
+					Usage: "Bearer token to authenticate to OCI repository",
+					Value: "",
+				},
 				cli.BoolFlag{
 					Name:  "skip-boot, skip-bootkit",
 					Usage: "Do not add in a bootkit layer",
 				},
 			},
 		},
+		cli.Command{
+			Name:      "downgrade-token",
+			Action:    doDowngradeToken,
+			Usage:     "authorize installing an install manifest with a lower security version than a machine has accepted",
+			ArgsUsage: "install-manifest-url",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "project, product",
+					Usage: "project (specified as \"keyset:project\") with whose key to sign the token",
+				},
+				cli.StringFlag{
+					Name:  "key",
+					Usage: "private key file or PKCS#11 URI with which to sign the token, instead of the project's",
+				},
+				cli.StringFlag{
+					Name:  "cert",
+					Usage: "certificate for --key, instead of the project's",
+				},
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "file to write the token to",
+				},
+			},
+		},
 	},
 }
 
 func doPublishManifest(ctx *cli.Context) error {
 	return mosconfig.PublishManifestFromArgs(ctx)
 }
+
+func doDowngradeToken(ctx *cli.Context) error {
+	return mosconfig.DowngradeTokenFromArgs(ctx)
+}
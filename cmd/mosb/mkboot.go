@@ -60,6 +60,10 @@ func doMkBoot(ctx *cli.Context) error {
 
 	cachedir := filepath.Join(tmpd, "cache")
 	utils.EnsureDir(cachedir)
+	reg, err := mosconfig.RegistryFromContext(ctx)
+	if err != nil {
+		return err
+	}
 	ociboot := mosconfig.OciBoot{
 		KeySet:         s[0],
 		Project:        s[1],
@@ -70,6 +74,7 @@ func doMkBoot(ctx *cli.Context) error {
 		Cmdline:        ctx.String("cmdline"),
 		BootFromRemote: ctx.Bool("boot-from-remote"),
 		RepoDir:        cachedir,
+		Registry:       reg,
 	}
 
 	ociboot.Files = map[string]string{}
@@ -41,7 +41,11 @@ func doMkProvision(ctx *cli.Context) error {
 	keyset := s[0]
 	project := s[1]
 
-	if err := mosconfig.BuildProvisioner(keyset, project, outfile); err != nil {
+	reg, err := mosconfig.RegistryFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	if err := mosconfig.BuildProvisioner(reg, keyset, project, outfile); err != nil {
 		return errors.Wrapf(err, "Failed building provisioning ISO")
 	}
 
@@ -42,7 +42,10 @@ func doActivate(ctx *cli.Context) error {
 		target = "hostfs"
 	}
 
-	opts := mosconfig.DefaultMosOptions()
+	opts, err := mosOptions(ctx)
+	if err != nil {
+		return err
+	}
 	opts.RootDir = rfs
 	capath := ctx.String("capath")
 	if capath != "" {
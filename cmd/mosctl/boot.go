@@ -13,7 +13,10 @@ var bootCmd = cli.Command{
 }
 
 func doBootCmd(ctx *cli.Context) error {
-	opts := mosconfig.DefaultMosOptions()
+	opts, err := mosOptions(ctx)
+	if err != nil {
+		return err
+	}
 	mos, err := mosconfig.OpenMos(opts)
 	if err != nil {
 		return errors.Wrapf(err, "Failed opening mos")
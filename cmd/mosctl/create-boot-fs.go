@@ -33,7 +33,10 @@ var createBootFsCmd = cli.Command{
 // Note, setup of luks keys, SUDI keys, and extension of PCR7
 // must already have been done.
 func doCreateBootfs(ctx *cli.Context) error {
-	opts := mosconfig.DefaultMosOptions()
+	opts, err := mosOptions(ctx)
+	if err != nil {
+		return err
+	}
 
 	if ctx.IsSet("rfs") {
 		opts.RootDir = ctx.String("rfs")
@@ -45,7 +48,7 @@ func doCreateBootfs(ctx *cli.Context) error {
 	}
 
 	dest := ctx.String("dest")
-	err = mos.Mount("hostfs", dest, "", ctx.Bool("readonly"))
+	err = mos.MountBootHostfs(dest, ctx.Bool("readonly"))
 	if err != nil {
 		return errors.Wrapf(err, "Error mounting rootfs %q", dest)
 	}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/project-machine/mos/pkg/mosconfig"
+	"github.com/project-machine/mos/pkg/utils"
+	"github.com/urfave/cli"
+)
+
+var gcCmd = cli.Command{
+	Name:   "gc",
+	Usage:  "remove images and storage metadata which are no longer needed",
+	Action: doGC,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "root, rfs, r",
+			Usage: "Directory under which to find the mos install",
+			Value: "/",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Only show what would be removed",
+		},
+		cli.IntFlag{
+			Name:  "keep-history",
+			Usage: "Also keep the images of this many earlier manifest revisions, for rollback",
+			Value: 0,
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the result as json",
+		},
+	},
+}
+
+// humanSize formats @n bytes for people.
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func doGC(ctx *cli.Context) error {
+	rfs := ctx.String("root")
+	if rfs == "" || !utils.PathExists(rfs) {
+		return fmt.Errorf("A valid root directory must be specified")
+	}
+
+	opts, err := mosOptions(ctx)
+	if err != nil {
+		return err
+	}
+	opts.RootDir = rfs
+	opts.LayersReadOnly = ctx.Bool("dry-run")
+
+	mos, err := mosconfig.OpenMos(opts)
+	if err != nil {
+		return fmt.Errorf("Failed opening mos: %w", err)
+	}
+	defer mos.Close()
+
+	res, err := mos.GC(mosconfig.GCOptions{
+		DryRun:      ctx.Bool("dry-run"),
+		KeepHistory: ctx.Int("keep-history"),
+	})
+	if err != nil {
+		return fmt.Errorf("Garbage collection failed: %w", err)
+	}
+
+	if ctx.Bool("json") {
+		return printJson(res)
+	}
+
+	verb := "Removed"
+	if res.DryRun {
+		verb = "Would remove"
+	}
+	for _, t := range res.RemovedTags {
+		fmt.Printf("%s image %s\n", verb, t)
+	}
+	for _, p := range res.RemovedMetadata {
+		fmt.Printf("%s %s\n", verb, p)
+	}
+	fmt.Printf("%s %d images, %d blobs and %d stale metadata entries, reclaiming %s\n",
+		verb, len(res.RemovedTags), len(res.RemovedBlobs), len(res.RemovedMetadata), humanSize(res.Reclaimed))
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/project-machine/mos/pkg/mosconfig"
+	"github.com/project-machine/mos/pkg/utils"
+	"github.com/urfave/cli"
+)
+
+var historyFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "root, rfs, r",
+		Usage: "Directory under which to find the mos install",
+		Value: "/",
+	},
+	cli.BoolFlag{
+		Name:  "json",
+		Usage: "Print the history as json",
+	},
+}
+
+var historyCmd = cli.Command{
+	Name:   "history",
+	Usage:  "list past system manifests",
+	Action: doHistory,
+	Flags:  historyFlags,
+	Subcommands: []cli.Command{
+		cli.Command{
+			Name:      "show",
+			Usage:     "show the details of one system manifest revision",
+			ArgsUsage: "[revision]",
+			Action:    doHistoryShow,
+			Flags:     historyFlags,
+		},
+	},
+}
+
+func historyMos(ctx *cli.Context) (*mosconfig.Mos, error) {
+	rfs := ctx.String("root")
+	if rfs == "" || !utils.PathExists(rfs) {
+		return nil, fmt.Errorf("A valid root directory must be specified")
+	}
+
+	opts, err := mosOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	opts.RootDir = rfs
+
+	mos, err := mosconfig.OpenMos(opts)
+	if err != nil {
+		return nil, fmt.Errorf("Failed opening mos: %w", err)
+	}
+	return mos, nil
+}
+
+func printJson(v interface{}) error {
+	bytes, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed marshalling json: %w", err)
+	}
+	fmt.Println(string(bytes))
+	return nil
+}
+
+func doHistory(ctx *cli.Context) error {
+	mos, err := historyMos(ctx)
+	if err != nil {
+		return err
+	}
+	defer mos.Close()
+
+	revs, err := mos.History()
+	if err != nil {
+		return fmt.Errorf("Failed reading manifest history: %w", err)
+	}
+
+	if ctx.Bool("json") {
+		return printJson(revs)
+	}
+
+	for _, r := range revs {
+		subject := strings.SplitN(r.Message, "\n", 2)[0]
+		fmt.Printf("%s %s %s\n", r.Revision[:12], r.Time.Format("2006-01-02 15:04:05"), subject)
+		for _, c := range r.Changes {
+			fmt.Printf("    %s\n", c)
+		}
+	}
+
+	return nil
+}
+
+func doHistoryShow(ctx *cli.Context) error {
+	if len(ctx.Args()) > 1 {
+		return fmt.Errorf("Only one revision may be specified")
+	}
+
+	mos, err := historyMos(ctx)
+	if err != nil {
+		return err
+	}
+	defer mos.Close()
+
+	r, err := mos.ShowRevision(ctx.Args().First())
+	if err != nil {
+		return fmt.Errorf("Failed reading manifest revision: %w", err)
+	}
+
+	if ctx.Bool("json") {
+		return printJson(r)
+	}
+
+	fmt.Printf("revision %s\n", r.Revision)
+	fmt.Printf("Date: %s\n\n", r.Time.Format("2006-01-02 15:04:05 -0700"))
+	for _, l := range strings.Split(r.Message, "\n") {
+		fmt.Printf("    %s\n", l)
+	}
+
+	fmt.Printf("\nTargets:\n")
+	for _, t := range r.Targets {
+		fmt.Printf("  %s\n", t.Name)
+		fmt.Printf("    version:      %s\n", t.Version)
+		fmt.Printf("    digest:       %s\n", t.Digest)
+		fmt.Printf("    service type: %s\n", t.ServiceType)
+		fmt.Printf("    update type:  %s\n", t.UpdateType)
+		fmt.Printf("    product:      %s\n", t.Product)
+		fmt.Printf("    cert subject: %s\n", t.CertSubject)
+	}
+
+	fmt.Printf("\nChanges:\n")
+	if len(r.Changes) == 0 {
+		fmt.Printf("  none\n")
+	}
+	for _, c := range r.Changes {
+		fmt.Printf("  %s\n", c)
+	}
+
+	return nil
+}
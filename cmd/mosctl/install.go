@@ -34,6 +34,19 @@ var installCmd = cli.Command{
 			Usage: "Directory under which to find the mos install",
 			Value: "/",
 		},
+		cli.StringFlag{
+			Name:  "storage-type",
+			Usage: "How to store and mount target images: atomfs or puzzlefs",
+			Value: string(mosconfig.AtomfsStorageType),
+		},
+		cli.StringSliceFlag{
+			Name:  "mirror",
+			Usage: "Registry or mirror to fetch from, tried in the order given before the one in the url.  Saved for later updates",
+		},
+		cli.StringFlag{
+			Name:  "downgrade-token",
+			Usage: "Token from 'mosb manifest downgrade-token' authorizing a manifest with a lower security version than the TPM has recorded",
+		},
 	},
 }
 
@@ -602,14 +615,26 @@ func doPartition(opts mosconfig.InstallOpts) error {
 
 func doInstall(ctx *cli.Context) error {
 	opts := mosconfig.InstallOpts{
-		RFS:       ctx.String("rfs"),
-		StoreDir:  "/atomfs-store",
-		ConfigDir: "/config",
-		CaPath:    "/factory/secure/manifestCA.pem",
+		RFS:          ctx.String("rfs"),
+		StoreDir:     "/atomfs-store",
+		ConfigDir:    "/config",
+		CaPath:       "/factory/secure/manifestCA.pem",
+		SudiCertPath: "/factory/secure/server.crt",
+
+		StorageType:    mosconfig.StorageType(ctx.String("storage-type")),
+		Registry:       mosconfig.RegistryOptionsFromContext(ctx),
+		DowngradeToken: ctx.String("downgrade-token"),
+	}
+	opts.Registry.Mirrors = ctx.StringSlice("mirror")
+	t, err := mosconfig.VerifyTimeFromContext(ctx)
+	if err != nil {
+		return err
 	}
+	opts.VerifyTime = t
 
 	if ctx.IsSet("rfs") {
 		opts.CaPath = filepath.Join(opts.RFS, opts.CaPath)
+		opts.SudiCertPath = filepath.Join(opts.RFS, opts.SudiCertPath)
 		opts.ConfigDir = filepath.Join(opts.RFS, opts.ConfigDir)
 		opts.StoreDir = filepath.Join(opts.RFS, opts.StoreDir)
 	}
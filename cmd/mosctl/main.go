@@ -18,8 +18,15 @@ func main() {
 		createBootFsCmd,
 		activateCmd,
 		bootCmd,
+		deactivateCmd,
+		gcCmd,
+		historyCmd,
 		installCmd,
 		mountCmd,
+		restartCmd,
+		rollbackCmd,
+		statusCmd,
+		stopCmd,
 		updateCmd,
 		// trust subcommands
 		initrdSetupCmd,
@@ -32,15 +39,31 @@ func main() {
 			Usage: "display additional debug information",
 		},
 	}
+	app.Flags = append(app.Flags, mosconfig.RegistryFlags...)
+	app.Flags = append(app.Flags, mosconfig.VerifyFlags...)
 
 	app.Before = func(c *cli.Context) error {
 		if c.Bool("debug") {
 			log.SetLevel(log.DebugLevel)
 		}
-		return nil
+		_, err := mosconfig.VerifyTimeFromContext(c)
+		return err
 	}
 
 	if err := app.Run(os.Args); err != nil {
 		log.Fatalf("%v\n", err)
 	}
 }
+
+// mosOptions returns the default MosOptions, with the registry and
+// verification settings from the global flags.
+func mosOptions(ctx *cli.Context) (mosconfig.MosOptions, error) {
+	opts := mosconfig.DefaultMosOptions()
+	opts.Registry = mosconfig.RegistryOptionsFromContext(ctx)
+	t, err := mosconfig.VerifyTimeFromContext(ctx)
+	if err != nil {
+		return opts, err
+	}
+	opts.VerifyTime = t
+	return opts, nil
+}
@@ -11,7 +11,7 @@ import (
 
 var mountCmd = cli.Command{
 	Name:   "mount",
-	Usage:  "mount a service filesystem, from host manifest or manifest at OCI URL (positional argument)",
+	Usage:  "mount a service filesystem, from host manifest or manifest at OCI URL or oci:/layout:tag (positional argument)",
 	Action: doMount,
 	Flags: []cli.Flag{
 		cli.StringFlag{
@@ -58,7 +58,10 @@ func doMount(ctx *cli.Context) error {
 		dest = ctx.String("dest")
 	}
 
-	opts := mosconfig.DefaultMosOptions()
+	opts, err := mosOptions(ctx)
+	if err != nil {
+		return err
+	}
 	opts.RootDir = rfs
 
 	mos, err := mosconfig.OpenMos(opts)
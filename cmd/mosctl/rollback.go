@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/project-machine/mos/pkg/mosconfig"
+	"github.com/project-machine/mos/pkg/utils"
+	"github.com/urfave/cli"
+)
+
+var rollbackCmd = cli.Command{
+	Name:   "rollback",
+	Usage:  "revert to a previous system manifest",
+	Action: doRollback,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "root, rfs, r",
+			Usage: "Directory under which to find the mos install",
+			Value: "/",
+		},
+		cli.StringFlag{
+			Name:  "capath, ca",
+			Usage: "Manifest CA path",
+			Value: "/factory/secure/manifestCA.pem",
+		},
+		cli.StringFlag{
+			Name:  "to",
+			Usage: "Manifest revision (git commit) to roll back to",
+		},
+		cli.IntFlag{
+			Name:  "steps",
+			Usage: "Number of manifest revisions to roll back",
+			Value: 1,
+		},
+		cli.StringFlag{
+			Name:  "downgrade-token",
+			Usage: "Token from 'mosb manifest downgrade-token' authorizing a manifest with a lower security version",
+		},
+	},
+}
+
+func doRollback(ctx *cli.Context) error {
+	rfs := ctx.String("root")
+	if rfs == "" || !utils.PathExists(rfs) {
+		return fmt.Errorf("A valid root directory must be specified")
+	}
+
+	if ctx.IsSet("to") && ctx.IsSet("steps") {
+		return fmt.Errorf("Only one of --to and --steps may be specified")
+	}
+
+	opts, err := mosOptions(ctx)
+	if err != nil {
+		return err
+	}
+	opts.RootDir = rfs
+	capath := ctx.String("capath")
+	if capath != "" {
+		opts.CaPath = capath
+	}
+	opts.LayersReadOnly = false
+	opts.ManifestReadOnly = false
+	opts.DowngradeToken = ctx.String("downgrade-token")
+
+	mos, err := mosconfig.OpenMos(opts)
+	if err != nil {
+		return fmt.Errorf("Failed opening mos: %w", err)
+	}
+	defer mos.Close()
+
+	err = mos.Rollback(ctx.String("to"), ctx.Int("steps"))
+	if err != nil {
+		return fmt.Errorf("Rollback failed: %w", err)
+	}
+
+	return nil
+}
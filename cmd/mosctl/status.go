@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/project-machine/mos/pkg/mosconfig"
+	"github.com/project-machine/mos/pkg/utils"
+	"github.com/urfave/cli"
+)
+
+var statusCmd = cli.Command{
+	Name:   "status",
+	Usage:  "show the state of every service",
+	Action: doStatus,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "root, rfs, r",
+			Usage: "Directory under which to find the mos install",
+			Value: "/",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the status as json",
+		},
+	},
+}
+
+func doStatus(ctx *cli.Context) error {
+	rfs := ctx.String("root")
+	if rfs == "" || !utils.PathExists(rfs) {
+		return fmt.Errorf("A valid root directory must be specified")
+	}
+
+	opts, err := mosOptions(ctx)
+	if err != nil {
+		return err
+	}
+	opts.RootDir = rfs
+
+	mos, err := mosconfig.OpenMos(opts)
+	if err != nil {
+		return fmt.Errorf("Failed opening mos: %w", err)
+	}
+	defer mos.Close()
+
+	status, err := mos.Status()
+	if err != nil {
+		return err
+	}
+
+	if ctx.Bool("json") {
+		return printJson(status)
+	}
+
+	for _, s := range status {
+		running := s.RunningHash
+		if running == "" {
+			running = "not running"
+		}
+		fmt.Printf("%s (%s)\n", s.Name, s.ServiceType)
+		fmt.Printf("    version:  %s\n", s.Version)
+		fmt.Printf("    digest:   %s\n", s.Digest)
+		fmt.Printf("    running:  %s\n", running)
+		if s.RunningVer != "" {
+			fmt.Printf("    running version: %s (%s)\n", s.RunningVer, s.RunningDig)
+		}
+		if s.HashMismatch {
+			fmt.Printf("    WARNING:  running layer does not match the manifest\n")
+		}
+		if s.LxcState != "" {
+			fmt.Printf("    lxc:      %s\n", s.LxcState)
+		}
+		if s.UnitState != "" {
+			fmt.Printf("    systemd:  %s\n", s.UnitState)
+		}
+		for _, a := range s.Addresses {
+			fmt.Printf("    address:  %s\n", a)
+		}
+		for _, p := range s.Ports {
+			fmt.Printf("    port:     %d -> %d\n", p.HostPort, p.ContainerPort)
+		}
+		for _, v := range s.Storage {
+			mounted := "mounted"
+			if !v.Mounted {
+				mounted = "not mounted"
+			}
+			fmt.Printf("    storage:  %s at %s (%s)\n", v.Label, v.Dest, mounted)
+		}
+		if s.Error != "" {
+			fmt.Printf("    error:    %s\n", s.Error)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/project-machine/mos/pkg/mosconfig"
+	"github.com/project-machine/mos/pkg/utils"
+	"github.com/urfave/cli"
+)
+
+var targetCmdFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "root, rfs, r",
+		Usage: "Directory under which to find the mos install",
+		Value: "/",
+	},
+	cli.StringFlag{
+		Name:  "capath, ca",
+		Usage: "Manifest CA path",
+		Value: "/factory/secure/manifestCA.pem",
+	},
+}
+
+var stopCmd = cli.Command{
+	Name:      "stop",
+	Usage:     "stop a running service",
+	ArgsUsage: "<target>",
+	Action:    doStop,
+	Flags:     targetCmdFlags,
+}
+
+var restartCmd = cli.Command{
+	Name:      "restart",
+	Usage:     "stop and start a service",
+	ArgsUsage: "<target>",
+	Action:    doRestart,
+	Flags:     targetCmdFlags,
+}
+
+var deactivateCmd = cli.Command{
+	Name:      "deactivate",
+	Usage:     "stop a service and keep it from starting at boot, until it is activated again",
+	ArgsUsage: "<target>",
+	Action:    doDeactivate,
+	Flags:     targetCmdFlags,
+}
+
+// openTargetMos opens mos for a command acting on the single target
+// named in its arguments.
+func openTargetMos(ctx *cli.Context) (*mosconfig.Mos, string, error) {
+	if len(ctx.Args()) != 1 {
+		return nil, "", fmt.Errorf("A single target must be specified")
+	}
+	target := ctx.Args()[0]
+
+	rfs := ctx.String("root")
+	if rfs == "" || !utils.PathExists(rfs) {
+		return nil, "", fmt.Errorf("A valid root directory must be specified")
+	}
+
+	opts, err := mosOptions(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	opts.RootDir = rfs
+	capath := ctx.String("capath")
+	if capath != "" {
+		opts.CaPath = capath
+	}
+	mos, err := mosconfig.OpenMos(opts)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed opening mos: %w", err)
+	}
+
+	return mos, target, nil
+}
+
+func doStop(ctx *cli.Context) error {
+	mos, target, err := openTargetMos(ctx)
+	if err != nil {
+		return err
+	}
+	defer mos.Close()
+
+	if err := mos.Stop(target); err != nil {
+		return fmt.Errorf("Failed to stop %s: %w", target, err)
+	}
+	return nil
+}
+
+func doRestart(ctx *cli.Context) error {
+	mos, target, err := openTargetMos(ctx)
+	if err != nil {
+		return err
+	}
+	defer mos.Close()
+
+	if err := mos.Restart(target); err != nil {
+		return fmt.Errorf("Failed to restart %s: %w", target, err)
+	}
+	return nil
+}
+
+func doDeactivate(ctx *cli.Context) error {
+	mos, target, err := openTargetMos(ctx)
+	if err != nil {
+		return err
+	}
+	defer mos.Close()
+
+	if err := mos.Deactivate(target); err != nil {
+		return fmt.Errorf("Failed to deactivate %s: %w", target, err)
+	}
+	return nil
+}
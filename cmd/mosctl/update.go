@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"path/filepath"
+	"strings"
 
 	"github.com/project-machine/mos/pkg/mosconfig"
 	"github.com/project-machine/mos/pkg/utils"
@@ -19,36 +20,169 @@ var updateCmd = cli.Command{
 			Usage: "Directory under which to find the mos install",
 			Value: "/",
 		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Only show what the update would do",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "With --dry-run, print the plan as json",
+		},
+		cli.BoolFlag{
+			Name:  "stage",
+			Usage: "Only download and verify the update, to be applied later with --apply",
+		},
+		cli.BoolFlag{
+			Name:  "apply",
+			Usage: "Apply the staged update, without network access",
+		},
+		cli.BoolFlag{
+			Name:  "discard",
+			Usage: "Drop the staged update",
+		},
+		cli.StringSliceFlag{
+			Name:  "mirror",
+			Usage: "Registry or mirror to fetch from, tried in the order given before the one in the url (default from /config/registries.yaml)",
+		},
+		cli.StringFlag{
+			Name:  "downgrade-token",
+			Usage: "Token from 'mosb manifest downgrade-token' authorizing a manifest with a lower security version",
+		},
 	},
 }
 
+func shortDigest(d string) string {
+	d = strings.TrimPrefix(d, "sha256:")
+	if len(d) > 12 {
+		return d[:12]
+	}
+	return d
+}
+
+func printUpdatePlan(plan *mosconfig.UpdatePlan) {
+	fmt.Printf("Update to %s (%s, %s update)\n", plan.Url, plan.Product, plan.UpdateType)
+	for _, t := range plan.Added {
+		fmt.Printf("  add      %s %s (%s)\n", t.Name, t.NewVersion, shortDigest(t.NewDigest))
+	}
+	for _, t := range plan.Replaced {
+		fmt.Printf("  replace  %s %s (%s) -> %s (%s)\n", t.Name, t.OldVersion, shortDigest(t.OldDigest),
+			t.NewVersion, shortDigest(t.NewDigest))
+	}
+	for _, t := range plan.Kept {
+		fmt.Printf("  keep     %s %s (%s)\n", t.Name, t.NewVersion, shortDigest(t.NewDigest))
+	}
+	for _, t := range plan.Removed {
+		fmt.Printf("  remove   %s %s (%s)\n", t.Name, t.OldVersion, shortDigest(t.OldDigest))
+	}
+	for _, s := range plan.StorageCreated {
+		fmt.Printf("  create storage %s (%d MiB)\n", s.Label, s.Size)
+	}
+	for _, s := range plan.StorageDeleted {
+		fmt.Printf("  delete storage %s\n", s.Label)
+	}
+	for _, u := range plan.NewUidMaps {
+		fmt.Printf("  new uid map %s at %d\n", u.Name, u.Hostid)
+	}
+	fmt.Printf("Download size: %s\n", humanSize(plan.DownloadBytes))
+	if plan.RebootNeeded {
+		fmt.Printf("Reboot needed to activate the new %s\n", strings.Join(plan.RebootFor, " and "))
+	}
+}
+
 func doUpdate(ctx *cli.Context) error {
 	rfs := ctx.String("root")
 	if rfs == "" || !utils.PathExists(rfs) {
 		return fmt.Errorf("A valid root directory must be specified")
 	}
 
-	opts := mosconfig.DefaultMosOptions()
+	opts, err := mosOptions(ctx)
+	if err != nil {
+		return err
+	}
 	opts.RootDir = rfs
+	opts.LayersReadOnly = ctx.Bool("dry-run")
+	opts.Registry.Mirrors = ctx.StringSlice("mirror")
+	opts.DowngradeToken = ctx.String("downgrade-token")
 	capath := filepath.Join(rfs, "factory/secure/manifestCA.pem")
 	if ctx.IsSet(capath) {
 		opts.CaPath = capath
 	}
 
+	modes := 0
+	for _, m := range []string{"dry-run", "stage", "apply", "discard"} {
+		if ctx.Bool(m) {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return fmt.Errorf("Only one of --dry-run, --stage, --apply and --discard may be given")
+	}
+
 	mos, err := mosconfig.OpenMos(opts)
 	if err != nil {
 		return fmt.Errorf("Failed opening mos: %w", err)
 	}
 	defer mos.Close()
 
+	if ctx.Bool("apply") || ctx.Bool("discard") {
+		if len(ctx.Args()) != 0 {
+			return fmt.Errorf("--apply and --discard take no arguments")
+		}
+		if ctx.Bool("discard") {
+			return mos.DiscardStagedUpdate()
+		}
+		s, err := mos.StagedUpdate()
+		if err != nil {
+			return err
+		}
+		if s == nil {
+			return fmt.Errorf("No update is staged")
+		}
+		if err := mos.ApplyStagedUpdate(); err != nil {
+			return fmt.Errorf("Applying staged update from %q failed: %w", s.Url, err)
+		}
+		return reportUpdate(mos)
+	}
+
 	if len(ctx.Args()) != 1 {
 		return fmt.Errorf("update requires an oci url for update manifest")
 	}
 	url := ctx.Args()[0]
+
+	if ctx.Bool("stage") {
+		s, err := mos.StageUpdate(url)
+		if err != nil {
+			return fmt.Errorf("Staging update using %q failed: %w", url, err)
+		}
+		fmt.Printf("Update to %s (%d targets) staged, apply it with 'mosctl update --apply'\n", s.Url, len(s.Targets))
+		return nil
+	}
+
+	if ctx.Bool("dry-run") {
+		plan, err := mos.PlanUpdate(url)
+		if err != nil {
+			return fmt.Errorf("Planning update using %q failed: %w", url, err)
+		}
+		if ctx.Bool("json") {
+			return printJson(plan)
+		}
+		printUpdatePlan(plan)
+		return nil
+	}
+
 	err = mos.Update(url)
 	if err != nil {
 		return fmt.Errorf("Update using %q failed: %w", url, err)
 	}
 
+	return reportUpdate(mos)
+}
+
+func reportUpdate(mos *mosconfig.Mos) error {
+	res, err := mos.LastUpdateResult()
+	if err == nil && res.RebootNeeded {
+		fmt.Println("Update complete, reboot pending to activate the new hostfs")
+	}
+
 	return nil
 }
@@ -93,7 +93,11 @@ func makeKeydirs(keysetPath string) error {
 	return nil
 }
 
-func initkeyset(keysetName string, Org []string) error {
+// initkeyset creates a new keyset.  The manifest CA and the default
+// project's manifest signing key are of type @keyType.  The UEFI, UKI,
+// TPM policy and SUDI keys are always RSA 2048, as firmware and TPMs
+// expect.
+func initkeyset(keysetName string, Org []string, keyType string) error {
 	var caTemplate, certTemplate x509.Certificate
 	const (
 		doGUID = true
@@ -137,7 +141,7 @@ func initkeyset(keysetName string, Org []string) error {
 	caTemplate.BasicConstraintsValid = true
 
 	// Generate the manifest rootCA
-	err = generaterootCA(filepath.Join(keysetPath, "manifest-ca"), &caTemplate, noGUID)
+	err = generaterootCA(filepath.Join(keysetPath, "manifest-ca"), &caTemplate, noGUID, keyType)
 	if err != nil {
 		return err
 	}
@@ -145,7 +149,7 @@ func initkeyset(keysetName string, Org []string) error {
 	// Generate the sudi rootCA
 	caTemplate.Subject.CommonName = "SUDI rootCA"
 	caTemplate.NotAfter = time.Date(2099, time.December, 31, 23, 0, 0, 0, time.UTC)
-	err = generaterootCA(filepath.Join(keysetPath, "sudi-ca"), &caTemplate, noGUID)
+	err = generaterootCA(filepath.Join(keysetPath, "sudi-ca"), &caTemplate, noGUID, trust.KeyTypeRSA2048)
 	if err != nil {
 		return err
 	}
@@ -153,7 +157,7 @@ func initkeyset(keysetName string, Org []string) error {
 	// Generate PK
 	caTemplate.Subject.CommonName = "UEFI PK"
 	caTemplate.NotAfter = time.Now().AddDate(50, 0, 0)
-	err = generaterootCA(filepath.Join(keysetPath, "uefi-pk"), &caTemplate, doGUID)
+	err = generaterootCA(filepath.Join(keysetPath, "uefi-pk"), &caTemplate, doGUID, trust.KeyTypeRSA2048)
 	if err != nil {
 		return err
 	}
@@ -180,7 +184,7 @@ func initkeyset(keysetName string, Org []string) error {
 	certTemplate.Subject.CommonName = "UEFI KEK"
 	certTemplate.NotAfter = time.Now().AddDate(50, 0, 0)
 	certTemplate.ExtKeyUsage = nil
-	err = SignCert(&certTemplate, CAcert, CAprivkey, filepath.Join(keysetPath, "uefi-kek"))
+	err = SignCert(&certTemplate, CAcert, CAprivkey, filepath.Join(keysetPath, "uefi-kek"), trust.KeyTypeRSA2048)
 	if err != nil {
 		return err
 	}
@@ -200,7 +204,7 @@ func initkeyset(keysetName string, Org []string) error {
 		return errors.Wrapf(err, "Failed creating default sudi directory")
 	}
 
-	if err = generateNewUUIDCreds(keysetName, mName); err != nil {
+	if err = generateNewUUIDCreds(keysetName, mName, keyType, ""); err != nil {
 		return errors.Wrapf(err, "Failed creating default project keyset")
 	}
 
@@ -267,6 +271,11 @@ var keysetCmd = cli.Command{
 					Hidden: true,
 					Value:  "",
 				},
+				cli.StringFlag{
+					Name:  "key-type",
+					Usage: fmt.Sprintf("Type of the manifest CA and signing keys, one of %s", strings.Join(trust.KeyTypes, ", ")),
+					Value: trust.DefaultKeyType,
+				},
 			},
 		},
 		{
@@ -331,6 +340,14 @@ func doAddKeyset(ctx *cli.Context) error {
 
 	mosctlPath := ctx.String("mosctl-path")
 
+	keyType := ctx.String("key-type")
+	if err := trust.CheckKeyType(keyType); err != nil {
+		return err
+	}
+	if keysetName == "snakeoil" && keyType != trust.DefaultKeyType {
+		return errors.New("The snakeoil keyset is fetched, not generated, so --key-type cannot be used with it")
+	}
+
 	bootkitVersion := ctx.String("bootkit-version")
 	Org := ctx.StringSlice("org")
 	if Org == nil {
@@ -355,7 +372,7 @@ func doAddKeyset(ctx *cli.Context) error {
 
 	default:
 		// Otherwise, generate a new keyset
-		err = initkeyset(keysetName, Org)
+		err = initkeyset(keysetName, Org, keyType)
 	}
 	if err != nil {
 		os.Remove(keysetPath)
@@ -586,7 +603,7 @@ func buildProvisioner(keysetName string) error {
 	outfile := filepath.Join(keyPath, "artifacts", "provision.iso")
 	utils.EnsureDir(filepath.Dir(outfile))
 
-	if err := mosconfig.BuildProvisioner(keysetName, "default", outfile); err != nil {
+	if err := mosconfig.BuildProvisioner(nil, keysetName, "default", outfile); err != nil {
 		return errors.Wrapf(err, "Failed to create provisioning ISO")
 	}
 
@@ -610,7 +627,7 @@ func buildInstaller(keysetName string) error {
 		return errors.Wrapf(err, "Failed creating %q", outfile)
 	}
 
-	if err := mosconfig.BuildInstaller(keysetName, "default", outfile); err != nil {
+	if err := mosconfig.BuildInstaller(nil, keysetName, "default", outfile); err != nil {
 		return errors.Wrapf(err, "Failed to create provisioning ISO")
 	}
 
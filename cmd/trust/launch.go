@@ -113,7 +113,7 @@ func doLaunch(ctx *cli.Context) error {
 	}
 
 	uuid := ctx.String("uuid")
-	sudiDir, err := genSudi(keysetDir, projDir, uuid)
+	sudiDir, err := genSudi(keysetDir, projDir, uuid, "")
 	if err != nil {
 		return errors.Wrapf(err, "Failed generating SUDI")
 	}
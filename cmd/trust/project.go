@@ -3,11 +3,14 @@ package main
 // Project == product
 
 import (
+	"crypto"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/pkg/errors"
+	"github.com/project-machine/mos/pkg/trust"
 	"github.com/project-machine/mos/pkg/utils"
 	"github.com/urfave/cli"
 )
@@ -27,6 +30,22 @@ var projectCmd = cli.Command{
 			Action:    doAddProject,
 			Usage:     "add a new project",
 			ArgsUsage: "<keyset-name> <project-name>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "key-type",
+					Usage: fmt.Sprintf("Type of the manifest signing key, one of %s (default: that of the keyset's manifest CA)", strings.Join(trust.KeyTypes, ", ")),
+				},
+				cli.StringFlag{
+					Name:  "key",
+					Usage: "Existing manifest signing key, as a PKCS#11 URI (pkcs11:token=...;object=...), to certify instead of creating one",
+				},
+			},
+		},
+		cli.Command{
+			Name:      "revoke",
+			Action:    doRevokeProject,
+			Usage:     "revoke a project's manifest signing certificate, e.g. if its key has leaked",
+			ArgsUsage: "<keyset-name> <project-name>",
 		},
 	},
 }
@@ -51,12 +70,31 @@ func doAddProject(ctx *cli.Context) error {
 		return fmt.Errorf("Project %s already exists", projName)
 	}
 
+	keyRef := ctx.String("key")
+	keyType := ctx.String("key-type")
+	if keyRef != "" && keyType != "" {
+		return errors.New("--key and --key-type cannot be used together")
+	}
+	if keyRef == "" && keyType == "" {
+		caCert, err := readCertificateFromFile(filepath.Join(keysetPath, "manifest-ca", "cert.pem"))
+		if err != nil {
+			return errors.Wrapf(err, "Failed reading manifest CA certificate")
+		}
+		if keyType, err = trust.KeyTypeOf(caCert.PublicKey); err != nil {
+			return errors.Wrapf(err, "Bad manifest CA key")
+		}
+	} else if keyType != "" {
+		if err := trust.CheckKeyType(keyType); err != nil {
+			return err
+		}
+	}
+
 	if err = os.Mkdir(projPath, 0750); err != nil {
 		return errors.Wrapf(err, "Failed creating project directory %q", projPath)
 	}
 
 	// Create new manifest credentials
-	err = generateNewUUIDCreds(keysetName, projPath)
+	err = generateNewUUIDCreds(keysetName, projPath, keyType, keyRef)
 	if err != nil {
 		os.RemoveAll(projPath)
 		return errors.Wrapf(err, "Failed creating new project")
@@ -71,6 +109,52 @@ func doAddProject(ctx *cli.Context) error {
 	return nil
 }
 
+// doRevokeProject adds the project's certificate to the revocation list
+// of the keyset's manifest CA, manifest-ca/crl.pem.  The list is
+// published with every install manifest signed for the keyset's
+// projects, and machines which fetch one will refuse manifests signed
+// with the project's key from then on.
+func doRevokeProject(ctx *cli.Context) error {
+	args := ctx.Args()
+	if len(args) != 2 {
+		return errors.New("Usage: trust project revoke <keyset-name> <project-name>")
+	}
+
+	keysetName := args[0]
+	projName := args[1]
+
+	trustDir, err := utils.GetMosKeyPath()
+	if err != nil {
+		return err
+	}
+	keysetPath := filepath.Join(trustDir, keysetName)
+	projPath := filepath.Join(keysetPath, "manifest", projName)
+	if !utils.PathExists(projPath) {
+		return fmt.Errorf("Project %s not found in keyset %s", projName, keysetName)
+	}
+
+	cert, err := readCertificateFromFile(filepath.Join(projPath, "cert.pem"))
+	if err != nil {
+		return errors.Wrapf(err, "Failed reading project certificate")
+	}
+	CAcert, CAkey, err := getCA("manifest-ca", keysetName)
+	if err != nil {
+		return err
+	}
+	signer, ok := CAkey.(crypto.Signer)
+	if CAcert == nil || !ok {
+		return fmt.Errorf("Failed reading the manifest CA of keyset %s", keysetName)
+	}
+
+	crlPath := filepath.Join(keysetPath, "manifest-ca", "crl.pem")
+	if err := trust.RevokeCert(crlPath, CAcert, signer, cert); err != nil {
+		return err
+	}
+
+	fmt.Printf("Revoked project %s. The revocation list %s will be published with the keyset's manifests.\n", projName, crlPath)
+	return nil
+}
+
 func doListProjects(ctx *cli.Context) error {
 	args := ctx.Args()
 	if len(args) == 0 {
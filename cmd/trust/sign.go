@@ -21,7 +21,7 @@ var signCmd = cli.Command{
 			Flags: []cli.Flag{
 				cli.StringFlag{
 					Name:  "key",
-					Usage: "The private key to sign the efi binary.",
+					Usage: "The private key, or its PKCS#11 URI, to sign the efi binary.",
 				},
 				cli.StringFlag{
 					Name:  "cert",
@@ -33,6 +33,22 @@ var signCmd = cli.Command{
 				},
 			},
 		},
+		cli.Command{
+			Name:      "file",
+			Action:    doSignFile,
+			Usage:     "sign a file, such as an install manifest",
+			ArgsUsage: "<file>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "key",
+					Usage: "The private key, or its PKCS#11 URI, to sign the file.",
+				},
+				cli.StringFlag{
+					Name:  "output",
+					Usage: "PathName for the signature.",
+				},
+			},
+		},
 	},
 }
 
@@ -61,7 +77,7 @@ func doSignEFI(ctx *cli.Context) error {
 	}
 
 	// Make sure the key and cert exists
-	if !utils.PathExists(key) {
+	if !trust.IsPKCS11URI(key) && !utils.PathExists(key) {
 		return fmt.Errorf("%s does not exist", key)
 	}
 
@@ -77,3 +93,32 @@ func doSignEFI(ctx *cli.Context) error {
 	fmt.Printf("Signed %s\n", output)
 	return nil
 }
+
+func doSignFile(ctx *cli.Context) error {
+	args := ctx.Args()
+	if len(args) != 1 {
+		return errors.New("The pathname of the file is missing (please see \"--help\")")
+	}
+
+	file := args[0]
+	if !utils.PathExists(file) {
+		return fmt.Errorf("%s does not exist", file)
+	}
+
+	key := ctx.String("key")
+	output := ctx.String("output")
+	if key == "" || output == "" {
+		return errors.New("Specify a key and output. (please see \"--help\")")
+	}
+
+	if !trust.IsPKCS11URI(key) && !utils.PathExists(key) {
+		return fmt.Errorf("%s does not exist", key)
+	}
+
+	alg, err := trust.Sign(file, output, key)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Signed %s (%s) to %s\n", file, alg, output)
+	return nil
+}
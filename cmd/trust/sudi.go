@@ -10,6 +10,7 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
+	"github.com/project-machine/mos/pkg/trust"
 	"github.com/project-machine/mos/pkg/utils"
 	"github.com/urfave/cli"
 )
@@ -30,6 +31,12 @@ var sudiCmd = cli.Command{
 			Action:    doGenSudi,
 			Usage:     "add a new sudi key to project",
 			ArgsUsage: "<keyset-name> <project-name> [<serial-number>|uuid]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "ca-key",
+					Usage: "SUDI CA key file or PKCS#11 URI (pkcs11:token=...;object=...) to sign with, instead of the keyset's",
+				},
+			},
 		},
 	},
 }
@@ -64,7 +71,7 @@ func doGenSudi(ctx *cli.Context) error {
 		return fmt.Errorf("Project not found: %s", projName)
 	}
 
-	if _, err = genSudi(keysetPath, projPath, myUUID); err != nil {
+	if _, err = genSudi(keysetPath, projPath, myUUID, ctx.String("ca-key")); err != nil {
 		return errors.Wrapf(err, "Failed generating SUDI")
 	}
 
@@ -72,8 +79,10 @@ func doGenSudi(ctx *cli.Context) error {
 }
 
 // Generate a SUDI key for given uuid.  If uuid is "", then generate a
-// new UUID.  Return the directory path for this new SUDI cert.
-func genSudi(keysetPath, projDir, sudiUUID string) (string, error) {
+// new UUID.  It is signed with the SUDI CA key named by caKeyRef, or if
+// that is "", the keyset's.  Return the directory path for this new SUDI
+// cert.
+func genSudi(keysetPath, projDir, sudiUUID, caKeyRef string) (string, error) {
 	prodUUID, err := os.ReadFile(filepath.Join(projDir, "uuid"))
 	if err != nil {
 		return "", errors.Wrapf(err, "Failed reading project UUID")
@@ -90,11 +99,18 @@ func genSudi(keysetPath, projDir, sudiUUID string) (string, error) {
 		return "", errors.Wrapf(err, "Failed reading SUDI CA certificate")
 	}
 
-	// read the project CA private key to sign the sudi key with
-	caKey, err := readPrivKeyFromFile(filepath.Join(capath, "privkey.pem"))
+	// open the SUDI CA private key to sign the sudi key with
+	if caKeyRef == "" {
+		caKeyRef, err = trust.KeyRef(capath)
+		if err != nil {
+			return "", errors.Wrapf(err, "Failed finding SUDI CA key")
+		}
+	}
+	caKey, err := trust.NewSigner(caKeyRef)
 	if err != nil {
 		return "", errors.Wrapf(err, "Failed reading SUDI CA key")
 	}
+	defer caKey.Close()
 
 	certTmpl := newCertTemplate(string(prodUUID), sudiUUID)
 
@@ -103,7 +119,7 @@ func genSudi(keysetPath, projDir, sudiUUID string) (string, error) {
 		return "", errors.Wrapf(err, "Failed creating new SUDI directory")
 	}
 
-	if err := SignCert(&certTmpl, caCert, caKey, snPath); err != nil {
+	if err := SignCert(&certTmpl, caCert, caKey, snPath, trust.KeyTypeRSA2048); err != nil {
 		os.RemoveAll(snPath)
 		return "", errors.Wrapf(err, "Failed creating new SUDI keypair")
 	}
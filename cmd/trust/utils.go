@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
@@ -45,8 +46,9 @@ func KeysetExists(keysetname string) bool {
 	}
 }
 
-// SignCert creates a CA signed certificate and keypair in destdir
-func SignCert(template, CAcert *x509.Certificate, CAkey any, destdir string) error {
+// SignCert creates a CA signed certificate and keypair of type @keyType
+// in destdir
+func SignCert(template, CAcert *x509.Certificate, CAkey any, destdir, keyType string) error {
 	// Check if credentials already exist
 	if utils.PathExists(filepath.Join(destdir, "privkey.pem")) {
 		return fmt.Errorf("credentials already exist in %s", destdir)
@@ -70,7 +72,7 @@ func SignCert(template, CAcert *x509.Certificate, CAkey any, destdir string) err
 	}
 	defer certPEM.Close()
 
-	if err := signCertToFiles(template, CAcert, CAkey, certPEM, keyPEM); err != nil {
+	if err := signCertToFiles(template, CAcert, CAkey, keyType, certPEM, keyPEM); err != nil {
 		os.Remove(keyPEM.Name())
 		os.Remove(certPEM.Name())
 		return err
@@ -79,37 +81,68 @@ func SignCert(template, CAcert *x509.Certificate, CAkey any, destdir string) err
 	return nil
 }
 
-func signCertToFiles(template, CAcert *x509.Certificate, CAkey any,
-	certWriter io.Writer, keyWriter io.Writer) error {
-	// Generate a keypair
-	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
+// SignCertForKey creates a CA signed certificate in destdir for the
+// existing key named by @keyRef, such as a PKCS#11 URI, which is saved
+// in privkey.uri.
+func SignCertForKey(template, CAcert *x509.Certificate, CAkey any, destdir, keyRef string) error {
+	if utils.PathExists(filepath.Join(destdir, "privkey.pem")) || utils.PathExists(filepath.Join(destdir, "privkey.uri")) {
+		return fmt.Errorf("credentials already exist in %s", destdir)
+	}
+
+	signer, err := trust.NewSigner(keyRef)
 	if err != nil {
 		return err
 	}
+	pubKey := signer.Public()
+	signer.Close()
 
-	err = privKey.Validate()
+	signedCert, err := createCert(template, CAcert, CAkey, pubKey)
 	if err != nil {
 		return err
 	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: signedCert})
+	if err := os.WriteFile(filepath.Join(destdir, "cert.pem"), certPEM, 0640); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(destdir, "privkey.uri"), []byte(keyRef+"\n"), 0600); err != nil {
+		os.Remove(filepath.Join(destdir, "cert.pem"))
+		return err
+	}
+
+	return nil
+}
 
+// createCert returns the DER encoded certificate for @pubKey made from
+// @template and signed by @CAcert.
+func createCert(template, CAcert *x509.Certificate, CAkey any, pubKey crypto.PublicKey) ([]byte, error) {
 	// Additional info to add to certificate template
 	serialNo, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// SubjectKeyID is sha1 hash of the public key
-	pubKey := privKey.PublicKey
-	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&pubKey)
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(pubKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	subjectKeyID := sha1.Sum(publicKeyBytes)
 
 	template.SerialNumber = serialNo
 	template.SubjectKeyId = subjectKeyID[:]
 
-	signedCert, err := x509.CreateCertificate(rand.Reader, template, CAcert, &pubKey, CAkey)
+	return x509.CreateCertificate(rand.Reader, template, CAcert, pubKey, CAkey)
+}
+
+func signCertToFiles(template, CAcert *x509.Certificate, CAkey any, keyType string,
+	certWriter io.Writer, keyWriter io.Writer) error {
+	// Generate a keypair
+	privKey, err := trust.GenerateKey(keyType)
+	if err != nil {
+		return err
+	}
+
+	signedCert, err := createCert(template, CAcert, CAkey, privKey.Public())
 	if err != nil {
 		return err
 	}
@@ -180,7 +213,10 @@ func getCA(CAname, keysetName string) (*x509.Certificate, any, error) {
 	return CAcert, CAkey, nil
 }
 
-func generateNewUUIDCreds(keysetName, destdir string) error {
+// generateNewUUIDCreds creates the manifest signing key, of type
+// @keyType, and certificate for a new project in @destdir.  If @keyRef
+// is set, the certificate is instead for that existing key.
+func generateNewUUIDCreds(keysetName, destdir, keyType, keyRef string) error {
 	// Create new manifest credentials
 	newUUID := uuid.NewString()
 
@@ -202,7 +238,11 @@ func generateNewUUIDCreds(keysetName, destdir string) error {
 		return err
 	}
 
-	err = SignCert(&certTemplate, CAcert, CAprivkey, destdir)
+	if keyRef != "" {
+		err = SignCertForKey(&certTemplate, CAcert, CAprivkey, destdir, keyRef)
+	} else {
+		err = SignCert(&certTemplate, CAcert, CAprivkey, destdir, keyType)
+	}
 	if err != nil {
 		return err
 	}
@@ -210,6 +250,7 @@ func generateNewUUIDCreds(keysetName, destdir string) error {
 	err = os.WriteFile(filepath.Join(destdir, "uuid"), []byte(newUUID), 0640)
 	if err != nil {
 		os.Remove(filepath.Join(destdir, "privkey.pem"))
+		os.Remove(filepath.Join(destdir, "privkey.uri"))
 		os.Remove(filepath.Join(destdir, "cert.pem"))
 		return err
 	}
@@ -217,13 +258,9 @@ func generateNewUUIDCreds(keysetName, destdir string) error {
 	return nil
 }
 
-func generaterootCA(destdir string, caTemplate *x509.Certificate, doguid bool) error {
+func generaterootCA(destdir string, caTemplate *x509.Certificate, doguid bool, keyType string) error {
 	// Generate keypair
-	privkey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return err
-	}
-	err = privkey.Validate()
+	privkey, err := trust.GenerateKey(keyType)
 	if err != nil {
 		return err
 	}
@@ -235,7 +272,7 @@ func generaterootCA(destdir string, caTemplate *x509.Certificate, doguid bool) e
 	}
 	caTemplate.SerialNumber = serialNo
 
-	rootCA, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &privkey.PublicKey, privkey)
+	rootCA, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, privkey.Public(), privkey)
 	if err != nil {
 		return err
 	}
@@ -571,7 +608,7 @@ func addPcr7data(keysetName string, pdata pcr7Data) error {
 				return err
 			}
 			signingKey := filepath.Join(keysetPath, "tpmpol-admin/privkey.pem")
-			if err = trust.Sign(policyFile, policyFile, signingKey); err != nil {
+			if _, err = trust.Sign(policyFile, policyFile, signingKey); err != nil {
 				return err
 			}
 		case "production":
@@ -581,7 +618,7 @@ func addPcr7data(keysetName string, pdata pcr7Data) error {
 				return err
 			}
 			signingKey := filepath.Join(keysetPath, "tpmpol-luks/privkey.pem")
-			if err = trust.Sign(policyFile, policyFile, signingKey); err != nil {
+			if _, err = trust.Sign(policyFile, policyFile, signingKey); err != nil {
 				return err
 			}
 		default:
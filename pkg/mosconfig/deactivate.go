@@ -0,0 +1,101 @@
+package mosconfig
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"github.com/project-machine/mos/pkg/utils"
+)
+
+// Stop a running target.  It stays in the manifest, and will be started
+// again at next boot or activate.
+func (mos *Mos) Stop(name string) error {
+	t, err := mos.Current(name)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to get current version of %s", name)
+	}
+
+	if t.ServiceType == HostfsService || name == "bootkit" {
+		return errors.Errorf("Stopping %s is not supported.  Please poweroff", name)
+	}
+
+	r, err := mos.RunningTarget(t)
+	if err != nil {
+		return errors.Wrapf(err, "Failed getting running version of %s", name)
+	}
+	if r == nil {
+		log.Infof("%s is not running", name)
+		return nil
+	}
+
+	return mos.StopTarget(t)
+}
+
+// Restart a target, whether or not it is already running the current
+// version.
+func (mos *Mos) Restart(name string) error {
+	if mos.IsDeactivated(name) {
+		return errors.Errorf("%s is deactivated, activate it instead", name)
+	}
+	if err := mos.Stop(name); err != nil {
+		return errors.Wrapf(err, "Failed stopping %s", name)
+	}
+	return mos.Activate(name)
+}
+
+func (mos *Mos) deactivatedPath(name string) string {
+	return filepath.Join(mos.opts.ConfigDir, "deactivated", name)
+}
+
+// IsDeactivated reports whether @name has been disabled by Deactivate.
+func (mos *Mos) IsDeactivated(name string) bool {
+	return utils.PathExists(mos.deactivatedPath(name))
+}
+
+// Deactivate stops a target and keeps it from being started at boot,
+// without removing it from the manifest.  Activating the target again
+// undoes this.
+func (mos *Mos) Deactivate(name string) error {
+	t, err := mos.Current(name)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to get current version of %s", name)
+	}
+
+	if t.ServiceType == HostfsService || name == "bootkit" {
+		return errors.Errorf("%s cannot be deactivated", name)
+	}
+
+	p := mos.deactivatedPath(name)
+	if err := utils.EnsureDir(filepath.Dir(p)); err != nil {
+		return errors.Wrapf(err, "Failed creating %q", filepath.Dir(p))
+	}
+	if err := os.WriteFile(p, []byte{}, 0644); err != nil {
+		return errors.Wrapf(err, "Failed marking %s deactivated", name)
+	}
+
+	if err := mos.Stop(name); err != nil {
+		return err
+	}
+
+	if t.ServiceType == ContainerService {
+		unitName := fmt.Sprintf("%s.service", t.ServiceName)
+		out, rc := utils.RunCommandWithRc("systemctl", "disable", unitName)
+		if rc != 0 {
+			log.Warnf("Failed disabling %s: %s", unitName, string(out))
+		}
+	}
+
+	return nil
+}
+
+// reactivate clears a deactivation, if any, of @name.
+func (mos *Mos) reactivate(name string) error {
+	p := mos.deactivatedPath(name)
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Failed clearing deactivation of %s", name)
+	}
+	return nil
+}
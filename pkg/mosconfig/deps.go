@@ -0,0 +1,114 @@
+package mosconfig
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Targets may name other targets in DependsOn and After.  Both order
+// startup, so that a target is only started after the ones it lists.
+// DependsOn additionally means that the target will not be started if
+// any of those failed to start.  hostfs and bootkit are always up by the
+// time services are started, so depending on them is a no-op.
+
+// dependencyWaves sorts @names into waves, each containing the names
+// whose dependencies in @deps all appear in earlier waves.  Dependencies
+// on names not in @names are ignored.  An error naming the targets
+// involved is returned if there is a cycle.
+func dependencyWaves(names []string, deps map[string][]string) ([][]string, error) {
+	known := map[string]bool{}
+	for _, n := range names {
+		known[n] = true
+	}
+
+	remaining := map[string][]string{}
+	for _, n := range names {
+		r := []string{}
+		for _, d := range deps[n] {
+			if known[d] {
+				r = append(r, d)
+			}
+		}
+		remaining[n] = r
+	}
+
+	done := map[string]bool{}
+	waves := [][]string{}
+	for len(done) < len(names) {
+		wave := []string{}
+		for _, n := range names {
+			if done[n] {
+				continue
+			}
+			ready := true
+			for _, d := range remaining[n] {
+				if !done[d] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				wave = append(wave, n)
+			}
+		}
+		if len(wave) == 0 {
+			cycle := []string{}
+			for _, n := range names {
+				if !done[n] {
+					cycle = append(cycle, n)
+				}
+			}
+			sort.Strings(cycle)
+			return nil, errors.Errorf("Dependency cycle among targets: %s", strings.Join(cycle, ", "))
+		}
+		for _, n := range wave {
+			done[n] = true
+		}
+		waves = append(waves, wave)
+	}
+
+	return waves, nil
+}
+
+// orderingDeps returns everything @t must start after.
+func (t *Target) orderingDeps() []string {
+	ret := []string{}
+	for _, d := range append(append([]string{}, t.DependsOn...), t.After...) {
+		if d == "hostfs" || d == "bootkit" {
+			continue
+		}
+		ret = append(ret, d)
+	}
+	return ret
+}
+
+func (ts InstallTargets) validateDependencies() error {
+	names := []string{}
+	deps := map[string][]string{}
+	for _, t := range ts {
+		for _, d := range append(append([]string{}, t.DependsOn...), t.After...) {
+			if d == t.ServiceName {
+				return errors.Errorf("Target %s cannot depend on itself", t.ServiceName)
+			}
+		}
+		names = append(names, t.ServiceName)
+		deps[t.ServiceName] = t.orderingDeps()
+	}
+	_, err := dependencyWaves(names, deps)
+	return err
+}
+
+// activationWaves sorts the targets of @m into waves for ActivateAll.
+func activationWaves(m *SysManifest) ([][]string, error) {
+	names := []string{}
+	deps := map[string][]string{}
+	for _, t := range m.SysTargets {
+		names = append(names, t.Name)
+		if t.raw != nil {
+			deps[t.Name] = t.raw.orderingDeps()
+		}
+	}
+	return dependencyWaves(names, deps)
+}
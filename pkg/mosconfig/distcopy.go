@@ -0,0 +1,231 @@
+package mosconfig
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+)
+
+// Images are copied between registries and OCI layouts over DistRepo
+// rather than with containers/image, so that the TLS and credentials
+// settings in RegistryOptions apply to them as they do to the install
+// manifest.  Manifests are copied byte for byte, so an image keeps its
+// digest wherever it is copied to.
+
+const dockerManifestType = "application/vnd.docker.distribution.manifest.v2+json"
+
+// PullImage copies image @name:@ref from the registry into the OCI layout
+// at @destdir, tagged as @tag.
+func (r *DistRepo) PullImage(name, ref, destdir, tag string) error {
+	ctx := context.Background()
+	b, mediaType, err := r.fetchManifestBytes(name, ref)
+	if err != nil {
+		return err
+	}
+	var m ispec.Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return errors.Wrapf(err, "Failed parsing manifest for %s:%s", name, ref)
+	}
+
+	oci, err := openOrCreateLayout(destdir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	blobs := append([]ispec.Descriptor{m.Config}, m.Layers...)
+	for _, d := range blobs {
+		if err := r.pullBlob(ctx, oci, name, d); err != nil {
+			return err
+		}
+	}
+
+	// The manifest goes last, so that it is only there once
+	// everything it refers to is.
+	mDigest, mSize, err := oci.PutBlob(ctx, bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrapf(err, "Failed writing manifest for %s:%s", name, ref)
+	}
+	desc := ispec.Descriptor{MediaType: mediaType, Digest: mDigest, Size: mSize}
+	return updateLayoutReference(ctx, oci, tag, desc)
+}
+
+func (r *DistRepo) pullBlob(ctx context.Context, oci casext.Engine, name string, d ispec.Descriptor) error {
+	if ok, err := oci.StatBlob(ctx, d.Digest); err == nil && ok {
+		return nil
+	}
+	rdr, err := r.openBlob(name, d.Digest, d.Size)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+
+	got, size, err := oci.PutBlob(ctx, rdr)
+	if err != nil {
+		return errors.Wrapf(err, "Failed writing blob %s", d.Digest)
+	}
+	if got != d.Digest || size != d.Size {
+		oci.DeleteBlob(ctx, got)
+		return errors.Errorf("Blob %s (size %d) was received as %s (size %d)", d.Digest, d.Size, got, size)
+	}
+	return nil
+}
+
+// PushImage copies image @ref from the OCI layout at @srcdir to the
+// registry as @name:@tag.
+func (r *DistRepo) PushImage(srcdir, ref, name, tag string) error {
+	ctx := context.Background()
+	oci, err := umoci.OpenLayout(srcdir)
+	if err != nil {
+		return errors.Wrapf(err, "Failed opening oci layout at %q", srcdir)
+	}
+	defer oci.Close()
+
+	var desc ispec.Descriptor
+	if d, err := digest.Parse(ref); err == nil {
+		desc = ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: d}
+	} else {
+		paths, err := oci.ResolveReference(ctx, ref)
+		if err != nil {
+			return errors.Wrapf(err, "Failed looking up %q", ref)
+		}
+		if len(paths) != 1 {
+			return errors.Errorf("Bad descriptor for %q in %q", ref, srcdir)
+		}
+		desc = paths[0].Descriptor()
+	}
+
+	rdr, err := oci.GetBlob(ctx, desc.Digest)
+	if err != nil {
+		return errors.Wrapf(err, "Failed reading manifest %s", desc.Digest)
+	}
+	b, err := io.ReadAll(rdr)
+	if err == nil {
+		err = rdr.Close()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Failed reading manifest %s", desc.Digest)
+	}
+	var m ispec.Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return errors.Wrapf(err, "Failed parsing manifest %s", desc.Digest)
+	}
+	mediaType := m.MediaType
+	if mediaType == "" {
+		mediaType = desc.MediaType
+	}
+
+	disturl := DistUrl{name: name, tag: tag, repo: r}
+	blobs := append([]ispec.Descriptor{m.Config}, m.Layers...)
+	for _, d := range blobs {
+		if err := disturl.pushBlob(srcdir, d); err != nil {
+			return err
+		}
+	}
+
+	return disturl.putManifest(tag, b, mediaType)
+}
+
+// hasBlob reports whether the registry already has blob @d.
+func (disturl *DistUrl) hasBlob(d digest.Digest) (bool, error) {
+	u := disturl.repo.apiUrl(fmt.Sprintf("%s/blobs/%s", disturl.name, d))
+	req, err := http.NewRequest(http.MethodHead, u, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := disturl.repo.do(req, pushScope(disturl.name))
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode == 200, nil
+}
+
+// pushBlob uploads blob @d from the OCI layout at @srcdir, unless the
+// registry already has it.
+func (disturl *DistUrl) pushBlob(srcdir string, d ispec.Descriptor) error {
+	ok, err := disturl.hasBlob(d.Digest)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+
+	path := filepath.Join(srcdir, "blobs", d.Digest.Algorithm().String(), d.Digest.Encoded())
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "Failed opening blob %s", d.Digest)
+	}
+	defer f.Close()
+
+	return disturl.uploadBlob(f, d.Size, d.Digest)
+}
+
+// isRegistryUrl reports whether @url names an image on a registry.
+func isRegistryUrl(url string) bool {
+	for _, p := range []string{"docker://", "http://", "https://"} {
+		if strings.HasPrefix(url, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// copyImage copies the image with manifest digest @d from @src, which is
+// on a registry or in an OCI layout, to @dest on a registry.  Registries
+// are reached as @reg says.
+func copyImage(reg *Registry, src, d, dest string) error {
+	destRepo, err := NewDistRepo(reg, dest)
+	if err != nil {
+		return errors.Wrapf(err, "Failed opening %s", dest)
+	}
+	destUrl, err := destRepo.findUrl(dest)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(src, ociLayoutPrefix) {
+		srcdir, _, err := parseLocalUrl(src)
+		if err != nil {
+			return err
+		}
+		return destRepo.PushImage(srcdir, d, destUrl.name, destUrl.tag)
+	}
+	if !isRegistryUrl(src) {
+		return errors.Errorf("Unsupported image source %q", src)
+	}
+
+	srcRepo, err := NewDistRepo(reg, src)
+	if err != nil {
+		return errors.Wrapf(err, "Failed opening %s", src)
+	}
+	srcUrl, err := srcRepo.findUrl(src)
+	if err != nil {
+		return err
+	}
+
+	tmpdir, err := os.MkdirTemp("", "copy-image")
+	if err != nil {
+		return errors.Wrapf(err, "Failed creating tempdir")
+	}
+	defer os.RemoveAll(tmpdir)
+	layout := filepath.Join(tmpdir, "oci")
+
+	if err := srcRepo.PullImage(srcUrl.name, d, layout, "image"); err != nil {
+		return err
+	}
+	return destRepo.PushImage(layout, d, destUrl.name, destUrl.tag)
+}
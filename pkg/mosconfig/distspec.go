@@ -10,7 +10,9 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 
+	"github.com/apex/log"
 	digest "github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
@@ -21,6 +23,11 @@ const (
 	installArtifact = "application/vnd.machine.install"
 	pubkeyArtifact  = "application/vnd.machine.pubkeycrt"
 	sigArtifact     = "application/vnd.machine.signature"
+	crlArtifact     = "application/vnd.machine.crl"
+
+	// sigAlgAnnotation on a signature artifact names the algorithm
+	// (one of trust.SigAlg*) with which it was made.
+	sigAlgAnnotation = "vnd.machine.signature.algorithm"
 )
 
 type DistUrl struct {
@@ -35,7 +42,17 @@ type DistUrl struct {
 }
 
 type DistRepo struct {
-	addr string // 10.0.2.2:5000 or /mnt/oci
+	addr   string // 10.0.2.2:5000 or /mnt/oci
+	scheme string // http or https
+	reg    *Registry
+	client *http.Client
+	auth   *registryAuth
+
+	mirrors     []*DistRepo // to fetch from, in order, see mirrors.go
+	retries     int
+	unreachable atomic.Bool // skip when trying mirrors
+
+	referrersTag bool // only use the referrers tag schema, see referrers.go
 }
 
 // Pick out the name and tag from a url
@@ -67,15 +84,15 @@ func (r *DistRepo) openUrl(base string) (DistUrl, error) {
 
 	// Get the image digests we need from,  e.g.
 	// http://0.0.0.0:18080/v2/machine/install/manifests/1.0.0
-	u := fmt.Sprintf("http://%s/v2/%s/manifests/%s", r.addr, url.name, url.tag)
-	resp, err := http.Get(u)
+	u := fmt.Sprintf("%s/manifests/%s", url.name, url.tag)
+	resp, err := r.get(u, pullScope(url.name))
 	if err != nil {
-		return url, errors.Wrapf(err, "Failed connecting to %q", u)
+		return url, err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return url, errors.Errorf("Bad status code connecting to %q: %d", u, resp.StatusCode)
+		return url, errors.Errorf("Bad status code connecting to %q: %d", r.apiUrl(u), resp.StatusCode)
 	}
-	defer resp.Body.Close()
 
 	// This is the digest we need to use to get the list of referrers
 	url.mDigest = resp.Header.Get("Docker-Content-Digest")
@@ -112,61 +129,105 @@ func dropURLPrefix(url string) string {
 	return url
 }
 
-// PingRepo checks whether a given dist url, say 10.0.2.2:5000, is
-// up.
-func PingRepo(base string) error {
-	url := "http://" + base + "/v2/"
-	resp, err := http.Get(url)
-	if err != nil {
-		return errors.Errorf("Failed connecting to %q", url)
+// newRepo returns a DistRepo for the registry at @addr, which came
+// from url @rawUrl, along with any mirrors of @reg.
+func newRepo(reg *Registry, rawUrl, addr string) *DistRepo {
+	r := newEndpoint(reg, rawUrl, addr)
+	for _, m := range reg.opts.Mirrors {
+		maddr := strings.TrimSuffix(dropURLPrefix(m), "/")
+		if maddr == addr {
+			r.mirrors = append(r.mirrors, r)
+			continue
+		}
+		r.mirrors = append(r.mirrors, newEndpoint(reg, m, maddr))
 	}
-	if resp.StatusCode != 200 {
-		return errors.Errorf("Bad status code %d connecting to %q: %d", url, resp.StatusCode)
+	return r
+}
+
+func newEndpoint(reg *Registry, rawUrl, addr string) *DistRepo {
+	user, pass := registryCreds(addr, reg.opts)
+	retries := reg.opts.Retries
+	if retries == 0 {
+		retries = DefaultRegistryRetries
+	}
+	return &DistRepo{
+		addr:   addr,
+		scheme: registryScheme(rawUrl, addr, reg.opts),
+		reg:    reg,
+		client: reg.client,
+		auth: &registryAuth{
+			username: user,
+			password: pass,
+			token:    reg.opts.Token,
+		},
+		retries:      retries,
+		referrersTag: reg.opts.ReferrersTag,
 	}
-	resp.Body.Close()
+}
 
+// ping checks that the registry is up.  A registry which wants us to
+// log in is up as well.
+func (r *DistRepo) ping() error {
+	url := r.apiUrl("")
+	resp, err := r.client.Get(url)
+	if err != nil {
+		return errors.Wrapf(err, "Failed connecting to %q", url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 && resp.StatusCode != http.StatusUnauthorized {
+		return errors.Errorf("Bad status code connecting to %q: %d", url, resp.StatusCode)
+	}
 	return nil
 }
 
-// Given a 10.0.2.2:5000/foo/install.json, set addr to
-// http://10.0.2.2:5000, and check for connection using
-// http://10.0.2.2:5000/v2
-func NewDistRepo(base string) (*DistRepo, error) {
-	r := DistRepo{}
+// url returns the url for image @name:@tag on this registry, in a form
+// which NewDistRepo will open the same way.
+func (r *DistRepo) url(name, tag string) string {
+	prefix := "docker://"
+	if r.scheme != registryScheme("", r.addr, r.reg.opts) {
+		prefix = r.scheme + "://"
+	}
+	return fmt.Sprintf("%s%s/%s:%s", prefix, r.addr, name, tag)
+}
+
+// PingRepo checks whether a given dist url, say 10.0.2.2:5000, is
+// up.
+func PingRepo(reg *Registry, base string) error {
+	return newEndpoint(reg.orDefault(), base, dropURLPrefix(base)).ping()
+}
+
+// Given a 10.0.2.2:5000/foo/install.json, set addr to 10.0.2.2:5000,
+// and check for connection using https://10.0.2.2:5000/v2/ (or http,
+// see registryScheme), with the options of @reg.
+func NewDistRepo(reg *Registry, base string) (*DistRepo, error) {
+	rawUrl := base
 	base = dropURLPrefix(base)
 	s := strings.SplitN(base, "/", 2)
 	if len(s) != 2 {
-		return &r, errors.Errorf("Failed parsing oci repo url: no '/' in %q", base)
+		return &DistRepo{}, errors.Errorf("Failed parsing oci repo url: no '/' in %q", base)
 	}
-	base = s[0]
 
-	url := "http://" + base + "/v2/"
-	resp, err := http.Get(url)
-	if err != nil {
-		return &r, errors.Errorf("Failed connecting to %q", url)
-	}
-	if resp.StatusCode != 200 {
-		return &r, errors.Errorf("Bad status code %d connecting to %q: %d", url, resp.StatusCode)
+	r := newRepo(reg.orDefault(), rawUrl, s[0])
+	var err error
+	for _, c := range r.candidates() {
+		if err = c.ping(); err == nil {
+			return r, nil
+		}
+		log.Infof("Registry %s is not reachable: %v", c.addr, err)
+		c.unreachable.Store(true)
 	}
-	defer resp.Body.Close()
-
-	r.addr = base
-	return &r, nil
+	return r, err
 }
 
 func (r *DistRepo) FetchFile(path string, dest string) error {
-	url := "http://" + r.addr + "/v2/" + path
-	resp, err := http.Get(url)
+	name, d, _ := strings.Cut(path, "/blobs/")
+	source, err := r.openBlob(name, digest.Digest(d), -1)
 	if err != nil {
-		return errors.Errorf("Failed connecting to %q", url)
-	}
-	if resp.StatusCode != 200 {
-		return errors.Errorf("Bad status code connecting to %q: %d", url, resp.StatusCode)
+		return err
 	}
-	source := resp.Body
 	defer source.Close()
 
-	outf, err := os.OpenFile(dest, os.O_RDWR|os.O_CREATE, 0644)
+	outf, err := os.OpenFile(dest, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
@@ -185,84 +246,152 @@ func (r *DistRepo) FetchInstall(disturl DistUrl, dest string) error {
 	return r.FetchFile(u, dest)
 }
 
-// end-12b     GET     /v2/<name>/referrers/<digest>?artifactType=<artifactType>     200     404/400
+// GetReferrers returns the artifacts of type @artifactType which refer
+// to @disturl, from the referrers API or else the referrers tag.
 func (r *DistRepo) GetReferrers(disturl DistUrl, artifactType string) (ispec.Index, error) {
-	// Now fetch /v2/<name>/referrers/<digest>?artifactType=<artifactType>
 	idx := ispec.Index{}
-	u := fmt.Sprintf("http://%s/v2/%s/referrers/%s?artifactType=%s", r.addr, disturl.name, disturl.mDigest, artifactType)
-	resp, err := http.Get(u)
-	if err != nil {
-		return idx, errors.Errorf("Failed connecting to %q", u)
-	}
-	if resp.StatusCode != 200 {
-		return idx, errors.Errorf("Bad status code connecting to %q: %d", u, resp.StatusCode)
+	found := false
+	if !r.referrersTag {
+		var err error
+		idx, found, err = r.referrersFromApi(disturl, artifactType)
+		if err != nil {
+			return idx, err
+		}
 	}
-	body := resp.Body
-	defer body.Close()
-
-	err = json.NewDecoder(body).Decode(&idx)
-	if err != nil {
-		return idx, errors.Wrapf(err, "Failed parsing the list of referrers")
+	if !found || len(idx.Manifests) == 0 {
+		var err error
+		idx, err = r.referrersFromTag(disturl, artifactType)
+		if err != nil {
+			return idx, err
+		}
 	}
 
 	if len(idx.Manifests) == 0 {
-		return idx, errors.Errorf("No manifest for artifact type %v at %#v (queried url %q)", artifactType, disturl, u)
+		return idx, errors.Errorf("No manifest for artifact type %v referring to %s:%s", artifactType, disturl.name, disturl.tag)
 	}
 
 	return idx, nil
 }
 
-func (r *DistRepo) fetchArtifact(disturl DistUrl, artifactType, dest string) error {
-	referrer, err := r.GetReferrers(disturl, artifactType)
-	if err != nil {
-		return errors.Wrapf(err, "Failed getting list of referrers")
-	}
-
-	if len(referrer.Manifests) > 1 {
-		// What do do?  Should we find one right here that the capath can verify?
-		// Probably - but for now, just take the first one.
-		fmt.Println("Warning: multiple referrers found, using first one")
+// fetchReferrer writes the single layer of the artifact manifest @d,
+// which refers to @disturl, to @dest, and returns the manifest's
+// annotations.  Neither may be over maxReferrerSize.
+func (r *DistRepo) fetchReferrer(disturl DistUrl, d ispec.Descriptor, dest string) (map[string]string, error) {
+	if d.Size > maxReferrerSize {
+		return nil, errors.Errorf("Artifact manifest is too large (%d bytes)", d.Size)
 	}
 
-	digest := referrer.Manifests[0].Digest
-
-	// we have the digest for a manifest whose layers[0] contains
-	// the artifact we're looking for
-	u := fmt.Sprintf("http://%s/v2/%s/blobs/%s", r.addr, disturl.name, digest)
+	// @d is a manifest whose layers[0] contains the artifact
+	// we're looking for
+	u := fmt.Sprintf("%s/blobs/%s", disturl.name, d.Digest)
 	manifest := ispec.Manifest{}
 
-	resp, err := http.Get(u)
+	resp, err := r.get(u, pullScope(disturl.name))
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return errors.Errorf("bad response code from oci repo")
+		return nil, errors.Errorf("bad response code from oci repo")
 	}
-	defer resp.Body.Close()
-	err = json.NewDecoder(resp.Body).Decode(&manifest)
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxReferrerSize)).Decode(&manifest)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if len(manifest.Layers) == 0 {
-		return errors.Errorf("Error parsing artifacts list")
+		return nil, errors.Errorf("Error parsing artifacts list")
+	}
+	layer := manifest.Layers[0]
+	if layer.Size > maxReferrerSize {
+		return nil, errors.Errorf("Artifact is too large (%d bytes)", layer.Size)
 	}
 
-	digest = manifest.Layers[0].Digest
-	u = fmt.Sprintf("%s/blobs/%s", disturl.name, digest)
-	return r.FetchFile(u, dest)
+	source, err := r.openBlob(disturl.name, layer.Digest, layer.Size)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+	outf, err := os.OpenFile(dest, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer outf.Close()
+	return manifest.Annotations, copyLimited(outf, source, maxReferrerSize)
+}
+
+// copyLimited copies @src to @dest, failing if it is over @max bytes.
+func copyLimited(dest io.Writer, src io.Reader, max int64) error {
+	n, err := io.Copy(dest, io.LimitReader(src, max+1))
+	if err != nil {
+		return err
+	}
+	if n > max {
+		return errors.Errorf("More than %d bytes", max)
+	}
+	return nil
+}
+
+// FetchImageManifest fetches the image manifest for @name:@ref, and
+// checks that its digest is @ref if that is a digest.
+func (r *DistRepo) FetchImageManifest(name, ref string) (ispec.Manifest, error) {
+	manifest := ispec.Manifest{}
+	b, _, err := r.fetchManifestBytes(name, ref)
+	if err != nil {
+		return manifest, err
+	}
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return manifest, errors.Wrapf(err, "Failed parsing manifest for %s:%s", name, ref)
+	}
+	return manifest, nil
 }
 
-func (r *DistRepo) FetchCert(disturl DistUrl, dest string) error {
-	return r.fetchArtifact(disturl, pubkeyArtifact, dest)
+// fetchManifestBytes fetches the image manifest for @name:@ref, and
+// returns it along with its media type.  Its digest is checked if @ref
+// is a digest.
+func (r *DistRepo) fetchManifestBytes(name, ref string) ([]byte, string, error) {
+	u := fmt.Sprintf("%s/manifests/%s", name, ref)
+	resp, err := r.get(u, pullScope(name), ispec.MediaTypeImageManifest, dockerManifestType)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, "", errors.Errorf("Bad status code connecting to %q: %d", r.apiUrl(u), resp.StatusCode)
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "Failed reading %q", r.apiUrl(u))
+	}
+	if d, err := digest.Parse(ref); err == nil {
+		if got := d.Algorithm().FromBytes(b); got != d {
+			return nil, "", errors.Errorf("Manifest at %q has digest %s", r.apiUrl(u), got)
+		}
+	}
+	mediaType := resp.Header.Get("Content-Type")
+	if mediaType == "" {
+		mediaType = ispec.MediaTypeImageManifest
+	}
+	return b, mediaType, nil
 }
 
-func (r *DistRepo) FetchSignature(disturl DistUrl, dest string) error {
-	return r.fetchArtifact(disturl, sigArtifact, dest)
+// signatureReferrers returns the certificate and signature referrers of
+// @disturl.
+func (r *DistRepo) signatureReferrers(disturl DistUrl) ([]ispec.Descriptor, []ispec.Descriptor, error) {
+	certs, err := r.GetReferrers(disturl, pubkeyArtifact)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "Error fetching the certificate")
+	}
+	sigs, err := r.GetReferrers(disturl, sigArtifact)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "Error fetching the signature")
+	}
+	return certs.Manifests, sigs.Manifests, nil
 }
 
-func getSizeDigestDist(inUrl string) (string, int64, error) {
+func getSizeDigestDist(reg *Registry, inUrl string) (string, int64, error) {
 	// http://127.0.0.1:18080/v2/os/busybox-squashfs/manifests/1.0
-	r, err := NewDistRepo(inUrl)
+	r, err := NewDistRepo(reg, inUrl)
 	if err != nil {
 		return "", 0, errors.Wrapf(err, "Failed to find source repo info for %q", inUrl)
 	}
@@ -275,11 +404,11 @@ func getSizeDigestDist(inUrl string) (string, int64, error) {
 	return u.mDigest, u.mSize, nil
 }
 
-func getSizeDigest(inUrl string) (string, int64, error) {
+func getSizeDigest(reg *Registry, inUrl string) (string, int64, error) {
 	if strings.HasPrefix(inUrl, "oci:") {
 		return getSizeDigestOCI(inUrl)
 	}
-	return getSizeDigestDist(inUrl)
+	return getSizeDigestDist(reg, inUrl)
 }
 
 // An empty digest, consisting of "{}", is required for an artifact.
@@ -288,42 +417,61 @@ func getSizeDigest(inUrl string) (string, int64, error) {
 const emptyDigest = "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"
 
 func (disturl *DistUrl) PostEmptyConfig() error {
-	url := "http://" + disturl.repo.addr + "/v2/" + disturl.name + "/blobs/uploads/?digest=" + emptyDigest
-	buf := bytes.NewBufferString("{}")
-	resp, err := http.Post(url, "application/octet-stream", buf)
-	if err != nil {
+	if err := disturl.uploadBlob(strings.NewReader("{}"), 2, emptyDigest); err != nil {
 		return errors.Wrapf(err, "Failed posting empty config")
 	}
-	resp.Body.Close()
-	if resp.StatusCode != 201 {
-		return errors.Wrapf(err, "Failed posting empty config. Response was: %q", resp.Status)
-	}
 	return nil
 }
 
 func (disturl *DistUrl) Post(path string) (int64, digest.Digest, error) {
 	d := digest.FromString("")
-	b, err := os.ReadFile(path)
+	f, err := os.Open(path)
 	if err != nil {
-		return 0, d, errors.Wrapf(err, "Failed reading %q", path)
+		return 0, d, errors.Wrapf(err, "Failed opening %q", path)
 	}
-	fSize := int64(len(b))
-	fDigest := digest.FromBytes(b)
+	defer f.Close()
 
-	u := "http://" + disturl.repo.addr + "/v2/" + disturl.name + "/blobs/uploads/?digest=" + fDigest.String()
-	buf := bytes.NewBuffer(b)
-	resp, err := http.Post(u, "application/octet-stream", buf)
+	digester := digest.Canonical.Digester()
+	fSize, err := io.Copy(digester.Hash(), f)
 	if err != nil {
-		return fSize, fDigest, errors.Wrapf(err, "Failed writing manifest as blob")
+		return 0, d, errors.Wrapf(err, "Failed reading %q", path)
 	}
-	resp.Body.Close()
-	if resp.StatusCode != 201 {
-		return fSize, fDigest, errors.Wrapf(err, "Repo returned error for manifest as blob.  Response was: %q", resp.Status)
+	fDigest := digester.Digest()
+
+	if err := disturl.uploadBlob(f, fSize, fDigest); err != nil {
+		return fSize, fDigest, errors.Wrapf(err, "Failed writing manifest as blob")
 	}
 
 	return fSize, fDigest, nil
 }
 
+// putManifest uploads manifest @b, of type @mediaType, as @ref.
+func (disturl *DistUrl) putManifest(ref string, b []byte, mediaType string) error {
+	_, err := disturl.sendManifest(ref, b, mediaType)
+	return err
+}
+
+// sendManifest uploads manifest @b, of type @mediaType, as @ref, and
+// returns the headers of the response.
+func (disturl *DistUrl) sendManifest(ref string, b []byte, mediaType string) (http.Header, error) {
+	u := disturl.repo.apiUrl(disturl.name + "/manifests/" + ref)
+	req, err := http.NewRequest(http.MethodPut, u, bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed opening PUT request")
+	}
+	req.Header.Set("Content-Type", mediaType)
+	resp, err := disturl.repo.do(req, pushScope(disturl.name))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed sending PUT request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 201 {
+		return nil, errors.Errorf("Repo returned error for manifest %s.  Response was: %q", ref, resp.Status)
+	}
+	return resp.Header, nil
+}
+
 // remoteManifest: fetch an install.json manifest from an
 // OCI distribution spec remote.  Get the signature and
 // certificate from referring artifacts, verify the signature,
@@ -339,13 +487,20 @@ func (mos *Mos) remoteManifest(url string) (*InstallFile, error) {
 		return &InstallFile{}, errors.Errorf("Opening remote manifest on installed host is unsupported")
 	}
 
+	vopts, err := mos.fetchVerifyOpts()
+	if err != nil {
+		return &InstallFile{}, err
+	}
 	is := InstallSource{}
-	if err := is.FetchFromZot(url); err != nil {
+	if err := is.Fetch(mos.registry, url, vopts); err != nil {
 		return &InstallFile{}, errors.Wrapf(err, "Error fetching remote manifest")
 	}
 	defer is.Cleanup()
+	if err := mos.checkFetched(&is); err != nil {
+		return &InstallFile{}, err
+	}
 
-	manifest, err := ReadVerifyInstallManifest(is, mos.opts.CaPath, mos.storage)
+	manifest, err := ReadVerifyInstallManifest(is, vopts, mos.storage)
 	if err != nil {
 		return &InstallFile{}, errors.Wrapf(err, "Error verifying remote manifest")
 	}
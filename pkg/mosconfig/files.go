@@ -108,6 +108,8 @@ type Target struct {
 	Digest      string            `json:"digest"`
 	Storage     TargetStorageList `json:"storage"`
 	Size        int64             `json:"size"`
+	DependsOn   []string          `json:"depends_on,omitempty"` // targets which must be running first
+	After       []string          `json:"after,omitempty"`      // targets which, if present, start first
 }
 type InstallTargets []Target
 
@@ -209,7 +211,9 @@ func (i *StorageItem) Create(mos *Mos, allDisks disko.DiskSet, mysys disko.Syste
 		if err != nil {
 			return err
 		}
-		if len(idmapset.Idmap) != 0 {
+		// If the volume can be idmapped, then it is shifted as it is
+		// bind mounted into the containers.  See storageMountOpts().
+		if len(idmapset.Idmap) != 0 && !mos.canIdmap(dest, idmapset) {
 			if err := idmapset.ShiftFile(dest); err != nil {
 				return errors.Wrapf(err, "Failed shifting %q to %#v", dest, idmapset.Idmap)
 			}
@@ -231,6 +235,14 @@ func (s StorageList) Contains(n StorageItem) bool {
 	return false
 }
 
+// StorageRemoval asks a partial update to delete a storage volume.
+// A persistent volume is only deleted if Persistent is set as well, so
+// that its data is not lost by accident.
+type StorageRemoval struct {
+	Label      string `json:"label" yaml:"label"`
+	Persistent bool   `json:"persistent" yaml:"persistent"`
+}
+
 // This describes an install manifest
 type InstallFile struct {
 	Version    int            `json:"version"`
@@ -238,6 +250,15 @@ type InstallFile struct {
 	Storage    StorageList    `json:"storage"`
 	Targets    InstallTargets `json:"targets"`
 	UpdateType UpdateType     `json:"update_type"`
+
+	// Raised by the publisher whenever an update fixes a security
+	// problem.  Hosts refuse manifests older than one they have
+	// accepted (see secversion.go).
+	SecurityVersion uint64 `json:"security_version,omitempty"`
+
+	// Targets and storage for a partial update to remove
+	RemoveTargets []string         `json:"remove_targets,omitempty"`
+	RemoveStorage []StorageRemoval `json:"remove_storage,omitempty"`
 }
 
 // Note we only do combined uid+gid ranges, range 65536, and only starting at
@@ -306,6 +327,65 @@ func (af *InstallFile) Validate() error {
 		af.UpdateType = PartialUpdate
 	}
 
+	if err := af.validateRemovals(); err != nil {
+		return err
+	}
+
+	// A partial update may depend on targets from earlier installs,
+	// but a complete one must be self-contained.
+	if af.UpdateType == FullUpdate {
+		for _, t := range af.Targets {
+			for _, d := range t.DependsOn {
+				if d == "hostfs" || d == "bootkit" {
+					continue
+				}
+				if _, err := af.GetTarget(d); err != nil {
+					return fmt.Errorf("Target %s depends on unknown target %s", t.ServiceName, d)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateRemovals checks the remove_targets and remove_storage lists.
+// A complete update already removes whatever it does not list, so they
+// are only allowed in partial updates.
+func (af *InstallFile) validateRemovals() error {
+	if len(af.RemoveTargets) == 0 && len(af.RemoveStorage) == 0 {
+		return nil
+	}
+	if af.UpdateType == FullUpdate {
+		return fmt.Errorf("remove_targets and remove_storage are only allowed in partial updates")
+	}
+
+	for _, n := range af.RemoveTargets {
+		if n == "hostfs" || n == "bootkit" {
+			return fmt.Errorf("Target %s cannot be removed", n)
+		}
+		if _, err := af.GetTarget(n); err == nil {
+			return fmt.Errorf("Target %s is both listed and removed", n)
+		}
+	}
+
+	for _, r := range af.RemoveStorage {
+		i := StorageItem{Label: r.Label}
+		if r.Label == "" || i.IsReserved() {
+			return fmt.Errorf("Invalid storage name %q", r.Label)
+		}
+		if af.Storage.Contains(i) {
+			return fmt.Errorf("Storage %s is both listed and removed", r.Label)
+		}
+		for _, t := range af.Targets {
+			for _, ts := range t.Storage {
+				if ts.Label == r.Label {
+					return fmt.Errorf("Target %s uses removed storage %s", t.ServiceName, r.Label)
+				}
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -335,46 +415,72 @@ func simpleParseInstall(manifestPath string) (InstallFile, error) {
 // Verify an install.json manifest.  Return the parsed manifest.
 // @is is the InstallSource of the install.json.
 // @s is the storage driver, currently always an atomfs.
-func ReadVerifyInstallManifest(is InstallSource, capath string, s Storage) (InstallFile, error) {
-	bytes, err := os.ReadFile(is.FilePath)
+func ReadVerifyInstallManifest(is InstallSource, vopts trust.VerifyOpts, s Storage) (InstallFile, error) {
+	manifest, err := VerifyInstallManifest(is, vopts)
 	if err != nil {
-		return InstallFile{}, fmt.Errorf("Failed reading manifest: %w", err)
-	}
-
-	if err := trust.VerifyManifest(bytes, is.SignPath, is.CertPath, capath); err != nil {
 		return InstallFile{}, err
 	}
 
-	var manifest InstallFile
-	err = json.Unmarshal(bytes, &manifest)
-	if err != nil {
-		return InstallFile{}, fmt.Errorf("Failed parsing manifest: %w", err)
-	}
-
 	// We've verified the install.json contents.  Now verify that the container
 	// image manifest files pointed to have not been altered.
-	for _, t := range manifest.Targets {
-		if is.ocirepo != nil {
+	targets := append([]Target{}, manifest.Targets...)
+	_, err = forEachTarget(targets, func(t *Target) error {
+		if src := is.targetSource(t); src != "" {
 			// Import the layer into our zot store.
 			// We could consider deleting the layer if VerifyTarget fails below.
 			// This is not terribly important as nothing will use it,
 			// unless there's a manifest which is properly signed which refers
 			// to it, in which case we'll regret having deleted it...
-			src := fmt.Sprintf("docker://%s/mos:%s", is.ocirepo.addr, dropHashAlg(t.Digest))
-			if err := s.ImportTarget(src, &t); err != nil {
-				return InstallFile{}, err
+			if err := s.ImportTarget(is.registry(), src, t); err != nil {
+				return err
 			}
 		}
 
-		if err := s.VerifyTarget(&t); err != nil {
-			return InstallFile{}, fmt.Errorf("Bad manifest hash for %q: %w", t.ServiceName, err)
+		if err := s.VerifyTarget(t); err != nil {
+			return fmt.Errorf("Bad manifest hash for %q: %w", t.ServiceName, err)
 		}
+		return nil
+	})
+	if err != nil {
+		return InstallFile{}, err
+	}
+
+	return manifest, nil
+}
+
+// VerifyInstallManifest reads the install manifest from @is and verifies
+// its signature, checking the certificate as in @vopts and against
+// is.CRLPaths, its contents, its product against is.SudiCertPath, and
+// its security version against is.MinSecurityVersion, but unlike
+// ReadVerifyInstallManifest does not import or check the targets.
+func VerifyInstallManifest(is InstallSource, vopts trust.VerifyOpts) (InstallFile, error) {
+	bytes, err := os.ReadFile(is.FilePath)
+	if err != nil {
+		return InstallFile{}, fmt.Errorf("Failed reading manifest: %w", err)
+	}
+
+	if err := trust.VerifyManifestOpts(bytes, is.SignPath, is.CertPath, is.SignAlg, is.verifyOpts(vopts)); err != nil {
+		return InstallFile{}, err
+	}
+
+	var manifest InstallFile
+	err = json.Unmarshal(bytes, &manifest)
+	if err != nil {
+		return InstallFile{}, fmt.Errorf("Failed parsing manifest: %w", err)
 	}
 
 	if err := manifest.Validate(); err != nil {
 		return InstallFile{}, err
 	}
 
+	if err := checkProduct(manifest, is.SudiCertPath); err != nil {
+		return InstallFile{}, err
+	}
+
+	if err := is.checkSecurityVersion(manifest, bytes, vopts); err != nil {
+		return InstallFile{}, err
+	}
+
 	return manifest, nil
 }
 
@@ -393,18 +499,21 @@ func (ts InstallTargets) Validate() error {
 		}
 	}
 
-	return nil
+	return ts.validateDependencies()
 }
 
 // The import manifest (manifest.yaml) which the user writes,
 // and which mosb converts into an install.json.
 
 type ImportFile struct {
-	Version    int         `yaml:"version"`
-	Product    string      `yaml:"product"`
-	Storage    StorageList `yaml:"storage"`
-	Targets    UserTargets `yaml:"targets"`
-	UpdateType UpdateType  `yaml:"update_type"`
+	Version         int              `yaml:"version"`
+	Product         string           `yaml:"product"`
+	Storage         StorageList      `yaml:"storage"`
+	Targets         UserTargets      `yaml:"targets"`
+	UpdateType      UpdateType       `yaml:"update_type"`
+	SecurityVersion uint64           `yaml:"security_version"`
+	RemoveTargets   []string         `yaml:"remove_targets"`
+	RemoveStorage   []StorageRemoval `yaml:"remove_storage"`
 }
 
 func (i *ImportFile) HasTarget(name string) bool {
@@ -455,5 +564,7 @@ type UserTarget struct {
 	NSGroup     string            `yaml:"nsgroup"`
 	Digest      string            `yaml:"digest"`
 	Size        int64             `yaml:"size"`
+	DependsOn   []string          `yaml:"depends_on"`
+	After       []string          `yaml:"after"`
 }
 type UserTargets []UserTarget
@@ -0,0 +1,331 @@
+package mosconfig
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/project-machine/mos/pkg/utils"
+	"stackerbuild.io/stacker/pkg/mount"
+)
+
+// Every update imports new images into $StorageCache/mos, tagged by
+// manifest digest, and nothing removes the old ones.  GC removes the
+// images which are no longer needed, keeping those used by:
+//   - the current manifest, and the KeepHistory revisions before it,
+//   - the hostfs which create-boot-fs may fall back to or try next,
+//   - a staged update,
+//   - anything still running.
+// Blobs shared between a kept image and a removed one are kept.
+
+// GCOptions tunes GC.
+type GCOptions struct {
+	// Only report what would be removed.
+	DryRun bool
+
+	// How many manifest revisions before the current one to keep the
+	// images for, so that they can be rolled back to.
+	KeepHistory int
+}
+
+// GCResult describes what GC removed, or would have removed.
+type GCResult struct {
+	DryRun          bool     `json:"dry_run"`
+	KeptTags        []string `json:"kept_tags"`
+	RemovedTags     []string `json:"removed_tags"`
+	RemovedBlobs    []string `json:"removed_blobs"`
+	RemovedMetadata []string `json:"removed_metadata"`
+	Reclaimed       int64    `json:"reclaimed"` // bytes
+}
+
+// GC removes images and storage metadata which are no longer needed.
+func (mos *Mos) GC(opts GCOptions) (*GCResult, error) {
+	if opts.KeepHistory < 0 {
+		return nil, errors.Errorf("Invalid history count %d", opts.KeepHistory)
+	}
+
+	keep, err := mos.gcRoots(opts.KeepHistory)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed finding images in use")
+	}
+
+	res := &GCResult{
+		DryRun:          opts.DryRun,
+		KeptTags:        []string{},
+		RemovedTags:     []string{},
+		RemovedBlobs:    []string{},
+		RemovedMetadata: []string{},
+	}
+
+	ocidir := filepath.Join(mos.opts.StorageCache, "mos")
+	if utils.PathExists(filepath.Join(ocidir, "index.json")) {
+		if err := gcOCILayout(ocidir, keep, res); err != nil {
+			return res, errors.Wrapf(err, "Failed cleaning up %q", ocidir)
+		}
+	}
+
+	stale, err := mos.storage.StaleMetadata()
+	if err != nil {
+		return res, errors.Wrapf(err, "Failed finding stale %s metadata", mos.storage.Type())
+	}
+	for _, p := range stale {
+		res.Reclaimed += diskUsage(p)
+		res.RemovedMetadata = append(res.RemovedMetadata, p)
+		if opts.DryRun {
+			continue
+		}
+		if err := os.RemoveAll(p); err != nil {
+			return res, errors.Wrapf(err, "Failed removing %q", p)
+		}
+	}
+
+	return res, nil
+}
+
+// gcRoots returns the digests of all images which must be kept.
+func (mos *Mos) gcRoots(keepHistory int) (map[string]bool, error) {
+	keep := map[string]bool{}
+
+	repo, err := mos.openManifestRepo()
+	if err != nil {
+		return nil, err
+	}
+	c, err := resolveManifestCommit(repo, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i <= keepHistory; i++ {
+		r, err := readManifestRevision(c)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range r.Targets {
+			keep[t.Digest] = true
+		}
+		if c.NumParents() == 0 {
+			break
+		}
+		c, err = c.Parent(0)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed reading parent of manifest revision %s", r.Revision)
+		}
+	}
+
+	s, err := mos.HostfsBootState()
+	if err != nil {
+		return nil, err
+	}
+	if s != nil {
+		for _, rev := range []string{s.Previous, s.Next} {
+			if rev == "" {
+				continue
+			}
+			c, err := resolveManifestCommit(repo, rev, 0)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Failed finding hostfs revision %s", rev)
+			}
+			r, err := readManifestRevision(c)
+			if err != nil {
+				return nil, err
+			}
+			for _, t := range r.Targets {
+				if t.Name == "hostfs" {
+					keep[t.Digest] = true
+				}
+			}
+		}
+	}
+
+	staged, err := mos.StagedUpdate()
+	if err != nil {
+		return nil, err
+	}
+	if staged != nil {
+		for _, d := range staged.Targets {
+			keep[d] = true
+		}
+	}
+
+	// A service may still be running an image which has since been
+	// replaced in the manifest.
+	entries, err := os.ReadDir(filepath.Join(mos.opts.ScratchWrites, "running"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, e := range entries {
+		bytes, err := os.ReadFile(filepath.Join(mos.opts.ScratchWrites, "running", e.Name()))
+		if err != nil {
+			continue
+		}
+		var r RunningTarget
+		if err := json.Unmarshal(bytes, &r); err != nil || r.BootId != currentBootId() {
+			continue
+		}
+		if r.Digest != "" {
+			keep[r.Digest] = true
+		}
+	}
+
+	return keep, nil
+}
+
+// gcOCILayout removes the tags in the OCI layout at @ocidir which are not
+// in @keep, and then all blobs which the remaining tags do not reach.
+func gcOCILayout(ocidir string, keep map[string]bool, res *GCResult) error {
+	ctx := context.Background()
+
+	oci, err := umoci.OpenLayout(ocidir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	refs, err := oci.ListReferences(ctx)
+	if err != nil {
+		return err
+	}
+	sort.Strings(refs)
+
+	reachable := map[digest.Digest]bool{}
+	for _, ref := range refs {
+		// puzzlefs images are tagged without the digest's
+		// algorithm (see puzzlefsTag).
+		if !keep[ref] && !keep[digest.Canonical.String()+":"+ref] {
+			res.RemovedTags = append(res.RemovedTags, ref)
+			continue
+		}
+		res.KeptTags = append(res.KeptTags, ref)
+		paths, err := oci.ResolveReference(ctx, ref)
+		if err != nil {
+			return errors.Wrapf(err, "Failed resolving %s", ref)
+		}
+		for _, p := range paths {
+			if err := markReachable(ctx, oci, p.Descriptor(), reachable); err != nil {
+				return errors.Wrapf(err, "Failed walking %s", ref)
+			}
+		}
+	}
+
+	blobs, err := oci.ListBlobs(ctx)
+	if err != nil {
+		return err
+	}
+	unreachable := []digest.Digest{}
+	for _, b := range blobs {
+		if reachable[b] {
+			continue
+		}
+		unreachable = append(unreachable, b)
+		res.RemovedBlobs = append(res.RemovedBlobs, b.String())
+		if fi, err := os.Stat(filepath.Join(ocidir, "blobs", b.Algorithm().String(), b.Encoded())); err == nil {
+			res.Reclaimed += fi.Size()
+		}
+	}
+
+	if res.DryRun {
+		return nil
+	}
+
+	for _, ref := range res.RemovedTags {
+		log.Debugf("Removing tag %s", ref)
+		if err := oci.DeleteReference(ctx, ref); err != nil {
+			return errors.Wrapf(err, "Failed removing tag %s", ref)
+		}
+	}
+	for _, b := range unreachable {
+		log.Debugf("Removing blob %s", b)
+		if err := oci.DeleteBlob(ctx, b); err != nil {
+			return errors.Wrapf(err, "Failed removing blob %s", b)
+		}
+	}
+
+	return oci.Clean(ctx)
+}
+
+// markReachable adds @desc and everything it refers to to @seen.  Only
+// manifests and indexes are read; layers can be large, and only need to
+// be marked.
+func markReachable(ctx context.Context, oci casext.Engine, desc ispec.Descriptor, seen map[digest.Digest]bool) error {
+	if seen[desc.Digest] {
+		return nil
+	}
+	seen[desc.Digest] = true
+
+	var children []ispec.Descriptor
+	switch desc.MediaType {
+	case ispec.MediaTypeImageManifest:
+		var m ispec.Manifest
+		if err := readBlobJSON(ctx, oci, desc.Digest, &m); err != nil {
+			return err
+		}
+		children = append(children, m.Config)
+		children = append(children, m.Layers...)
+		if m.Subject != nil {
+			children = append(children, *m.Subject)
+		}
+	case ispec.MediaTypeImageIndex:
+		var idx ispec.Index
+		if err := readBlobJSON(ctx, oci, desc.Digest, &idx); err != nil {
+			return err
+		}
+		children = idx.Manifests
+	}
+
+	for _, c := range children {
+		if err := markReachable(ctx, oci, c, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readBlobJSON(ctx context.Context, oci casext.Engine, d digest.Digest, v interface{}) error {
+	r, err := oci.GetBlob(ctx, d)
+	if err != nil {
+		return errors.Wrapf(err, "Failed reading blob %s", d)
+	}
+	defer r.Close()
+	if err := json.NewDecoder(r).Decode(v); err != nil {
+		return errors.Wrapf(err, "Failed parsing blob %s", d)
+	}
+	return nil
+}
+
+// diskUsage returns the total size of the files under @path.
+func diskUsage(path string) int64 {
+	var total int64
+	filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if fi, err := d.Info(); err == nil {
+				total += fi.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
+
+// hasMountUnder reports whether anything in @mounts is mounted at or
+// under @path.
+func hasMountUnder(mounts mount.Mounts, path string) bool {
+	path = filepath.Clean(path)
+	for _, m := range mounts {
+		if m.Target == path || strings.HasPrefix(m.Target, path+"/") {
+			return true
+		}
+	}
+	return false
+}
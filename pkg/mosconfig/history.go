@@ -0,0 +1,284 @@
+package mosconfig
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/pkg/errors"
+)
+
+// RevisionTarget describes a target as recorded in one revision of
+// the system manifest.
+type RevisionTarget struct {
+	Name        string      `json:"name"`
+	Version     string      `json:"version"`
+	Digest      string      `json:"digest"`
+	ServiceType ServiceType `json:"service_type"`
+	Source      string      `json:"source"` // install manifest which defined it
+	Product     string      `json:"product"`
+	UpdateType  UpdateType  `json:"update_type"`
+	CertSubject string      `json:"cert_subject"`
+}
+
+// TargetChange describes how a target differs between two revisions
+// of the system manifest.
+type TargetChange struct {
+	Name       string `json:"name"`
+	Change     string `json:"change"` // added, removed or changed
+	OldVersion string `json:"old_version,omitempty"`
+	OldDigest  string `json:"old_digest,omitempty"`
+	NewVersion string `json:"new_version,omitempty"`
+	NewDigest  string `json:"new_digest,omitempty"`
+}
+
+func (c TargetChange) String() string {
+	switch c.Change {
+	case "added":
+		return fmt.Sprintf("%s: added %s (%s)", c.Name, c.NewVersion, c.NewDigest)
+	case "removed":
+		return fmt.Sprintf("%s: removed %s (%s)", c.Name, c.OldVersion, c.OldDigest)
+	}
+	return fmt.Sprintf("%s: %s (%s) -> %s (%s)", c.Name, c.OldVersion, c.OldDigest, c.NewVersion, c.NewDigest)
+}
+
+// ManifestRevision describes one commit in $config/manifest.git.
+type ManifestRevision struct {
+	Revision string           `json:"revision"`
+	Time     time.Time        `json:"time"`
+	Message  string           `json:"message"`
+	Targets  []RevisionTarget `json:"targets"`
+	Changes  []TargetChange   `json:"changes"` // against the previous revision
+}
+
+// diffTargets lists the targets which were added, removed, or changed
+// version or digest between @prev and @next.
+func diffTargets(prev, next []RevisionTarget) []TargetChange {
+	changes := []TargetChange{}
+	old := map[string]RevisionTarget{}
+	for _, t := range prev {
+		old[t.Name] = t
+	}
+	for _, t := range next {
+		o, ok := old[t.Name]
+		delete(old, t.Name)
+		switch {
+		case !ok:
+			changes = append(changes, TargetChange{
+				Name:       t.Name,
+				Change:     "added",
+				NewVersion: t.Version,
+				NewDigest:  t.Digest,
+			})
+		case o.Version != t.Version || o.Digest != t.Digest:
+			changes = append(changes, TargetChange{
+				Name:       t.Name,
+				Change:     "changed",
+				OldVersion: o.Version,
+				OldDigest:  o.Digest,
+				NewVersion: t.Version,
+				NewDigest:  t.Digest,
+			})
+		}
+	}
+	// Keep removals in the order of the previous revision
+	for _, t := range prev {
+		if _, ok := old[t.Name]; !ok {
+			continue
+		}
+		changes = append(changes, TargetChange{
+			Name:       t.Name,
+			Change:     "removed",
+			OldVersion: t.Version,
+			OldDigest:  t.Digest,
+		})
+	}
+	return changes
+}
+
+// sysRevisionTargets summarizes the targets of a SysManifest whose
+// raw targets have been filled in.
+func sysRevisionTargets(m *SysManifest) []RevisionTarget {
+	ret := []RevisionTarget{}
+	for _, t := range m.SysTargets {
+		r := RevisionTarget{Name: t.Name, Source: t.Source}
+		if t.raw != nil {
+			r.Version = t.raw.Version
+			r.Digest = t.raw.Digest
+			r.ServiceType = t.raw.ServiceType
+		}
+		ret = append(ret, r)
+	}
+	return ret
+}
+
+// manifestCommitMessage builds the manifest.git commit message for
+// switching from @prev to @next using install manifest @shaSum.
+func manifestCommitMessage(product, shaSum string, prev, next *SysManifest) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Update product %s to install manifest %s\n", product, shaSum)
+	changes := diffTargets(sysRevisionTargets(prev), sysRevisionTargets(next))
+	if len(changes) == 0 {
+		return b.String()
+	}
+	b.WriteString("\nChanged targets:\n")
+	for _, c := range changes {
+		fmt.Fprintf(&b, "  %s\n", c)
+	}
+	return b.String()
+}
+
+// History returns every revision of the system manifest, newest first,
+// following first parents from HEAD.
+func (mos *Mos) History() ([]ManifestRevision, error) {
+	repo, err := mos.openManifestRepo()
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := resolveManifestCommit(repo, "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []ManifestRevision{}
+	for {
+		r, err := readManifestRevision(c)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, r)
+		if c.NumParents() == 0 {
+			break
+		}
+		c, err = c.Parent(0)
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading parent of manifest revision %s: %w", r.Revision, err)
+		}
+	}
+
+	for i := range ret {
+		prev := []RevisionTarget{}
+		if i+1 < len(ret) {
+			prev = ret[i+1].Targets
+		}
+		ret[i].Changes = diffTargets(prev, ret[i].Targets)
+	}
+
+	return ret, nil
+}
+
+// ShowRevision returns manifest revision @rev, diffed against its
+// first parent.
+func (mos *Mos) ShowRevision(rev string) (*ManifestRevision, error) {
+	repo, err := mos.openManifestRepo()
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := resolveManifestCommit(repo, rev, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := readManifestRevision(c)
+	if err != nil {
+		return nil, err
+	}
+
+	prev := []RevisionTarget{}
+	if c.NumParents() > 0 {
+		p, err := c.Parent(0)
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading parent of manifest revision %s: %w", r.Revision, err)
+		}
+		pr, err := readManifestRevision(p)
+		if err != nil {
+			return nil, err
+		}
+		prev = pr.Targets
+	}
+	r.Changes = diffTargets(prev, r.Targets)
+
+	return &r, nil
+}
+
+// readManifestRevision reads the targets recorded in commit @c.  The
+// install manifests are not verified, since their certificates may
+// well have expired by now.
+func readManifestRevision(c *object.Commit) (ManifestRevision, error) {
+	ret := ManifestRevision{
+		Revision: c.Hash.String(),
+		Time:     c.Committer.When,
+		Message:  strings.TrimSpace(c.Message),
+		Targets:  []RevisionTarget{},
+	}
+
+	dir, err := os.MkdirTemp("", "history")
+	if err != nil {
+		return ret, err
+	}
+	defer os.RemoveAll(dir)
+
+	sm, err := extractManifestCommit(c, dir)
+	if err != nil {
+		return ret, err
+	}
+
+	installs := map[string]InstallFile{}
+	subjects := map[string]string{}
+	for _, st := range sm.SysTargets {
+		cf, ok := installs[st.Source]
+		if !ok {
+			cf, err = simpleParseInstall(filepath.Join(dir, st.Source))
+			if err != nil {
+				return ret, errors.Wrapf(err, "Failed reading %s from manifest revision %s", st.Source, c.Hash)
+			}
+			installs[st.Source] = cf
+			certPath := filepath.Join(dir, strings.TrimSuffix(st.Source, ".json")+".pem")
+			subjects[st.Source], err = certSubject(certPath)
+			if err != nil {
+				return ret, errors.Wrapf(err, "Failed reading certificate for %s from manifest revision %s", st.Source, c.Hash)
+			}
+		}
+
+		t, ok := findTarget(cf, st.Name)
+		if !ok {
+			return ret, errors.Errorf("target %s not found in %s", st.Name, st.Source)
+		}
+
+		ret.Targets = append(ret.Targets, RevisionTarget{
+			Name:        st.Name,
+			Version:     t.Version,
+			Digest:      t.Digest,
+			ServiceType: t.ServiceType,
+			Source:      st.Source,
+			Product:     cf.Product,
+			UpdateType:  cf.UpdateType,
+			CertSubject: subjects[st.Source],
+		})
+	}
+
+	return ret, nil
+}
+
+func certSubject(path string) (string, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(bytes)
+	if block == nil {
+		return "", errors.Errorf("No PEM data found in %s", path)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed parsing certificate %s", path)
+	}
+	return cert.Subject.String(), nil
+}
@@ -0,0 +1,323 @@
+package mosconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/apex/log"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/pkg/errors"
+	"github.com/project-machine/mos/pkg/utils"
+)
+
+// A new hostfs only takes effect at the next boot.  When an update or
+// rollback changes the hostfs, the manifest revision holding it is
+// recorded as "next", along with the revision holding the last hostfs
+// which booted successfully.  create-boot-fs then tries the next hostfs
+// up to MaxAttempts times.  Once 'mosctl boot' has set up storage under
+// it, it is known to be good and becomes the new previous, whether or
+// not every service then starts.  If it never gets that far, then
+// create-boot-fs falls back to the previous hostfs, and commits a new
+// manifest revision with it in place of the new one, so that the
+// manifest names the hostfs which is really running.
+
+// DefaultHostfsBootAttempts is how many times a new hostfs is tried
+// before falling back to the previous one.
+const DefaultHostfsBootAttempts = 3
+
+const hostfsStateFile = "hostfs-boot.json"
+
+// HostfsBootState is kept in $config/hostfs-boot.json.
+type HostfsBootState struct {
+	Previous    string `json:"previous"` // manifest revision with the last good hostfs
+	Next        string `json:"next"`     // manifest revision with the hostfs to try
+	Attempts    int    `json:"attempts"`
+	MaxAttempts int    `json:"max_attempts"`
+	FellBack    bool   `json:"fell_back"`
+}
+
+// Pending reports whether a new hostfs is waiting to be booted.
+func (s *HostfsBootState) Pending() bool {
+	return s != nil && s.Next != "" && !s.FellBack
+}
+
+func (mos *Mos) hostfsStatePath() string {
+	return filepath.Join(mos.opts.ConfigDir, hostfsStateFile)
+}
+
+// HostfsBootState returns the A/B hostfs state, or nil if no hostfs
+// update has been staged.
+func (mos *Mos) HostfsBootState() (*HostfsBootState, error) {
+	p := mos.hostfsStatePath()
+	bytes, err := os.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "Failed reading %s", p)
+	}
+	var s HostfsBootState
+	if err := json.Unmarshal(bytes, &s); err != nil {
+		return nil, errors.Wrapf(err, "Failed parsing %s", p)
+	}
+	return &s, nil
+}
+
+func (mos *Mos) saveHostfsBootState(s *HostfsBootState) error {
+	bytes, err := json.Marshal(s)
+	if err != nil {
+		return errors.Wrapf(err, "Failed marshalling hostfs boot state")
+	}
+	p := mos.hostfsStatePath()
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, bytes, 0644); err != nil {
+		return errors.Wrapf(err, "Failed writing %s", tmp)
+	}
+	return os.Rename(tmp, p)
+}
+
+func (mos *Mos) clearHostfsBootState() error {
+	err := os.Remove(mos.hostfsStatePath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// targetChanged reports whether target @name differs between @prev
+// and @next.
+func targetChanged(prev, next *SysManifest, name string) bool {
+	p, perr := prev.GetTarget(name)
+	n, nerr := next.GetTarget(name)
+	if (perr == nil) != (nerr == nil) {
+		return true
+	}
+	if perr != nil {
+		return false
+	}
+	if p.raw == nil || n.raw == nil {
+		return p.Source != n.Source
+	}
+	return !reflect.DeepEqual(*p.raw, *n.raw)
+}
+
+// needsReboot reports whether going from @prev to @next changes the
+// hostfs or bootkit, which only take effect at boot.
+func needsReboot(prev, next *SysManifest) bool {
+	return targetChanged(prev, next, "hostfs") || targetChanged(prev, next, "bootkit")
+}
+
+// stageHostfs records that the hostfs at manifest revision @next should
+// be tried at next boot, falling back to the one at @prev.  If an
+// earlier staged hostfs has not yet booted, then its fallback is kept.
+func (mos *Mos) stageHostfs(prev, next plumbing.Hash) error {
+	old, err := mos.HostfsBootState()
+	if err != nil {
+		log.Warnf("Replacing unreadable hostfs boot state: %v", err)
+		old = nil
+	}
+
+	s := HostfsBootState{
+		Previous:    prev.String(),
+		Next:        next.String(),
+		MaxAttempts: mos.opts.HostfsBootAttempts,
+	}
+	if s.MaxAttempts < 1 {
+		s.MaxAttempts = DefaultHostfsBootAttempts
+	}
+	if old != nil && old.Next != "" {
+		// The hostfs staged earlier never booted, or failed
+		// and we fell back.  Either way we are still running
+		// the earlier previous one.
+		s.Previous = old.Previous
+	}
+
+	log.Infof("New hostfs staged, reboot to activate it")
+	return mos.saveHostfsBootState(&s)
+}
+
+// confirmHostfs is called once storage has been set up under the
+// booted hostfs, marking it as good.
+func (mos *Mos) confirmHostfs() error {
+	s, err := mos.HostfsBootState()
+	if err != nil || s == nil {
+		return err
+	}
+	if s.FellBack {
+		// Keep the record of the failure until the next update
+		return nil
+	}
+	log.Infof("hostfs from manifest revision %s booted successfully", s.Next)
+	return mos.clearHostfsBootState()
+}
+
+// hostfsAt returns the verified hostfs target from manifest revision
+// @rev.
+func (mos *Mos) hostfsAt(rev string) (*Target, error) {
+	repo, err := mos.openManifestRepo()
+	if err != nil {
+		return nil, err
+	}
+	c, err := resolveManifestCommit(repo, rev, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpdir, err := os.MkdirTemp("", "hostfs")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	sm, err := mos.verifiedManifestAt(c, tmpdir)
+	if err != nil {
+		return nil, err
+	}
+	t, err := sm.GetTarget("hostfs")
+	if err != nil {
+		return nil, errors.Wrapf(err, "No hostfs in manifest revision %s", rev)
+	}
+	return t.raw, nil
+}
+
+// bootHostfs picks the hostfs which create-boot-fs should mount.  If a
+// new hostfs is staged, it counts an attempt to boot it, and falls back
+// to the previous one once it has used up its attempts.
+func (mos *Mos) bootHostfs() (*Target, error) {
+	s, err := mos.HostfsBootState()
+	if err != nil {
+		log.Warnf("Ignoring hostfs boot state: %v", err)
+		s = nil
+	}
+	if s == nil {
+		return mos.Current("hostfs")
+	}
+
+	if !s.FellBack {
+		s.Attempts++
+		if s.Attempts > s.MaxAttempts {
+			log.Warnf("hostfs from manifest revision %s failed to boot %d times, falling back to revision %s",
+				s.Next, s.MaxAttempts, s.Previous)
+			s.FellBack = true
+		}
+		if err := mos.saveHostfsBootState(s); err != nil {
+			return nil, errors.Wrapf(err, "Failed saving hostfs boot state")
+		}
+	}
+
+	if s.FellBack {
+		return mos.fallBackHostfs(s.Previous)
+	}
+
+	t, err := mos.hostfsAt(s.Next)
+	if err != nil {
+		log.Warnf("Failed reading staged hostfs, falling back: %v", err)
+		s.FellBack = true
+		if err := mos.saveHostfsBootState(s); err != nil {
+			log.Warnf("Failed saving hostfs boot state: %v", err)
+		}
+		return mos.fallBackHostfs(s.Previous)
+	}
+	return t, nil
+}
+
+// fallBackHostfs returns the hostfs from manifest revision @prev, to
+// boot in place of a new one which failed.  Unless the current manifest
+// already has it, a revision which does replaces the current one.  If
+// that fails, we still boot the old hostfs, as the new one cannot be.
+func (mos *Mos) fallBackHostfs(prev string) (*Target, error) {
+	repo, err := mos.openManifestRepo()
+	if err != nil {
+		return nil, err
+	}
+	c, err := resolveManifestCommit(repo, prev, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpdir, err := os.MkdirTemp("", "hostfs")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	old, err := mos.verifiedManifestAt(c, tmpdir)
+	if err != nil {
+		return nil, err
+	}
+	t, err := old.GetTarget("hostfs")
+	if err != nil {
+		return nil, errors.Wrapf(err, "No hostfs in manifest revision %s", prev)
+	}
+
+	if err := mos.revertHostfs(old, t, tmpdir, prev); err != nil {
+		log.Warnf("Failed switching the manifest back to the hostfs from revision %s: %v", prev, err)
+	}
+	return t.raw, nil
+}
+
+// revertHostfs commits a manifest revision which is the current one,
+// but with hostfs @t from manifest revision @prev, whose system manifest
+// @old and install manifests are in @dir.
+func (mos *Mos) revertHostfs(old *SysManifest, t *SysTarget, dir, prev string) error {
+	manifest, err := mos.CurrentManifest()
+	if err != nil {
+		return err
+	}
+	if !targetChanged(manifest, old, "hostfs") {
+		return nil
+	}
+
+	sysmanifest := *manifest
+	sysmanifest.SysTargets = []SysTarget{}
+	for _, st := range manifest.SysTargets {
+		if st.Name == "hostfs" {
+			st = *t
+		}
+		sysmanifest.SysTargets = append(sysmanifest.SysTargets, st)
+	}
+
+	bytes, err := json.Marshal(&sysmanifest)
+	if err != nil {
+		return errors.Wrapf(err, "Failed marshalling the system manifest")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "manifest.json"), bytes, 0640); err != nil {
+		return errors.Wrapf(err, "Failed writing system manifest")
+	}
+
+	msg := fmt.Sprintf("Fall back to the hostfs from revision %s", prev)
+	if err := mos.updateManifest(manifest, &sysmanifest, dir, msg); err != nil {
+		return err
+	}
+	mos.Manifest = nil
+	log.Warnf("%s", msg)
+	return nil
+}
+
+// MountBootHostfs mounts the hostfs to boot onto @dest.  See
+// bootHostfs().
+func (mos *Mos) MountBootHostfs(dest string, ro bool) error {
+	t, err := mos.bootHostfs()
+	if err != nil {
+		return errors.Wrapf(err, "Failed finding hostfs to boot")
+	}
+
+	if err := utils.EnsureDir(dest); err != nil {
+		return errors.Wrapf(err, "Failed creating mountpoint")
+	}
+
+	log.Infof("Booting hostfs version %s (%s)", t.Version, t.Digest)
+	if ro {
+		_, err = mos.storage.Mount(t, dest)
+	} else {
+		_, err = mos.storage.MountWriteable(t, dest)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Failed mounting hostfs onto %q", dest)
+	}
+
+	return nil
+}
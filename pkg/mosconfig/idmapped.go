@@ -0,0 +1,245 @@
+package mosconfig
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"github.com/apex/log"
+	"github.com/lxc/lxd/shared/idmap"
+	"github.com/pkg/errors"
+	"github.com/project-machine/mos/pkg/utils"
+	"golang.org/x/sys/unix"
+)
+
+// Containers in an nsgroup run with their ids shifted to the nsgroup's
+// host range, so their rootfs and storage must appear owned by those
+// shifted ids.  Where the kernel and filesystem support it, this is done
+// with an idmapped mount, which takes constant time and leaves the image
+// untouched.  Otherwise we fall back to chowning every file with
+// ShiftFile, which for a rootfs means first copying the whole image up
+// into the writeable overlay.
+
+// usernsFd returns an fd for a new user namespace with the mappings in
+// @set.  The namespace is created by a short-lived child, and lives on
+// as long as the fd is open.
+func usernsFd(set idmap.IdmapSet) (int, error) {
+	uids := []syscall.SysProcIDMap{}
+	gids := []syscall.SysProcIDMap{}
+	for _, e := range set.Idmap {
+		m := syscall.SysProcIDMap{ContainerID: int(e.Nsid), HostID: int(e.Hostid), Size: int(e.Maprange)}
+		if e.Isuid {
+			uids = append(uids, m)
+		}
+		if e.Isgid {
+			gids = append(gids, m)
+		}
+	}
+
+	cmd := exec.Command("sleep", "1000")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER,
+		UidMappings: uids,
+		GidMappings: gids,
+	}
+	if err := cmd.Start(); err != nil {
+		return -1, errors.Wrapf(err, "Failed creating user namespace")
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	fd, err := unix.Open(fmt.Sprintf("/proc/%d/ns/user", cmd.Process.Pid), unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, errors.Wrapf(err, "Failed opening user namespace")
+	}
+	return fd, nil
+}
+
+// idmappedTree returns an fd for a detached copy of the mount at @src,
+// with ids shifted per @set.
+func idmappedTree(src string, set idmap.IdmapSet) (int, error) {
+	nsfd, err := usernsFd(set)
+	if err != nil {
+		return -1, err
+	}
+	defer unix.Close(nsfd)
+
+	fd, err := unix.OpenTree(unix.AT_FDCWD, src, unix.OPEN_TREE_CLONE|unix.OPEN_TREE_CLOEXEC)
+	if err != nil {
+		return -1, errors.Wrapf(err, "open_tree of %q failed", src)
+	}
+
+	attr := unix.MountAttr{
+		Attr_set:  unix.MOUNT_ATTR_IDMAP,
+		Userns_fd: uint64(nsfd),
+	}
+	if err := unix.MountSetattr(fd, "", unix.AT_EMPTY_PATH, &attr); err != nil {
+		unix.Close(fd)
+		return -1, errors.Wrapf(err, "Failed idmapping %q", src)
+	}
+	return fd, nil
+}
+
+// idmapMount mounts @src onto @dest with ids shifted per @set.
+func idmapMount(src, dest string, set idmap.IdmapSet) error {
+	fd, err := idmappedTree(src, set)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	if err := unix.MoveMount(fd, "", unix.AT_FDCWD, dest, unix.MOVE_MOUNT_F_EMPTY_PATH); err != nil {
+		return errors.Wrapf(err, "Failed mounting idmapped %q onto %q", src, dest)
+	}
+	return nil
+}
+
+// canIdmap reports whether the filesystem at @path can be idmapped.
+// Support depends on the kernel and the filesystem type, so each type
+// is only probed once.
+func (mos *Mos) canIdmap(path string, set idmap.IdmapSet) bool {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(path, &fs); err != nil {
+		log.Debugf("Cannot idmap %q: %v", path, err)
+		return false
+	}
+	fsType := int64(fs.Type)
+
+	mos.idmapLock.Lock()
+	defer mos.idmapLock.Unlock()
+	if ok, probed := mos.idmapOK[fsType]; probed {
+		return ok
+	}
+	if mos.idmapOK == nil {
+		mos.idmapOK = map[int64]bool{}
+	}
+
+	ok := true
+	fd, err := idmappedTree(path, set)
+	if err != nil {
+		log.Debugf("Cannot idmap %q: %v", path, err)
+		ok = false
+	} else {
+		unix.Close(fd)
+	}
+	mos.idmapOK[fsType] = ok
+	return ok
+}
+
+func (mos *Mos) containerDir(name string) string {
+	return filepath.Join(mos.opts.ScratchWrites, "containers", name)
+}
+
+// mountContainerRootfs sets up the rootfs for container @t: a writeable
+// overlay over its readonly storage mount @rfs, shifted per @set.  It
+// returns the path to the rootfs.
+func (mos *Mos) mountContainerRootfs(t *Target, rfs string, set idmap.IdmapSet) (string, error) {
+	if err := mos.umountContainerRootfs(t.ServiceName); err != nil {
+		return "", err
+	}
+
+	useIdmap := len(set.Idmap) != 0
+	if useIdmap && mos.canIdmap(rfs, set) {
+		rootfs, err := mos.containerOverlay(t.ServiceName, rfs, set, true)
+		if err == nil {
+			log.Infof("Using idmapped rootfs for %s", t.ServiceName)
+			return rootfs, nil
+		}
+		log.Infof("Idmapped mounts unavailable for %s, shifting its rootfs instead: %v", t.ServiceName, err)
+		if err := mos.umountContainerRootfs(t.ServiceName); err != nil {
+			return "", err
+		}
+	}
+
+	rootfs, err := mos.containerOverlay(t.ServiceName, rfs, set, false)
+	if err != nil {
+		return "", err
+	}
+	if useIdmap {
+		if err := set.ShiftFile(rootfs); err != nil {
+			return "", errors.Wrapf(err, "Failed shifting %q", rootfs)
+		}
+	}
+	return rootfs, nil
+}
+
+func (mos *Mos) containerOverlay(name, rfs string, set idmap.IdmapSet, idmapped bool) (string, error) {
+	base := mos.containerDir(name)
+	lower := filepath.Join(base, "lower")
+	upper := filepath.Join(base, "upper")
+	work := filepath.Join(base, "work")
+	rootfs := filepath.Join(base, "rootfs")
+	for _, d := range []string{lower, upper, work, rootfs} {
+		if err := utils.EnsureDir(d); err != nil {
+			return "", errors.Wrapf(err, "Failed creating %q", d)
+		}
+	}
+
+	if idmapped {
+		if err := idmapMount(rfs, lower, set); err != nil {
+			return "", err
+		}
+	} else if err := unix.Mount(rfs, lower, "", unix.MS_BIND, ""); err != nil {
+		return "", errors.Wrapf(err, "Failed bind mounting %q", rfs)
+	}
+
+	overlayArgs := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s,userxattr", lower, upper, work)
+	if err := unix.Mount("overlayfs", rootfs, "overlay", 0, overlayArgs); err != nil {
+		return "", errors.Wrapf(err, "Failed mounting writeable overlay for %s", name)
+	}
+	return rootfs, nil
+}
+
+// umountContainerRootfs undoes mountContainerRootfs, discarding anything
+// the container wrote to its rootfs.
+func (mos *Mos) umountContainerRootfs(name string) error {
+	base := mos.containerDir(name)
+	for _, d := range []string{"rootfs", "lower"} {
+		mp := filepath.Join(base, d)
+		mounted, err := utils.IsMountpoint(mp)
+		if err != nil {
+			return errors.Wrapf(err, "Failed checking whether %q is mounted", mp)
+		}
+		if !mounted {
+			continue
+		}
+		if err := unix.Unmount(mp, unix.MNT_DETACH); err != nil {
+			return errors.Wrapf(err, "Failed unmounting %q", mp)
+		}
+	}
+	if err := os.RemoveAll(base); err != nil {
+		return errors.Wrapf(err, "Failed removing %q", base)
+	}
+	return nil
+}
+
+// storageMountOpts prepares storage volume @src to be bind mounted into a
+// container running with ids @set, and returns any extra lxc mount
+// options needed.  Volumes shifted by older versions of mos are left
+// alone.
+func (mos *Mos) storageMountOpts(src string, set idmap.IdmapSet) (string, error) {
+	if len(set.Idmap) == 0 {
+		return "", nil
+	}
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if ok && int64(st.Uid) == set.Idmap[0].Hostid {
+		return "", nil
+	}
+
+	if mos.canIdmap(src, set) {
+		return ",idmap=container", nil
+	}
+	if err := set.ShiftFile(src); err != nil {
+		return "", errors.Wrapf(err, "Failed shifting %q to %#v", src, set.Idmap)
+	}
+	return "", nil
+}
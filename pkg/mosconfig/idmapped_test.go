@@ -0,0 +1,148 @@
+package mosconfig
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/lxc/lxd/shared/idmap"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+var testIdmap = idmap.IdmapSet{
+	Idmap: []idmap.IdmapEntry{
+		{Isuid: true, Isgid: true, Nsid: 0, Hostid: 100000, Maprange: 65536},
+	},
+}
+
+// idmapTestDir returns a tmpfs to test in, which is unmounted when the
+// test ends, and the tmpfs filesystem type.
+func idmapTestDir(t *testing.T) (string, int64) {
+	if os.Geteuid() != 0 {
+		t.Skip("idmapped mount tests must be run as root")
+	}
+	dir := t.TempDir()
+	if err := unix.Mount("tmpfs", dir, "tmpfs", 0, ""); err != nil {
+		t.Skipf("Cannot mount tmpfs: %v", err)
+	}
+	t.Cleanup(func() { unix.Unmount(dir, unix.MNT_DETACH) })
+
+	var fs unix.Statfs_t
+	if err := unix.Statfs(dir, &fs); err != nil {
+		t.Fatal(err)
+	}
+	return dir, int64(fs.Type)
+}
+
+func ownerOf(t *testing.T, path string) uint32 {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Sys().(*syscall.Stat_t).Uid
+}
+
+// makeTree creates @dir holding etc/hostname, owned by root.
+func makeTree(t *testing.T, dir string) {
+	if err := os.MkdirAll(filepath.Join(dir, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "etc/hostname"), []byte("test\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStorageMountOptsIdmapped(t *testing.T) {
+	dir, _ := idmapTestDir(t)
+	vol := filepath.Join(dir, "vol")
+	makeTree(t, vol)
+
+	mos := &Mos{}
+	if !mos.canIdmap(dir, testIdmap) {
+		t.Skip("tmpfs cannot be idmapped on this kernel")
+	}
+	opts, err := mos.storageMountOpts(vol, testIdmap)
+	assert.Nil(t, err)
+	assert.Equal(t, ",idmap=container", opts)
+	// The volume is shifted by the mount, not on disk
+	assert.Equal(t, uint32(0), ownerOf(t, filepath.Join(vol, "etc/hostname")))
+}
+
+func TestStorageMountOptsShifted(t *testing.T) {
+	dir, fsType := idmapTestDir(t)
+	vol := filepath.Join(dir, "vol")
+	makeTree(t, vol)
+
+	mos := &Mos{idmapOK: map[int64]bool{fsType: false}}
+	opts, err := mos.storageMountOpts(vol, testIdmap)
+	assert.Nil(t, err)
+	assert.Equal(t, "", opts)
+	assert.Equal(t, uint32(100000), ownerOf(t, vol))
+	assert.Equal(t, uint32(100000), ownerOf(t, filepath.Join(vol, "etc/hostname")))
+
+	// A volume which was already shifted is left alone, without
+	// probing for idmap support.
+	mos = &Mos{}
+	opts, err = mos.storageMountOpts(vol, testIdmap)
+	assert.Nil(t, err)
+	assert.Equal(t, "", opts)
+	assert.Empty(t, mos.idmapOK)
+}
+
+func TestCanIdmapProbesOnce(t *testing.T) {
+	dir, fsType := idmapTestDir(t)
+	for _, d := range []string{"a", "b"} {
+		makeTree(t, filepath.Join(dir, d))
+	}
+
+	mos := &Mos{}
+	first := mos.canIdmap(filepath.Join(dir, "a"), testIdmap)
+	assert.Equal(t, map[int64]bool{fsType: first}, mos.idmapOK)
+
+	// The cached answer is used for the same filesystem type
+	mos.idmapOK[fsType] = !first
+	assert.Equal(t, !first, mos.canIdmap(filepath.Join(dir, "b"), testIdmap))
+}
+
+func testContainerRootfs(t *testing.T, mos *Mos, dir string) {
+	rfs := filepath.Join(dir, "rfs")
+	makeTree(t, rfs)
+	mos.opts.ScratchWrites = filepath.Join(dir, "scratch")
+
+	target := &Target{ServiceName: "c1"}
+	rootfs, err := mos.mountContainerRootfs(target, rfs, testIdmap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mos.umountContainerRootfs(target.ServiceName)
+
+	assert.Equal(t, uint32(100000), ownerOf(t, filepath.Join(rootfs, "etc/hostname")))
+	// The image itself is untouched
+	assert.Equal(t, uint32(0), ownerOf(t, filepath.Join(rfs, "etc/hostname")))
+
+	// The container's writes go to the overlay
+	assert.Nil(t, os.WriteFile(filepath.Join(rootfs, "etc/written"), []byte("x"), 0644))
+	_, err = os.Stat(filepath.Join(rfs, "etc/written"))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, mos.umountContainerRootfs(target.ServiceName))
+	_, err = os.Stat(mos.containerDir(target.ServiceName))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestContainerRootfsIdmapped(t *testing.T) {
+	dir, _ := idmapTestDir(t)
+	mos := &Mos{}
+	if !mos.canIdmap(dir, testIdmap) {
+		t.Skip("tmpfs cannot be idmapped on this kernel")
+	}
+	testContainerRootfs(t, mos, dir)
+}
+
+func TestContainerRootfsShifted(t *testing.T) {
+	dir, fsType := idmapTestDir(t)
+	mos := &Mos{idmapOK: map[int64]bool{fsType: false}}
+	testContainerRootfs(t, mos, dir)
+}
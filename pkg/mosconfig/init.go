@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/apex/log"
 	"github.com/project-machine/mos/pkg/utils"
@@ -35,7 +36,7 @@ Description=%s
 DefaultDependencies=no
 After=network-online.target cloud-init.target
 Wants=network.target
-
+%s
 [Service]
 Restart=on-failure
 RestartSec=1
@@ -66,7 +67,8 @@ func (mos *Mos) writeContainerService(t *Target) error {
 	dest := filepath.Join(mos.opts.RootDir, "/etc", "systemd", "system", unitName)
 	log.Infof("Writing container service at %q", dest)
 	os.Remove(dest)
-	content := []byte(fmt.Sprintf(execServiceTemplate, t.ServiceName, t.ServiceName, t.ServiceName))
+	deps := mos.unitDependencies(t)
+	content := []byte(fmt.Sprintf(execServiceTemplate, t.ServiceName, deps, t.ServiceName, t.ServiceName))
 	if err := os.WriteFile(dest, content, 0644); err != nil {
 		return fmt.Errorf("Failed writing systemd.service file for %q: %w", unitName, err)
 	}
@@ -74,6 +76,34 @@ func (mos *Mos) writeContainerService(t *Target) error {
 	return nil
 }
 
+// unitDependencies returns the After= and Requires= lines for the
+// systemd unit of @t.  Only container targets have units, so only they
+// are listed; fs-only targets are ordered by ActivateAll.
+func (mos *Mos) unitDependencies(t *Target) string {
+	units := func(names []string) []string {
+		ret := []string{}
+		for _, n := range names {
+			d, err := mos.Current(n)
+			if err != nil || d.ServiceType != ContainerService {
+				continue
+			}
+			ret = append(ret, fmt.Sprintf("%s.service", n))
+		}
+		return ret
+	}
+
+	lines := ""
+	after := units(append(append([]string{}, t.DependsOn...), t.After...))
+	if len(after) != 0 {
+		lines += fmt.Sprintf("After=%s\n", strings.Join(after, " "))
+	}
+	requires := units(t.DependsOn)
+	if len(requires) != 0 {
+		lines += fmt.Sprintf("Requires=%s\n", strings.Join(requires, " "))
+	}
+	return lines
+}
+
 func (mos *Mos) startInit(t *Target) error {
 	unitName := fmt.Sprintf("%s.service", t.ServiceName)
 	if err := systemdStart(unitName); err != nil {
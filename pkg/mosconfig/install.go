@@ -1,11 +1,10 @@
 package mosconfig
 
 import (
-	"bytes"
+	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
-	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -21,9 +20,8 @@ import (
 	"github.com/project-machine/mos/pkg/trust"
 	"github.com/project-machine/mos/pkg/utils"
 	"github.com/urfave/cli"
+	"golang.org/x/term"
 	"gopkg.in/yaml.v2"
-
-	"stackerbuild.io/stacker/pkg/lib"
 )
 
 // InstallSource represents an install file, its signature, and
@@ -34,7 +32,19 @@ type InstallSource struct {
 	FilePath string
 	CertPath string
 	SignPath string
+	SignAlg  string   // signature algorithm, "" if not known
+	CRLPaths []string // revocation lists from our CA published with it
 	ocirepo  *DistRepo
+	layout   string // local oci layout holding the targets
+
+	// Security versions below MinSecurityVersion are refused, unless
+	// authorized by the downgrade token at DowngradeToken.
+	MinSecurityVersion uint64
+	DowngradeToken     string
+
+	// If set, the manifest must be for the product of the SUDI
+	// certificate at SudiCertPath.
+	SudiCertPath string
 
 	NeedsCleanup bool
 }
@@ -47,17 +57,22 @@ func (is *InstallSource) Cleanup() {
 	}
 }
 
-func (is *InstallSource) FetchFromZot(inUrl string) error {
+// FetchFromZot fetches the install manifest at @inUrl from a registry,
+// reached as @reg says, along with a certificate and signature for it,
+// and any CRLs.  If vopts.CaPath is set, they are ones which verify
+// under it.
+func (is *InstallSource) FetchFromZot(reg *Registry, inUrl string, vopts trust.VerifyOpts) error {
 	dir, err := os.MkdirTemp("", "install")
 	if err != nil {
 		return err
 	}
 	is.Basedir = dir
+	is.NeedsCleanup = true
 	is.FilePath = filepath.Join(is.Basedir, "install.json") // TODO - switch to json
 	is.CertPath = filepath.Join(is.Basedir, "manifestCert.pem")
 	is.SignPath = filepath.Join(is.Basedir, "install.json.signed")
 
-	r, err := NewDistRepo(inUrl)
+	r, err := NewDistRepo(reg, inUrl)
 	if err != nil {
 		return errors.Wrapf(err, "Error opening OCI repo connection")
 	}
@@ -73,17 +88,24 @@ func (is *InstallSource) FetchFromZot(inUrl string) error {
 		return errors.Wrapf(err, "Error fetching the install manifest")
 	}
 
-	err = r.FetchCert(url, is.CertPath)
+	fetch := func(d ispec.Descriptor, dest string) (map[string]string, error) {
+		return r.fetchReferrer(url, d, dest)
+	}
+	crls, err := r.GetReferrers(url, crlArtifact)
 	if err != nil {
-		return errors.Wrapf(err, "Error fetching the certificate")
+		log.Warnf("Failed listing revocation lists: %v", err)
+	} else {
+		is.fetchCRLs(crls.Manifests, vopts.CaPath, fetch)
 	}
 
-	err = r.FetchSignature(url, is.SignPath)
+	certs, sigs, err := r.signatureReferrers(url)
 	if err != nil {
-		return errors.Wrapf(err, "Error fetching the signature")
+		return err
+	}
+	err = is.pickSignature(certs, sigs, vopts, fetch)
+	if err != nil {
+		return err
 	}
-
-	is.NeedsCleanup = true
 
 	return nil
 }
@@ -91,32 +113,55 @@ func (is *InstallSource) FetchFromZot(inUrl string) error {
 // SaveToZot: Save an installsource to local zot.
 // Local zot is running on zotport.  The name to be used for the
 // manifest is 'name', e.g. machine/livecd:1.0.0
-func (is *InstallSource) SaveToZot(zotport int, name string) error {
+func (is *InstallSource) SaveToZot(reg *Registry, zotport int, name string) error {
 	repo := fmt.Sprintf("127.0.0.1:%d", zotport)
 
 	// Post install.json as manifest
 	dest := repo + "/" + name
-	mDigest, mSize, err := PostManifest(is.FilePath, dest, installArtifact)
+	mDigest, mSize, err := PostManifest(reg, is.FilePath, dest, installArtifact)
 	if err != nil {
 		return errors.Wrapf(err, "Failed writing install.json to %s", dest)
 	}
 
-	if err = PostArtifact(mDigest, mSize, is.CertPath, pubkeyArtifact, dest); err != nil {
+	if err = PostArtifact(reg, mDigest, mSize, is.CertPath, pubkeyArtifact, dest, nil); err != nil {
 		return errors.Wrapf(err, "Failed writing certificate to %s", dest)
 	}
-	if err = PostArtifact(mDigest, mSize, is.SignPath, sigArtifact, dest); err != nil {
+	var annotations map[string]string
+	if is.SignAlg != "" {
+		annotations = map[string]string{sigAlgAnnotation: is.SignAlg}
+	}
+	if err = PostArtifact(reg, mDigest, mSize, is.SignPath, sigArtifact, dest, annotations); err != nil {
 		return errors.Wrapf(err, "Failed writing signature to %s", dest)
 	}
+	for _, crl := range is.CRLPaths {
+		if err = PostArtifact(reg, mDigest, mSize, crl, crlArtifact, dest, nil); err != nil {
+			return errors.Wrapf(err, "Failed writing revocation list to %s", dest)
+		}
+	}
 
 	return nil
 }
 
 type InstallOpts struct {
-	RFS         string
-	CaPath      string
-	ConfigDir   string
-	StoreDir    string
-	SkipBootkit bool
+	RFS          string
+	CaPath       string
+	SudiCertPath string
+	ConfigDir    string
+	StoreDir     string
+	SkipBootkit  bool
+	StorageType  StorageType
+
+	// How to reach registries.  Any Mirrors are saved in
+	// $config/registries.yaml for later updates.
+	Registry RegistryOptions
+
+	// A token authorizing a manifest older than the host has accepted
+	// before, if it is being reinstalled.
+	DowngradeToken string
+
+	// The time as of which manifest certificates are checked.  The
+	// zero time means now.
+	VerifyTime time.Time
 }
 
 func InitializeMos(ctx *cli.Context, opts InstallOpts) error {
@@ -125,34 +170,66 @@ func InitializeMos(ctx *cli.Context, opts InstallOpts) error {
 		return errors.Errorf("An install source is required.\nUsage: mos install [--config-dir /config] [--atomfs-store /atomfs-store] docker://10.0.2.2:5000/mos/install.json:1.0")
 	}
 
+	reg, err := configuredRegistry(opts.ConfigDir, opts.Registry)
+	if err != nil {
+		return err
+	}
+
 	var is InstallSource
 	defer is.Cleanup()
 
-	err := is.FetchFromZot(args[0])
+	vopts := trust.VerifyOpts{CaPath: opts.CaPath, Time: opts.VerifyTime}
+	err = is.Fetch(reg, args[0], vopts)
 	if err != nil {
 		return err
 	}
 
-	mos, err := NewMos(opts.ConfigDir, opts.StoreDir)
+	if opts.StorageType == "" {
+		opts.StorageType = AtomfsStorageType
+	}
+	mos, err := NewMos(opts.ConfigDir, opts.StoreDir, opts.StorageType)
 	if err != nil {
 		return errors.Errorf("Error opening manifest: %w", err)
 	}
 	defer mos.Close()
+	mos.registry = reg
+	mos.opts.VerifyTime = opts.VerifyTime
 
-	// Well, bit of a chicken and egg problem here.  We parse the configfile
-	// first so we can copy all the needed zot images.
-	cf, err := simpleParseInstall(is.FilePath)
+	if err := saveCRLs(opts.ConfigDir, is); err != nil {
+		return err
+	}
+
+	if len(opts.Registry.Mirrors) != 0 {
+		if err := writeRegistryConfig(opts.ConfigDir, RegistryConfig{Mirrors: opts.Registry.Mirrors}); err != nil {
+			return err
+		}
+	}
+
+	// A reinstall must not go back to a lower security version than
+	// the TPM has recorded.
+	is.MinSecurityVersion, err = readSecurityVersion(opts.ConfigDir)
+	if err != nil {
+		return err
+	}
+	is.DowngradeToken = opts.DowngradeToken
+	is.SudiCertPath = opts.SudiCertPath
+
+	// Well, bit of a chicken and egg problem here.  We verify the
+	// configfile first so we can copy all the needed zot images.
+	cf, err := VerifyInstallManifest(is, vopts)
+	if err != nil {
+		return errors.Wrapf(err, "Failed verifying install configuration")
+	}
+
+	_, err = forEachTarget(cf.Targets, func(t *Target) error {
+		return mos.storage.ImportTarget(reg, is.targetSource(t), t)
+	})
 	if err != nil {
-		return errors.Wrapf(err, "Failed parsing install configuration")
+		return errors.Wrapf(err, "Failed reading targets while initializing mos")
 	}
 
 	var boot Target
 	for _, target := range cf.Targets {
-		src := fmt.Sprintf("docker://%s/mos:%s", is.ocirepo.addr, dropHashAlg(target.Digest))
-		err = mos.storage.ImportTarget(src, &target)
-		if err != nil {
-			return errors.Wrapf(err, "Failed reading targets while initializing mos")
-		}
 		if target.ServiceName == "bootkit" {
 			boot = target
 			log.Infof("Found a bootkit layer.  Will update EFI with %#v", boot)
@@ -174,12 +251,16 @@ func InitializeMos(ctx *cli.Context, opts InstallOpts) error {
 
 	// Set up our manifest store
 	// The manifest will be re-read as it is verified.
-	err = mos.initManifest(is.FilePath, is.CertPath, opts.CaPath, opts.ConfigDir)
+	err = mos.initManifest(is.FilePath, is.CertPath, is.verifyOpts(vopts), opts.ConfigDir)
 	if err != nil {
 		return errors.Errorf("Error initializing system manifest: %w", err)
 	}
 
-	return nil
+	if err := recordSecurityVersion(opts.ConfigDir, cf.SecurityVersion); err != nil {
+		return err
+	}
+
+	return saveStorageType(opts.ConfigDir, opts.StorageType)
 }
 
 const StartupNSH = `
@@ -270,6 +351,27 @@ func efiBootMgrSetup() error {
 
 }
 
+// readPassword prints @prompt and reads a password from stdin, without
+// echoing it if stdin is a terminal.
+func readPassword(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		pass, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", errors.Wrapf(err, "Failed reading password")
+		}
+		return string(pass), nil
+	}
+
+	pass, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && pass == "" {
+		return "", errors.Wrapf(err, "Failed reading password")
+	}
+	return strings.TrimRight(pass, "\r\n"), nil
+}
+
 // PublishManifest is used by mosctl to convert and publish a
 // import manifest in yaml format to a install manifest in json
 // format, sign it, and post all referenced layers as well as the
@@ -292,7 +394,24 @@ func PublishManifestFromArgs(ctx *cli.Context) error {
 		return fmt.Errorf("file is a required positional argument")
 	}
 	infile := args[0]
-	return PublishManifest(proj, repo, destpath, infile, ctx.Bool("skip-bootkit"))
+
+	opts := RegistryOptionsFromContext(ctx)
+	opts.Username = ctx.String("user")
+	opts.Password = ctx.String("pass")
+	opts.Token = ctx.String("token")
+	if opts.Username != "" && opts.Password == "" {
+		pass, err := readPassword(fmt.Sprintf("Password for %s: ", opts.Username))
+		if err != nil {
+			return err
+		}
+		opts.Password = pass
+	}
+	reg, err := NewRegistry(opts)
+	if err != nil {
+		return err
+	}
+
+	return PublishManifestWithKey(reg, proj, repo, destpath, infile, ctx.Bool("skip-bootkit"), ctx.String("key"), ctx.String("cert"))
 }
 
 const (
@@ -300,7 +419,15 @@ const (
 	UseBootkit  = false
 )
 
-func PublishManifest(project, repo, destpath, manifestpath string, skipBootkit bool) error {
+func PublishManifest(reg *Registry, project, repo, destpath, manifestpath string, skipBootkit bool) error {
+	return PublishManifestWithKey(reg, project, repo, destpath, manifestpath, skipBootkit, "", "")
+}
+
+// PublishManifestWithKey is PublishManifest signing with the key named
+// by @keyRef, a key file or PKCS#11 URI, whose certificate is at
+// @certPath.  If they are "", the project's key and certificate are
+// used.  Registries are reached as @reg says.
+func PublishManifestWithKey(reg *Registry, project, repo, destpath, manifestpath string, skipBootkit bool, keyRef, certPath string) error {
 	b, err := os.ReadFile(manifestpath)
 	if err != nil {
 		return errors.Wrapf(err, "Error reading %s", manifestpath)
@@ -324,9 +451,12 @@ func PublishManifest(project, repo, destpath, manifestpath string, skipBootkit b
 	}
 
 	install := InstallFile{
-		Version:    imports.Version,
-		Product:    imports.Product,
-		UpdateType: imports.UpdateType,
+		Version:         imports.Version,
+		Product:         imports.Product,
+		UpdateType:      imports.UpdateType,
+		SecurityVersion: imports.SecurityVersion,
+		RemoveTargets:   imports.RemoveTargets,
+		RemoveStorage:   imports.RemoveStorage,
 	}
 
 	for _, s := range imports.Storage {
@@ -340,7 +470,7 @@ func PublishManifest(project, repo, destpath, manifestpath string, skipBootkit b
 	// verify digest and size, and append them to the install
 	// manifest's list.
 	for _, t := range imports.Targets {
-		digest, size, err := getSizeDigest(t.Source)
+		digest, size, err := getSizeDigest(reg, t.Source)
 		if err != nil {
 			return errors.Wrapf(err, "Failed checking %s", t.Source)
 		}
@@ -351,15 +481,8 @@ func PublishManifest(project, repo, destpath, manifestpath string, skipBootkit b
 			return errors.Errorf("Size (%d) specified for %s does not match remote image's (%s)", t.Size, t.Source, size)
 		}
 
-		dest := "docker://" + repo + "/mos:" + dropHashAlg(digest)
-		copyOpts := lib.ImageCopyOpts{
-			Src:         t.Source,
-			Dest:        dest,
-			Progress:    os.Stdout,
-			SrcSkipTLS:  true,
-			DestSkipTLS: true,
-		}
-		if err := lib.ImageCopy(copyOpts); err != nil {
+		dest := repo + "/mos:" + dropHashAlg(digest)
+		if err := copyImage(reg, t.Source, digest, dest); err != nil {
 			return errors.Wrapf(err, "Failed copying %s to %s", t.Source, dest)
 		}
 		install.Targets = append(install.Targets, Target{
@@ -370,11 +493,20 @@ func PublishManifest(project, repo, destpath, manifestpath string, skipBootkit b
 			NSGroup:     t.NSGroup,
 			Storage:     t.Storage,
 			Digest:      digest,
-			Size:        size},
+			Size:        size,
+			DependsOn:   t.DependsOn,
+			After:       t.After},
 		)
 		log.Infof("appending storage item %#v", t.Storage)
 	}
 
+	if err := install.Targets.validateDependencies(); err != nil {
+		return err
+	}
+	if err := install.validateRemovals(); err != nil {
+		return err
+	}
+
 	workdir, err := os.MkdirTemp("", "manifest")
 	if err != nil {
 		return errors.Wrapf(err, "Failed creating tempdir")
@@ -392,31 +524,51 @@ func PublishManifest(project, repo, destpath, manifestpath string, skipBootkit b
 
 	signPath := filepath.Join(workdir, "install.json.signed")
 
-	key, err := projectKey(project)
-	if err != nil {
-		return errors.Wrapf(err, "Failed getting manifest signing key for %q", project)
+	key := keyRef
+	if key == "" {
+		key, err = projectKey(project)
+		if err != nil {
+			return errors.Wrapf(err, "Failed getting manifest signing key for %q", project)
+		}
 	}
-	if err = trust.Sign(filePath, signPath, key); err != nil {
+	alg, err := trust.Sign(filePath, signPath, key)
+	if err != nil {
 		return errors.Wrapf(err, "Failed signing file")
 	}
 
 	dest := repo + "/" + destpath
-	mDigest, mSize, err := PostManifest(filePath, dest, installArtifact)
+	mDigest, mSize, err := PostManifest(reg, filePath, dest, installArtifact)
 	if err != nil {
 		return errors.Wrapf(err, "Failed writing install.json to %s", dest)
 	}
 
-	cert, err := projectCert(project)
-	if err != nil {
-		return errors.Wrapf(err, "Failed getting manifest signing cert")
+	cert := certPath
+	if cert == "" {
+		cert, err = projectCert(project)
+		if err != nil {
+			return errors.Wrapf(err, "Failed getting manifest signing cert")
+		}
 	}
-	if err = PostArtifact(mDigest, mSize, cert, pubkeyArtifact, dest); err != nil {
+	if err = PostArtifact(reg, mDigest, mSize, cert, pubkeyArtifact, dest, nil); err != nil {
 		return errors.Wrapf(err, "Failed writing certificate to %s", dest)
 	}
-	if err = PostArtifact(mDigest, mSize, signPath, sigArtifact, dest); err != nil {
+	annotations := map[string]string{sigAlgAnnotation: alg}
+	if err = PostArtifact(reg, mDigest, mSize, signPath, sigArtifact, dest, annotations); err != nil {
 		return errors.Wrapf(err, "Failed writing signature to %s", dest)
 	}
 
+	// Ship the keyset's revocation list, if any, so that machines
+	// which install this learn of revoked manifest keys.
+	crl, err := keysetCRL(project)
+	if err != nil {
+		return err
+	}
+	if utils.PathExists(crl) {
+		if err = PostArtifact(reg, mDigest, mSize, crl, crlArtifact, dest, nil); err != nil {
+			return errors.Wrapf(err, "Failed writing revocation list to %s", dest)
+		}
+	}
+
 	return nil
 }
 
@@ -450,8 +602,8 @@ func getSizeDigestOCI(inUrl string) (string, int64, error) {
 // PostManifest: Post an install.json.  Return the digest and size
 // of the *manifest* describing the install.json blob, as that will
 // be needed for the referring artifacts.
-func PostManifest(path, dest, mediatype string) (digest.Digest, int64, error) {
-	r, err := NewDistRepo(dest)
+func PostManifest(reg *Registry, path, dest, mediatype string) (digest.Digest, int64, error) {
+	r, err := NewDistRepo(reg, dest)
 	if err != nil {
 		return "", 0, errors.Wrapf(err, "Failed parsing destination address")
 	}
@@ -496,23 +648,8 @@ func PostManifest(path, dest, mediatype string) (digest.Digest, int64, error) {
 	}
 	mSize := int64(len(b))
 	mDigest := digest.FromBytes(b)
-	u := "http://" + murl.repo.addr + "/v2/" + murl.name + "/manifests/" + murl.tag
-	req, err := http.NewRequest(http.MethodPut, u, bytes.NewBuffer(b))
-	if err != nil {
-		return "", 0, errors.Wrapf(err, "Failed opening PUT request")
-	}
-	req.Header.Set("Content-Type", ispec.MediaTypeImageManifest)
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", 0, errors.Wrapf(err, "Failed sending PUT request")
-	}
-	defer resp.Body.Close()
-
-	resp.Body.Close()
-	if resp.StatusCode != 201 {
-		fmt.Printf("response code was %d, %q\n", resp.StatusCode, resp.Status)
-		return "", 0, errors.Wrapf(err, "Repo retunrred error for manifest wrapper.  Response was: %q", resp.Status)
+	if err := murl.putManifest(murl.tag, b, ispec.MediaTypeImageManifest); err != nil {
+		return "", 0, err
 	}
 	return mDigest, mSize, nil
 }
@@ -521,8 +658,8 @@ func PostManifest(path, dest, mediatype string) (digest.Digest, int64, error) {
 // refDigest.  Since we've already run PostManifest, we know that
 // the empty config (with digest emptyDigest) has certainly already been
 // posted.
-func PostArtifact(refDigest digest.Digest, refSize int64, path, mediatype, dest string) error {
-	r, err := NewDistRepo(dest)
+func PostArtifact(reg *Registry, refDigest digest.Digest, refSize int64, path, mediatype, dest string, annotations map[string]string) error {
+	r, err := NewDistRepo(reg, dest)
 	if err != nil {
 		return errors.Wrapf(err, "Failed parsing destination address")
 	}
@@ -551,6 +688,10 @@ func PostArtifact(refDigest digest.Digest, refSize int64, path, mediatype, dest
 		Size:      refSize,
 	}
 	t := time.Now().Format(time.RFC3339)
+	manifestAnnotations := map[string]string{ispec.AnnotationCreated: t}
+	for k, v := range annotations {
+		manifestAnnotations[k] = v
+	}
 	manifest := ispec.Manifest{
 		Versioned:    specs.Versioned{SchemaVersion: 2},
 		MediaType:    ispec.MediaTypeImageManifest,
@@ -558,33 +699,21 @@ func PostArtifact(refDigest digest.Digest, refSize int64, path, mediatype, dest
 		Config:       ispec.DescriptorEmptyJSON,
 		Layers:       layers,
 		Subject:      &subject,
-		Annotations:  map[string]string{ispec.AnnotationCreated: t},
+		Annotations:  manifestAnnotations,
 	}
 
 	b, err := json.Marshal(&manifest)
 	if err != nil {
 		return errors.Wrapf(err, "Failed marshalling manifest")
 	}
-	bDigest := digest.FromBytes(b)
-	u := "http://" + murl.repo.addr + "/v2/" + murl.name + "/manifests/" + bDigest.String()
-	req, err := http.NewRequest(http.MethodPut, u, bytes.NewBuffer(b))
-	if err != nil {
-		return errors.Wrapf(err, "Failed opening PUT request")
-	}
-	req.Header.Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return errors.Wrapf(err, "Failed sending PUT request")
-	}
-	defer resp.Body.Close()
-
-	resp.Body.Close()
-	if resp.StatusCode != 201 {
-		fmt.Printf("response code was %d, %q\n", resp.StatusCode, resp.Status)
-		return errors.Wrapf(err, "Repo retunrred error for manifest wrapper.  Response was: %q", resp.Status)
+	desc := ispec.Descriptor{
+		MediaType:    ispec.MediaTypeImageManifest,
+		ArtifactType: mediatype,
+		Digest:       digest.FromBytes(b),
+		Size:         int64(len(b)),
+		Annotations:  manifest.Annotations,
 	}
-	return nil
+	return murl.putReferrer(refDigest, desc, b)
 }
 
 func bootkitDir(name string) (string, error) {
@@ -622,7 +751,7 @@ func projectKey(name string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return filepath.Join(projDir, "privkey.pem"), nil
+	return trust.KeyRef(projDir)
 }
 
 func projectCert(name string) (string, error) {
@@ -632,3 +761,13 @@ func projectCert(name string) (string, error) {
 	}
 	return filepath.Join(projDir, "cert.pem"), nil
 }
+
+// keysetCRL returns the path of the revocation list of the manifest CA
+// of project @name's keyset, kept by 'trust project revoke'.
+func keysetCRL(name string) (string, error) {
+	projDir, err := projectDir(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(projDir, "..", "..", "manifest-ca", "crl.pem"), nil
+}
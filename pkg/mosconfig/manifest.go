@@ -12,15 +12,17 @@ import (
 	stackeroci "stackerbuild.io/stacker/pkg/oci"
 
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/opencontainers/umoci"
 	"github.com/pkg/errors"
+	"github.com/project-machine/mos/pkg/trust"
 	"github.com/project-machine/mos/pkg/utils"
 )
 
 // Only used during first install.  Create a new $config/manifest.git/
-func (mos *Mos) initManifest(manifestPath, manifestCert, manifestCA, configPath string) error {
+func (mos *Mos) initManifest(manifestPath, manifestCert string, vopts trust.VerifyOpts, configPath string) error {
 	shaSum, err := utils.ShaSum(manifestPath)
 	if err != nil {
 		return fmt.Errorf("Failed calculating shasum: %w", err)
@@ -46,7 +48,7 @@ func (mos *Mos) initManifest(manifestPath, manifestCert, manifestCA, configPath
 		CertPath: manifestCert,
 		SignPath: manifestPath + ".signed",
 	}
-	cf, err := ReadVerifyInstallManifest(is, manifestCA, mos.storage)
+	cf, err := ReadVerifyInstallManifest(is, vopts, mos.storage)
 	if err != nil {
 		return fmt.Errorf("Failed verifying signature on %s: %w", manifestPath, err)
 	}
@@ -128,7 +130,11 @@ func (mos *Mos) initManifest(manifestPath, manifestCert, manifestCA, configPath
 		Author:    defaultSignature(),
 		Committer: defaultSignature(),
 	}
-	_, err = w.Commit("Initial commit", commitOpts)
+	msg := fmt.Sprintf("Install product %s from install manifest %s\n\nTargets:\n", cf.Product, shaSum)
+	for _, t := range cf.Targets {
+		msg += fmt.Sprintf("  %s: %s (%s)\n", t.ServiceName, t.Version, t.Digest)
+	}
+	_, err = w.Commit(msg, commitOpts)
 	if err != nil {
 		return fmt.Errorf("Failed committing to git")
 	}
@@ -215,6 +221,12 @@ func (mos *Mos) CurrentManifest() (*SysManifest, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Failed parsing manifest: %w", err)
 	}
+	if sysmanifest.UsedPorts == nil {
+		sysmanifest.UsedPorts = make(map[uint]string)
+	}
+	if sysmanifest.IpAddrs == nil {
+		sysmanifest.IpAddrs = make(map[string]string)
+	}
 
 	manifests := make(map[string]InstallFile)
 	ret := SysTargets{}
@@ -273,9 +285,10 @@ func (mos *Mos) readInstallManifest(gitdir string, l map[string]InstallFile, yNa
 		FilePath:     filepath.Join(gitdir, yName),
 		CertPath:     filepath.Join(gitdir, pemName),
 		SignPath:     filepath.Join(gitdir, fmt.Sprintf("%s.signed", yName)),
+		SudiCertPath: mos.opts.SudiCertPath,
 		NeedsCleanup: false,
 	}
-	manifest, err := ReadVerifyInstallManifest(is, mos.opts.CaPath, mos.storage)
+	manifest, err := ReadVerifyInstallManifest(is, mos.verifyOpts(), mos.storage)
 	if err != nil {
 		return InstallFile{}, errors.Wrapf(err, "Failed verifying signature for target %q", yName)
 	}
@@ -284,26 +297,75 @@ func (mos *Mos) readInstallManifest(gitdir string, l map[string]InstallFile, yNa
 	return manifest, nil
 }
 
-func (mos *Mos) UpdateManifest(manifest *SysManifest, newmanifest *SysManifest, newdir string) error {
-	// Check out a new branch, copy over each required install.json
-	// from the old manifest, and the files from the new install.
+// UpdateManifest commits @newmanifest, whose install manifests are in
+// @newdir, in place of @manifest.  The commit message records @product,
+// the shasum of the new install manifest, and the changed targets.
+func (mos *Mos) UpdateManifest(manifest *SysManifest, newmanifest *SysManifest, newdir, product, shaSum string) error {
+	msg := manifestCommitMessage(product, shaSum, manifest, newmanifest)
+	return mos.updateManifest(manifest, newmanifest, newdir, msg)
+}
+
+func (mos *Mos) updateManifest(manifest *SysManifest, newmanifest *SysManifest, newdir, msg string) error {
+	// The new manifest is committed in a scratch clone of manifest.git,
+	// so that a failure part way through leaves the live repo alone.
+	// Only once the commit is complete do we fetch it into manifest.git
+	// and switch master over to it.
+	repo, err := mos.openManifestRepo()
+	if err != nil {
+		return err
+	}
 
-	// TODO - upon failure we should restore the old git branch
+	stagedir, err := os.MkdirTemp("", "manifest-stage")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stagedir)
 
+	hash, err := mos.stageManifest(stagedir, manifest, newmanifest, newdir, msg)
+	if err != nil {
+		return err
+	}
+
+	remote := git.NewRemote(repo.Storer, &config.RemoteConfig{
+		Name: "stage",
+		URLs: []string{stagedir},
+	})
+	refspec := config.RefSpec("+" + plumbing.Master + ":" + stagedManifestRef)
+	err = remote.Fetch(&git.FetchOptions{RefSpecs: []config.RefSpec{refspec}})
+	if err != nil {
+		return fmt.Errorf("Failed fetching staged manifest: %w", err)
+	}
+	defer repo.Storer.RemoveReference(stagedManifestRef)
+
+	return mos.switchManifest(hash)
+}
+
+// The branch in manifest.git to which a new manifest is fetched before
+// master is switched over to it.
+const stagedManifestRef = plumbing.ReferenceName("refs/heads/staged")
+
+// stageManifest clones manifest.git into @stagedir and commits
+// @newmanifest there.  Any install manifests which are still needed
+// from @manifest are copied into @newdir.
+func (mos *Mos) stageManifest(stagedir string, manifest, newmanifest *SysManifest, newdir, msg string) (plumbing.Hash, error) {
 	mPath := filepath.Join(mos.opts.ConfigDir, "manifest.git")
-	repo, err := git.PlainOpen(mPath)
+	repo, err := git.PlainClone(stagedir, false, &git.CloneOptions{
+		URL:           mPath,
+		ReferenceName: plumbing.Master,
+		SingleBranch:  true,
+	})
 	if err != nil {
-		return fmt.Errorf("Failed opening manifest git repo at %q: %w", mPath, err)
+		return plumbing.ZeroHash, fmt.Errorf("Failed cloning manifest repo: %w", err)
 	}
 
-	files, err := os.ReadDir(mPath)
+	files, err := os.ReadDir(stagedir)
 	if err != nil {
-		return fmt.Errorf("Failed reading manifest directory: %w", err)
+		return plumbing.ZeroHash, fmt.Errorf("Failed reading manifest directory: %w", err)
 	}
 
 	w, err := repo.Worktree()
 	if err != nil {
-		return fmt.Errorf("Failed opening manifest repo: %w", err)
+		return plumbing.ZeroHash, fmt.Errorf("Failed opening manifest repo: %w", err)
 	}
 
 	// Copy any needed source jsons into our tempdir
@@ -315,57 +377,189 @@ func (mos *Mos) UpdateManifest(manifest *SysManifest, newmanifest *SysManifest,
 		base := strings.TrimSuffix(f, ".json")
 		for _, ext := range []string{".json", ".json.signed", ".pem"} {
 			fName := base + ext
-			src := filepath.Join(mPath, fName)
+			src := filepath.Join(stagedir, fName)
 			dest := filepath.Join(newdir, fName)
 			if err := utils.CopyFileBits(src, dest); err != nil {
-				return fmt.Errorf("Failed copying %q out of system manifest repo: %w", src, err)
+				return plumbing.ZeroHash, fmt.Errorf("Failed copying %q out of system manifest repo: %w", src, err)
 			}
 		}
 	}
 
 	// Remove all files from git index
 	for _, f := range files {
+		if f.Name() == ".git" {
+			continue
+		}
 		if _, err := w.Remove(f.Name()); err != nil {
-			return fmt.Errorf("Failed removing %q from previous manifest: %w", f.Name(), err)
+			return plumbing.ZeroHash, fmt.Errorf("Failed removing %q from previous manifest: %w", f.Name(), err)
 		}
 	}
 
 	// And copy back the files we need
 	for _, t := range newmanifest.SysTargets {
 		f := t.Source
-		if utils.PathExists(filepath.Join(mPath, f)) {
+		if utils.PathExists(filepath.Join(stagedir, f)) {
 			continue
 		}
 		base := strings.TrimSuffix(f, ".json")
 		for _, ext := range []string{".json", ".json.signed", ".pem"} {
 			fName := base + ext
 			src := filepath.Join(newdir, fName)
-			dest := filepath.Join(mPath, fName)
+			dest := filepath.Join(stagedir, fName)
 			if err := utils.CopyFileBits(src, dest); err != nil {
-				return fmt.Errorf("Failed copying %q to system manifest repo: %w", src, err)
+				return plumbing.ZeroHash, fmt.Errorf("Failed copying %q to system manifest repo: %w", src, err)
 			}
 			if _, err = w.Add(fName); err != nil {
-				return fmt.Errorf("Error adding %q to manifest git index: %w", src, err)
+				return plumbing.ZeroHash, fmt.Errorf("Error adding %q to manifest git index: %w", src, err)
 			}
 		}
 	}
 	src := filepath.Join(newdir, "manifest.json")
-	dest := filepath.Join(mPath, "manifest.json")
+	dest := filepath.Join(stagedir, "manifest.json")
 	if err := utils.CopyFileBits(src, dest); err != nil {
-		return fmt.Errorf("Failed copying manifest to final directory")
+		return plumbing.ZeroHash, fmt.Errorf("Failed copying manifest to final directory")
 	}
 	if _, err = w.Add("manifest.json"); err != nil {
-		return fmt.Errorf("Error adding manifest.json to manifest git index: %w", err)
+		return plumbing.ZeroHash, fmt.Errorf("Error adding manifest.json to manifest git index: %w", err)
 	}
 
 	commitOpts := &git.CommitOptions{
 		Author:    defaultSignature(),
 		Committer: defaultSignature(),
 	}
-	msg := "System upgrade to (TODO - fill in version)" // TODO
-	if _, err := w.Commit(msg, commitOpts); err != nil {
-		return fmt.Errorf("Failed committing to git")
+	hash, err := w.Commit(msg, commitOpts)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("Failed committing to git")
+	}
+
+	return hash, nil
+}
+
+// switchManifest points master in manifest.git at @hash, and checks it
+// out.  This is also used to restore the previous manifest after a
+// failed update.  Note that mos.Manifest is left alone, as the caller
+// may still need the old one to stop services.
+func (mos *Mos) switchManifest(hash plumbing.Hash) error {
+	repo, err := mos.openManifestRepo()
+	if err != nil {
+		return err
+	}
+
+	w, err := repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("Failed opening manifest repo: %w", err)
+	}
+
+	// Reset moves master first, and then updates the index and the
+	// checked out files.
+	err = w.Reset(&git.ResetOptions{Commit: hash, Mode: git.HardReset})
+	if err != nil {
+		return fmt.Errorf("Failed switching manifest to %s: %w", hash, err)
 	}
 
 	return nil
 }
+
+// manifestHead returns the current revision of manifest.git
+func (mos *Mos) manifestHead() (plumbing.Hash, error) {
+	repo, err := mos.openManifestRepo()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("Failed finding manifest HEAD: %w", err)
+	}
+	return head.Hash(), nil
+}
+
+func (mos *Mos) openManifestRepo() (*git.Repository, error) {
+	mPath := filepath.Join(mos.opts.ConfigDir, "manifest.git")
+	repo, err := git.PlainOpen(mPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed opening manifest git repo at %q: %w", mPath, err)
+	}
+	return repo, nil
+}
+
+// resolveManifestCommit finds the manifest.git commit named by @rev.  If
+// @rev is "", then walk back @steps first-parent commits from HEAD.
+func resolveManifestCommit(repo *git.Repository, rev string, steps int) (*object.Commit, error) {
+	if rev != "" {
+		h, err := repo.ResolveRevision(plumbing.Revision(rev))
+		if err != nil {
+			return nil, fmt.Errorf("Failed resolving manifest revision %q: %w", rev, err)
+		}
+		return repo.CommitObject(*h)
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return nil, fmt.Errorf("Failed finding manifest HEAD: %w", err)
+	}
+	c, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading manifest HEAD: %w", err)
+	}
+	for i := 0; i < steps; i++ {
+		if c.NumParents() == 0 {
+			return nil, fmt.Errorf("Manifest history only has %d previous revisions", i)
+		}
+		c, err = c.Parent(0)
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading parent of manifest revision: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// extractManifestCommit writes the system manifest from commit @c, along
+// with every install manifest, signature and certificate it refers to,
+// into @dir.  It returns the parsed system manifest.  The install manifests
+// are not verified here.
+func extractManifestCommit(c *object.Commit, dir string) (*SysManifest, error) {
+	tree, err := c.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading tree for manifest revision %s: %w", c.Hash, err)
+	}
+
+	extract := func(name string) ([]byte, error) {
+		f, err := tree.File(name)
+		if err != nil {
+			return nil, fmt.Errorf("%q not found in manifest revision %s: %w", name, c.Hash, err)
+		}
+		contents, err := f.Contents()
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading %q from manifest revision %s: %w", name, c.Hash, err)
+		}
+		dest := filepath.Join(dir, name)
+		if err := os.WriteFile(dest, []byte(contents), 0640); err != nil {
+			return nil, fmt.Errorf("Failed writing %q: %w", dest, err)
+		}
+		return []byte(contents), nil
+	}
+
+	contents, err := extract("manifest.json")
+	if err != nil {
+		return nil, err
+	}
+
+	var sysmanifest SysManifest
+	if err := json.Unmarshal(contents, &sysmanifest); err != nil {
+		return nil, fmt.Errorf("Failed parsing manifest from revision %s: %w", c.Hash, err)
+	}
+
+	for _, t := range sysmanifest.SysTargets {
+		base := strings.TrimSuffix(t.Source, ".json")
+		for _, ext := range []string{".json", ".json.signed", ".pem"} {
+			if utils.PathExists(filepath.Join(dir, base+ext)) {
+				continue
+			}
+			if _, err := extract(base + ext); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &sysmanifest, nil
+}
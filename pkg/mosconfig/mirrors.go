@@ -0,0 +1,206 @@
+package mosconfig
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// A machine can be given an ordered list of registries to fetch from,
+// for instance a cache at its own site followed by the central registry.
+// Every manifest and blob we fetch is checked against its digest, so it
+// does not matter which registry serves it.  Each is tried in turn for
+// each request, and the registry named in the url is tried last unless
+// it is in the list.  A request which fails to connect, or gets a server
+// error, is first retried on the same registry, with backoff.  Uploads
+// only go to the registry named in the url.
+//
+// The list comes from MosOptions.Registry.Mirrors, or else from
+// $config/registries.yaml, which looks like:
+//
+//	mirrors:
+//	  - https://zot.site1.example.com:5000
+//	  - zot.example.com
+//	timeout: 30s
+//	retries: 3
+//	referrers_tag: true
+
+const registryConfigFile = "registries.yaml"
+
+const (
+	DefaultRegistryTimeout = 30 * time.Second
+	DefaultRegistryRetries = 2
+	maxRegistryBackoff     = 30 * time.Second
+)
+
+// RegistryConfig is the contents of $config/registries.yaml.
+type RegistryConfig struct {
+	Mirrors      []string      `yaml:"mirrors,omitempty"`
+	Timeout      time.Duration `yaml:"timeout,omitempty"`
+	Retries      int           `yaml:"retries,omitempty"`
+	ReferrersTag bool          `yaml:"referrers_tag,omitempty"`
+}
+
+// readRegistryConfig reads $config/registries.yaml.  It is not an error
+// for it not to exist.
+func readRegistryConfig(configDir string) (RegistryConfig, error) {
+	var cfg RegistryConfig
+	p := filepath.Join(configDir, registryConfigFile)
+	bytes, err := os.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return cfg, errors.Wrapf(err, "Failed reading %s", p)
+	}
+	if err := yaml.Unmarshal(bytes, &cfg); err != nil {
+		return cfg, errors.Wrapf(err, "Failed parsing %s", p)
+	}
+	return cfg, nil
+}
+
+func writeRegistryConfig(configDir string, cfg RegistryConfig) error {
+	bytes, err := yaml.Marshal(&cfg)
+	if err != nil {
+		return errors.Wrapf(err, "Failed marshalling registry config")
+	}
+	p := filepath.Join(configDir, registryConfigFile)
+	if err := os.WriteFile(p, bytes, 0644); err != nil {
+		return errors.Wrapf(err, "Failed writing %s", p)
+	}
+	return nil
+}
+
+// configuredRegistry returns a Registry using @opts, with the mirrors,
+// timeout and retries from $config/registries.yaml under @configDir
+// where @opts does not set them.
+func configuredRegistry(configDir string, opts RegistryOptions) (*Registry, error) {
+	cfg, err := readRegistryConfig(configDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.Mirrors) == 0 {
+		opts.Mirrors = cfg.Mirrors
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = cfg.Timeout
+	}
+	if opts.Retries == 0 {
+		opts.Retries = cfg.Retries
+	}
+	opts.ReferrersTag = opts.ReferrersTag || cfg.ReferrersTag
+	return NewRegistry(opts)
+}
+
+// candidates returns the registries to fetch from, in order.
+func (r *DistRepo) candidates() []*DistRepo {
+	for _, m := range r.mirrors {
+		if m == r {
+			return r.mirrors
+		}
+	}
+	return append(append([]*DistRepo{}, r.mirrors...), r)
+}
+
+// do sends @req, which is for this registry, to each candidate registry
+// in turn until one succeeds, and returns the last response.  Once a
+// mirror cannot be reached, it is skipped.  Requests which need push
+// access only go to this registry.
+func (r *DistRepo) do(req *http.Request, scope string) (*http.Response, error) {
+	candidates := []*DistRepo{r}
+	if !strings.HasSuffix(scope, ",push") {
+		candidates = r.candidates()
+	}
+
+	var resp *http.Response
+	var err error
+	for i, c := range candidates {
+		last := i == len(candidates)-1
+		if c.unreachable.Load() && !last {
+			continue
+		}
+		creq := req
+		if c != r {
+			creq = c.retarget(req)
+		}
+		resp, err = c.doRetry(creq, scope)
+		if last {
+			break
+		}
+		if err != nil {
+			var connErr *registryConnError
+			if errors.As(err, &connErr) {
+				c.unreachable.Store(true)
+			}
+			log.Infof("%v, trying next registry", err)
+			continue
+		}
+		if resp.StatusCode < 300 {
+			break
+		}
+		log.Infof("Registry %s returned %q for %s, trying next registry", c.addr, resp.Status, req.URL.Path)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	return resp, err
+}
+
+// retarget returns a copy of @req sent to this registry instead.
+func (r *DistRepo) retarget(req *http.Request) *http.Request {
+	creq := req.Clone(req.Context())
+	creq.URL.Scheme = r.scheme
+	creq.URL.Host = r.addr
+	creq.Host = ""
+	creq.Header.Del("Authorization")
+	return creq
+}
+
+// doRetry sends @req to this registry, retrying with backoff if it fails
+// to connect or returns a server error.
+func (r *DistRepo) doRetry(req *http.Request, scope string) (*http.Response, error) {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.Body != nil {
+			if req.GetBody == nil {
+				return nil, errors.Errorf("Cannot resend request body to %q", req.URL.Redacted())
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		resp, err := r.doAuth(req, scope)
+		var connErr *registryConnError
+		retry := false
+		switch {
+		case err != nil:
+			retry = errors.As(err, &connErr)
+		case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+			retry = true
+		}
+		if !retry || attempt >= r.retries {
+			return resp, err
+		}
+
+		if err == nil {
+			err = errors.Errorf("%s returned %q", req.URL.Redacted(), resp.Status)
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		log.Infof("%v, retrying in %v", err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxRegistryBackoff {
+			backoff = maxRegistryBackoff
+		}
+	}
+}
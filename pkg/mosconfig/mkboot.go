@@ -10,9 +10,9 @@ import (
 
 	"github.com/apex/log"
 	"github.com/pkg/errors"
+	"github.com/project-machine/mos/pkg/trust"
 	"github.com/project-machine/mos/pkg/utils"
 	"golang.org/x/sys/unix"
-	"stackerbuild.io/stacker/pkg/lib"
 )
 
 type BootMode int
@@ -87,6 +87,7 @@ type OciBoot struct {
 	OutFile        string            // The output file (iso or qcow)
 	BootFromRemote bool              // if true, manifest and oci layers are not copied onto boot media
 	RepoDir        string            // The directory against which zot is running - to optionally rsync into iso
+	Registry       *Registry         // how to reach registries, or nil for the defaults
 }
 
 func (o *OciBoot) getBootKit() error {
@@ -295,7 +296,7 @@ func (o *OciBoot) Build() error {
 		return err
 	}
 
-	repo, err := NewDistRepo(o.BootURL)
+	repo, err := NewDistRepo(o.Registry, o.BootURL)
 	if err != nil {
 		return err
 	}
@@ -306,13 +307,13 @@ func (o *OciBoot) Build() error {
 	}
 
 	is := InstallSource{}
-	if err := is.FetchFromZot(o.BootURL); err != nil {
+	if err := is.FetchFromZot(o.Registry, o.BootURL, trust.VerifyOpts{}); err != nil {
 		return errors.Wrapf(err, "Error fetching remote manifest %s", o.BootURL)
 	}
 	defer is.Cleanup()
 
 	imgname := disturl.name + ":" + disturl.tag
-	if err := is.SaveToZot(o.ZotPort, imgname); err != nil {
+	if err := is.SaveToZot(o.Registry, o.ZotPort, imgname); err != nil {
 		return errors.Wrapf(err, "Failed saving image manifest to %s on local zot", imgname)
 	}
 
@@ -324,17 +325,10 @@ func (o *OciBoot) Build() error {
 	for _, t := range manifest.Targets {
 		//src := "docker://" + repo.addr + "/" + disturl.name + ":" + disturl.tag
 		//dest := fmt.Sprintf("docker://127.0.0.1:%d/%s:%s", o.ZotPort, disturl.name, disturl.tag)
-		src := fmt.Sprintf("docker://%s/mos:%s", repo.addr, dropHashPrefix(t.Digest))
+		src := repo.url("mos", dropHashPrefix(t.Digest))
 		dest := fmt.Sprintf("docker://127.0.0.1:%d/mos:%s", o.ZotPort, dropHashPrefix(t.Digest))
-		copyOpts := lib.ImageCopyOpts{
-			Src:         src,
-			Dest:        dest,
-			Progress:    os.Stdout,
-			SrcSkipTLS:  true,
-			DestSkipTLS: true,
-		}
-		log.Debugf("Copying %s to %s using %#v", src, dest, copyOpts)
-		if err := lib.ImageCopy(copyOpts); err != nil {
+		log.Debugf("Copying %s to %s", src, dest)
+		if err := copyImage(o.Registry, src, t.Digest, dest); err != nil {
 			return errors.Wrapf(err, "failed copying layer")
 		}
 	}
@@ -461,8 +455,9 @@ targets:
       type: none
 `
 
-// Build a provisioning ISO for the given keyset
-func BuildProvisioner(keysetName, projectName, isofile string) error {
+// Build a provisioning ISO for the given keyset, fetching its layers
+// as @reg says.
+func BuildProvisioner(reg *Registry, keysetName, projectName, isofile string) error {
 	dir, err := os.MkdirTemp("", "provision")
 	if err != nil {
 		return errors.Wrapf(err, "failed creating temporary directory")
@@ -497,7 +492,7 @@ func BuildProvisioner(keysetName, projectName, isofile string) error {
 	}
 
 	fullproject := keysetName + ":" + projectName
-	err = PublishManifest(fullproject, repo, name, manifestpath, SkipBootkit)
+	err = PublishManifest(reg, fullproject, repo, name, manifestpath, SkipBootkit)
 	if err != nil {
 		return errors.Wrapf(err, "Failed writing manifest artifacts to local zot")
 	}
@@ -516,12 +511,13 @@ func BuildProvisioner(keysetName, projectName, isofile string) error {
 		RepoDir:        cacheDir,
 		Files:          map[string]string{},
 		ZotPort:        zotPort,
+		Registry:       reg,
 	}
 
 	return o.Build()
 }
 
-func BuildInstaller(keysetName, projectName, isofile string) error {
+func BuildInstaller(reg *Registry, keysetName, projectName, isofile string) error {
 	dir, err := os.MkdirTemp("", "installiso")
 	if err != nil {
 		return errors.Wrapf(err, "failed creating temporary directory")
@@ -556,7 +552,7 @@ func BuildInstaller(keysetName, projectName, isofile string) error {
 	}
 
 	fullproject := keysetName + ":" + projectName
-	err = PublishManifest(fullproject, repo, name, manifestpath, SkipBootkit)
+	err = PublishManifest(reg, fullproject, repo, name, manifestpath, SkipBootkit)
 	if err != nil {
 		return errors.Wrapf(err, "Failed writing manifest artifacts to local zot")
 	}
@@ -575,6 +571,7 @@ func BuildInstaller(keysetName, projectName, isofile string) error {
 		RepoDir:        cacheDir,
 		Files:          map[string]string{},
 		ZotPort:        zotPort,
+		Registry:       reg,
 	}
 
 	return o.Build()
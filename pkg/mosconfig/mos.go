@@ -18,7 +18,8 @@ import (
 )
 
 type MosOptions struct {
-	// Storage type - atomfs for now
+	// Storage type - atomfs or puzzlefs.  If empty, then whichever
+	// the system was installed with.
 	StorageType StorageType
 
 	// The host root directory.  If you specify this (to anything other
@@ -47,19 +48,41 @@ type MosOptions struct {
 
 	// OTOH if we want to fetch the manifest CA from a custom path:
 	CaPath string
+
+	// The provisioned SUDI certificate, whose product install
+	// manifests must be for.
+	SudiCertPath string
+
+	// How many times to try booting a new hostfs before falling back
+	// to the previous one.
+	HostfsBootAttempts int
+
+	// How to reach registries.  Mirrors, Timeout and Retries which
+	// are unset are taken from $config/registries.yaml.
+	Registry RegistryOptions
+
+	// A token authorizing an update to a manifest with a lower
+	// security version than the host has accepted.
+	DowngradeToken string
+
+	// The time as of which manifest certificates are checked.  The
+	// zero time means now.
+	VerifyTime time.Time
 }
 
 func DefaultMosOptions() MosOptions {
 	return MosOptions{
-		StorageType:      AtomfsStorageType,
-		ConfigDir:        "",
-		StorageCache:     "",
-		ScratchWrites:    "",
-		RootDir:          "/",
-		LayersReadOnly:   true,
-		ManifestReadOnly: true,
-		NoHostCerts:      false,
-		CaPath:           "/factory/secure/manifestCA.pem",
+		StorageType:        "",
+		ConfigDir:          "",
+		StorageCache:       "",
+		ScratchWrites:      "",
+		RootDir:            "/",
+		LayersReadOnly:     true,
+		ManifestReadOnly:   true,
+		NoHostCerts:        false,
+		CaPath:             "/factory/secure/manifestCA.pem",
+		SudiCertPath:       "/factory/secure/server.crt",
+		HostfsBootAttempts: DefaultHostfsBootAttempts,
 	}
 }
 
@@ -73,11 +96,21 @@ type Mos struct {
 	Manifest *SysManifest
 
 	NetLock sync.Mutex
+
+	// serializes usermod calls when targets are set up in parallel
+	uidLock sync.Mutex
+
+	// whether each filesystem type can be idmapped, probed once
+	idmapLock sync.Mutex
+	idmapOK   map[int64]bool
+
+	// how to reach registries for updates
+	registry *Registry
 }
 
-func NewMos(configDir, storeDir string) (*Mos, error) {
+func NewMos(configDir, storeDir string, storageType StorageType) (*Mos, error) {
 	opts := MosOptions{
-		StorageType:      AtomfsStorageType,
+		StorageType:      storageType,
 		ConfigDir:        configDir,
 		StorageCache:     storeDir,
 		RootDir:          "/",
@@ -120,20 +153,37 @@ func setDirOpts(opts MosOptions) MosOptions {
 	if opts.RootDir != "/" && !strings.HasPrefix(opts.CaPath, opts.RootDir) {
 		opts.CaPath = filepath.Join(opts.RootDir, opts.CaPath)
 	}
+	if opts.RootDir != "/" && opts.SudiCertPath != "" && !strings.HasPrefix(opts.SudiCertPath, opts.RootDir) {
+		opts.SudiCertPath = filepath.Join(opts.RootDir, opts.SudiCertPath)
+	}
 	return opts
 }
 
 func OpenMos(opts MosOptions) (*Mos, error) {
 	opts = setDirOpts(opts)
 
+	if opts.StorageType == "" {
+		st, err := installedStorageType(opts.ConfigDir)
+		if err != nil {
+			return nil, err
+		}
+		opts.StorageType = st
+	}
+
 	s, err := NewStorage(opts)
 	if err != nil {
-		return nil, fmt.Errorf("Error initializing storage")
+		return nil, fmt.Errorf("Error initializing %s storage: %w", opts.StorageType, err)
+	}
+
+	reg, err := configuredRegistry(opts.ConfigDir, opts.Registry)
+	if err != nil {
+		return nil, err
 	}
 
 	mos := &Mos{
-		opts:    opts,
-		storage: s,
+		opts:     opts,
+		storage:  s,
+		registry: reg,
 	}
 
 	err = mos.acquireLock()
@@ -192,6 +242,13 @@ func (mos *Mos) Boot() error {
 	if err := mos.SetupStorage(m); err != nil {
 		return errors.Wrapf(err, "Failed setting up storage")
 	}
+
+	// We got this far, so the hostfs we booted is good.  Whether the
+	// services start is up to them, not the hostfs.
+	if err := mos.confirmHostfs(); err != nil {
+		log.Warnf("Failed recording successful hostfs boot: %v", err)
+	}
+
 	// Now start the services
 	return mos.ActivateAll(m)
 }
@@ -224,24 +281,135 @@ func (mos *Mos) SetupStorage(m *SysManifest) error {
 	return nil
 }
 
-// Activate all services
+// RemoveStorage unmounts and deletes the storage volumes @items.
+func (mos *Mos) RemoveStorage(items StorageList) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	for _, n := range items {
+		dest := filepath.Join("/storage", n.Label)
+		mounted, err := utils.IsMountpoint(dest)
+		if err != nil {
+			return errors.Wrapf(err, "Failed checking whether %q is mounted", dest)
+		}
+		if mounted {
+			if err := unix.Unmount(dest, 0); err != nil {
+				return errors.Wrapf(err, "Failed unmounting %q", dest)
+			}
+		}
+		if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+			log.Warnf("Failed removing %q: %v", dest, err)
+		}
+	}
+
+	sys := linux.System()
+	allDisks, err := sys.ScanAllDisks(func(disko.Disk) bool { return true })
+	if err != nil {
+		return err
+	}
+	for _, n := range items {
+		if err := n.Delete(allDisks, sys); err != nil {
+			return errors.Wrapf(err, "Failed deleting %#v", n)
+		}
+		log.Infof("Removed storage %s", n.Label)
+	}
+
+	return nil
+}
+
+// Activate all services.  Targets are started in waves, each holding
+// the targets whose dependencies were started in earlier waves, and the
+// targets in a wave are set up in parallel.  A failure to start one
+// target does not stop the others, except for those which depend on it.
 func (mos *Mos) ActivateAll(m *SysManifest) error {
+	// Make sure the manifest is cached before Activate is called in
+	// parallel.
+	if _, err := mos.CurrentManifest(); err != nil {
+		return errors.Wrapf(err, "Failed opening manifest")
+	}
+
+	waves, err := activationWaves(m)
+	if err != nil {
+		return err
+	}
+
+	var lock sync.Mutex
+	failed := map[string]error{}
+	for _, wave := range waves {
+		// Check the whole wave before starting any of it, as failed
+		// is written by the goroutines below.
+		start := []string{}
+		for _, name := range wave {
+			if name == "hostfs" || name == "bootkit" {
+				continue
+			}
+			if mos.IsDeactivated(name) {
+				log.Infof("Not starting deactivated target %s", name)
+				continue
+			}
+			if err := mos.checkDependsOn(m, name, failed); err != nil {
+				failed[name] = err
+				continue
+			}
+			start = append(start, name)
+		}
+
+		var wg sync.WaitGroup
+		for _, name := range start {
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				if err := mos.Activate(name); err != nil {
+					lock.Lock()
+					failed[name] = err
+					lock.Unlock()
+				}
+			}(name)
+		}
+		wg.Wait()
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+	msgs := []string{}
 	for _, t := range m.SysTargets {
-		if t.Name == "hostfs" || t.Name == "bootkit" {
+		if err, ok := failed[t.Name]; ok {
+			log.Warnf("Failed starting %s: %v", t.Name, err)
+			msgs = append(msgs, fmt.Sprintf("%s: %v", t.Name, err))
+		}
+	}
+	return errors.Errorf("Failed starting %d targets: %s", len(msgs), strings.Join(msgs, "; "))
+}
+
+// checkDependsOn returns an error if target @name depends on a target
+// which is missing or failed to start.
+func (mos *Mos) checkDependsOn(m *SysManifest, name string, failed map[string]error) error {
+	st, err := m.GetTarget(name)
+	if err != nil || st.raw == nil {
+		return nil
+	}
+	for _, d := range st.raw.DependsOn {
+		if d == "hostfs" || d == "bootkit" {
 			continue
 		}
-		if err := mos.Activate(t.Name); err != nil {
-			return errors.Wrapf(err, "Failed starting %s", t.Name)
+		if _, err := m.GetTarget(d); err != nil {
+			return errors.Errorf("Dependency %s is not installed", d)
+		}
+		if _, ok := failed[d]; ok {
+			return errors.Errorf("Dependency %s failed to start", d)
 		}
 	}
-
 	return nil
 }
 
 // Activate a target (service):
 // If it is not yet running then start it.
 // If it is already running, but is not at the newest version (i.e. after an
-// upgrade), then restart it. (Not fully implemented)
+// upgrade), then restart it.
+// If it is already running the newest version, then leave it alone.
+// If it was deactivated, then it no longer is.
 func (mos *Mos) Activate(name string) error {
 	t, err := mos.Current(name)
 	if err != nil {
@@ -249,27 +417,37 @@ func (mos *Mos) Activate(name string) error {
 	}
 
 	if t.ServiceType == HostfsService {
-		return errors.Errorf("Reboot not yet supported, do it yourself")
+		s, err := mos.HostfsBootState()
+		if err != nil {
+			return err
+		}
+		if s.Pending() {
+			log.Infof("hostfs from manifest revision %s is staged, please reboot to activate it", s.Next)
+		} else if s != nil && s.FellBack {
+			log.Warnf("hostfs from manifest revision %s failed to boot, and the one from revision %s is running instead",
+				s.Next, s.Previous)
+		} else {
+			log.Infof("hostfs is activated at boot, nothing to do")
+		}
+		return nil
+	}
+
+	if err := mos.reactivate(name); err != nil {
+		return err
 	}
 
-	v, err := mos.RunningVersion(t)
+	r, err := mos.RunningTarget(t)
 	if err != nil {
 		return errors.Wrapf(err, "Failed getting running version of %s", name)
 	}
 
-	log.Infof("running version is \"%q\" wanted version is %q", v, t.Version)
-	if v == t.Version {
-		// TODO this is actually broken - what we get is the layer config
-		// hash (e.g. ee60af2a371e08a67174387985dd5f270d5596f7265f94f15107889aab454157),
-		// but we need the version.  This isn't so bad, we just always restart
-		// on activate.
-
-		// latest version already running
+	if r.Matches(t) {
+		log.Infof("%s is already running version %s (%s)", name, t.Version, t.Digest)
 		return nil
 	}
 
-	if v != "" {
-		log.Infof("Stopping target %q", t.ServiceName)
+	if r != nil {
+		log.Infof("Stopping target %q (running version %q, wanted version %q)", t.ServiceName, r.Version, t.Version)
 		err = mos.StopTarget(t)
 		if err != nil {
 			return errors.Wrapf(err, "Failed stopping service %s for update", name)
@@ -282,13 +460,15 @@ func (mos *Mos) Activate(name string) error {
 		return errors.Wrapf(err, "Error setting up runtime for %s", name)
 	}
 
-	if t.ServiceType != ContainerService {
-		return nil
+	if t.ServiceType == ContainerService {
+		err = mos.startInit(t)
+		if err != nil {
+			return errors.Wrapf(err, "Error starting %s", name)
+		}
 	}
 
-	err = mos.startInit(t)
-	if err != nil {
-		return errors.Wrapf(err, "Error starting %s", name)
+	if err := mos.recordRunning(t); err != nil {
+		log.Warnf("Failed recording running version of %s: %v", name, err)
 	}
 
 	return nil
@@ -393,7 +573,10 @@ func (mos *Mos) writeLxcConfig(t *Target) error {
 		lxcConf = append(lxcConf, "lxc.idmap = "+line)
 	}
 
-	if err := addUidMapping(idmapset); err != nil {
+	mos.uidLock.Lock()
+	err = addUidMapping(idmapset)
+	mos.uidLock.Unlock()
+	if err != nil {
 		return err
 	}
 
@@ -423,20 +606,19 @@ func (mos *Mos) writeLxcConfig(t *Target) error {
 	}
 	log.Infof("mountpoint %q is ready after %d seconds", rfs, count)
 
-	if !UidmapIsHost() {
-		err = fixupSymlinks(rfs)
-		if err != nil {
-			return err
-		}
+	rootfs, err := mos.mountContainerRootfs(t, rfs, idmapset)
+	if err != nil {
+		return fmt.Errorf("Failed setting up rootfs for %q: %w", t.ServiceName, err)
 	}
 
-	if len(idmapset.Idmap) != 0 {
-		err = idmapset.ShiftFile(rfs)
+	if !UidmapIsHost() {
+		err = fixupSymlinks(rootfs)
 		if err != nil {
 			return err
 		}
 	}
-	lxcConf = append(lxcConf, "lxc.rootfs.path = "+rfs)
+
+	lxcConf = append(lxcConf, "lxc.rootfs.path = "+rootfs)
 
 	netconf, err := mos.SetupTargetNetwork(t)
 	if err != nil {
@@ -471,7 +653,11 @@ func (mos *Mos) writeLxcConfig(t *Target) error {
 		if isdir {
 			filetype = "dir"
 		}
-		lxcConf = append(lxcConf, fmt.Sprintf("lxc.mount.entry = %s %s none bind,create=%s 0 0", src, dest, filetype))
+		extra, err := mos.storageMountOpts(src, idmapset)
+		if err != nil {
+			return errors.Wrapf(err, "Failed preparing storage %q for %s", m.Label, t.ServiceName)
+		}
+		lxcConf = append(lxcConf, fmt.Sprintf("lxc.mount.entry = %s %s none bind,create=%s%s 0 0", src, dest, filetype, extra))
 	}
 
 	// Write the result
@@ -489,18 +675,25 @@ func (mos *Mos) writeLxcConfig(t *Target) error {
 	return nil
 }
 
-// Return the layer hash for a running service.
-// We do this by looking for the mounted fs and using the hash to look
-// back through the manifest and find the current version.
+// Return the version of a running service, as recorded when it was
+// activated.  If it is running but we do not know what it was started
+// from, return the mounted layer hash instead.
 // Return "", nil if the service is not running.
 func (mos *Mos) RunningVersion(t *Target) (string, error) {
-	hash, err := mos.storage.MountedByHash(t)
+	r, err := mos.RunningTarget(t)
 	if err != nil {
 		return "", err
 	}
-	log.Infof("RunningVersion: %s has version %q", t.ServiceName, hash)
+	if r == nil {
+		return "", nil
+	}
+	v := r.Version
+	if v == "" {
+		v = r.LayerHash
+	}
+	log.Infof("RunningVersion: %s has version %q", t.ServiceName, v)
 
-	return hash, nil
+	return v, nil
 }
 
 func (mos *Mos) StopTarget(t *Target) error {
@@ -517,6 +710,10 @@ func (mos *Mos) StopTarget(t *Target) error {
 		if err := mos.StopTargetNetwork(t); err != nil {
 			log.Warnf("Failed tearing down network for %q: %v", t.ServiceName, err)
 		}
+
+		if err := mos.umountContainerRootfs(t.ServiceName); err != nil {
+			return fmt.Errorf("Failed removing rootfs of %s: %w", t.ServiceName, err)
+		}
 	case HostfsService:
 		return fmt.Errorf("Stopping hostfs is not yet supported.  Please poweroff")
 	case FsService:
@@ -525,7 +722,6 @@ func (mos *Mos) StopTarget(t *Target) error {
 		if err != nil {
 			return err
 		}
-		return nil
 	default:
 		return fmt.Errorf("Unhandled service type: %s", t.ServiceType)
 	}
@@ -535,5 +731,7 @@ func (mos *Mos) StopTarget(t *Target) error {
 		return fmt.Errorf("Failed shutting down storage for %s: %w", t.ServiceName, err)
 	}
 
+	// Only now is nothing left of what it ran from.
+	mos.clearRunning(t.ServiceName)
 	return nil
 }
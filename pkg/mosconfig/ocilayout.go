@@ -0,0 +1,448 @@
+package mosconfig
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/apex/log"
+	digest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/project-machine/mos/pkg/trust"
+	"github.com/project-machine/mos/pkg/utils"
+)
+
+// Install manifests can also be read from a local OCI layout, for
+// instance on a USB stick at a site which cannot reach a registry:
+//
+//	oci:/media/usb/layout:1.0.0
+//
+// or from a bundle, which is a tarball (optionally gzipped) of such a
+// layout:
+//
+//	oci-archive:/media/usb/update.tar:1.0.0
+//
+// The tag names the install manifest.  Its certificate and signature
+// are found among the manifests in the layout's index.json which have it
+// as their subject, or in the index tagged sha256-<digest> of the install
+// manifest, as written by clients which have no referrers API.  The
+// targets are found in the same layout by digest, so they need not be
+// tagged.
+
+const (
+	ociLayoutPrefix  = "oci:"
+	ociArchivePrefix = "oci-archive:"
+)
+
+// isLocalUrl reports whether @url names a local OCI layout or bundle
+// rather than a registry.
+func isLocalUrl(url string) bool {
+	return strings.HasPrefix(url, ociLayoutPrefix) || strings.HasPrefix(url, ociArchivePrefix)
+}
+
+// parseLocalUrl splits oci:/path:ref or oci-archive:/path:ref into the
+// path and ref.
+func parseLocalUrl(url string) (string, string, error) {
+	split := strings.SplitN(url, ":", 3)
+	if len(split) != 3 || split[1] == "" || split[2] == "" {
+		return "", "", errors.Errorf("Bad oci url: %s", url)
+	}
+	return split[1], split[2], nil
+}
+
+// Fetch fetches the install manifest, certificate and signature at
+// @url, which may be on a registry or local, and any CRLs published with
+// it.  If vopts.CaPath is set, the certificate and signature are ones
+// which verify under it.  Registries are reached as @reg says.
+func (is *InstallSource) Fetch(reg *Registry, url string, vopts trust.VerifyOpts) error {
+	if isLocalUrl(url) {
+		return is.FetchFromLayout(url, vopts)
+	}
+	return is.FetchFromZot(reg, url, vopts)
+}
+
+// registry returns the Registry the install manifest was fetched with,
+// or nil if it was read from a local layout.
+func (is *InstallSource) registry() *Registry {
+	if is.ocirepo == nil {
+		return nil
+	}
+	return is.ocirepo.reg
+}
+
+// FetchFromLayout reads the install manifest, certificate and signature,
+// and any CRLs, from the local OCI layout or bundle at @url.
+func (is *InstallSource) FetchFromLayout(url string, vopts trust.VerifyOpts) error {
+	path, ref, err := parseLocalUrl(url)
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "install")
+	if err != nil {
+		return err
+	}
+	is.Basedir = dir
+	is.NeedsCleanup = true
+	is.FilePath = filepath.Join(is.Basedir, "install.json")
+	is.CertPath = filepath.Join(is.Basedir, "manifestCert.pem")
+	is.SignPath = filepath.Join(is.Basedir, "install.json.signed")
+
+	is.layout = path
+	if strings.HasPrefix(url, ociArchivePrefix) {
+		is.layout = filepath.Join(is.Basedir, "bundle")
+		if err := extractBundle(path, is.layout); err != nil {
+			return errors.Wrapf(err, "Failed extracting bundle %q", path)
+		}
+	}
+
+	ctx := context.Background()
+	oci, err := umoci.OpenLayout(is.layout)
+	if err != nil {
+		return errors.Wrapf(err, "Failed opening oci layout at %q", path)
+	}
+	defer oci.Close()
+
+	paths, err := oci.ResolveReference(ctx, ref)
+	if err != nil {
+		return errors.Wrapf(err, "Failed looking up %q in %q", ref, path)
+	}
+	if len(paths) != 1 {
+		return errors.Errorf("Bad descriptor for %q in %q", ref, path)
+	}
+	desc := paths[0].Descriptor()
+
+	if _, err := fetchLayoutArtifact(ctx, oci, desc.Digest, is.FilePath, -1); err != nil {
+		return errors.Wrapf(err, "Error reading the install manifest")
+	}
+
+	fetch := func(d ispec.Descriptor, dest string) (map[string]string, error) {
+		if d.Size > maxReferrerSize {
+			return nil, errors.Errorf("Artifact manifest is too large (%d bytes)", d.Size)
+		}
+		return fetchLayoutArtifact(ctx, oci, d.Digest, dest, maxReferrerSize)
+	}
+	crls, err := layoutReferrers(ctx, oci, desc.Digest, crlArtifact)
+	if err != nil {
+		return err
+	}
+	is.fetchCRLs(crls, vopts.CaPath, fetch)
+
+	certs, err := layoutReferrers(ctx, oci, desc.Digest, pubkeyArtifact)
+	if err != nil {
+		return err
+	}
+	sigs, err := layoutReferrers(ctx, oci, desc.Digest, sigArtifact)
+	if err != nil {
+		return err
+	}
+	return is.pickSignature(certs, sigs, vopts, fetch)
+}
+
+// targetSource returns the url from which to import target @t, or "" if
+// the install manifest did not come from a registry or layout.
+func (is *InstallSource) targetSource(t *Target) string {
+	switch {
+	case is.ocirepo != nil:
+		return is.ocirepo.url("mos", dropHashAlg(t.Digest))
+	case is.layout != "":
+		return fmt.Sprintf("%s%s:%s", ociLayoutPrefix, is.layout, t.Digest)
+	}
+	return ""
+}
+
+// targetManifest returns the image manifest of target @t.
+func (is *InstallSource) targetManifest(t *Target) (ispec.Manifest, error) {
+	if is.ocirepo != nil {
+		return is.ocirepo.FetchImageManifest("mos", t.Digest)
+	}
+
+	var m ispec.Manifest
+	if is.layout == "" {
+		return m, errors.Errorf("No source for %s", t.ServiceName)
+	}
+	oci, err := umoci.OpenLayout(is.layout)
+	if err != nil {
+		return m, errors.Wrapf(err, "Failed opening oci layout at %q", is.layout)
+	}
+	defer oci.Close()
+	err = readBlobJSON(context.Background(), oci, digest.Digest(t.Digest), &m)
+	return m, err
+}
+
+// layoutReferrers returns the descriptors of the artifacts of type
+// @artifactType which refer to @subject.
+func layoutReferrers(ctx context.Context, oci casext.Engine, subject digest.Digest, artifactType string) ([]ispec.Descriptor, error) {
+	idx, err := oci.GetIndex(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed reading oci index")
+	}
+	candidates := idx.Manifests
+
+	fallback := referrersTagName(subject)
+	for _, d := range idx.Manifests {
+		if d.Annotations[ispec.AnnotationRefName] != fallback || d.MediaType != ispec.MediaTypeImageIndex {
+			continue
+		}
+		var fidx ispec.Index
+		if err := readBlobJSON(ctx, oci, d.Digest, &fidx); err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, fidx.Manifests...)
+	}
+
+	ret := []ispec.Descriptor{}
+	seen := map[digest.Digest]bool{}
+	for _, d := range candidates {
+		if seen[d.Digest] || d.MediaType != ispec.MediaTypeImageManifest {
+			continue
+		}
+		seen[d.Digest] = true
+		if d.ArtifactType != "" && d.ArtifactType != artifactType {
+			continue
+		}
+		var m ispec.Manifest
+		if err := readBlobJSON(ctx, oci, d.Digest, &m); err != nil {
+			return nil, err
+		}
+		if m.Subject == nil || m.Subject.Digest != subject {
+			continue
+		}
+		if m.ArtifactType != artifactType && m.Config.MediaType != artifactType {
+			continue
+		}
+		ret = append(ret, d)
+	}
+	return ret, nil
+}
+
+// fetchLayoutArtifact writes the single layer of the artifact manifest
+// @d to @dest, and returns the manifest's annotations.  If @max is not
+// -1, the layer may not be over @max bytes.
+func fetchLayoutArtifact(ctx context.Context, oci casext.Engine, d digest.Digest, dest string, max int64) (map[string]string, error) {
+	var m ispec.Manifest
+	if err := readBlobJSON(ctx, oci, d, &m); err != nil {
+		return nil, err
+	}
+	if len(m.Layers) == 0 {
+		return nil, errors.Errorf("No layers found in artifact %s", d)
+	}
+	if max != -1 && m.Layers[0].Size > max {
+		return nil, errors.Errorf("Artifact %s is too large (%d bytes)", d, m.Layers[0].Size)
+	}
+
+	r, err := oci.GetBlob(ctx, m.Layers[0].Digest)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed reading blob %s", m.Layers[0].Digest)
+	}
+	outf, err := os.OpenFile(dest, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	defer outf.Close()
+	if max != -1 {
+		err = copyLimited(outf, r, max)
+	} else {
+		_, err = io.Copy(outf, r)
+	}
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	// Close verifies the digest
+	return m.Annotations, r.Close()
+}
+
+// copyLayoutImage copies the image @ref from the OCI layout at @srcdir
+// into the one at @destdir, tagged as @tag.
+func copyLayoutImage(srcdir, ref, destdir, tag string) error {
+	ctx := context.Background()
+	src, err := umoci.OpenLayout(srcdir)
+	if err != nil {
+		return errors.Wrapf(err, "Failed opening oci layout at %q", srcdir)
+	}
+	defer src.Close()
+
+	var desc ispec.Descriptor
+	if d, err := digest.Parse(ref); err == nil {
+		desc = ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: d}
+	} else {
+		paths, err := src.ResolveReference(ctx, ref)
+		if err != nil {
+			return errors.Wrapf(err, "Failed looking up %q", ref)
+		}
+		if len(paths) != 1 {
+			return errors.Errorf("Bad descriptor for %q in %q", ref, srcdir)
+		}
+		desc = paths[0].Descriptor()
+	}
+
+	var m ispec.Manifest
+	if err := readBlobJSON(ctx, src, desc.Digest, &m); err != nil {
+		return err
+	}
+
+	dest, err := openOrCreateLayout(destdir)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	// The manifest goes last, so that it is only there once
+	// everything it refers to is.
+	blobs := append([]ispec.Descriptor{m.Config}, m.Layers...)
+	blobs = append(blobs, desc)
+	for _, b := range blobs {
+		if err := copyLayoutBlob(ctx, src, dest, b.Digest); err != nil {
+			return err
+		}
+	}
+
+	desc.Size = 0
+	if fi, err := os.Stat(filepath.Join(destdir, "blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded())); err == nil {
+		desc.Size = fi.Size()
+	}
+	return updateLayoutReference(ctx, dest, tag, desc)
+}
+
+// layoutLock serializes changes to the index.json of our OCI layouts,
+// since targets are imported in parallel.
+var layoutLock sync.Mutex
+
+// updateLayoutReference tags @desc as @tag in @oci.
+func updateLayoutReference(ctx context.Context, oci casext.Engine, tag string, desc ispec.Descriptor) error {
+	layoutLock.Lock()
+	defer layoutLock.Unlock()
+	return oci.UpdateReference(ctx, tag, desc)
+}
+
+// openOrCreateLayout opens the OCI layout at @dir, creating it if it
+// does not yet exist.
+func openOrCreateLayout(dir string) (casext.Engine, error) {
+	layoutLock.Lock()
+	defer layoutLock.Unlock()
+	var oci casext.Engine
+	var err error
+	if utils.PathExists(filepath.Join(dir, "index.json")) {
+		oci, err = umoci.OpenLayout(dir)
+	} else {
+		oci, err = umoci.CreateLayout(dir)
+	}
+	if err != nil {
+		return oci, errors.Wrapf(err, "Failed opening oci layout at %q", dir)
+	}
+	return oci, nil
+}
+
+func copyLayoutBlob(ctx context.Context, src, dest casext.Engine, d digest.Digest) error {
+	if ok, err := dest.StatBlob(ctx, d); err == nil && ok {
+		return nil
+	}
+	log.Debugf("Copying blob %s", d)
+	r, err := src.GetBlob(ctx, d)
+	if err != nil {
+		return errors.Wrapf(err, "Failed reading blob %s", d)
+	}
+	got, _, err := dest.PutBlob(ctx, r)
+	if err != nil {
+		r.Close()
+		return errors.Wrapf(err, "Failed writing blob %s", d)
+	}
+	if err := r.Close(); err != nil {
+		return errors.Wrapf(err, "Failed verifying blob %s", d)
+	}
+	if got != d {
+		return errors.Errorf("Blob %s was stored as %s", d, got)
+	}
+	return nil
+}
+
+// extractBundle unpacks the tarball of an OCI layout at @path into
+// @dest.
+func extractBundle(path, dest string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = bufio.NewReader(f)
+	if magic, err := r.(*bufio.Reader).Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	if err := utils.EnsureDir(dest); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Clean(hdr.Name)
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return errors.Errorf("Bad path %q in bundle", hdr.Name)
+		}
+		p := filepath.Join(dest, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := utils.EnsureDir(p); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := utils.EnsureDir(filepath.Dir(p)); err != nil {
+				return err
+			}
+			outf, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(outf, tr)
+			outf.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			log.Debugf("Skipping %q in bundle", hdr.Name)
+		}
+	}
+
+	return nil
+}
+
+// copyLocal imports @target from the OCI layout named by @image, of the
+// form oci:/path:ref, into the layout under @zotPath, tagged @tag.
+func copyLocal(zotPath, image string, target *Target, tag string) error {
+	srcdir, ref, err := parseLocalUrl(image)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Copying %s from %s to local storage", target.ServiceName, image)
+	if err := utils.EnsureDir(zotPath); err != nil {
+		return errors.Wrapf(err, "Failed creating local zot directory %q", zotPath)
+	}
+	return copyLayoutImage(srcdir, ref, filepath.Join(zotPath, "mos"), tag)
+}
@@ -0,0 +1,201 @@
+package mosconfig
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/project-machine/mos/pkg/utils"
+)
+
+// PlannedTarget describes what an update would do to one target.
+type PlannedTarget struct {
+	Name        string      `json:"name"`
+	ServiceType ServiceType `json:"service_type"`
+	OldVersion  string      `json:"old_version,omitempty"`
+	OldDigest   string      `json:"old_digest,omitempty"`
+	NewVersion  string      `json:"new_version,omitempty"`
+	NewDigest   string      `json:"new_digest,omitempty"`
+}
+
+// UpdatePlan describes what Mos.Update would do with a given install
+// manifest.
+type UpdatePlan struct {
+	Url        string     `json:"url"`
+	Product    string     `json:"product"`
+	UpdateType UpdateType `json:"update_type"`
+
+	Added    []PlannedTarget `json:"added"`
+	Replaced []PlannedTarget `json:"replaced"`
+	Kept     []PlannedTarget `json:"kept"`
+	Removed  []PlannedTarget `json:"removed"`
+
+	StorageCreated []StorageItem `json:"storage_created"`
+	StorageDeleted []StorageItem `json:"storage_deleted"`
+	NewUidMaps     []IdmapSet    `json:"new_uidmaps"`
+
+	// Total size of the blobs which are not yet in our store
+	DownloadBytes int64 `json:"download_bytes"`
+
+	RebootNeeded bool     `json:"reboot_needed"`
+	RebootFor    []string `json:"reboot_for,omitempty"` // hostfs and/or bootkit
+}
+
+// PlanUpdate works out what updating to the install manifest at @url
+// would do, without changing anything.  The manifest's signature is
+// verified, but its targets are not imported.
+func (mos *Mos) PlanUpdate(url string) (*UpdatePlan, error) {
+	var is InstallSource
+	defer is.Cleanup()
+
+	vopts, err := mos.fetchVerifyOpts()
+	if err != nil {
+		return nil, err
+	}
+	if err := is.Fetch(mos.registry, url, vopts); err != nil {
+		return nil, err
+	}
+	if err := mos.checkFetched(&is); err != nil {
+		return nil, err
+	}
+
+	newIF, err := VerifyInstallManifest(is, vopts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed verifying signature on %s", is.FilePath)
+	}
+
+	manifest, err := mos.CurrentManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	shaSum, err := utils.ShaSum(is.FilePath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed calculating shasum: %w", err)
+	}
+	newtargets := installSysTargets(newIF, fmt.Sprintf("%s.json", shaSum))
+
+	merged, err := mergeUpdateTargets(manifest, newtargets, newIF)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &UpdatePlan{
+		Url:            url,
+		Product:        newIF.Product,
+		UpdateType:     newIF.UpdateType,
+		Added:          []PlannedTarget{},
+		Replaced:       []PlannedTarget{},
+		Kept:           []PlannedTarget{},
+		Removed:        []PlannedTarget{},
+		StorageCreated: []StorageItem{},
+		StorageDeleted: []StorageItem{},
+		NewUidMaps:     []IdmapSet{},
+	}
+
+	for _, n := range merged.SysTargets {
+		p := PlannedTarget{
+			Name:        n.Name,
+			ServiceType: n.raw.ServiceType,
+			NewVersion:  n.raw.Version,
+			NewDigest:   n.raw.Digest,
+		}
+		o, err := manifest.GetTarget(n.Name)
+		switch {
+		case err != nil:
+			plan.Added = append(plan.Added, p)
+		case o.raw.Digest == n.raw.Digest && o.raw.Version == n.raw.Version:
+			p.OldVersion, p.OldDigest = o.raw.Version, o.raw.Digest
+			plan.Kept = append(plan.Kept, p)
+		default:
+			p.OldVersion, p.OldDigest = o.raw.Version, o.raw.Digest
+			plan.Replaced = append(plan.Replaced, p)
+		}
+	}
+	for _, o := range manifest.SysTargets {
+		if _, err := merged.GetTarget(o.Name); err == nil {
+			continue
+		}
+		plan.Removed = append(plan.Removed, PlannedTarget{
+			Name:        o.Name,
+			ServiceType: o.raw.ServiceType,
+			OldVersion:  o.raw.Version,
+			OldDigest:   o.raw.Digest,
+		})
+	}
+
+	for _, n := range merged.Storage {
+		if !manifest.Storage.Contains(n) {
+			plan.StorageCreated = append(plan.StorageCreated, n)
+		}
+	}
+	plan.StorageDeleted = append(plan.StorageDeleted, storageToRemove(manifest, &merged, newIF)...)
+
+	for _, u := range merged.UidMaps {
+		found := false
+		for _, o := range manifest.UidMaps {
+			if o.Name == u.Name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			plan.NewUidMaps = append(plan.NewUidMaps, u)
+		}
+	}
+
+	for _, name := range []string{"hostfs", "bootkit"} {
+		if targetChanged(manifest, &merged, name) {
+			plan.RebootNeeded = true
+			plan.RebootFor = append(plan.RebootFor, name)
+		}
+	}
+
+	plan.DownloadBytes, err = mos.downloadSize(is, newtargets)
+	if err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+// downloadSize adds up the sizes of the blobs of @targets, as listed in
+// their manifests at @is, which are not already in our store.  Blobs
+// shared between targets are only counted once.
+func (mos *Mos) downloadSize(is InstallSource, targets SysTargets) (int64, error) {
+	blobdir := filepath.Join(mos.opts.StorageCache, "mos", "blobs")
+	have := func(d digest.Digest) bool {
+		_, err := os.Stat(filepath.Join(blobdir, d.Algorithm().String(), d.Encoded()))
+		return err == nil
+	}
+
+	counted := map[digest.Digest]bool{}
+	var total int64
+	for _, t := range targets {
+		d, err := digest.Parse(t.raw.Digest)
+		if err != nil {
+			return 0, errors.Wrapf(err, "Bad digest for %s", t.Name)
+		}
+		if have(d) {
+			continue
+		}
+		m, err := is.targetManifest(t.raw)
+		if err != nil {
+			return 0, errors.Wrapf(err, "Failed fetching manifest for %s", t.Name)
+		}
+		if !counted[d] {
+			counted[d] = true
+			total += t.raw.Size
+		}
+		for _, b := range append(m.Layers, m.Config) {
+			if counted[b.Digest] || have(b.Digest) {
+				continue
+			}
+			counted[b.Digest] = true
+			total += b.Size
+		}
+	}
+	return total, nil
+}
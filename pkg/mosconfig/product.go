@@ -0,0 +1,73 @@
+package mosconfig
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"github.com/project-machine/mos/pkg/trust"
+)
+
+// All the products of a keyset share its manifest CA, so a manifest
+// signed for one would verify on a machine provisioned for another.
+// A provisioned machine's SUDI certificate, /factory/secure/server.crt,
+// has the subject serial number "PID:<product uuid> SN:<machine uuid>",
+// and an install manifest is only accepted if its product is the
+// machine's.  A machine which has not been provisioned has no SUDI
+// certificate, and accepts any product.  One whose TPM was provisioned
+// but whose SUDI certificate is missing accepts none.
+
+// sudiProduct returns the product UUID in the SUDI certificate at
+// @certPath, or "" if there is no such file.
+func sudiProduct(certPath string) (string, error) {
+	bytes, err := os.ReadFile(certPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", errors.Wrapf(err, "Failed reading SUDI certificate")
+	}
+	block, _ := pem.Decode(bytes)
+	if block == nil {
+		return "", errors.Errorf("No PEM data found in %s", certPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed parsing SUDI certificate %s", certPath)
+	}
+
+	for _, f := range strings.Fields(cert.Subject.SerialNumber) {
+		if pid, ok := strings.CutPrefix(f, "PID:"); ok && pid != "" {
+			return pid, nil
+		}
+	}
+	return "", errors.Errorf("No product in SUDI certificate %s subject %q", certPath, cert.Subject.SerialNumber)
+}
+
+// checkProduct refuses @manifest if it is not for the product of the
+// SUDI certificate at @certPath.  If @certPath is "", or there is no
+// such file and the TPM is not provisioned, any product is accepted.
+func checkProduct(manifest InstallFile, certPath string) error {
+	if certPath == "" {
+		return nil
+	}
+	product, err := sudiProduct(certPath)
+	if err != nil {
+		return err
+	}
+	if product == "" {
+		if trust.TPMProvisioned() {
+			return errors.Errorf("This machine's TPM is provisioned, but it has no SUDI certificate at %s", certPath)
+		}
+		log.Warnf("No SUDI certificate at %s, not checking product", certPath)
+		return nil
+	}
+	if !strings.EqualFold(manifest.Product, product) {
+		return errors.Errorf("Install manifest is for product %q, but this machine is provisioned for product %q",
+			manifest.Product, product)
+	}
+	return nil
+}
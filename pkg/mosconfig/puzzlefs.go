@@ -0,0 +1,352 @@
+package mosconfig
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"github.com/project-machine/mos/pkg/utils"
+	"golang.org/x/sys/unix"
+	"stackerbuild.io/stacker/pkg/mount"
+)
+
+// PuzzlefsStorage keeps targets as puzzlefs images in the same OCI layout
+// which atomfs uses.  puzzlefs splits files into content-defined chunks,
+// each stored as its own blob, so images which differ in a few files
+// share nearly all of their blobs, rather than only whole identical
+// layers.  Images are mounted using the puzzlefs fuse driver.
+//
+// Unlike an atomfs mount, a puzzlefs mount does not show which image it
+// came from in mountinfo.  So every mount is recorded under
+// $scratch-writes/puzzlefs/mounts/, which is where MountedByHash and
+// TearDownTarget look.
+type PuzzlefsStorage struct {
+	RootDir     string
+	zotPath     string
+	scratchPath string
+}
+
+func NewPuzzlefsStorage(rootDir, zotPath, scratchPath string) (*PuzzlefsStorage, error) {
+	return &PuzzlefsStorage{
+		RootDir:     rootDir,
+		zotPath:     zotPath,
+		scratchPath: scratchPath,
+	}, nil
+}
+
+func (p *PuzzlefsStorage) Type() StorageType {
+	return PuzzlefsStorageType
+}
+
+func (p *PuzzlefsStorage) ociDir() string {
+	return filepath.Join(p.zotPath, "mos")
+}
+
+// puzzlefsTag is the tag of @t's image in the OCI layout.  The puzzlefs
+// cli takes the image as <dir>:<tag>, and would split a digest's
+// "sha256:" off as the tag, so the algorithm is left out.
+func puzzlefsTag(t *Target) string {
+	return dropHashAlg(t.Digest)
+}
+
+// puzzlefsMount is the record of a mount done by PuzzlefsStorage.
+type puzzlefsMount struct {
+	ServiceName string `json:"service_name"`
+	Digest      string `json:"digest"`
+	Mountpoint  string `json:"mountpoint"`
+	BootId      string `json:"boot_id"`
+
+	// For writeable mounts, the readonly mount and overlay dirs
+	// under it.
+	Overlay *overlayDirs `json:"overlay,omitempty"`
+}
+
+func (p *PuzzlefsStorage) mountsDir() string {
+	return filepath.Join(p.scratchPath, "puzzlefs", "mounts")
+}
+
+func (p *PuzzlefsStorage) mountRecordPath(mountpoint string) string {
+	sum := sha256.Sum256([]byte(filepath.Clean(mountpoint)))
+	return filepath.Join(p.mountsDir(), hex.EncodeToString(sum[:])+".json")
+}
+
+func (p *PuzzlefsStorage) saveMount(m puzzlefsMount) error {
+	m.BootId = currentBootId()
+	bytes, err := json.Marshal(&m)
+	if err != nil {
+		return errors.Wrapf(err, "Failed marshalling mount record for %q", m.Mountpoint)
+	}
+	if err := utils.EnsureDir(p.mountsDir()); err != nil {
+		return errors.Wrapf(err, "Failed creating %q", p.mountsDir())
+	}
+	path := p.mountRecordPath(m.Mountpoint)
+	if err := os.WriteFile(path, bytes, 0644); err != nil {
+		return errors.Wrapf(err, "Failed writing %q", path)
+	}
+	return nil
+}
+
+// getMount returns the record of what is mounted at @mountpoint, or nil
+// if we did not mount anything there during this boot.
+func (p *PuzzlefsStorage) getMount(mountpoint string) *puzzlefsMount {
+	bytes, err := os.ReadFile(p.mountRecordPath(mountpoint))
+	if err != nil {
+		return nil
+	}
+	var m puzzlefsMount
+	if err := json.Unmarshal(bytes, &m); err != nil {
+		log.Warnf("Ignoring corrupt puzzlefs mount record for %q: %v", mountpoint, err)
+		return nil
+	}
+	if m.BootId != currentBootId() {
+		return nil
+	}
+	return &m
+}
+
+func (p *PuzzlefsStorage) dropMount(mountpoint string) {
+	path := p.mountRecordPath(mountpoint)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Failed removing %q: %v", path, err)
+	}
+}
+
+// puzzlefsUmount unmounts a puzzlefs or overlay mount.  If we are not
+// allowed to umount a fuse mount directly, fusermount can still do it.
+func puzzlefsUmount(mountpoint string) error {
+	err := unix.Unmount(mountpoint, 0)
+	if err == nil {
+		return nil
+	}
+	out, rc := utils.RunCommandWithRc("fusermount", "-u", mountpoint)
+	if rc != 0 {
+		return fmt.Errorf("Failed unmounting %q: %v (fusermount: %s)", mountpoint, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (p *PuzzlefsStorage) Mount(t *Target, mountpoint string) (func(), error) {
+	if err := utils.EnsureDir(mountpoint); err != nil {
+		return func() {}, fmt.Errorf("Failed creating mountpoint %q: %w", mountpoint, err)
+	}
+
+	image := fmt.Sprintf("%s:%s", p.ociDir(), puzzlefsTag(t))
+	out, rc := utils.RunCommandWithRc("puzzlefs", "mount", image, mountpoint)
+	if rc != 0 {
+		return func() {}, fmt.Errorf("Failed mounting puzzlefs image %s: %s", image, string(out))
+	}
+
+	cleanup := func() {
+		if err := puzzlefsUmount(mountpoint); err != nil {
+			log.Warnf("unmounting %s failed: %s", mountpoint, err)
+		}
+		p.dropMount(mountpoint)
+	}
+
+	err := p.saveMount(puzzlefsMount{
+		ServiceName: t.ServiceName,
+		Digest:      t.Digest,
+		Mountpoint:  mountpoint,
+	})
+	if err != nil {
+		return cleanup, err
+	}
+	return cleanup, nil
+}
+
+func (p *PuzzlefsStorage) MountWriteable(t *Target, mountpoint string) (func(), error) {
+	ovCleanup, dirs, err := mountWriteableOverlay(p.scratchPath, t, mountpoint, p.Mount)
+	if err != nil {
+		return ovCleanup, err
+	}
+
+	cleanup := func() {
+		ovCleanup()
+		p.dropMount(mountpoint)
+	}
+
+	err = p.saveMount(puzzlefsMount{
+		ServiceName: t.ServiceName,
+		Digest:      t.Digest,
+		Mountpoint:  mountpoint,
+		Overlay:     &dirs,
+	})
+	if err != nil {
+		return cleanup, err
+	}
+	return cleanup, nil
+}
+
+// MountedByHash returns the encoded digest of the image which @target is
+// running from, or "" if it is not running.
+func (p *PuzzlefsStorage) MountedByHash(target *Target) (string, error) {
+	rootsDir := filepath.Join(p.scratchPath, "roots", target.ServiceName)
+
+	var m *puzzlefsMount
+	switch target.ServiceType {
+	case "hostfs":
+		// The hostfs was mounted from the initrd, under
+		// whatever path it was booted from.
+		m = p.getMount(p.RootDir)
+		if m == nil {
+			m = p.findMount("hostfs")
+		}
+	case "fs-only":
+		/* see SetupTargetRuntime() */
+		mounted, err := utils.IsMountpoint(filepath.Join(p.RootDir, "mnt/atom", target.ServiceName))
+		if err != nil || !mounted {
+			return "", nil
+		}
+		m = p.getMount(rootsDir)
+	case "container":
+		out, rc := utils.RunCommandWithRc("lxc-info", "-H", "-n", target.ServiceName, "-s")
+		if rc != 0 {
+			/* if the service didn't previously exist, it's ok for lxc-ls to fail */
+			return "", nil
+		}
+		if strings.TrimSpace(string(out)) != "RUNNING" {
+			return "", nil
+		}
+		m = p.getMount(rootsDir)
+	default:
+		return "", fmt.Errorf("couldn't determine mountpoint for %s (%s)", target.ServiceName, target.ServiceType)
+	}
+
+	if m == nil {
+		return "", nil
+	}
+	return dropHashAlg(m.Digest), nil
+}
+
+// findMount returns any current record of a mount of target @name.
+func (p *PuzzlefsStorage) findMount(name string) *puzzlefsMount {
+	entries, err := os.ReadDir(p.mountsDir())
+	if err != nil {
+		return nil
+	}
+	for _, e := range entries {
+		bytes, err := os.ReadFile(filepath.Join(p.mountsDir(), e.Name()))
+		if err != nil {
+			continue
+		}
+		var m puzzlefsMount
+		if err := json.Unmarshal(bytes, &m); err != nil {
+			continue
+		}
+		if m.ServiceName == name && m.BootId == currentBootId() {
+			return &m
+		}
+	}
+	return nil
+}
+
+func (p *PuzzlefsStorage) SetupTarget(t *Target) error {
+	return setupTargetMount(p, p.scratchPath, t, p.umountRecorded)
+}
+
+// We mount a readonly copy of the fs under $scratch-writes/roots/$target,
+// same as atomfs.
+func (p *PuzzlefsStorage) TargetMountdir(t *Target) (string, error) {
+	return filepath.Join(p.scratchPath, "roots", t.ServiceName), nil
+}
+
+// umountRecorded unmounts @mountpoint, along with the readonly mount
+// under it if it is writeable, and removes the scratch dirs.
+func (p *PuzzlefsStorage) umountRecorded(mountpoint string) error {
+	if err := puzzlefsUmount(mountpoint); err != nil {
+		return err
+	}
+
+	m := p.getMount(mountpoint)
+	p.dropMount(mountpoint)
+	if m == nil || m.Overlay == nil {
+		return nil
+	}
+
+	if err := puzzlefsUmount(m.Overlay.Lower); err != nil {
+		return err
+	}
+	p.dropMount(m.Overlay.Lower)
+	m.Overlay.remove()
+	return nil
+}
+
+func (p *PuzzlefsStorage) TearDownTarget(name string) error {
+	log.Warnf("tearing down %q", name)
+	mp := filepath.Join(p.scratchPath, "roots", name)
+	mounted, err := utils.IsMountpoint(mp)
+	if err != nil {
+		return fmt.Errorf("Failed checking whether %q is mounted: %w", mp, err)
+	}
+	if !mounted {
+		p.dropMount(mp)
+		return nil
+	}
+
+	if err := p.umountRecorded(mp); err != nil {
+		return fmt.Errorf("puzzlefs umount of %q failed: %w", mp, err)
+	}
+	return nil
+}
+
+// A mount record is stale if it is from an earlier boot, or nothing is
+// mounted there any more.  Then so are the overlay dirs it lists.  The
+// hostfs was mounted before the switch to it, so its mountpoint is no
+// longer visible, but its record is kept for MountedByHash.
+func (p *PuzzlefsStorage) StaleMetadata() ([]string, error) {
+	stale := []string{}
+	entries, err := os.ReadDir(p.mountsDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return stale, nil
+		}
+		return nil, err
+	}
+
+	mounts, err := mount.ParseMounts("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		path := filepath.Join(p.mountsDir(), e.Name())
+		bytes, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var m puzzlefsMount
+		if err := json.Unmarshal(bytes, &m); err == nil && m.BootId == currentBootId() {
+			if m.ServiceName == "hostfs" || hasMountUnder(mounts, m.Mountpoint) {
+				continue
+			}
+		}
+		stale = append(stale, path)
+		if m.Overlay == nil {
+			continue
+		}
+		for _, d := range []string{m.Overlay.Lower, m.Overlay.Upper, m.Overlay.Work} {
+			if d != "" && utils.PathExists(d) && !hasMountUnder(mounts, d) {
+				stale = append(stale, d)
+			}
+		}
+	}
+
+	return stale, nil
+}
+
+func (p *PuzzlefsStorage) VerifyTarget(t *Target) error {
+	return verifyOCITarget(p.ociDir(), puzzlefsTag(t), t)
+}
+
+// Import a target's storage from an oci distribution server.  The image
+// must have been built as puzzlefs, for instance using
+// 'stacker build --layer-type puzzlefs'.
+func (p *PuzzlefsStorage) ImportTarget(reg *Registry, src string, target *Target) error {
+	return importOCITarget(reg, p.zotPath, src, target, puzzlefsTag(target))
+}
@@ -0,0 +1,316 @@
+package mosconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/project-machine/mos/pkg/trust"
+)
+
+// The certificate and signature of an install manifest are artifacts
+// whose subject is the install manifest.  Registries which implement
+// the referrers API list them under /v2/<name>/referrers/<digest>.
+// For those which do not, the OCI 1.1 referrers tag schema is used: the
+// pusher keeps an image index of them tagged <alg>-<digest>, e.g.
+// sha256-d63dbe48...  When pushing, we know the registry has the
+// referrers API if it answers with an OCI-Subject header, and otherwise
+// also update the tag.  When fetching, we fall back to the tag if the
+// registry has no referrers API or lists nothing.  RegistryOptions
+// .ReferrersTag makes us use only the tag.
+
+// referrersTagName returns the tag under which the referrers of @d are
+// kept by the referrers tag schema.
+func referrersTagName(d digest.Digest) string {
+	return fmt.Sprintf("%s-%s", d.Algorithm(), d.Encoded())
+}
+
+// filterReferrers returns those of @descs which are of @artifactType.
+func filterReferrers(descs []ispec.Descriptor, artifactType string) []ispec.Descriptor {
+	ret := []ispec.Descriptor{}
+	for _, d := range descs {
+		if d.ArtifactType == artifactType {
+			ret = append(ret, d)
+		}
+	}
+	return ret
+}
+
+// referrersFromApi returns the referrers of @disturl of @artifactType
+// from the referrers API.  It returns false if the registry does not
+// have the referrers API.
+func (r *DistRepo) referrersFromApi(disturl DistUrl, artifactType string) (ispec.Index, bool, error) {
+	idx := ispec.Index{}
+	u := fmt.Sprintf("%s/referrers/%s?artifactType=%s", disturl.name, disturl.mDigest, url.QueryEscape(artifactType))
+	resp, err := r.get(u, pullScope(disturl.name))
+	if err != nil {
+		return idx, false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusBadRequest, http.StatusMethodNotAllowed:
+		log.Debugf("No referrers API at %s (%d), using the referrers tag", r.addr, resp.StatusCode)
+		return idx, false, nil
+	default:
+		return idx, false, errors.Errorf("Bad status code connecting to %q: %d", r.apiUrl(u), resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&idx); err != nil {
+		return idx, false, errors.Wrapf(err, "Failed parsing the list of referrers")
+	}
+	// The registry need not have applied the filter.
+	idx.Manifests = filterReferrers(idx.Manifests, artifactType)
+	return idx, true, nil
+}
+
+// referrersIndex fetches the referrers tag index of @subject.  If there
+// is none yet, it returns an empty one.
+func (disturl *DistUrl) referrersIndex(subject digest.Digest) (ispec.Index, error) {
+	idx := ispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ispec.MediaTypeImageIndex,
+	}
+	u := fmt.Sprintf("%s/manifests/%s", disturl.name, referrersTagName(subject))
+	resp, err := disturl.repo.get(u, pullScope(disturl.name), ispec.MediaTypeImageIndex)
+	if err != nil {
+		return idx, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return idx, nil
+	default:
+		return idx, errors.Errorf("Bad status code connecting to %q: %d", disturl.repo.apiUrl(u), resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&idx); err != nil {
+		return idx, errors.Wrapf(err, "Failed parsing referrers tag %s", referrersTagName(subject))
+	}
+	return idx, nil
+}
+
+// referrersFromTag returns the referrers of @disturl of @artifactType
+// from the referrers tag.
+func (r *DistRepo) referrersFromTag(disturl DistUrl, artifactType string) (ispec.Index, error) {
+	d, err := digest.Parse(disturl.mDigest)
+	if err != nil {
+		return ispec.Index{}, errors.Wrapf(err, "Bad manifest digest %q", disturl.mDigest)
+	}
+	disturl.repo = r
+	idx, err := disturl.referrersIndex(d)
+	if err != nil {
+		return idx, err
+	}
+	idx.Manifests = filterReferrers(idx.Manifests, artifactType)
+	return idx, nil
+}
+
+// putReferrer uploads the artifact manifest @b, described by @desc,
+// whose subject is @subject, and adds it to the referrers tag unless the
+// registry lists it under the referrers API.
+func (disturl *DistUrl) putReferrer(subject digest.Digest, desc ispec.Descriptor, b []byte) error {
+	hdrs, err := disturl.sendManifest(desc.Digest.String(), b, ispec.MediaTypeImageManifest)
+	if err != nil {
+		return err
+	}
+	if !disturl.repo.referrersTag && hdrs.Get("OCI-Subject") != "" {
+		return nil
+	}
+
+	idx, err := disturl.referrersIndex(subject)
+	if err != nil {
+		return err
+	}
+	for _, d := range idx.Manifests {
+		if d.Digest == desc.Digest {
+			return nil
+		}
+	}
+	idx.Manifests = append(idx.Manifests, desc)
+	ib, err := json.Marshal(&idx)
+	if err != nil {
+		return errors.Wrapf(err, "Failed marshalling referrers index")
+	}
+	log.Debugf("Adding %s to referrers tag %s", desc.Digest, referrersTagName(subject))
+	return disturl.putManifest(referrersTagName(subject), ib, ispec.MediaTypeImageIndex)
+}
+
+// An install manifest may have several certificate and signature
+// referrers, for instance while the manifest key is being rotated and
+// it is signed with both the old and the new one.  Anyone who can push
+// to the registry can also add referrers, so we must not trust any
+// one of them just because it is there.  Instead we first drop the
+// certificates which our CA did not issue, and then try each signature
+// with each of the certificates left, and use the first pair which
+// verifies.  Junk referrers cost a fetch each, which maxReferrerSize
+// bounds, but cannot hide a good pair.
+
+// maxReferrerSize is the most we will fetch of a certificate, signature
+// or revocation list referrer, and of the artifact manifest naming it.
+const maxReferrerSize = 1024 * 1024
+
+// fetchReferrerFunc writes the contents of referrer @d to @dest, and
+// returns its annotations.  Neither may be over maxReferrerSize.
+type fetchReferrerFunc func(d ispec.Descriptor, dest string) (map[string]string, error)
+
+// pickSignature fetches a certificate from @certs and a signature from
+// @sigs, the referrers of the install manifest at is.FilePath, to
+// is.CertPath and is.SignPath, and sets is.SignAlg from the signature's
+// annotation.  If vopts.CaPath is set, each pair is tried until one
+// verifies, also checking is.CRLPaths.  Otherwise the first of each is
+// used.
+func (is *InstallSource) pickSignature(certs, sigs []ispec.Descriptor, vopts trust.VerifyOpts, fetch fetchReferrerFunc) error {
+	if len(certs) == 0 {
+		return errors.Errorf("No certificate found for the install manifest")
+	}
+	if len(sigs) == 0 {
+		return errors.Errorf("No signature found for the install manifest")
+	}
+
+	if vopts.CaPath == "" {
+		if len(certs) > 1 || len(sigs) > 1 {
+			log.Warnf("Multiple signatures found and no CA to check them with, using first one")
+		}
+		if _, err := fetch(certs[0], is.CertPath); err != nil {
+			return errors.Wrapf(err, "Error fetching the certificate")
+		}
+		annotations, err := fetch(sigs[0], is.SignPath)
+		if err != nil {
+			return errors.Wrapf(err, "Error fetching the signature")
+		}
+		is.SignAlg = annotations[sigAlgAnnotation]
+		return nil
+	}
+
+	contents, err := os.ReadFile(is.FilePath)
+	if err != nil {
+		return errors.Wrapf(err, "Failed reading install manifest")
+	}
+
+	var failures []string
+	certFiles := []candidateFile{}
+	for _, cert := range is.fetchCandidates(certs, "cert", fetch, &failures) {
+		if _, err := trust.VerifyCertFile(cert.path, is.verifyOpts(vopts)); err != nil {
+			log.Warnf("Ignoring certificate %s: %v", cert.desc.Digest, err)
+			failures = append(failures, fmt.Sprintf("certificate %s: %v", cert.desc.Digest, err))
+			os.Remove(cert.path)
+			continue
+		}
+		certFiles = append(certFiles, cert)
+	}
+	defer func() {
+		for _, c := range certFiles {
+			os.Remove(c.path)
+		}
+	}()
+	if len(certFiles) == 0 {
+		return errors.Errorf("No certificate of the install manifest verifies:\n  %s", strings.Join(failures, "\n  "))
+	}
+
+	// Fetch the signatures one at a time, as only one is wanted.
+	for i, d := range sigs {
+		sig, err := is.fetchCandidate(d, "sig", i, fetch)
+		if err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+		for _, cert := range certFiles {
+			err := trust.VerifyManifestOpts(contents, sig.path, cert.path, sig.alg, is.verifyOpts(vopts))
+			if err != nil {
+				msg := fmt.Sprintf("certificate %s with signature %s: %v", cert.desc.Digest, sig.desc.Digest, err)
+				log.Warnf("Unverifiable %s", msg)
+				failures = append(failures, msg)
+				continue
+			}
+			if len(certs) > 1 || len(sigs) > 1 {
+				log.Infof("Using certificate %s with signature %s", cert.desc.Digest, sig.desc.Digest)
+			}
+			if err := os.Rename(cert.path, is.CertPath); err != nil {
+				os.Remove(sig.path)
+				return errors.Wrapf(err, "Failed saving certificate")
+			}
+			if err := os.Rename(sig.path, is.SignPath); err != nil {
+				return errors.Wrapf(err, "Failed saving signature")
+			}
+			is.SignAlg = sig.alg
+			return nil
+		}
+		os.Remove(sig.path)
+	}
+
+	return errors.Errorf("No certificate and signature of the install manifest verify:\n  %s", strings.Join(failures, "\n  "))
+}
+
+// candidateFile is a referrer fetched to @path.  @alg is the
+// signature algorithm, if it is a signature which names one.
+type candidateFile struct {
+	desc ispec.Descriptor
+	path string
+	alg  string
+}
+
+// fetchCandidate fetches @d, the @i'th referrer of its @kind, to a file
+// named after them.
+func (is *InstallSource) fetchCandidate(d ispec.Descriptor, kind string, i int, fetch fetchReferrerFunc) (candidateFile, error) {
+	p := filepath.Join(is.Basedir, fmt.Sprintf("%s-%d", kind, i))
+	annotations, err := fetch(d, p)
+	if err != nil {
+		log.Warnf("Failed fetching %s %s: %v", kind, d.Digest, err)
+		os.Remove(p)
+		return candidateFile{}, errors.Errorf("%s %s: %v", kind, d.Digest, err)
+	}
+	return candidateFile{desc: d, path: p, alg: annotations[sigAlgAnnotation]}, nil
+}
+
+// fetchCandidates fetches each of @descs to a file named after @kind,
+// and returns those fetched.  Failures are appended to @failures.
+func (is *InstallSource) fetchCandidates(descs []ispec.Descriptor, kind string, fetch fetchReferrerFunc, failures *[]string) []candidateFile {
+	files := make([]candidateFile, 0, len(descs))
+	for i, d := range descs {
+		c, err := is.fetchCandidate(d, kind, i, fetch)
+		if err != nil {
+			*failures = append(*failures, err.Error())
+			continue
+		}
+		files = append(files, c)
+	}
+	return files
+}
+
+// fetchCRLs fetches each of the CRL referrers @descs, and adds those
+// issued by the CA at @capath to is.CRLPaths.  Anyone can add a
+// referrer, so those which are not are dropped.  If @capath is "", all
+// are kept, to be checked by whoever installs from us.
+func (is *InstallSource) fetchCRLs(descs []ispec.Descriptor, capath string, fetch fetchReferrerFunc) {
+	var failures []string
+	for _, c := range is.fetchCandidates(descs, "crl", fetch, &failures) {
+		if capath == "" {
+			is.CRLPaths = append(is.CRLPaths, c.path)
+			continue
+		}
+		if err := trust.CheckCRL(c.path, capath); err != nil {
+			log.Warnf("Ignoring revocation list %s: %v", c.desc.Digest, err)
+			os.Remove(c.path)
+			continue
+		}
+		is.CRLPaths = append(is.CRLPaths, c.path)
+	}
+}
+
+// verifyOpts returns @vopts with the CRLs fetched with the install
+// manifest added.
+func (is *InstallSource) verifyOpts(vopts trust.VerifyOpts) trust.VerifyOpts {
+	vopts.CRLPaths = append(append([]string{}, vopts.CRLPaths...), is.CRLPaths...)
+	return vopts
+}
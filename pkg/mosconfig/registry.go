@@ -0,0 +1,453 @@
+package mosconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// Registries are reached over https, verified against the system CAs
+// plus any in RegistryOptions.CAFile.  Plain http is only used for
+// loopback addresses, for registries listed in Insecure, or when the url
+// explicitly starts with http://.
+//
+// Credentials are taken from RegistryOptions, or else from the docker
+// config.json.  They are sent as basic auth, or exchanged for a bearer
+// token if the registry asks for one, following the distribution spec
+// token flow.
+
+// RegistryOptions configures how we talk to OCI registries.
+type RegistryOptions struct {
+	CAFile   string   // PEM bundle of extra CAs to trust
+	Insecure []string // host[:port]s to reach over plain http
+
+	Username string
+	Password string
+	Token    string // bearer token, used as is
+
+	// docker config.json to read credentials from.  If "", then
+	// $DOCKER_CONFIG/config.json or ~/.docker/config.json.
+	AuthFile string
+
+	// Registries to fetch from, in order, before the one named in
+	// the url.  See mirrors.go.
+	Mirrors []string
+
+	// How long to wait to connect to a registry, and then for it to
+	// start answering a request.  0 for DefaultRegistryTimeout.
+	Timeout time.Duration
+
+	// How many times to retry a request to a registry which fails to
+	// connect or returns a server error.  0 for
+	// DefaultRegistryRetries.
+	Retries int
+
+	// Keep the referrers of a manifest in the referrers tag rather
+	// than relying on the referrers API.  See referrers.go.
+	ReferrersTag bool
+}
+
+// RegistryFlags are the global flags which mosb and mosctl take to set
+// RegistryOptions.
+var RegistryFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "registry-ca",
+		Usage: "PEM file of CA certificates to trust for registries, besides the system ones",
+	},
+	cli.StringFlag{
+		Name:  "registry-auth-file",
+		Usage: "docker config.json with registry credentials (default $DOCKER_CONFIG/config.json or ~/.docker/config.json)",
+	},
+	cli.StringSliceFlag{
+		Name:  "insecure-registry",
+		Usage: "address:port of a registry to reach over plain http.  May be given more than once",
+	},
+	cli.BoolFlag{
+		Name:  "referrers-tag",
+		Usage: "Use the referrers tag schema for signatures, for registries without the referrers API",
+	},
+}
+
+// RegistryOptionsFromContext returns the RegistryOptions set by
+// RegistryFlags.
+func RegistryOptionsFromContext(c *cli.Context) RegistryOptions {
+	return RegistryOptions{
+		CAFile:   c.GlobalString("registry-ca"),
+		AuthFile: c.GlobalString("registry-auth-file"),
+		Insecure: c.GlobalStringSlice("insecure-registry"),
+
+		ReferrersTag: c.GlobalBool("referrers-tag"),
+	}
+}
+
+// A Registry reaches OCI registries with one set of RegistryOptions.
+// Each Mos has its own, built from MosOptions.Registry and
+// $config/registries.yaml.  A nil *Registry uses the default options.
+type Registry struct {
+	opts   RegistryOptions
+	client *http.Client
+}
+
+// NewRegistry returns a Registry using @opts.
+func NewRegistry(opts RegistryOptions) (*Registry, error) {
+	client, err := newRegistryClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Registry{opts: opts, client: client}, nil
+}
+
+// RegistryFromContext returns a Registry using the options set by
+// RegistryFlags.
+func RegistryFromContext(c *cli.Context) (*Registry, error) {
+	return NewRegistry(RegistryOptionsFromContext(c))
+}
+
+// orDefault returns @reg, or if it is nil, a Registry with the default
+// options.
+func (reg *Registry) orDefault() *Registry {
+	if reg != nil {
+		return reg
+	}
+	client, _ := newRegistryClient(RegistryOptions{})
+	return &Registry{client: client}
+}
+
+func newRegistryClient(opts RegistryOptions) (*http.Client, error) {
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = DefaultRegistryTimeout
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = timeout
+	transport.ResponseHeaderTimeout = timeout
+	if opts.CAFile == "" {
+		return &http.Client{Transport: transport}, nil
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	pem, err := os.ReadFile(opts.CAFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed reading CA bundle %q", opts.CAFile)
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("No certificates found in %q", opts.CAFile)
+	}
+
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &http.Client{Transport: transport}, nil
+}
+
+// registryScheme returns the scheme to use for registry @addr, given
+// the url @rawUrl it came from.
+func registryScheme(rawUrl, addr string, opts RegistryOptions) string {
+	switch {
+	case strings.HasPrefix(rawUrl, "http://"):
+		return "http"
+	case strings.HasPrefix(rawUrl, "https://"):
+		return "https"
+	}
+	for _, i := range opts.Insecure {
+		if i == addr {
+			return "http"
+		}
+	}
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	if host == "localhost" {
+		return "http"
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return "http"
+	}
+	return "https"
+}
+
+// registryCreds returns the username and password to use for @addr.
+func registryCreds(addr string, opts RegistryOptions) (string, string) {
+	if opts.Username != "" {
+		return opts.Username, opts.Password
+	}
+
+	path := opts.AuthFile
+	if path == "" {
+		dir := os.Getenv("DOCKER_CONFIG")
+		if dir == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return "", ""
+			}
+			dir = filepath.Join(home, ".docker")
+		}
+		path = filepath.Join(dir, "config.json")
+	}
+
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) || opts.AuthFile != "" {
+			log.Warnf("Failed reading registry credentials from %q: %v", path, err)
+		}
+		return "", ""
+	}
+
+	var cfg struct {
+		Auths map[string]struct {
+			Auth     string `json:"auth"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(bytes, &cfg); err != nil {
+		log.Warnf("Failed parsing registry credentials in %q: %v", path, err)
+		return "", ""
+	}
+
+	for k, a := range cfg.Auths {
+		k = strings.TrimSuffix(dropURLPrefix(k), "/")
+		if i := strings.Index(k, "/"); i != -1 {
+			k = k[:i]
+		}
+		if k != addr {
+			continue
+		}
+		if a.Username != "" {
+			return a.Username, a.Password
+		}
+		dec, err := base64.StdEncoding.DecodeString(a.Auth)
+		if err != nil {
+			log.Warnf("Bad auth entry for %s in %q", k, path)
+			return "", ""
+		}
+		user, pass, _ := strings.Cut(string(dec), ":")
+		return user, pass
+	}
+	return "", ""
+}
+
+// registryAuth holds what we have learned about authenticating to one
+// registry.
+type registryAuth struct {
+	sync.Mutex
+	username string
+	password string
+	token    string            // static bearer token
+	tokens   map[string]string // bearer tokens by scope
+	basic    bool              // registry asked for basic auth
+}
+
+// authorize adds the credentials we know are needed to @req.
+func (a *registryAuth) authorize(req *http.Request, scope string) {
+	a.Lock()
+	defer a.Unlock()
+	switch {
+	case a.token != "":
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	case a.tokens[scope] != "":
+		req.Header.Set("Authorization", "Bearer "+a.tokens[scope])
+	case a.basic && a.username != "":
+		req.SetBasicAuth(a.username, a.password)
+	}
+}
+
+// parseChallenge parses a WWW-Authenticate header into its scheme and
+// parameters.
+func parseChallenge(h string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(h), " ")
+	params := map[string]string{}
+	for rest != "" {
+		rest = strings.TrimLeft(rest, ", ")
+		k, v, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		if strings.HasPrefix(v, "\"") {
+			end := strings.Index(v[1:], "\"")
+			if end == -1 {
+				params[strings.ToLower(k)] = v[1:]
+				break
+			}
+			params[strings.ToLower(k)] = v[1 : end+1]
+			rest = v[end+2:]
+		} else {
+			val, r, _ := strings.Cut(v, ",")
+			params[strings.ToLower(k)] = val
+			rest = r
+		}
+	}
+	return strings.ToLower(scheme), params
+}
+
+// answerChallenge handles a 401 with WWW-Authenticate header @h for a
+// request needing @scope.  It returns false if there is nothing more we
+// can try.
+func (a *registryAuth) answerChallenge(client *http.Client, h, scope string) (bool, error) {
+	scheme, params := parseChallenge(h)
+	a.Lock()
+	defer a.Unlock()
+
+	switch scheme {
+	case "basic":
+		if a.basic || a.username == "" {
+			return false, nil
+		}
+		a.basic = true
+		return true, nil
+	case "bearer":
+		if a.token != "" || a.tokens[scope] != "" {
+			return false, nil
+		}
+		realm := params["realm"]
+		if realm == "" {
+			return false, errors.Errorf("No realm in bearer challenge %q", h)
+		}
+		u, err := url.Parse(realm)
+		if err != nil {
+			return false, errors.Wrapf(err, "Bad realm in bearer challenge %q", h)
+		}
+		q := u.Query()
+		if s := params["service"]; s != "" {
+			q.Set("service", s)
+		}
+		// The token is kept under the scope we need, but is
+		// requested for the one the registry asked for.
+		if s := params["scope"]; s != "" {
+			q.Set("scope", s)
+		} else if scope != "" {
+			q.Set("scope", scope)
+		}
+		u.RawQuery = q.Encode()
+
+		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return false, err
+		}
+		if a.username != "" {
+			req.SetBasicAuth(a.username, a.password)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return false, errors.Wrapf(err, "Failed requesting token from %q", realm)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return false, errors.Errorf("Token request to %q failed: %s", realm, resp.Status)
+		}
+		var tok struct {
+			Token       string `json:"token"`
+			AccessToken string `json:"access_token"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+			return false, errors.Wrapf(err, "Failed parsing token from %q", realm)
+		}
+		if tok.Token == "" {
+			tok.Token = tok.AccessToken
+		}
+		if tok.Token == "" {
+			return false, errors.Errorf("No token received from %q", realm)
+		}
+		if a.tokens == nil {
+			a.tokens = map[string]string{}
+		}
+		a.tokens[scope] = tok.Token
+		return true, nil
+	}
+	return false, nil
+}
+
+// registryConnError is a failure to reach a registry, which is worth
+// retrying.
+type registryConnError struct {
+	err error
+}
+
+func (e *registryConnError) Error() string {
+	return e.err.Error()
+}
+
+func (e *registryConnError) Unwrap() error {
+	return e.err
+}
+
+// doAuth sends @req to the registry, authenticating if asked to.  @scope
+// is the token scope the request needs, e.g. repository:foo/bar:pull.
+func (r *DistRepo) doAuth(req *http.Request, scope string) (*http.Response, error) {
+	for {
+		r.auth.authorize(req, scope)
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return nil, &registryConnError{errors.Wrapf(err, "Failed connecting to %q", req.URL.Redacted())}
+		}
+		if resp.StatusCode != http.StatusUnauthorized {
+			return resp, nil
+		}
+
+		h := resp.Header.Get("WWW-Authenticate")
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		retry, err := r.auth.answerChallenge(r.client, h, scope)
+		if err != nil {
+			return nil, err
+		}
+		if !retry {
+			return nil, errors.Errorf("Not authorized for %q", req.URL.Redacted())
+		}
+
+		if req.Body != nil {
+			if req.GetBody == nil {
+				return nil, errors.Errorf("Cannot resend request body to %q", req.URL.Redacted())
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+		req.Header.Del("Authorization")
+	}
+}
+
+// get GETs @path (under /v2/) from the registry.
+func (r *DistRepo) get(path, scope string, accept ...string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, r.apiUrl(path), nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range accept {
+		req.Header.Add("Accept", a)
+	}
+	return r.do(req, scope)
+}
+
+// apiUrl returns the url for @path under /v2/.
+func (r *DistRepo) apiUrl(path string) string {
+	return fmt.Sprintf("%s://%s/v2/%s", r.scheme, r.addr, path)
+}
+
+func pullScope(name string) string {
+	return fmt.Sprintf("repository:%s:pull", name)
+}
+
+func pushScope(name string) string {
+	return fmt.Sprintf("repository:%s:pull,push", name)
+}
@@ -0,0 +1,256 @@
+package mosconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/apex/log"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/pkg/errors"
+)
+
+// Rollback reverts the system manifest to a previous revision in
+// $config/manifest.git.  If @rev is not "", it names the revision to
+// return to.  Otherwise we go back @steps revisions from the current
+// one.  The install manifests from the old revision are re-verified
+// against our manifest CA, and all the layers they reference must
+// still be present in our storage.  Those which the current revision
+// does not use must not have a lower security version than we have
+// accepted, unless our downgrade token authorizes it.  The old manifest
+// is then committed as a new revision, and any services which changed
+// are restarted.
+func (mos *Mos) Rollback(rev string, steps int) error {
+	if rev == "" && steps < 1 {
+		return errors.Errorf("Must roll back at least one revision")
+	}
+
+	manifest, err := mos.CurrentManifest()
+	if err != nil {
+		return errors.Wrapf(err, "Failed opening manifest")
+	}
+
+	repo, err := mos.openManifestRepo()
+	if err != nil {
+		return err
+	}
+
+	c, err := resolveManifestCommit(repo, rev, steps)
+	if err != nil {
+		return err
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return errors.Wrapf(err, "Failed finding manifest HEAD")
+	}
+	if head.Hash() == c.Hash {
+		return errors.Errorf("Manifest revision %s is already the current one", c.Hash)
+	}
+
+	tmpdir, err := os.MkdirTemp("", "rollback")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	oldmanifest, err := mos.verifiedManifestAt(c, tmpdir)
+	if err != nil {
+		return err
+	}
+	if err := mos.checkRollbackSecurity(manifest, oldmanifest, tmpdir); err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("Roll back to revision %s", c.Hash)
+	if err := mos.updateManifest(manifest, oldmanifest, tmpdir, msg); err != nil {
+		return errors.Wrapf(err, "Failed committing manifest revision %s", c.Hash)
+	}
+
+	if _, err := mos.activateChanged(manifest, oldmanifest, false); err != nil {
+		return err
+	}
+
+	if targetChanged(manifest, oldmanifest, "hostfs") {
+		newHead, err := mos.manifestHead()
+		if err != nil {
+			return err
+		}
+		if err := mos.stageHostfs(head.Hash(), newHead); err != nil {
+			return errors.Wrapf(err, "Failed staging hostfs")
+		}
+	}
+
+	return nil
+}
+
+// verifiedManifestAt extracts the system manifest at commit @c into
+// @dir, and verifies each of its install manifests against our manifest
+// CA, as well as the presence and hashes of their layers.
+func (mos *Mos) verifiedManifestAt(c *object.Commit, dir string) (*SysManifest, error) {
+	sm, err := extractManifestCommit(c, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := make(map[string]InstallFile)
+	for i, t := range sm.SysTargets {
+		s, err := mos.readInstallManifest(dir, manifests, t.Source)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed verifying %s from manifest revision %s", t.Source, c.Hash)
+		}
+		raw, ok := findTarget(s, t.Name)
+		if !ok {
+			return nil, errors.Errorf("target %s not found in %s", t.Name, t.Source)
+		}
+		sm.SysTargets[i].raw = raw
+	}
+
+	return sm, nil
+}
+
+// checkRollbackSecurity refuses to roll back from @cur to @next, whose
+// install manifests are in @dir, if that would bring back an install
+// manifest with a lower security version than we have accepted, unless
+// our downgrade token authorizes it.
+func (mos *Mos) checkRollbackSecurity(cur, next *SysManifest, dir string) error {
+	min, err := mos.SecurityVersion()
+	if err != nil {
+		return err
+	}
+	vopts, err := mos.fetchVerifyOpts()
+	if err != nil {
+		return err
+	}
+
+	// Install manifests which are still in use were checked when
+	// they were installed.
+	checked := map[string]bool{}
+	for _, t := range cur.SysTargets {
+		checked[t.Source] = true
+	}
+	for _, t := range next.SysTargets {
+		if checked[t.Source] {
+			continue
+		}
+		checked[t.Source] = true
+
+		contents, err := os.ReadFile(filepath.Join(dir, t.Source))
+		if err != nil {
+			return errors.Wrapf(err, "Failed reading %s", t.Source)
+		}
+		var manifest InstallFile
+		if err := json.Unmarshal(contents, &manifest); err != nil {
+			return errors.Wrapf(err, "Failed parsing %s", t.Source)
+		}
+		is := InstallSource{MinSecurityVersion: min, DowngradeToken: mos.opts.DowngradeToken}
+		if err := is.checkSecurityVersion(manifest, contents, vopts); err != nil {
+			return errors.Wrapf(err, "Cannot roll back to %s", t.Source)
+		}
+	}
+	return nil
+}
+
+// activateChanged stops any services which were in @prev but are not
+// in @next, and (re)starts those which are new or changed in @next.
+// If @runningOnly is set, then only services which are currently
+// running are touched, and the rest pick up their new version when
+// next activated.  Changes to hostfs and bootkit only take effect after
+// a reboot.  The names of the targets which were stopped or started are
+// returned, even on failure, so that the caller can undo the changes.
+func (mos *Mos) activateChanged(prev, next *SysManifest, runningOnly bool) ([]string, error) {
+	touched := []string{}
+
+	nextTargets := SysTargets(next.SysTargets)
+	for _, t := range prev.SysTargets {
+		if nextTargets.Contains(t) || t.Name == "hostfs" || t.Name == "bootkit" {
+			continue
+		}
+		if runningOnly && !mos.isRunning(t.raw) {
+			continue
+		}
+		log.Infof("Stopping removed target %q", t.Name)
+		touched = append(touched, t.Name)
+		if err := mos.StopTarget(t.raw); err != nil {
+			return touched, errors.Wrapf(err, "Failed stopping %s", t.Name)
+		}
+	}
+
+	// Re-read the newly committed manifest before starting anything
+	mos.Manifest = nil
+
+	for _, t := range next.SysTargets {
+		p, err := prev.GetTarget(t.Name)
+		if err == nil && reflect.DeepEqual(*p.raw, *t.raw) {
+			continue
+		}
+		if t.Name == "hostfs" || t.Name == "bootkit" {
+			log.Warnf("%s has changed, please reboot to activate it", t.Name)
+			continue
+		}
+		if runningOnly && (err != nil || !mos.isRunning(p.raw)) {
+			continue
+		}
+		if mos.IsDeactivated(t.Name) {
+			log.Infof("Not starting deactivated target %s", t.Name)
+			continue
+		}
+		touched = append(touched, t.Name)
+		if err := mos.Activate(t.Name); err != nil {
+			return touched, errors.Wrapf(err, "Failed starting %s", t.Name)
+		}
+	}
+
+	return touched, nil
+}
+
+// restoreServices undoes activateChanged(@prev, @next) after the
+// manifest has been switched back to @prev.  Each target in @touched
+// which is in @prev is re-activated, and any which is only in @next
+// is stopped.
+func (mos *Mos) restoreServices(prev, next *SysManifest, touched []string) error {
+	var ret error
+	for _, name := range touched {
+		if _, err := prev.GetTarget(name); err == nil {
+			continue
+		}
+		t, err := next.GetTarget(name)
+		if err != nil {
+			continue
+		}
+		if mos.Manifest == nil {
+			// StopTarget needs a manifest for the network accounting
+			mos.Manifest = next
+		}
+		if err := mos.StopTarget(t.raw); err != nil {
+			log.Warnf("Failed stopping %s: %v", name, err)
+			ret = errors.Wrapf(err, "Failed stopping %s", name)
+		}
+	}
+
+	mos.Manifest = nil
+
+	for _, name := range touched {
+		if _, err := prev.GetTarget(name); err != nil {
+			continue
+		}
+		if err := mos.Activate(name); err != nil {
+			log.Warnf("Failed restarting %s: %v", name, err)
+			ret = errors.Wrapf(err, "Failed restarting %s", name)
+		}
+	}
+
+	return ret
+}
+
+// isRunning reports whether any version of @t is currently running.
+func (mos *Mos) isRunning(t *Target) bool {
+	hash, err := mos.RunningVersion(t)
+	if err != nil {
+		log.Warnf("Failed checking whether %s is running: %v", t.ServiceName, err)
+		return false
+	}
+	return hash != ""
+}
@@ -0,0 +1,116 @@
+package mosconfig
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"github.com/project-machine/mos/pkg/utils"
+)
+
+// RunningTarget records which manifest entry a running service was
+// started from.  The mounted layer hash alone cannot tell us that, so
+// Activate writes one of these under $scratch-writes/running/ once the
+// service is up, and StopTarget removes it.
+type RunningTarget struct {
+	ServiceName string    `json:"service_name"`
+	Version     string    `json:"version"`
+	Digest      string    `json:"digest"`
+	LayerHash   string    `json:"layer_hash"` // MountedByHash at start, if known
+	BootId      string    `json:"boot_id"`
+	Started     time.Time `json:"started"`
+}
+
+func (mos *Mos) runningPath(name string) string {
+	return filepath.Join(mos.opts.ScratchWrites, "running", name+".json")
+}
+
+// The record only means anything during the boot in which it was
+// written, in case scratch-writes survives a reboot.
+func currentBootId() string {
+	b, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// recordRunning notes that @t is now running.
+func (mos *Mos) recordRunning(t *Target) error {
+	hash, err := mos.storage.MountedByHash(t)
+	if err != nil {
+		log.Warnf("Failed finding running layer for %s: %v", t.ServiceName, err)
+		hash = ""
+	}
+
+	r := RunningTarget{
+		ServiceName: t.ServiceName,
+		Version:     t.Version,
+		Digest:      t.Digest,
+		LayerHash:   hash,
+		BootId:      currentBootId(),
+		Started:     time.Now(),
+	}
+	bytes, err := json.Marshal(&r)
+	if err != nil {
+		return errors.Wrapf(err, "Failed marshalling running record for %s", t.ServiceName)
+	}
+
+	p := mos.runningPath(t.ServiceName)
+	if err := utils.EnsureDir(filepath.Dir(p)); err != nil {
+		return errors.Wrapf(err, "Failed creating %q", filepath.Dir(p))
+	}
+	if err := os.WriteFile(p, bytes, 0644); err != nil {
+		return errors.Wrapf(err, "Failed writing %q", p)
+	}
+	return nil
+}
+
+func (mos *Mos) clearRunning(name string) {
+	p := mos.runningPath(name)
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Failed removing %q: %v", p, err)
+	}
+}
+
+// RunningTarget returns the record of what @t was started from, or nil
+// if @t is not running.  If it is running but there is no valid record,
+// for instance because it was started by an older mosctl, then only
+// LayerHash is filled in.
+func (mos *Mos) RunningTarget(t *Target) (*RunningTarget, error) {
+	hash, err := mos.storage.MountedByHash(t)
+	if err != nil {
+		return nil, err
+	}
+	if hash == "" {
+		return nil, nil
+	}
+
+	unknown := &RunningTarget{ServiceName: t.ServiceName, LayerHash: hash}
+
+	bytes, err := os.ReadFile(mos.runningPath(t.ServiceName))
+	if err != nil {
+		return unknown, nil
+	}
+	var r RunningTarget
+	if err := json.Unmarshal(bytes, &r); err != nil {
+		log.Warnf("Ignoring corrupt running record for %s: %v", t.ServiceName, err)
+		return unknown, nil
+	}
+	if r.BootId != currentBootId() || (r.LayerHash != "" && r.LayerHash != hash) {
+		log.Debugf("Ignoring stale running record for %s", t.ServiceName)
+		return unknown, nil
+	}
+	r.LayerHash = hash
+
+	return &r, nil
+}
+
+// Matches reports whether the running service was started from @t.
+func (r *RunningTarget) Matches(t *Target) bool {
+	return r != nil && r.Digest != "" && r.Digest == t.Digest && r.Version == t.Version
+}
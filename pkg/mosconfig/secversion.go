@@ -0,0 +1,282 @@
+package mosconfig
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"github.com/project-machine/mos/pkg/trust"
+	"github.com/urfave/cli"
+)
+
+// Install manifests carry a security_version, which the publisher
+// raises whenever an update fixes a security problem.  A host records
+// the highest security version it has installed in
+// $config/security-version, and in a TPM NV counter if it was
+// provisioned with one (see pkg/trust/secversion.go).  A newly fetched
+// manifest with a lower security version is refused, so that an older
+// but validly signed manifest cannot bring back a vulnerable service.
+// If that really is wanted, the manifest's publisher can authorize it
+// with a downgrade token.  A manifest may not raise the security version
+// by more than trust.MaxSecurityVersionStep.  Rolling back to an earlier revision of the
+// system manifest is checked the same way: any install manifest it
+// brings back must not have a lower security version, or must come
+// with a downgrade token.
+
+// securityVersionFile keeps the security version under the config
+// directory.
+const securityVersionFile = "security-version"
+
+// A DowngradeToken authorizes installing one install manifest whose
+// security version is lower than a host has accepted.  Its grant is
+// signed, as a manifest is, by a key certified by the manifest CA.
+type DowngradeToken struct {
+	Grant     []byte `json:"grant"` // DowngradeGrant, as json
+	Signature []byte `json:"signature"`
+	SignAlg   string `json:"signature_algorithm"`
+	Cert      string `json:"cert"` // PEM
+}
+
+// DowngradeGrant names the install manifest a DowngradeToken is for.
+type DowngradeGrant struct {
+	Manifest        string `json:"manifest"` // sha256 of the install.json
+	SecurityVersion uint64 `json:"security_version"`
+}
+
+// SecurityVersion returns the highest security version of install
+// manifest which this host has accepted.
+func (mos *Mos) SecurityVersion() (uint64, error) {
+	return readSecurityVersion(mos.opts.ConfigDir)
+}
+
+// readSecurityVersion returns the higher of the security versions kept
+// under @configDir and in the TPM.
+func readSecurityVersion(configDir string) (uint64, error) {
+	var v uint64
+	p := filepath.Join(configDir, securityVersionFile)
+	b, err := os.ReadFile(p)
+	if err == nil {
+		v, err = strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+		if err != nil {
+			return 0, errors.Wrapf(err, "Failed parsing %s", p)
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, errors.Wrapf(err, "Failed reading %s", p)
+	}
+
+	tv, ok, err := trust.TPMSecurityVersion()
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed reading security version from TPM")
+	}
+	if ok && tv > v {
+		v = tv
+	}
+	return v, nil
+}
+
+// recordSecurityVersion raises the security version kept in the TPM and
+// under @configDir to @v, if it is lower.  The TPM goes first, so that
+// the file is left alone if it cannot be raised.
+func recordSecurityVersion(configDir string, v uint64) error {
+	cur, err := readSecurityVersion(configDir)
+	if err != nil {
+		return err
+	}
+	if cur > v {
+		v = cur
+	}
+
+	if err := trust.RaiseTPMSecurityVersion(v); err != nil {
+		return err
+	}
+
+	p := filepath.Join(configDir, securityVersionFile)
+	if err := os.WriteFile(p+".tmp", []byte(fmt.Sprintf("%d\n", v)), 0644); err != nil {
+		return errors.Wrapf(err, "Failed saving security version")
+	}
+	if err := os.Rename(p+".tmp", p); err != nil {
+		return errors.Wrapf(err, "Failed saving security version")
+	}
+	return nil
+}
+
+// checkFetched has @is, a newly fetched install manifest, when verified,
+// refuse security versions lower than we have accepted, unless
+// authorized by our downgrade token, and products other than ours.
+func (mos *Mos) checkFetched(is *InstallSource) error {
+	v, err := mos.SecurityVersion()
+	if err != nil {
+		return err
+	}
+	is.MinSecurityVersion = v
+	is.DowngradeToken = mos.opts.DowngradeToken
+	is.SudiCertPath = mos.opts.SudiCertPath
+	return nil
+}
+
+// checkSecurityVersion refuses @manifest, whose contents are @contents,
+// if its security version is more than trust.MaxSecurityVersionStep
+// above is.MinSecurityVersion, or if it is below is.MinSecurityVersion,
+// unless is.DowngradeToken authorizes it.
+func (is *InstallSource) checkSecurityVersion(manifest InstallFile, contents []byte, vopts trust.VerifyOpts) error {
+	if manifest.SecurityVersion > is.MinSecurityVersion+trust.MaxSecurityVersionStep {
+		return errors.Errorf("Install manifest has security version %d, more than %d above %d which was accepted before",
+			manifest.SecurityVersion, trust.MaxSecurityVersionStep, is.MinSecurityVersion)
+	}
+	if manifest.SecurityVersion >= is.MinSecurityVersion {
+		return nil
+	}
+	if is.DowngradeToken == "" {
+		return errors.Errorf("Install manifest has security version %d, lower than %d which was accepted before",
+			manifest.SecurityVersion, is.MinSecurityVersion)
+	}
+	if err := verifyDowngradeToken(is.DowngradeToken, contents, manifest.SecurityVersion, is.verifyOpts(vopts)); err != nil {
+		return errors.Wrapf(err, "Install manifest has security version %d, lower than %d, and bad downgrade token",
+			manifest.SecurityVersion, is.MinSecurityVersion)
+	}
+	log.Warnf("Accepting install manifest with security version %d, lower than %d, as authorized by %s",
+		manifest.SecurityVersion, is.MinSecurityVersion, is.DowngradeToken)
+	return nil
+}
+
+func manifestDigest(contents []byte) string {
+	sum := sha256.Sum256(contents)
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyDowngradeToken checks that the downgrade token at @path is for
+// the install manifest @contents, with security version @version, and
+// that it is signed by a certificate which is valid as in @vopts.
+func verifyDowngradeToken(path string, contents []byte, version uint64, vopts trust.VerifyOpts) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "Failed reading downgrade token")
+	}
+	var tok DowngradeToken
+	if err := json.Unmarshal(b, &tok); err != nil {
+		return errors.Wrapf(err, "Failed parsing downgrade token %s", path)
+	}
+
+	block, _ := pem.Decode([]byte(tok.Cert))
+	if block == nil {
+		return errors.Errorf("Failed decoding downgrade token certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return errors.Wrapf(err, "Failed parsing downgrade token certificate")
+	}
+	if err := trust.VerifyBytes(tok.Grant, tok.Signature, cert, tok.SignAlg, vopts); err != nil {
+		return errors.Wrapf(err, "Failed verifying downgrade token")
+	}
+
+	var grant DowngradeGrant
+	if err := json.Unmarshal(tok.Grant, &grant); err != nil {
+		return errors.Wrapf(err, "Failed parsing downgrade grant")
+	}
+	if grant.Manifest != manifestDigest(contents) || grant.SecurityVersion != version {
+		return errors.Errorf("Downgrade token is for install manifest %s (security version %d)",
+			grant.Manifest, grant.SecurityVersion)
+	}
+	return nil
+}
+
+// NewDowngradeToken returns a downgrade token for the install manifest
+// @contents, signed with the key named by @keyRef, whose certificate is
+// at @certPath.
+func NewDowngradeToken(contents []byte, keyRef, certPath string) (DowngradeToken, error) {
+	var manifest InstallFile
+	if err := json.Unmarshal(contents, &manifest); err != nil {
+		return DowngradeToken{}, errors.Wrapf(err, "Failed parsing manifest")
+	}
+
+	grant, err := json.Marshal(DowngradeGrant{
+		Manifest:        manifestDigest(contents),
+		SecurityVersion: manifest.SecurityVersion,
+	})
+	if err != nil {
+		return DowngradeToken{}, errors.Wrapf(err, "Failed encoding downgrade grant")
+	}
+	sig, alg, err := trust.SignBytes(grant, keyRef)
+	if err != nil {
+		return DowngradeToken{}, errors.Wrapf(err, "Failed signing downgrade grant")
+	}
+	cert, err := os.ReadFile(certPath)
+	if err != nil {
+		return DowngradeToken{}, errors.Wrapf(err, "Failed reading certificate")
+	}
+
+	return DowngradeToken{Grant: grant, Signature: sig, SignAlg: alg, Cert: string(cert)}, nil
+}
+
+// DowngradeTokenFromArgs implements 'mosb manifest downgrade-token':
+// it fetches the install manifest at the url given, and writes a
+// downgrade token for it.
+func DowngradeTokenFromArgs(ctx *cli.Context) error {
+	args := ctx.Args()
+	if len(args) != 1 {
+		return fmt.Errorf("install manifest url is a required positional argument")
+	}
+	output := ctx.String("output")
+	if output == "" {
+		return fmt.Errorf("Output file is required")
+	}
+
+	keyRef, certPath := ctx.String("key"), ctx.String("cert")
+	if keyRef == "" || certPath == "" {
+		proj := ctx.String("project")
+		if proj == "" {
+			return fmt.Errorf("Project, or key and cert, are required")
+		}
+		var err error
+		if keyRef == "" {
+			if keyRef, err = projectKey(proj); err != nil {
+				return errors.Wrapf(err, "Failed getting manifest signing key for %q", proj)
+			}
+		}
+		if certPath == "" {
+			if certPath, err = projectCert(proj); err != nil {
+				return errors.Wrapf(err, "Failed getting manifest signing cert")
+			}
+		}
+	}
+
+	// This is signed by the manifest's publisher, who checks what it
+	// authorizes, so it need not verify here.
+	reg, err := RegistryFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	var is InstallSource
+	defer is.Cleanup()
+	if err := is.Fetch(reg, args[0], trust.VerifyOpts{}); err != nil {
+		return err
+	}
+	contents, err := os.ReadFile(is.FilePath)
+	if err != nil {
+		return errors.Wrapf(err, "Failed reading manifest")
+	}
+
+	tok, err := NewDowngradeToken(contents, keyRef, certPath)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(&tok)
+	if err != nil {
+		return errors.Wrapf(err, "Failed encoding downgrade token")
+	}
+	if err := os.WriteFile(output, b, 0644); err != nil {
+		return errors.Wrapf(err, "Failed writing %s", output)
+	}
+
+	log.Infof("Wrote downgrade token for %s to %s", args[0], output)
+	return nil
+}
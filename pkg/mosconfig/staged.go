@@ -0,0 +1,251 @@
+package mosconfig
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"github.com/project-machine/mos/pkg/utils"
+)
+
+// An update can be done in two steps.  StageUpdate downloads the install
+// manifest and all of its targets, and verifies them, which may take a
+// long time over a slow link.  The verified manifest, its signature and
+// certificate are then kept under $config/staged-update/.  Later,
+// ApplyStagedUpdate re-verifies them against our store, without any
+// network access, and does the rest of the update.  If the system
+// manifest has changed since the update was staged, then it must be
+// staged again.
+
+const stagedUpdateDir = "staged-update"
+const stagedUpdateFile = "staged.json"
+
+// stagedDowngradeToken is the downgrade token, if any, with which the
+// update was staged, so that it need not be given again to apply it.
+const stagedDowngradeToken = "downgrade-token.json"
+
+// StagedUpdate describes an update which is ready to be applied.
+type StagedUpdate struct {
+	Url        string     `json:"url"`
+	Product    string     `json:"product"`
+	UpdateType UpdateType `json:"update_type"`
+	Base       string     `json:"base_revision"` // manifest revision when staged
+	StagedAt   time.Time  `json:"staged_at"`
+	Targets    []string   `json:"targets"` // digests
+}
+
+func (mos *Mos) stagedUpdatePath() string {
+	return filepath.Join(mos.opts.ConfigDir, stagedUpdateDir)
+}
+
+// stagedInstallSource returns the InstallSource for the staged install
+// manifest under @dir.
+func stagedInstallSource(dir string) InstallSource {
+	return InstallSource{
+		Basedir:  dir,
+		FilePath: filepath.Join(dir, "install.json"),
+		CertPath: filepath.Join(dir, "manifestCert.pem"),
+		SignPath: filepath.Join(dir, "install.json.signed"),
+	}
+}
+
+// StagedUpdate returns the staged update, or nil if there is none.
+func (mos *Mos) StagedUpdate() (*StagedUpdate, error) {
+	p := filepath.Join(mos.stagedUpdatePath(), stagedUpdateFile)
+	bytes, err := os.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "Failed reading %s", p)
+	}
+	var s StagedUpdate
+	if err := json.Unmarshal(bytes, &s); err != nil {
+		return nil, errors.Wrapf(err, "Failed parsing %s", p)
+	}
+	return &s, nil
+}
+
+// StageUpdate fetches and verifies the install manifest at @url, and
+// imports all of its targets, but does not change the system manifest.
+// Any update staged earlier is replaced.
+func (mos *Mos) StageUpdate(url string) (*StagedUpdate, error) {
+	var is InstallSource
+	defer is.Cleanup()
+
+	res := UpdateResult{Url: url}
+	fail := func(err error) error {
+		return &UpdateError{Step: res.FailedStep, Target: res.FailedTarget, Err: err}
+	}
+
+	res.FailedStep = UpdateStepFetch
+	head, err := mos.manifestHead()
+	if err != nil {
+		return nil, fail(err)
+	}
+
+	vopts, err := mos.fetchVerifyOpts()
+	if err != nil {
+		return nil, fail(err)
+	}
+	if err := is.Fetch(mos.registry, url, vopts); err != nil {
+		return nil, fail(err)
+	}
+	if err := saveCRLs(mos.opts.ConfigDir, is); err != nil {
+		return nil, fail(err)
+	}
+	if err := mos.checkFetched(&is); err != nil {
+		return nil, fail(err)
+	}
+
+	newIF, err := mos.fetchUpdate(is, &res)
+	if err != nil {
+		return nil, fail(err)
+	}
+
+	s := StagedUpdate{
+		Url:        url,
+		Product:    newIF.Product,
+		UpdateType: newIF.UpdateType,
+		Base:       head.String(),
+		StagedAt:   time.Now().UTC(),
+		Targets:    []string{},
+	}
+	for _, t := range newIF.Targets {
+		s.Targets = append(s.Targets, t.Digest)
+	}
+
+	// Write the new staged update alongside any old one, and only
+	// then swap it in.
+	dest := mos.stagedUpdatePath()
+	tmpdir := dest + ".tmp"
+	if err := os.RemoveAll(tmpdir); err != nil {
+		return nil, err
+	}
+	if err := utils.EnsureDir(tmpdir); err != nil {
+		return nil, errors.Wrapf(err, "Failed creating %q", tmpdir)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	staged := stagedInstallSource(tmpdir)
+	files := map[string]string{
+		is.FilePath: staged.FilePath,
+		is.CertPath: staged.CertPath,
+		is.SignPath: staged.SignPath,
+	}
+	if is.DowngradeToken != "" {
+		files[is.DowngradeToken] = filepath.Join(tmpdir, stagedDowngradeToken)
+	}
+	for src, dst := range files {
+		if err := utils.CopyFileBits(src, dst); err != nil {
+			return nil, errors.Wrapf(err, "Failed copying %q to %q", src, dst)
+		}
+	}
+
+	bytes, err := json.Marshal(&s)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed marshalling staged update")
+	}
+	if err := os.WriteFile(filepath.Join(tmpdir, stagedUpdateFile), bytes, 0644); err != nil {
+		return nil, errors.Wrapf(err, "Failed writing staged update")
+	}
+
+	if err := os.RemoveAll(dest); err != nil {
+		return nil, errors.Wrapf(err, "Failed removing old staged update")
+	}
+	if err := os.Rename(tmpdir, dest); err != nil {
+		return nil, errors.Wrapf(err, "Failed saving staged update")
+	}
+
+	log.Infof("Update from %s staged", url)
+	return &s, nil
+}
+
+// ApplyStagedUpdate does the rest of the update staged by StageUpdate:
+// the manifest and targets are verified again against our store, and
+// then applied as by Update.  The outcome is saved as for Update.  The
+// staged update is dropped once it has been applied, but kept if the
+// update failed.  It is refused if the system manifest has changed
+// since it was staged.
+func (mos *Mos) ApplyStagedUpdate() error {
+	s, err := mos.StagedUpdate()
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return errors.Errorf("No update is staged")
+	}
+
+	res := UpdateResult{Url: s.Url}
+	err = mos.applyStaged(s, &res)
+	if err != nil {
+		res.Error = err.Error()
+	} else {
+		res.Success = true
+	}
+
+	if werr := mos.saveUpdateResult(&res); werr != nil {
+		log.Warnf("Failed saving update result: %v", werr)
+	}
+
+	if err != nil {
+		return &UpdateError{
+			Step:       res.FailedStep,
+			Target:     res.FailedTarget,
+			RolledBack: res.RolledBack,
+			Err:        err,
+		}
+	}
+
+	if err := mos.DiscardStagedUpdate(); err != nil {
+		log.Warnf("Failed removing applied staged update: %v", err)
+	}
+	return nil
+}
+
+func (mos *Mos) applyStaged(s *StagedUpdate, res *UpdateResult) error {
+	res.FailedStep = UpdateStepFetch
+	prevHead, err := mos.manifestHead()
+	if err != nil {
+		return err
+	}
+	res.Previous = prevHead.String()
+	if s.Base != prevHead.String() {
+		return errors.Errorf("System manifest has changed since the update was staged (from revision %s to %s), please stage it again",
+			s.Base, prevHead)
+	}
+
+	// With no target source, this only checks the targets already
+	// in our store.
+	is := stagedInstallSource(mos.stagedUpdatePath())
+	res.FailedStep = UpdateStepVerify
+	vopts, err := mos.fetchVerifyOpts()
+	if err != nil {
+		return err
+	}
+	if err := mos.checkFetched(&is); err != nil {
+		return err
+	}
+	token := filepath.Join(mos.stagedUpdatePath(), stagedDowngradeToken)
+	if is.DowngradeToken == "" && utils.PathExists(token) {
+		is.DowngradeToken = token
+	}
+	newIF, err := ReadVerifyInstallManifest(is, vopts, mos.storage)
+	if err != nil {
+		return errors.Wrapf(err, "Failed verifying staged update")
+	}
+
+	return mos.applyUpdate(is, newIF, prevHead, res)
+}
+
+// DiscardStagedUpdate drops the staged update, if any.  The images it
+// imported are left for GC to remove.
+func (mos *Mos) DiscardStagedUpdate() error {
+	if err := os.RemoveAll(mos.stagedUpdatePath()); err != nil {
+		return errors.Wrapf(err, "Failed removing staged update")
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package mosconfig
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/project-machine/mos/pkg/utils"
+)
+
+// StorageStatus describes a storage volume used by a target.
+type StorageStatus struct {
+	Label   string `json:"label"`
+	Dest    string `json:"dest"`
+	Mounted bool   `json:"mounted"`
+}
+
+// TargetStatus combines what the manifest says about a target with
+// what is actually running.
+type TargetStatus struct {
+	Name         string          `json:"name"`
+	ServiceType  ServiceType     `json:"service_type"`
+	Version      string          `json:"version"`
+	Digest       string          `json:"digest"`
+	RunningHash  string          `json:"running_hash"`
+	RunningVer   string          `json:"running_version,omitempty"`
+	RunningDig   string          `json:"running_digest,omitempty"`
+	HashMismatch bool            `json:"hash_mismatch"`
+	LxcState     string          `json:"lxc_state,omitempty"`
+	UnitState    string          `json:"unit_state,omitempty"`
+	Addresses    []string        `json:"addresses,omitempty"`
+	Ports        []SimplePort    `json:"ports,omitempty"`
+	Storage      []StorageStatus `json:"storage,omitempty"`
+	Error        string          `json:"error,omitempty"`
+}
+
+// Status reports the live state of every target in the current
+// manifest.  Failures to query one target are recorded in its Error
+// field rather than failing the whole report.
+func (mos *Mos) Status() ([]TargetStatus, error) {
+	manifest, err := mos.CurrentManifest()
+	if err != nil {
+		return nil, fmt.Errorf("Failed opening manifest: %w", err)
+	}
+
+	ret := []TargetStatus{}
+	for _, st := range manifest.SysTargets {
+		ret = append(ret, mos.targetStatus(st))
+	}
+	return ret, nil
+}
+
+func (mos *Mos) targetStatus(st SysTarget) TargetStatus {
+	t := st.raw
+	s := TargetStatus{
+		Name:        st.Name,
+		ServiceType: t.ServiceType,
+		Version:     t.Version,
+		Digest:      t.Digest,
+		Ports:       t.Network.Ports,
+	}
+
+	r, err := mos.RunningTarget(t)
+	if err != nil {
+		s.Error = err.Error()
+	}
+	if r != nil {
+		s.RunningHash = r.LayerHash
+		s.RunningVer = r.Version
+		s.RunningDig = r.Digest
+		switch {
+		case r.Digest != "":
+			s.HashMismatch = !r.Matches(t)
+		case t.ServiceType != ContainerService:
+			// No record of what was started, so compare the mounted
+			// layer.  For containers that is a scratch overlay, which
+			// tells us nothing.
+			s.HashMismatch = !layerHashMatches(st, r.LayerHash)
+		}
+	}
+
+	if t.ServiceType == ContainerService {
+		s.LxcState = lxcState(t.ServiceName)
+		s.UnitState = unitState(t.ServiceName)
+		s.Addresses = lxcAddresses(t.ServiceName)
+	}
+	if len(s.Addresses) == 0 {
+		if t.Network.Address != "" {
+			s.Addresses = append(s.Addresses, t.Network.Address)
+		}
+		if t.Network.Address6 != "" {
+			s.Addresses = append(s.Addresses, t.Network.Address6)
+		}
+	}
+
+	for _, ts := range t.Storage {
+		mounted, _ := utils.IsMountpoint(filepath.Join("/storage", ts.Label))
+		s.Storage = append(s.Storage, StorageStatus{
+			Label:   ts.Label,
+			Dest:    ts.Dest,
+			Mounted: mounted,
+		})
+	}
+
+	return s
+}
+
+// layerHashMatches reports whether @hash, as returned by MountedByHash,
+// is one of the layers of the target's OCI manifest.
+func layerHashMatches(st SysTarget, hash string) bool {
+	if dropHashAlg(st.raw.Digest) == hash {
+		return true
+	}
+	for _, l := range st.OCIManifest.Layers {
+		if l.Digest.Encoded() == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// lxcState returns the state of container @name as reported by
+// lxc-info, or "" if lxc does not know about it.
+func lxcState(name string) string {
+	out, rc := utils.RunCommandWithRc("lxc-info", "-H", "-n", name, "-s")
+	if rc != 0 {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// lxcAddresses returns the ip addresses of running container @name.
+func lxcAddresses(name string) []string {
+	out, rc := utils.RunCommandWithRc("lxc-info", "-H", "-n", name, "-i")
+	if rc != 0 {
+		return nil
+	}
+	return strings.Fields(string(out))
+}
+
+// unitState returns the systemd active state for the unit of service
+// @name.
+func unitState(name string) string {
+	unit := fmt.Sprintf("%s.service", name)
+	out, _ := utils.RunCommandWithRc("systemctl", "is-active", unit)
+	return strings.TrimSpace(string(out))
+}
@@ -5,8 +5,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"sync"
 
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 
@@ -16,7 +16,6 @@ import (
 	"github.com/project-machine/mos/pkg/utils"
 	"golang.org/x/sys/unix"
 	"stackerbuild.io/stacker/pkg/atomfs"
-	"stackerbuild.io/stacker/pkg/lib"
 	"stackerbuild.io/stacker/pkg/mount"
 )
 
@@ -39,7 +38,11 @@ type Storage interface {
 	SetupTarget(t *Target) error
 	VerifyTarget(t *Target) error
 
-	ImportTarget(src string, target *Target) error
+	ImportTarget(reg *Registry, src string, target *Target) error
+
+	// StaleMetadata lists the storage's working files under
+	// $scratch-writes which no current mount uses.
+	StaleMetadata() ([]string, error)
 }
 
 func NewStorage(opts MosOptions) (Storage, error) {
@@ -49,7 +52,7 @@ func NewStorage(opts MosOptions) (Storage, error) {
 	case AtomfsStorageType:
 		s, e = NewAtomfsStorage(opts.RootDir, opts.StorageCache, opts.ScratchWrites)
 	case PuzzlefsStorageType:
-		return nil, fmt.Errorf("Not yet implemented")
+		s, e = NewPuzzlefsStorage(opts.RootDir, opts.StorageCache, opts.ScratchWrites)
 	default:
 		return nil, fmt.Errorf("Unknown storage type requested")
 	}
@@ -57,10 +60,40 @@ func NewStorage(opts MosOptions) (Storage, error) {
 	return s, e
 }
 
+// The storage type is chosen at install, and recorded in
+// $config/storage-type so that later sessions use the same one.
+const storageTypeFile = "storage-type"
+
+// installedStorageType returns the storage type recorded under
+// @configDir.  Systems installed before it was recorded use atomfs.
+func installedStorageType(configDir string) (StorageType, error) {
+	p := filepath.Join(configDir, storageTypeFile)
+	bytes, err := os.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return AtomfsStorageType, nil
+		}
+		return "", errors.Wrapf(err, "Failed reading %s", p)
+	}
+	return StorageType(strings.TrimSpace(string(bytes))), nil
+}
+
+func saveStorageType(configDir string, st StorageType) error {
+	p := filepath.Join(configDir, storageTypeFile)
+	if err := os.WriteFile(p, []byte(string(st)+"\n"), 0644); err != nil {
+		return errors.Wrapf(err, "Failed writing %s", p)
+	}
+	return nil
+}
+
 type AtomfsStorage struct {
 	RootDir     string
 	zotPath     string
 	scratchPath string
+
+	// Targets can share layers, so only one molecule is mounted at a
+	// time, even when targets are set up in parallel.
+	mountLock sync.Mutex
 }
 
 func NewAtomfsStorage(rootDir, zotPath, scratchPath string) (*AtomfsStorage, error) {
@@ -96,6 +129,9 @@ func (a *AtomfsStorage) Mount(t *Target, mountpoint string) (func(), error) {
 		opts.AllowMissingVerityData = true
 	}
 
+	a.mountLock.Lock()
+	defer a.mountLock.Unlock()
+
 	mol, err := atomfs.BuildMoleculeFromOCI(opts)
 	if err != nil {
 		return func() {}, fmt.Errorf("Failed building atomfs molecule for %#v: %w", opts, err)
@@ -115,51 +151,72 @@ func (a *AtomfsStorage) Mount(t *Target, mountpoint string) (func(), error) {
 }
 
 func (a *AtomfsStorage) MountWriteable(t *Target, mountpoint string) (func(), error) {
-	ropath, err := os.MkdirTemp(a.scratchPath, fmt.Sprintf("%s-scratch-readonly-", t.ServiceName))
+	cleanup, _, err := mountWriteableOverlay(a.scratchPath, t, mountpoint, a.Mount)
+	return cleanup, err
+}
+
+// overlayDirs are the scratch directories backing a writeable mount.
+type overlayDirs struct {
+	Lower string `json:"lower"`
+	Upper string `json:"upper"`
+	Work  string `json:"work"`
+}
+
+func (d overlayDirs) remove() {
+	os.RemoveAll(d.Work)
+	os.RemoveAll(d.Upper)
+	os.Remove(d.Lower)
+}
+
+// mountWriteableOverlay mounts @t readonly under @scratchPath using
+// @mountRO, and then a writeable overlay of that onto @mountpoint.  It is
+// shared by the storage backends, which only differ in how they do the
+// readonly mount.
+func mountWriteableOverlay(scratchPath string, t *Target, mountpoint string, mountRO func(*Target, string) (func(), error)) (func(), overlayDirs, error) {
+	dirs := overlayDirs{}
+	ropath, err := os.MkdirTemp(scratchPath, fmt.Sprintf("%s-scratch-readonly-", t.ServiceName))
 	if err != nil {
-		return func() {}, fmt.Errorf("Failed creating readonly mountpoint: %w", err)
+		return func() {}, dirs, fmt.Errorf("Failed creating readonly mountpoint: %w", err)
 	}
+	dirs.Lower = ropath
 
-	roCleanup, err := a.Mount(t, ropath)
+	roCleanup, err := mountRO(t, ropath)
 	if err != nil {
 		os.Remove(ropath)
-		return func() {}, fmt.Errorf("Failed creating readonly mount for %#v: %w", t, err)
+		return func() {}, dirs, fmt.Errorf("Failed creating readonly mount for %#v: %w", t, err)
 	}
 
-	workdir, err := os.MkdirTemp(a.scratchPath, fmt.Sprintf("%s-scratch-workdir-", t.ServiceName))
+	workdir, err := os.MkdirTemp(scratchPath, fmt.Sprintf("%s-scratch-workdir-", t.ServiceName))
 	if err != nil {
 		roCleanup()
 		os.Remove(ropath)
-		return func() {}, fmt.Errorf("Failed creating workdir: %w", err)
+		return func() {}, dirs, fmt.Errorf("Failed creating workdir: %w", err)
 	}
+	dirs.Work = workdir
 
-	upperdir, err := os.MkdirTemp(a.scratchPath, fmt.Sprintf("%s-scratch-upperdir-", t.ServiceName))
+	upperdir, err := os.MkdirTemp(scratchPath, fmt.Sprintf("%s-scratch-upperdir-", t.ServiceName))
 	if err != nil {
 		roCleanup()
 		os.Remove(ropath)
 		os.RemoveAll(workdir)
-		return func() {}, fmt.Errorf("Failed creating upperdir: %w", err)
+		return func() {}, dirs, fmt.Errorf("Failed creating upperdir: %w", err)
 	}
+	dirs.Upper = upperdir
 
 	overlayArgs := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s,userxattr", ropath, upperdir, workdir)
 	err = unix.Mount("overlayfs", mountpoint, "overlay", 0, overlayArgs)
 	if err != nil {
 		roCleanup()
-		os.RemoveAll(workdir)
-		os.RemoveAll(upperdir)
-		os.Remove(ropath)
-		return nil, err
-		return func() {}, fmt.Errorf("Failed mounting writeable overlay: %w", err)
+		dirs.remove()
+		return func() {}, dirs, fmt.Errorf("Failed mounting writeable overlay: %w", err)
 	}
 	cleanup := func() {
 		unix.Unmount(mountpoint, 0)
 		roCleanup()
-		os.RemoveAll(workdir)
-		os.RemoveAll(upperdir)
-		os.Remove(ropath)
+		dirs.remove()
 	}
 
-	return cleanup, nil
+	return cleanup, dirs, nil
 }
 
 func getHashFromOverlay(mountinfo string, mountPoint string) (string, error) {
@@ -196,10 +253,6 @@ func (a *AtomfsStorage) MountedByHash(target *Target) (string, error) {
 		/* see SetupTargetRuntime() */
 		return getHashFromOverlay("/proc/self/mountinfo", filepath.Join(a.RootDir, "mnt/atom", target.ServiceName))
 	case "container":
-		// container services are lxc containers, which may or may not
-		// have their rootfs visible in this mount namespace. let's
-		// look at the specific mountinfo for the container just to be
-		// sure.
 		out, rc := utils.RunCommandWithRc("lxc-info", "-H", "-n", target.ServiceName, "-s")
 		if rc != 0 {
 			/* if the service didn't previously exist, it's ok for lxc-ls to fail */
@@ -208,30 +261,28 @@ func (a *AtomfsStorage) MountedByHash(target *Target) (string, error) {
 		if strings.TrimSpace(string(out)) != "RUNNING" {
 			return "", nil
 		}
-		out, rc = utils.RunCommandWithRc("lxc-info", "-H", "-n", target.ServiceName, "-p")
-		if rc != 0 {
-			/* if the service didn't previously exist, it's ok for lxc-ls to fail */
-			return "", nil
-		}
-		pid, err := strconv.Atoi(strings.TrimSpace(string(out)))
-		if err != nil {
-			return "", fmt.Errorf("couldn't get pid from %s: %w", strings.TrimSpace(string(out)), err)
-		}
-
-		return getHashFromOverlay(fmt.Sprintf("/proc/%d/mountinfo", pid), "/")
+		// The container's rootfs is an overlay over its readonly
+		// molecule under roots/, which is what tells us the layer.
+		return getHashFromOverlay("/proc/self/mountinfo", filepath.Join(a.scratchPath, "roots", target.ServiceName))
 	default:
 		return "", fmt.Errorf("couldn't determine mountpoint for %s (%s)", target.ServiceName, target.ServiceType)
 	}
 }
 
 func (a *AtomfsStorage) SetupTarget(t *Target) error {
-	mp := filepath.Join(a.scratchPath, "roots", t.ServiceName)
+	return setupTargetMount(a, a.scratchPath, t, atomfs.Umount)
+}
+
+// setupTargetMount mounts @t under $scratch-writes/roots/ using storage
+// @s, first unmounting whatever was there using @umount.
+func setupTargetMount(s Storage, scratchPath string, t *Target, umount func(string) error) error {
+	mp := filepath.Join(scratchPath, "roots", t.ServiceName)
 	mounted, err := utils.IsMountpoint(mp)
 	if err != nil {
 		return fmt.Errorf("Failed checking whether %q is mounted: %w", mp, err)
 	}
 	if mounted {
-		err := atomfs.Umount(mp)
+		err := umount(mp)
 		if err != nil {
 			return err
 		}
@@ -242,16 +293,9 @@ func (a *AtomfsStorage) SetupTarget(t *Target) error {
 		return fmt.Errorf("Failed creating mountpoint %q: %w", mp, err)
 	}
 
-	if t.ServiceType == "container" {
-		// For containers, we have to make this writeable to support
-		// uid shifting.  We can un-do this if/when we can use id mapped
-		// mounts.
-		// XXX TODO we should probably, therefore, umount this after
-		// every service stop.
-		_, err = a.MountWriteable(t, mp)
-	} else {
-		_, err = a.Mount(t, mp)
-	}
+	// This stays readonly.  Containers get a writeable, uid shifted
+	// overlay over it when started; see mountContainerRootfs().
+	_, err = s.Mount(t, mp)
 	if err != nil {
 		return fmt.Errorf("Failed mounting %s:%s to %q: %w", t.ServiceName, t.Version, mp, err)
 	}
@@ -285,9 +329,61 @@ func (a *AtomfsStorage) TearDownTarget(name string) error {
 	return err
 }
 
+// atomfs keeps the squashfs mounts of layers under mounts/ in its
+// metadata path, and per-molecule state in a directory named after the
+// mountpoint with '/' replaced by '-'.  Either is stale once nothing is
+// mounted there.
+func (a *AtomfsStorage) StaleMetadata() ([]string, error) {
+	stale := []string{}
+	dir := a.metadataPath()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return stale, nil
+		}
+		return nil, err
+	}
+
+	mounts, err := mount.ParseMounts("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	mounted := map[string]bool{}
+	for _, m := range mounts {
+		mounted[strings.ReplaceAll(m.Target, "/", "-")] = true
+	}
+
+	for _, e := range entries {
+		p := filepath.Join(dir, e.Name())
+		if e.Name() == "mounts" {
+			atoms, err := os.ReadDir(p)
+			if err != nil {
+				return nil, err
+			}
+			for _, atom := range atoms {
+				ap := filepath.Join(p, atom.Name())
+				if !hasMountUnder(mounts, ap) {
+					stale = append(stale, ap)
+				}
+			}
+			continue
+		}
+		if mounted[e.Name()] || hasMountUnder(mounts, p) {
+			continue
+		}
+		stale = append(stale, p)
+	}
+
+	return stale, nil
+}
+
 func (a *AtomfsStorage) VerifyTarget(t *Target) error {
-	ocidir := filepath.Join(a.zotPath, "mos")
-	name := t.Digest
+	return verifyOCITarget(filepath.Join(a.zotPath, "mos"), t.Digest, t)
+}
+
+// verifyOCITarget checks that the manifest tagged with @t's digest in the
+// OCI layout at @ocidir has the expected digest and size.
+func verifyOCITarget(ocidir, name string, t *Target) error {
 
 	oci, err := umoci.OpenLayout(ocidir)
 	if err != nil {
@@ -326,12 +422,23 @@ func (a *AtomfsStorage) VerifyTarget(t *Target) error {
 	return nil
 }
 
-// Import a target's storage from an oci distribution server.
-func (a *AtomfsStorage) ImportTarget(src string, target *Target) error {
+// Import a target's storage from an oci distribution server or a local
+// oci layout.
+func (a *AtomfsStorage) ImportTarget(reg *Registry, src string, target *Target) error {
+	return importOCITarget(reg, a.zotPath, src, target, target.Digest)
+}
+
+// importOCITarget copies @target from @src into the OCI layout under
+// @zotPath, tagged @tag.  Both atomfs and puzzlefs keep their images in
+// the same layout, so blobs shared between images are only stored once.
+// Registries are reached as @reg says.
+func importOCITarget(reg *Registry, zotPath, src string, target *Target, tag string) error {
 	var err error
 	switch {
-	case strings.HasPrefix(src, "docker://"):
-		err = a.copyRemote(src, target)
+	case isRegistryUrl(src):
+		err = copyRemote(reg, zotPath, src, target, tag)
+	case strings.HasPrefix(src, ociLayoutPrefix):
+		err = copyLocal(zotPath, src, target, tag)
 	default:
 		err = errors.Errorf("no oci or zot storage found under %s", src)
 	}
@@ -343,17 +450,22 @@ func (a *AtomfsStorage) ImportTarget(src string, target *Target) error {
 	return nil
 }
 
-func (a *AtomfsStorage) copyRemote(image string, target *Target) error {
+func copyRemote(reg *Registry, zotPath, image string, target *Target, tag string) error {
 	log.Debugf("Copying (%#v (image %s) to local storage", target, image)
-	tpath := filepath.Join(a.zotPath, "mos")
-	dest := fmt.Sprintf("oci:%s:%s", tpath, target.Digest)
+	tpath := filepath.Join(zotPath, "mos")
 	err := utils.EnsureDir(tpath)
 	if err != nil {
 		return errors.Wrapf(err, "Failed creating local zot directory %q", tpath)
 	}
-	copyOpts := lib.ImageCopyOpts{Src: image, Dest: dest, Progress: os.Stdout, SrcSkipTLS: true}
-	log.Debugf("Copying with following options:\n%#v", copyOpts)
-	if err := lib.ImageCopy(copyOpts); err != nil {
+	repo, err := NewDistRepo(reg, image)
+	if err != nil {
+		return errors.Wrapf(err, "Failed opening %s", image)
+	}
+	url, err := repo.findUrl(image)
+	if err != nil {
+		return err
+	}
+	if err := repo.PullImage(url.name, target.Digest, tpath, tag); err != nil {
 		return errors.Wrapf(err, "failed copying layer")
 	}
 
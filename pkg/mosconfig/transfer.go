@@ -0,0 +1,406 @@
+package mosconfig
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// Blobs, which for a hostfs can be several GB, are moved in pieces so
+// that a dropped connection only costs the piece in flight.  Uploads use
+// a distribution spec upload session: a POST to open it, a PATCH for
+// each chunk, and a PUT to close it.  If a chunk fails, we ask the
+// registry how much it has and go on from there.  A download which
+// breaks off is resumed with a ranged GET from where it stopped.
+//
+// Targets are imported by a small pool of workers, and the progress of
+// all transfers in flight is logged together, as structured fields,
+// every few seconds.
+
+const (
+	blobChunkSize    = 16 * 1024 * 1024
+	maxBlobResumes   = 5
+	importWorkers    = 4
+	progressInterval = 5 * time.Second
+)
+
+// transferProgress adds up the progress of all blob transfers in
+// flight.  It is reset once none are.
+type transferProgress struct {
+	sync.Mutex
+	active    int
+	blobs     int
+	blobsDone int
+	bytes     int64
+	bytesDone int64
+	reported  time.Time
+	progress  bool // progress was reported for these transfers
+}
+
+var transfers transferProgress
+
+// blobTransfer is one blob being uploaded or downloaded.
+type blobTransfer struct {
+	op     string
+	digest digest.Digest
+	done   int64
+}
+
+func (p *transferProgress) start(op string, d digest.Digest, size int64) *blobTransfer {
+	p.Lock()
+	defer p.Unlock()
+	if p.active == 0 {
+		p.reported = time.Now()
+	}
+	p.active++
+	p.blobs++
+	if size > 0 {
+		p.bytes += size
+	}
+	log.WithFields(log.Fields{"op": op, "digest": d.String(), "size": size}).Debug("Starting blob transfer")
+	return &blobTransfer{op: op, digest: d}
+}
+
+// add records @n more bytes moved for @b.  @n is negative if a transfer
+// has to go back.
+func (b *blobTransfer) add(n int64) {
+	b.done += n
+	p := &transfers
+	p.Lock()
+	defer p.Unlock()
+	p.bytesDone += n
+	if time.Since(p.reported) >= progressInterval {
+		p.report("Transfer progress")
+		p.progress = true
+	}
+}
+
+func (b *blobTransfer) finish() {
+	log.WithFields(log.Fields{"op": b.op, "digest": b.digest.String(), "bytes": b.done}).Debug("Finished blob transfer")
+	p := &transfers
+	p.Lock()
+	defer p.Unlock()
+	p.active--
+	p.blobsDone++
+	if p.active > 0 {
+		return
+	}
+	// Quick transfers are only worth a debug message.
+	if p.progress {
+		p.report("Transfers finished")
+	} else {
+		log.WithFields(p.fields()).Debug("Transfers finished")
+	}
+	p.blobs, p.blobsDone, p.bytes, p.bytesDone = 0, 0, 0, 0
+	p.progress = false
+}
+
+// report logs the totals.  Must be called with p locked.
+func (p *transferProgress) report(msg string) {
+	log.WithFields(p.fields()).Info(msg)
+	p.reported = time.Now()
+}
+
+func (p *transferProgress) fields() log.Fields {
+	fields := log.Fields{
+		"blobs":      p.blobs,
+		"blobs_done": p.blobsDone,
+		"bytes":      p.bytes,
+		"bytes_done": p.bytesDone,
+	}
+	if p.bytes > 0 {
+		fields["percent"] = p.bytesDone * 100 / p.bytes
+	}
+	return fields
+}
+
+// blobReader reads a blob from the registry.  If the transfer breaks
+// off, it is resumed with a ranged GET.
+type blobReader struct {
+	repo     *DistRepo
+	path     string
+	scope    string
+	body     io.ReadCloser
+	offset   int64
+	size     int64 // -1 if unknown
+	resumes  int
+	progress *blobTransfer
+}
+
+// openBlob opens blob @d of image @name for reading.  @size is its size,
+// or -1 if not known.
+func (r *DistRepo) openBlob(name string, d digest.Digest, size int64) (*blobReader, error) {
+	b := &blobReader{
+		repo:  r,
+		path:  fmt.Sprintf("%s/blobs/%s", name, d),
+		scope: pullScope(name),
+		size:  size,
+	}
+	if err := b.open(); err != nil {
+		return nil, err
+	}
+	b.progress = transfers.start("download", d, b.size)
+	return b, nil
+}
+
+// open (re)starts the GET at b.offset.
+func (b *blobReader) open() error {
+	req, err := http.NewRequest(http.MethodGet, b.repo.apiUrl(b.path), nil)
+	if err != nil {
+		return err
+	}
+	if b.offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", b.offset))
+	}
+	resp, err := b.repo.do(req, b.scope)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && b.offset > 0:
+		start := int64(-1)
+		fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start)
+		if start != b.offset {
+			resp.Body.Close()
+			return errors.Errorf("Asked for %s from %d, but got %q", b.path, b.offset, resp.Header.Get("Content-Range"))
+		}
+	case resp.StatusCode == http.StatusOK:
+		if b.size < 0 {
+			b.size = resp.ContentLength
+		}
+		if b.offset > 0 {
+			// No ranged GETs here, so skip what we already have.
+			if _, err := io.CopyN(io.Discard, resp.Body, b.offset); err != nil {
+				resp.Body.Close()
+				return errors.Wrapf(err, "Failed resuming %s", b.path)
+			}
+		}
+	default:
+		resp.Body.Close()
+		return errors.Errorf("Bad status code connecting to %q: %d", b.repo.apiUrl(b.path), resp.StatusCode)
+	}
+
+	b.body = resp.Body
+	return nil
+}
+
+func (b *blobReader) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	b.offset += int64(n)
+	b.progress.add(int64(n))
+	if err == nil || (err == io.EOF && (b.size < 0 || b.offset >= b.size)) {
+		return n, err
+	}
+
+	// The transfer broke off.
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if b.resumes >= maxBlobResumes {
+		return n, errors.Wrapf(err, "Failed reading %s after %d resumes", b.path, b.resumes)
+	}
+	b.resumes++
+	log.Infof("Reading %s failed at %d: %v, resuming", b.path, b.offset, err)
+	b.body.Close()
+	time.Sleep(time.Duration(b.resumes) * time.Second)
+	if rerr := b.open(); rerr != nil {
+		return n, errors.Wrapf(rerr, "Failed resuming %s after: %v", b.path, err)
+	}
+	return n, nil
+}
+
+func (b *blobReader) Close() error {
+	b.progress.finish()
+	return b.body.Close()
+}
+
+// uploadUrl returns the absolute url for upload @location, which may
+// be relative.
+func (disturl *DistUrl) uploadUrl(location string) (*url.URL, error) {
+	base, err := url.Parse(disturl.repo.apiUrl(""))
+	if err != nil {
+		return nil, err
+	}
+	loc, err := url.Parse(location)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Bad upload location %q", location)
+	}
+	return base.ResolveReference(loc), nil
+}
+
+// uploadRequest sends a request with @method to upload session @u.
+func (disturl *DistUrl) uploadRequest(method string, u *url.URL, body io.ReadSeeker, size int64, hdrs map[string]string) (*http.Response, error) {
+	var rdr io.Reader
+	if body != nil {
+		rdr = body
+	}
+	req, err := http.NewRequest(method, u.String(), rdr)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		req.GetBody = func() (io.ReadCloser, error) {
+			if _, err := body.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+			return io.NopCloser(body), nil
+		}
+	}
+	for k, v := range hdrs {
+		req.Header.Set(k, v)
+	}
+	return disturl.repo.do(req, pushScope(disturl.name))
+}
+
+// uploadLocation returns the session url from upload response @resp.
+func (disturl *DistUrl) uploadLocation(resp *http.Response) (*url.URL, error) {
+	loc := resp.Header.Get("Location")
+	if loc == "" {
+		return nil, errors.Errorf("No upload location received from %s", disturl.repo.addr)
+	}
+	return disturl.uploadUrl(loc)
+}
+
+// uploadStatus asks the registry how much of upload session @u it has.
+// It returns the offset to go on from, and the session url to use.
+func (disturl *DistUrl) uploadStatus(u *url.URL) (int64, *url.URL, error) {
+	resp, err := disturl.uploadRequest(http.MethodGet, u, nil, 0, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return 0, nil, errors.Errorf("Failed getting upload status: %q", resp.Status)
+	}
+	next, err := disturl.uploadLocation(resp)
+	if err != nil {
+		next = u
+	}
+	offset := int64(0)
+	if r := resp.Header.Get("Range"); r != "" {
+		_, end, _ := strings.Cut(r, "-")
+		n, err := strconv.ParseInt(end, 10, 64)
+		if err != nil {
+			return 0, nil, errors.Errorf("Bad upload range %q", r)
+		}
+		// An empty upload is reported as "0-0".
+		if n > 0 {
+			offset = n + 1
+		}
+	}
+	return offset, next, nil
+}
+
+// uploadBlob uploads the @size bytes of @src, whose digest is @d, in
+// chunks.
+func (disturl *DistUrl) uploadBlob(src io.ReaderAt, size int64, d digest.Digest) error {
+	progress := transfers.start("upload", d, size)
+	defer progress.finish()
+
+	u, err := disturl.uploadUrl(disturl.name + "/blobs/uploads/")
+	if err != nil {
+		return err
+	}
+	resp, err := disturl.uploadRequest(http.MethodPost, u, nil, 0, nil)
+	if err != nil {
+		return errors.Wrapf(err, "Failed starting upload of %s", d)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return errors.Errorf("Failed starting upload of %s: %q", d, resp.Status)
+	}
+	u, err = disturl.uploadLocation(resp)
+	if err != nil {
+		return err
+	}
+
+	offset := int64(0)
+	resumes := 0
+	for offset < size {
+		n := size - offset
+		if n > blobChunkSize {
+			n = blobChunkSize
+		}
+		chunk := io.NewSectionReader(src, offset, n)
+		resp, err := disturl.uploadRequest(http.MethodPatch, u, chunk, n, map[string]string{
+			"Content-Type":  "application/octet-stream",
+			"Content-Range": fmt.Sprintf("%d-%d", offset, offset+n-1),
+		})
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusAccepted {
+				offset += n
+				progress.add(n)
+				if next, lerr := disturl.uploadLocation(resp); lerr == nil {
+					u = next
+				}
+				continue
+			}
+			err = errors.Errorf("Upload of %s at %d failed: %q", d, offset, resp.Status)
+		}
+
+		if resumes >= maxBlobResumes {
+			return err
+		}
+		resumes++
+		log.Infof("%v, resuming", err)
+		time.Sleep(time.Duration(resumes) * time.Second)
+		got, next, serr := disturl.uploadStatus(u)
+		if serr != nil {
+			return errors.Wrapf(err, "Failed resuming upload (%v)", serr)
+		}
+		progress.add(got - offset)
+		offset, u = got, next
+	}
+
+	q := u.Query()
+	q.Set("digest", d.String())
+	u.RawQuery = q.Encode()
+	resp, err = disturl.uploadRequest(http.MethodPut, u, nil, 0, nil)
+	if err != nil {
+		return errors.Wrapf(err, "Failed finishing upload of %s", d)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return errors.Errorf("Repo returned error for blob %s.  Response was: %q", d, resp.Status)
+	}
+	return nil
+}
+
+// forEachTarget calls @fn for each of @targets, up to importWorkers at a
+// time.  If any fail, it returns the error for the first in the list to
+// fail, along with that target's name, once the rest are done.
+func forEachTarget(targets []Target, fn func(t *Target) error) (string, error) {
+	errs := make([]error, len(targets))
+	sem := make(chan struct{}, importWorkers)
+	var wg sync.WaitGroup
+	for i := range targets {
+		i := i
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = fn(&targets[i])
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return targets[i].ServiceName, err
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,220 @@
+package mosconfig
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// testBlob returns @size bytes which differ from one chunk to the next.
+func testBlob(size int) []byte {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = byte(i / 4093)
+	}
+	return b
+}
+
+// testRegistry is just enough of a registry to move one blob in and out
+// of, and to break transfers part way.
+type testRegistry struct {
+	sync.Mutex
+	blob []byte
+
+	// Serve only this many bytes of the first GET, then drop it.
+	breakGetAt int
+	// Ignore Range on GETs.
+	noRanges bool
+	ranged   []string
+
+	// Keep only this many bytes of the first PATCH starting at
+	// breakPatchFrom, then drop it.
+	breakPatchFrom int
+	breakPatchKeep int
+	uploaded       []byte
+	statusAsked    int
+	committed      digest.Digest
+}
+
+func (tr *testRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tr.Lock()
+	defer tr.Unlock()
+
+	switch {
+	case r.URL.Path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+
+	case r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/blobs/sha256:"):
+		start := 0
+		if rng := r.Header.Get("Range"); rng != "" && !tr.noRanges {
+			tr.ranged = append(tr.ranged, rng)
+			fmt.Sscanf(rng, "bytes=%d-", &start)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(tr.blob)-1, len(tr.blob)))
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(tr.blob)-start))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(tr.blob[start:])
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(tr.blob)))
+		w.WriteHeader(http.StatusOK)
+		if tr.breakGetAt > 0 {
+			// Short of the Content-Length, so the connection is dropped.
+			w.Write(tr.blob[:tr.breakGetAt])
+			tr.breakGetAt = 0
+			return
+		}
+		w.Write(tr.blob)
+
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/blobs/uploads/"):
+		w.Header().Set("Location", "/v2/test/blob/blobs/uploads/session")
+		w.WriteHeader(http.StatusAccepted)
+
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/uploads/session"):
+		tr.statusAsked++
+		w.Header().Set("Location", "/v2/test/blob/blobs/uploads/session")
+		w.Header().Set("Range", fmt.Sprintf("0-%d", len(tr.uploaded)-1))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPatch:
+		var start, end int
+		fmt.Sscanf(r.Header.Get("Content-Range"), "%d-%d", &start, &end)
+		if start != len(tr.uploaded) {
+			w.Header().Set("Range", fmt.Sprintf("0-%d", len(tr.uploaded)-1))
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if tr.breakPatchKeep > 0 && start == tr.breakPatchFrom {
+			part := make([]byte, tr.breakPatchKeep)
+			io.ReadFull(r.Body, part)
+			tr.uploaded = append(tr.uploaded, part...)
+			tr.breakPatchKeep = 0
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		tr.uploaded = append(tr.uploaded, b...)
+		w.Header().Set("Location", "/v2/test/blob/blobs/uploads/session")
+		w.WriteHeader(http.StatusAccepted)
+
+	case r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/uploads/session"):
+		d := digest.Digest(r.URL.Query().Get("digest"))
+		if digest.FromBytes(tr.uploaded) != d {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		tr.committed = d
+		w.WriteHeader(http.StatusCreated)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func startTestRegistry(t *testing.T, tr *testRegistry) *DistRepo {
+	srv := httptest.NewServer(tr)
+	t.Cleanup(srv.Close)
+	r, err := NewDistRepo(nil, strings.TrimPrefix(srv.URL, "http://")+"/test/blob:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func testDownloadResumes(t *testing.T, tr *testRegistry) {
+	tr.blob = testBlob(3 * 1024 * 1024)
+	tr.breakGetAt = 1024 * 1024
+	r := startTestRegistry(t, tr)
+
+	d := digest.FromBytes(tr.blob)
+	rdr, err := r.openBlob("test/blob", d, int64(len(tr.blob)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(rdr)
+	rdr.Close()
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(tr.blob, got), "downloaded blob differs")
+	assert.Equal(t, 1, rdr.resumes)
+}
+
+func TestBlobReaderResumesWithRange(t *testing.T) {
+	tr := &testRegistry{}
+	testDownloadResumes(t, tr)
+	assert.Equal(t, []string{"bytes=1048576-"}, tr.ranged)
+}
+
+func TestBlobReaderResumesWithoutRange(t *testing.T) {
+	tr := &testRegistry{noRanges: true}
+	testDownloadResumes(t, tr)
+	assert.Empty(t, tr.ranged)
+}
+
+func TestUploadBlobResumes(t *testing.T) {
+	blob := testBlob(blobChunkSize + 4*1024*1024)
+	tr := &testRegistry{
+		breakPatchFrom: blobChunkSize,
+		breakPatchKeep: 1024 * 1024,
+	}
+	r := startTestRegistry(t, tr)
+	disturl, err := r.findUrl("test/blob:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := digest.FromBytes(blob)
+	assert.Nil(t, disturl.uploadBlob(bytes.NewReader(blob), int64(len(blob)), d))
+	assert.Equal(t, d, tr.committed)
+	// The second chunk was picked up from where the registry had it,
+	// not sent again.
+	assert.Equal(t, 1, tr.statusAsked)
+	assert.True(t, bytes.Equal(blob, tr.uploaded), "uploaded blob differs")
+}
+
+func TestForEachTarget(t *testing.T) {
+	targets := make([]Target, 3*importWorkers)
+	for i := range targets {
+		targets[i].ServiceName = fmt.Sprintf("t%d", i)
+	}
+
+	var running, most int32
+	var lock sync.Mutex
+	name, err := forEachTarget(targets, func(t *Target) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		lock.Lock()
+		if n > most {
+			most = n
+		}
+		lock.Unlock()
+
+		switch t.ServiceName {
+		case "t3":
+			// Fails after t7 does
+			time.Sleep(50 * time.Millisecond)
+			return errors.Errorf("t3 failed")
+		case "t7":
+			return errors.Errorf("t7 failed")
+		}
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	})
+
+	assert.Equal(t, "t3", name)
+	assert.EqualError(t, err, "t3 failed")
+	assert.True(t, most > 1, "targets were not imported in parallel")
+	assert.True(t, most <= importWorkers, "%d targets imported at once", most)
+}
@@ -6,19 +6,168 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/apex/log"
+	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/pkg/errors"
 	"github.com/project-machine/mos/pkg/utils"
 )
 
+// UpdateStep names a stage of Mos.Update, so that a failed update can
+// report where it went wrong.
+type UpdateStep string
+
+const (
+	UpdateStepFetch    UpdateStep = "fetch"
+	UpdateStepVerify   UpdateStep = "verify"
+	UpdateStepImport   UpdateStep = "import"
+	UpdateStepMerge    UpdateStep = "merge"
+	UpdateStepCommit   UpdateStep = "commit"
+	UpdateStepActivate UpdateStep = "activate"
+	UpdateStepRecord   UpdateStep = "record"
+)
+
+// UpdateResult records the outcome of the last Mos.Update.  It is
+// written to $config/update-result.json.
+type UpdateResult struct {
+	Url          string     `json:"url"`
+	Previous     string     `json:"previous_revision"`
+	Revision     string     `json:"revision,omitempty"`
+	Success      bool       `json:"success"`
+	FailedStep   UpdateStep `json:"failed_step,omitempty"`
+	FailedTarget string     `json:"failed_target,omitempty"`
+	Error        string     `json:"error,omitempty"`
+	RolledBack   bool       `json:"rolled_back"`
+	RestoreError string     `json:"restore_error,omitempty"`
+	Activated    []string   `json:"activated,omitempty"`
+	RebootNeeded bool       `json:"reboot_needed"` // hostfs or bootkit changed
+}
+
+// UpdateError is returned by Mos.Update on failure.
+type UpdateError struct {
+	Step       UpdateStep
+	Target     string
+	RolledBack bool
+	Err        error
+}
+
+func (e *UpdateError) Error() string {
+	msg := fmt.Sprintf("update failed during %s", e.Step)
+	if e.Target != "" {
+		msg = fmt.Sprintf("%s of %s", msg, e.Target)
+	}
+	if e.RolledBack {
+		msg += " (rolled back)"
+	}
+	return fmt.Sprintf("%s: %v", msg, e.Err)
+}
+
+func (e *UpdateError) Unwrap() error {
+	return e.Err
+}
+
+const updateResultFile = "update-result.json"
+
+// Update installs the manifest at @url.  The new manifest is staged and
+// verified before the system manifest is switched over to it, and then
+// any running services which changed are restarted.  If restarting them
+// fails, then the previous manifest and services are restored.  Either
+// way, the outcome is saved and can be read with LastUpdateResult().
 func (mos *Mos) Update(url string) error {
+	res := UpdateResult{Url: url}
+	err := mos.update(url, &res)
+	if err != nil {
+		res.Error = err.Error()
+	} else {
+		res.Success = true
+	}
+
+	if werr := mos.saveUpdateResult(&res); werr != nil {
+		log.Warnf("Failed saving update result: %v", werr)
+	}
+
+	if err != nil {
+		return &UpdateError{
+			Step:       res.FailedStep,
+			Target:     res.FailedTarget,
+			RolledBack: res.RolledBack,
+			Err:        err,
+		}
+	}
+	return nil
+}
+
+func (mos *Mos) update(url string, res *UpdateResult) error {
 	var is InstallSource
 	defer is.Cleanup()
 
-	err := is.FetchFromZot(url)
+	res.FailedStep = UpdateStepFetch
+	prevHead, err := mos.manifestHead()
 	if err != nil {
 		return err
 	}
+	res.Previous = prevHead.String()
 
+	vopts, err := mos.fetchVerifyOpts()
+	if err != nil {
+		return err
+	}
+	err = is.Fetch(mos.registry, url, vopts)
+	if err != nil {
+		return err
+	}
+	if err := saveCRLs(mos.opts.ConfigDir, is); err != nil {
+		return err
+	}
+	if err := mos.checkFetched(&is); err != nil {
+		return err
+	}
+
+	newIF, err := mos.fetchUpdate(is, res)
+	if err != nil {
+		return err
+	}
+
+	return mos.applyUpdate(is, newIF, prevHead, res)
+}
+
+// fetchUpdate verifies the install manifest in @is, which has been
+// fetched from a registry, and imports all of its targets into our
+// store.  After this, applyUpdate needs no network access.
+func (mos *Mos) fetchUpdate(is InstallSource, res *UpdateResult) (InstallFile, error) {
+	res.FailedStep = UpdateStepVerify
+	vopts, err := mos.fetchVerifyOpts()
+	if err != nil {
+		return InstallFile{}, err
+	}
+	newIF, err := VerifyInstallManifest(is, vopts)
+	if err != nil {
+		return newIF, errors.Wrapf(err, "Failed verifying signature on %s", is.FilePath)
+	}
+
+	res.FailedStep = UpdateStepImport
+	targets := append([]Target{}, newIF.Targets...)
+	failed, err := forEachTarget(targets, func(t *Target) error {
+		if err := mos.storage.ImportTarget(mos.registry, is.targetSource(t), t); err != nil {
+			return fmt.Errorf("Failed copying %s: %w", t.ServiceName, err)
+		}
+		if err := mos.storage.VerifyTarget(t); err != nil {
+			return fmt.Errorf("Bad manifest hash for %q: %w", t.ServiceName, err)
+		}
+		return nil
+	})
+	if err != nil {
+		res.FailedTarget = failed
+		return newIF, err
+	}
+
+	return newIF, nil
+}
+
+// applyUpdate switches the system manifest over to install manifest
+// @newIF, read from @is, whose targets must already be in our store, and
+// activates the services which changed.  @prevHead is the manifest
+// revision being updated from.
+func (mos *Mos) applyUpdate(is InstallSource, newIF InstallFile, prevHead plumbing.Hash, res *UpdateResult) error {
 	manifest, err := mos.CurrentManifest()
 	if err != nil {
 		return err
@@ -30,33 +179,16 @@ func (mos *Mos) Update(url string) error {
 		return fmt.Errorf("Failed calculating shasum: %w", err)
 	}
 
-	newIF, err := ReadVerifyInstallManifest(is, mos.opts.CaPath, mos.storage)
-	if err != nil {
-		return errors.Wrapf(err, "Failed verifying signature on %s", is.FilePath)
-	}
-
 	// The shasum-named install.json which we'll place in
 	// /config/manifest.git
 	mFile := fmt.Sprintf("%s.json", shaSum)
 	sFile := fmt.Sprintf("%s.json.signed", shaSum)
 	cFile := fmt.Sprintf("%s.pem", shaSum)
 
-	newtargets := SysTargets{}
+	newtargets := installSysTargets(newIF, mFile)
 
-	for _, t := range newIF.Targets {
-		newT := SysTarget{
-			Name:   t.ServiceName,
-			Source: mFile,
-			raw:    &t,
-		}
-		newtargets = append(newtargets, newT)
-		src := fmt.Sprintf("docker://%s/mos:%s", is.ocirepo.addr, dropHashAlg(t.Digest))
-		if err := mos.storage.ImportTarget(src, &t); err != nil {
-			return fmt.Errorf("Failed copying %s: %w", newT.Name, err)
-		}
-	}
-
-	sysmanifest, err := mergeUpdateTargets(manifest, newtargets, newIF.Storage, newIF.UpdateType)
+	res.FailedStep = UpdateStepMerge
+	sysmanifest, err := mergeUpdateTargets(manifest, newtargets, newIF)
 	if err != nil {
 		return err
 	}
@@ -92,27 +224,173 @@ func (mos *Mos) Update(url string) error {
 		return fmt.Errorf("Failed writing system manifest: %w", err)
 	}
 
-	if err = mos.UpdateManifest(manifest, &sysmanifest, tmpdir); err != nil {
+	// Nothing so far has touched the live manifest.  UpdateManifest
+	// only switches to the new one once it has been fully committed.
+	res.FailedStep = UpdateStepCommit
+	if err = mos.UpdateManifest(manifest, &sysmanifest, tmpdir, newIF.Product, shaSum); err != nil {
+		return err
+	}
+
+	newHead, err := mos.manifestHead()
+	if err != nil {
+		return err
+	}
+	res.Revision = newHead.String()
+
+	// Make sure the new manifest reads back and verifies before
+	// restarting anything with it.
+	mos.Manifest = nil
+	newmanifest, err := mos.CurrentManifest()
+	if err != nil {
+		mos.restoreUpdate(res, prevHead, manifest, nil, nil)
+		return errors.Wrapf(err, "Failed reading back new manifest")
+	}
+
+	res.FailedStep = UpdateStepActivate
+	touched, err := mos.activateChanged(manifest, newmanifest, true)
+	res.Activated = touched
+	if err != nil {
+		if len(touched) > 0 {
+			res.FailedTarget = touched[len(touched)-1]
+		}
+		mos.restoreUpdate(res, prevHead, manifest, newmanifest, touched)
 		return err
 	}
 
+	// Raise the security version we accept only once the update is
+	// running, so that a failed update does not leave it raised.  An
+	// update which cannot record it is undone.
+	res.FailedStep = UpdateStepRecord
+	if err := recordSecurityVersion(mos.opts.ConfigDir, newIF.SecurityVersion); err != nil {
+		mos.restoreUpdate(res, prevHead, manifest, newmanifest, touched)
+		return errors.Wrapf(err, "Failed recording security version %d", newIF.SecurityVersion)
+	}
+
+	res.FailedStep = ""
+
+	// Only now that nothing can be rolled back, delete any storage
+	// which the update removed.
+	removed := storageToRemove(manifest, newmanifest, newIF)
+	if err := mos.RemoveStorage(removed); err != nil {
+		log.Warnf("Failed removing storage: %v", err)
+	}
+
+	if targetChanged(manifest, newmanifest, "hostfs") {
+		if err := mos.stageHostfs(prevHead, newHead); err != nil {
+			log.Warnf("Failed staging new hostfs, it will be booted without fallback: %v", err)
+		}
+	}
+	res.RebootNeeded = needsReboot(manifest, newmanifest)
+
 	return nil
 }
 
+// storageToRemove returns the storage in @old which going to @next by
+// install manifest @cf deletes.  Storage which is only missing from a
+// complete update's manifest is kept.
+func storageToRemove(old, next *SysManifest, cf InstallFile) StorageList {
+	removed := StorageList{}
+	for _, r := range cf.RemoveStorage {
+		for _, n := range old.Storage {
+			if n.Label == r.Label && !next.Storage.Contains(n) {
+				removed = append(removed, n)
+			}
+		}
+	}
+	return removed
+}
+
+// restoreUpdate switches the system manifest back to @prevHead after a
+// failed update, and undoes any changes to the running services.
+func (mos *Mos) restoreUpdate(res *UpdateResult, prevHead plumbing.Hash, prev, next *SysManifest, touched []string) {
+	log.Warnf("Update failed, restoring manifest revision %s", prevHead)
+	if err := mos.switchManifest(prevHead); err != nil {
+		res.RestoreError = err.Error()
+		return
+	}
+	res.RolledBack = true
+
+	if len(touched) == 0 {
+		mos.Manifest = prev
+		return
+	}
+
+	if err := mos.restoreServices(prev, next, touched); err != nil {
+		res.RestoreError = err.Error()
+	}
+}
+
+func (mos *Mos) saveUpdateResult(res *UpdateResult) error {
+	bytes, err := json.Marshal(res)
+	if err != nil {
+		return errors.Wrapf(err, "Failed marshalling update result")
+	}
+	p := filepath.Join(mos.opts.ConfigDir, updateResultFile)
+	return os.WriteFile(p, bytes, 0644)
+}
+
+// LastUpdateResult returns the outcome of the last Mos.Update.
+func (mos *Mos) LastUpdateResult() (*UpdateResult, error) {
+	p := filepath.Join(mos.opts.ConfigDir, updateResultFile)
+	bytes, err := os.ReadFile(p)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed reading %s", p)
+	}
+	var res UpdateResult
+	if err := json.Unmarshal(bytes, &res); err != nil {
+		return nil, errors.Wrapf(err, "Failed parsing %s", p)
+	}
+	return &res, nil
+}
+
+// installSysTargets returns the targets of install manifest @cf, which
+// is stored in the system manifest as @source.
+func installSysTargets(cf InstallFile, source string) SysTargets {
+	ret := SysTargets{}
+	for _, t := range cf.Targets {
+		t := t
+		ret = append(ret, SysTarget{
+			Name:   t.ServiceName,
+			Source: source,
+			raw:    &t,
+		})
+	}
+	return ret
+}
+
 // Any target in old which is also listed in updated, gets
 // switched for the one in updated.  Any target in updated
-// which is not in old gets appended.
-func mergeUpdateTargets(old *SysManifest, updated SysTargets, s StorageList, updateType UpdateType) (SysManifest, error) {
+// which is not in old gets appended.  A partial update @cf may
+// also remove targets and storage from old.
+func mergeUpdateTargets(old *SysManifest, updated SysTargets, cf InstallFile) (SysManifest, error) {
 	newtargets := SysTargets{}
 	newstorage := StorageList{}
-	if updateType == PartialUpdate {
+	removedStorage := map[string]StorageRemoval{}
+	if cf.UpdateType == PartialUpdate {
+		removed := map[string]bool{}
+		for _, n := range cf.RemoveTargets {
+			removed[n] = true
+			if _, err := old.GetTarget(n); err != nil {
+				log.Infof("Target %s to be removed is not installed", n)
+			}
+		}
 		for _, t := range old.SysTargets {
-			if !updated.Contains(t) {
+			if !updated.Contains(t) && !removed[t.Name] {
 				newtargets = append(newtargets, t)
 			}
 		}
+
+		for _, r := range cf.RemoveStorage {
+			removedStorage[r.Label] = r
+		}
 		for _, n := range old.Storage {
-			if !s.Contains(n) {
+			if r, ok := removedStorage[n.Label]; ok {
+				if n.Persistent && !r.Persistent {
+					return SysManifest{}, errors.Errorf("Storage %s is persistent, and may only be removed with 'persistent: true'", n.Label)
+				}
+				continue
+			}
+			if !cf.Storage.Contains(n) {
 				newstorage = append(newstorage, n)
 			}
 		}
@@ -122,10 +400,18 @@ func mergeUpdateTargets(old *SysManifest, updated SysTargets, s StorageList, upd
 		newtargets = append(newtargets, t)
 	}
 
-	for _, n := range s {
+	for _, n := range cf.Storage {
 		newstorage = append(newstorage, n)
 	}
 
+	for _, t := range newtargets {
+		for _, ts := range t.raw.Storage {
+			if _, ok := removedStorage[ts.Label]; ok {
+				return SysManifest{}, errors.Errorf("Cannot remove storage %s, which is used by target %s", ts.Label, t.Name)
+			}
+		}
+	}
+
 	uidmaps := []IdmapSet{}
 	for _, t := range newtargets {
 		uidmaps = addUIDMap(old.UidMaps, uidmaps, t.raw.NSGroup)
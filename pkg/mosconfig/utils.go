@@ -157,7 +157,7 @@ func waitOnZot(port int) error {
 
 func pingRepo(port int) error {
 	url := fmt.Sprintf("127.0.0.1:%d", port)
-	return PingRepo(url)
+	return PingRepo(nil, url)
 }
 
 func pathForPartition(diskPath string, ptnum uint) string {
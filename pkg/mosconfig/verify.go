@@ -0,0 +1,120 @@
+package mosconfig
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"github.com/project-machine/mos/pkg/trust"
+	"github.com/project-machine/mos/pkg/utils"
+	"github.com/urfave/cli"
+)
+
+// An install manifest's certificate must chain to the manifest CA, be
+// for code signing, and not be revoked (see pkg/trust/crl.go).  Besides
+// the CRL next to the CA, which comes with the machine, the manifest CA
+// may publish CRLs as artifacts referring to install manifests.  Those
+// which verify under our CA are saved in $config/crl/, and every later
+// install manifest we fetch is checked against all of them, so that an
+// update which revokes a leaked key keeps it revoked even if the next
+// manifest we are offered comes without the CRL.  Manifests which we
+// have already accepted are checked against only the CRL next to the
+// CA, so that revoking the key which signed the running system does not
+// stop it from booting.
+
+// crlDir is where the CRLs we have fetched are kept, under the config
+// directory.
+const crlDir = "crl"
+
+// VerifyFlags are the global flags which mosctl takes to set how
+// install manifests are verified.
+var VerifyFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "verify-time",
+		Usage:  "Check manifest certificates as of this time (RFC 3339, or YYYY-MM-DD) rather than now, for machines whose clock cannot be trusted",
+		EnvVar: "MOS_VERIFY_TIME",
+	},
+}
+
+// ParseVerifyTime parses a --verify-time value.  "" is the zero time,
+// meaning now.
+func ParseVerifyTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		return time.Time{}, errors.Errorf("Bad verification time %q: use RFC 3339 (2024-01-02T15:04:05Z) or 2024-01-02", s)
+	}
+	return t, nil
+}
+
+// VerifyTimeFromContext returns the time set by VerifyFlags.
+func VerifyTimeFromContext(c *cli.Context) (time.Time, error) {
+	return ParseVerifyTime(c.GlobalString("verify-time"))
+}
+
+// verifyOpts returns the options for verifying install manifests we
+// have already accepted.
+func (mos *Mos) verifyOpts() trust.VerifyOpts {
+	return trust.VerifyOpts{CaPath: mos.opts.CaPath, Time: mos.opts.VerifyTime}
+}
+
+// fetchVerifyOpts returns the options for verifying a newly fetched
+// install manifest, which include the CRLs we have saved.
+func (mos *Mos) fetchVerifyOpts() (trust.VerifyOpts, error) {
+	opts := mos.verifyOpts()
+	crls, err := savedCRLs(mos.opts.ConfigDir)
+	if err != nil {
+		return opts, err
+	}
+	opts.CRLPaths = crls
+	return opts, nil
+}
+
+// savedCRLs returns the paths of the CRLs saved under @configDir.
+func savedCRLs(configDir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(configDir, crlDir, "*.crl"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed listing saved revocation lists")
+	}
+	return paths, nil
+}
+
+// saveCRLs copies the CRLs fetched with @is, which have been checked
+// against our CA, to @configDir, unless they are already there.
+func saveCRLs(configDir string, is InstallSource) error {
+	if len(is.CRLPaths) == 0 {
+		return nil
+	}
+	dir := filepath.Join(configDir, crlDir)
+	if err := utils.EnsureDir(dir); err != nil {
+		return errors.Wrapf(err, "Failed creating %s", dir)
+	}
+	for _, p := range is.CRLPaths {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return errors.Wrapf(err, "Failed reading revocation list")
+		}
+		sum := sha256.Sum256(b)
+		dest := filepath.Join(dir, hex.EncodeToString(sum[:])+".crl")
+		if utils.PathExists(dest) {
+			continue
+		}
+		if err := os.WriteFile(dest+".tmp", b, 0644); err != nil {
+			return errors.Wrapf(err, "Failed saving revocation list")
+		}
+		if err := os.Rename(dest+".tmp", dest); err != nil {
+			return errors.Wrapf(err, "Failed saving revocation list")
+		}
+		log.Infof("Saved new revocation list %s", dest)
+	}
+	return nil
+}
@@ -1,24 +1,39 @@
 package trust
 
 import (
-	"crypto"
-	"crypto/rsa"
-	"crypto/sha256"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
 	"os"
+	"slices"
+	"time"
 
 	"github.com/foxboron/go-uefi/efi/pecoff"
 	"github.com/foxboron/go-uefi/efi/pkcs7"
 	"github.com/foxboron/go-uefi/efi/util"
+	"github.com/project-machine/mos/pkg/utils"
 )
 
-// VerifyCert checks that the product cert was signed by the
-// global puzzleos cert. This version can be used by outside
-// callers, like atomix extract-soci. Note that this version
-// does not verify product pid.
-func VerifyCert(parsedCert *x509.Certificate, caPath string) error {
+// VerifyOpts are the checks which VerifyCertOpts and VerifyManifestOpts
+// make of a manifest certificate, besides requiring it to be for code
+// signing.
+type VerifyOpts struct {
+	// CaPath is the CA which must have issued the certificate.  If
+	// it does not exist, the CA is looked for in the usual places.
+	CaPath string
+
+	// CRLPaths are certificate revocation lists, besides the one
+	// next to the CA, to check the certificate against.
+	CRLPaths []string
+
+	// Time is when the certificate must be valid, for machines whose
+	// clock cannot be trusted.  If zero, it is now.
+	Time time.Time
+}
+
+// findCA returns the path and contents of the manifest CA: @caPath if
+// it exists, otherwise the first of the usual places which does.
+func findCA(caPath string) (string, []byte, error) {
 	paths := []string{
 		"/factory/secure/manifestCA.pem",
 		"/factory/secure/layerCA.pem",
@@ -26,59 +41,113 @@ func VerifyCert(parsedCert *x509.Certificate, caPath string) error {
 		"/layerCA.pem",
 	}
 	if caPath != "" {
-		paths = append(paths, caPath)
+		paths = append([]string{caPath}, paths...)
 	}
 
-	var rootBytes []byte
 	var err error
 	for _, p := range paths {
+		var rootBytes []byte
 		rootBytes, err = os.ReadFile(p)
-		if err == nil || !os.IsNotExist(err) {
+		if err == nil {
+			return p, rootBytes, nil
+		}
+		if !os.IsNotExist(err) {
 			break
 		}
-
 	}
+	return "", nil, fmt.Errorf("Failed reading OCI signing CA: %w", err)
+}
+
+// VerifyCert checks that the product cert was signed by the
+// global puzzleos cert. This version can be used by outside
+// callers, like atomix extract-soci. Note that this version
+// does not verify product pid.
+func VerifyCert(parsedCert *x509.Certificate, caPath string) error {
+	return VerifyCertOpts(parsedCert, VerifyOpts{CaPath: caPath})
+}
+
+// VerifyCertOpts is VerifyCert with the checks in @opts.  The
+// certificate must be for code signing, valid at opts.Time, and not
+// revoked by any of the CRLs (see CheckRevoked).
+func VerifyCertOpts(parsedCert *x509.Certificate, opts VerifyOpts) error {
+	caPath, rootBytes, err := findCA(opts.CaPath)
 	if err != nil {
-		return fmt.Errorf("Failed reading OCI signing CA: %w", err)
+		return err
 	}
 	pool := x509.NewCertPool()
 	if !pool.AppendCertsFromPEM(rootBytes) {
 		return fmt.Errorf("Failed adding cert from OCI signing CA")
 	}
 
-	opts := x509.VerifyOptions{
-		Roots:     pool,
-		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	vopts := x509.VerifyOptions{
+		Roots:       pool,
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		CurrentTime: opts.Time,
 	}
-	_, err = parsedCert.Verify(opts)
+	chains, err := parsedCert.Verify(vopts)
 	if err != nil {
 		return fmt.Errorf("OCI signing certificate verification failed: %w", err)
 	}
-	return nil
+	// x509 takes a certificate without the extension to be good for
+	// any use.  We want the code signing bit to be set.
+	if !slices.Contains(parsedCert.ExtKeyUsage, x509.ExtKeyUsageCodeSigning) {
+		return fmt.Errorf("OCI signing certificate is not for code signing")
+	}
+
+	crlPaths := opts.CRLPaths
+	if p := caCRLPath(caPath); utils.PathExists(p) {
+		crlPaths = append([]string{p}, crlPaths...)
+	}
+	issuer := chains[0][0]
+	if len(chains[0]) > 1 {
+		issuer = chains[0][1]
+	}
+	return CheckRevoked(parsedCert, issuer, crlPaths)
 }
 
-// VerifyManifest checks that @contents is signed by
+// VerifyManifest checks that @contents is signed by the signature at
+// @sigPath, made with the key of the certificate at @certPath, and that
+// the certificate is signed by our CA.
 func VerifyManifest(contents []byte, sigPath, certPath, caPath string) error {
-	// Get the cert and extract the public key
-	var parsedCert *x509.Certificate
+	return VerifyManifestAlg(contents, sigPath, certPath, caPath, "")
+}
+
+// VerifyManifestAlg is VerifyManifest for a signature made with @sigAlg.
+// If @sigAlg is "", it is the default for the certificate's key.
+func VerifyManifestAlg(contents []byte, sigPath, certPath, caPath, sigAlg string) error {
+	return VerifyManifestOpts(contents, sigPath, certPath, sigAlg, VerifyOpts{CaPath: caPath})
+}
+
+// VerifyCertFile checks the manifest certificate at @certPath as in
+// VerifyCertOpts, and returns it.
+func VerifyCertFile(certPath string, opts VerifyOpts) (*x509.Certificate, error) {
 	certPEM, err := os.ReadFile(certPath)
 	if err != nil {
-		return fmt.Errorf("Failed reading manifest cert (%q): %w", certPath, err)
+		return nil, fmt.Errorf("Failed reading manifest cert (%q): %w", certPath, err)
 	}
 	block, _ := pem.Decode([]byte(certPEM))
 	if block == nil {
-		return fmt.Errorf("Failed to decode manifest cert (%q)", certPath)
+		return nil, fmt.Errorf("Failed to decode manifest cert (%q)", certPath)
 	}
-	parsedCert, err = x509.ParseCertificate(block.Bytes)
+	parsedCert, err := x509.ParseCertificate(block.Bytes)
 	if err != nil {
-		return fmt.Errorf("Failed parsing manifest cert (%q): %w", certPath, err)
+		return nil, fmt.Errorf("Failed parsing manifest cert (%q): %w", certPath, err)
 	}
-	rsaPublicKey := parsedCert.PublicKey.(*rsa.PublicKey)
 
 	// Verify the chain of trust
-	err = VerifyCert(parsedCert, caPath)
+	err = VerifyCertOpts(parsedCert, opts)
 	if err != nil {
-		return fmt.Errorf("Manifest certificate does not match the CA: %w", err)
+		return nil, fmt.Errorf("Manifest certificate does not match the CA: %w", err)
+	}
+	return parsedCert, nil
+}
+
+// VerifyManifestOpts is VerifyManifestAlg checking the certificate as
+// in VerifyCertOpts.
+func VerifyManifestOpts(contents []byte, sigPath, certPath, sigAlg string, opts VerifyOpts) error {
+	parsedCert, err := VerifyCertFile(certPath, opts)
+	if err != nil {
+		return err
 	}
 
 	// Get the signature
@@ -88,8 +157,7 @@ func VerifyManifest(contents []byte, sigPath, certPath, caPath string) error {
 	}
 
 	// Verify signature
-	msghash := sha256.Sum256(contents)
-	err = rsa.VerifyPKCS1v15(rsaPublicKey, crypto.SHA256, msghash[:], signature)
+	err = verifyBytes(contents, signature, parsedCert.PublicKey, sigAlg)
 	if err != nil {
 		return fmt.Errorf("Failed verifying manifest signature: %w", err)
 	}
@@ -97,56 +165,69 @@ func VerifyManifest(contents []byte, sigPath, certPath, caPath string) error {
 	return nil
 }
 
-// Sign signs a file
-// Sign the contents of @sourcePath using the key at @keyPath,
-// storing the result in the file called @signedpath
-func Sign(sourcePath, signedPath, keyPath string) error {
-	// Get the key to use for signing
-	privKey, err := os.ReadFile(keyPath)
-	if err != nil {
-		return fmt.Errorf("Failed reading (%q): %w", keyPath, err)
+// VerifyBytes checks that @signature is a signature of @contents made
+// with @sigAlg by the key of @cert, and that @cert is valid as in
+// VerifyCertOpts.
+func VerifyBytes(contents, signature []byte, cert *x509.Certificate, sigAlg string, opts VerifyOpts) error {
+	if err := VerifyCertOpts(cert, opts); err != nil {
+		return fmt.Errorf("Certificate does not match the CA: %w", err)
 	}
-	pemBlock, _ := pem.Decode(privKey)
-	if pemBlock == nil {
-		return fmt.Errorf("Failed to decode key: (%q)", keyPath)
+	return verifyBytes(contents, signature, cert.PublicKey, sigAlg)
+}
+
+// SignBytes signs @msg with the key named by @keyRef (see NewSigner),
+// returning the signature and its algorithm.
+func SignBytes(msg []byte, keyRef string) ([]byte, string, error) {
+	signer, err := NewSigner(keyRef)
+	if err != nil {
+		return nil, "", err
 	}
-	pkcsKey, err := x509.ParsePKCS8PrivateKey(pemBlock.Bytes)
+	defer signer.Close()
+	return signBytes(msg, signer)
+}
+
+// Sign signs a file
+// Sign the contents of @sourcePath using the key named by @keyRef (see
+// NewSigner), storing the result in the file called @signedpath.  The
+// signature algorithm is returned.
+func Sign(sourcePath, signedPath, keyRef string) (string, error) {
+	// Get the key to use for signing
+	signer, err := NewSigner(keyRef)
 	if err != nil {
-		return fmt.Errorf("Failed parsing key, (%q): %w", keyPath, err)
+		return "", err
 	}
+	defer signer.Close()
 
-	// Hash the data @sourcePath
 	msg, err := os.ReadFile(sourcePath)
 	if err != nil {
-		return fmt.Errorf("Failed reading (%q): %w", sourcePath, err)
+		return "", fmt.Errorf("Failed reading (%q): %w", sourcePath, err)
 	}
-	msghash := sha256.Sum256(msg)
 
-	// Sign the hash
-	signature, err := rsa.SignPKCS1v15(nil, pkcsKey.(*rsa.PrivateKey), crypto.SHA256, msghash[:])
+	signature, alg, err := signBytes(msg, signer)
 	if err != nil {
-		return fmt.Errorf("Failed signing hash of (%q): %w", sourcePath, err)
+		return "", fmt.Errorf("Failed signing (%q): %w", sourcePath, err)
 	}
 
 	// Write the signature to signedPath
 	err = os.WriteFile(signedPath, signature, 0640)
 	if err != nil {
-		return fmt.Errorf("Failed writing signature to (%q): %w", signedPath, err)
+		return "", fmt.Errorf("Failed writing signature to (%q): %w", signedPath, err)
 	}
 
-	return nil
+	return alg, nil
 }
 
 // SignEFI signs an efi binary
 // Sign the contents of @sourcePath using the key at @keyPath and
 // the cert at @certPath storing the result in the file
 // called @signedPath
-func SignEFI(sourcePath, signedPath, keyPath, certPath string) error {
+func SignEFI(sourcePath, signedPath, keyRef, certPath string) error {
 	// Get the key to use for signing
-	privkey, err := util.ReadKeyFromFile(keyPath)
+	privkey, err := NewSigner(keyRef)
 	if err != nil {
-		return fmt.Errorf("Failed reading (%q): %w", keyPath, err)
+		return err
 	}
+	defer privkey.Close()
 	cert, err := util.ReadCertFromFile(certPath)
 	if err != nil {
 		return fmt.Errorf("Failed reading (%q): %w", certPath, err)
@@ -15,7 +15,7 @@ func (i NVIndex) String() string {
 }
 
 const PolicyVersion EAPolicyVersion = 1
-const TpmLayoutVersion int = 3
+const TpmLayoutVersion int = 4
 const (
 	// This is the password for TPM administration.
 	TPM2IndexPassword NVIndex = 0x1500001
@@ -32,6 +32,12 @@ const (
 	TPM2IndexSBSKey NVIndex = 0x1500030
 	// The LUKS password for OS filesystems
 	TPM2IndexOSKey NVIndex = 0x1500040
+	// The NV counter holding the highest security version of install
+	// manifest the host has accepted, the counter's value when it
+	// was defined, and the auth value for raising it.
+	TPM2IndexSecurityVersion     NVIndex = 0x1500050
+	TPM2IndexSecurityVersionBase NVIndex = 0x1500051
+	TPM2IndexSecurityVersionAuth NVIndex = 0x1500052
 )
 
 const TPM_PCRS_DEF = "sha256:7"
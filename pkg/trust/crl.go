@@ -0,0 +1,207 @@
+package trust
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A manifest signing key which has leaked is retired by having the
+// manifest CA revoke its certificate in a certificate revocation list
+// (CRL).  CRLs are read from next to the CA, e.g.
+// /factory/secure/manifestCA.crl for /factory/secure/manifestCA.pem,
+// and from wherever the caller passes in VerifyOpts.CRLPaths, such as
+// those published alongside install manifests.  Since anyone can
+// publish a CRL, only those signed by the CA count.  A revoked
+// certificate stays revoked, so every CRL is checked, however old: a
+// stale CRL can only miss revocations, never undo them.
+
+// caCRLPath returns the path of the CRL kept next to the CA at @caPath.
+func caCRLPath(caPath string) string {
+	return strings.TrimSuffix(caPath, filepath.Ext(caPath)) + ".crl"
+}
+
+// ReadCRLs reads the CRLs, PEM or DER encoded, in the file at @path.
+func ReadCRLs(path string) ([]*x509.RevocationList, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading revocation list (%q): %w", path, err)
+	}
+
+	if !bytes.Contains(b, []byte("-----BEGIN")) {
+		crl, err := x509.ParseRevocationList(b)
+		if err != nil {
+			return nil, fmt.Errorf("Failed parsing revocation list (%q): %w", path, err)
+		}
+		return []*x509.RevocationList{crl}, nil
+	}
+
+	crls := []*x509.RevocationList{}
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		crl, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Failed parsing revocation list (%q): %w", path, err)
+		}
+		crls = append(crls, crl)
+	}
+	if len(crls) == 0 {
+		return nil, fmt.Errorf("No revocation list found in %q", path)
+	}
+	return crls, nil
+}
+
+// CheckRevoked returns an error if @cert is revoked by any of the CRLs
+// at @crlPaths issued by @ca.  Those of other issuers are ignored, but
+// one naming @ca as its issuer must be signed by it.
+func CheckRevoked(cert, ca *x509.Certificate, crlPaths []string) error {
+	for _, p := range crlPaths {
+		crls, err := ReadCRLs(p)
+		if err != nil {
+			return err
+		}
+		for _, crl := range crls {
+			if !bytes.Equal(crl.RawIssuer, ca.RawSubject) {
+				continue
+			}
+			if err := crl.CheckSignatureFrom(ca); err != nil {
+				return fmt.Errorf("Bad revocation list (%q): %w", p, err)
+			}
+			for _, r := range crl.RevokedCertificateEntries {
+				if r.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+					return fmt.Errorf("Certificate %q (serial %x) was revoked on %s by %q",
+						cert.Subject.CommonName, cert.SerialNumber, r.RevocationTime.Format(time.RFC3339), p)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// CheckCRL checks that each CRL at @crlPath is signed by the manifest
+// CA @caPath (or, as in VerifyOpts, by the one in the usual places).
+func CheckCRL(crlPath, caPath string) error {
+	_, rootBytes, err := findCA(caPath)
+	if err != nil {
+		return err
+	}
+	cas, err := parseCerts(rootBytes)
+	if err != nil {
+		return err
+	}
+	crls, err := ReadCRLs(crlPath)
+	if err != nil {
+		return err
+	}
+	for _, crl := range crls {
+		var lastErr error = errors.New("No CA certificate named as its issuer")
+		for _, ca := range cas {
+			if !bytes.Equal(crl.RawIssuer, ca.RawSubject) {
+				continue
+			}
+			if lastErr = crl.CheckSignatureFrom(ca); lastErr == nil {
+				break
+			}
+		}
+		if lastErr != nil {
+			return fmt.Errorf("Revocation list (%q) is not from the manifest CA: %w", crlPath, lastErr)
+		}
+	}
+	return nil
+}
+
+// parseCerts returns the certificates in the PEM encoded @b.
+func parseCerts(b []byte) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Failed parsing CA certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("No CA certificate found")
+	}
+	return certs, nil
+}
+
+// RevokeCert adds @cert to the CRL at @crlPath, which is issued by @ca
+// with @caKey, creating it if need be.  The new CRL replaces the old,
+// with the next CRL number.
+func RevokeCert(crlPath string, ca *x509.Certificate, caKey crypto.Signer, cert *x509.Certificate) error {
+	now := time.Now()
+	template := x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: now,
+		// Stale CRLs are still honoured, so this does not matter
+		// much.  It must be set, though.
+		NextUpdate: ca.NotAfter,
+	}
+	if !template.NextUpdate.After(now) {
+		template.NextUpdate = now.AddDate(1, 0, 0)
+	}
+
+	if _, err := os.Stat(crlPath); err == nil {
+		crls, err := ReadCRLs(crlPath)
+		if err != nil {
+			return err
+		}
+		old := crls[0]
+		if err := old.CheckSignatureFrom(ca); err != nil {
+			return fmt.Errorf("Revocation list (%q) is not from this CA: %w", crlPath, err)
+		}
+		for _, r := range old.RevokedCertificateEntries {
+			if r.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return fmt.Errorf("Certificate %q is already revoked", cert.Subject.CommonName)
+			}
+		}
+		template.RevokedCertificateEntries = old.RevokedCertificateEntries
+		template.Number = new(big.Int).Add(old.Number, big.NewInt(1))
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+		SerialNumber:   cert.SerialNumber,
+		RevocationTime: now,
+	})
+
+	// Manifest CAs have been created without a key usage extension,
+	// which allows them to sign CRLs, but x509 wants to see the bit.
+	issuer := *ca
+	issuer.KeyUsage |= x509.KeyUsageCRLSign
+
+	der, err := x509.CreateRevocationList(rand.Reader, &template, &issuer, caKey)
+	if err != nil {
+		return fmt.Errorf("Failed creating revocation list: %w", err)
+	}
+	b := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+	if err := os.WriteFile(crlPath, b, 0644); err != nil {
+		return fmt.Errorf("Failed writing revocation list (%q): %w", crlPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,356 @@
+package trust
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/pkcs11"
+	"github.com/miekg/pkcs11/p11"
+	pkcs11uri "github.com/stefanberger/go-pkcs11uri"
+)
+
+// The PKCS#11 URI selects the token by its token, serial, manufacturer,
+// model or slot-id attributes, and the key by its object (label) or id.
+// The module to load is given by module-path or module-name, or else
+// by $MOS_PKCS11_MODULE, and the user PIN by pin-value or pin-source,
+// or else by $MOS_PKCS11_PIN.  The key's public part is read from the
+// public key or certificate object of the same label or id.
+
+const (
+	PKCS11ModuleEnv = "MOS_PKCS11_MODULE"
+	PKCS11PinEnv    = "MOS_PKCS11_PIN"
+)
+
+// pkcs11ModuleDirs are searched for the module-name of a PKCS#11 URI.
+var pkcs11ModuleDirs = []string{
+	"/usr/lib/x86_64-linux-gnu/pkcs11",
+	"/usr/lib/aarch64-linux-gnu/pkcs11",
+	"/usr/lib/x86_64-linux-gnu/softhsm",
+	"/usr/lib/aarch64-linux-gnu/softhsm",
+	"/usr/lib64/pkcs11",
+	"/usr/lib/pkcs11",
+	"/usr/lib/softhsm",
+}
+
+// Not defined by github.com/miekg/pkcs11.
+const (
+	ckkECEdwards = 0x00000040
+	ckmEdDSA     = 0x00001057
+)
+
+// DER encoded DigestInfo prefixes for RSA PKCS#1 v1.5 signatures.
+var digestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+var (
+	oidCurveP256    = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+	oidCurveP384    = asn1.ObjectIdentifier{1, 3, 132, 0, 34}
+	oidCurveEd25519 = asn1.ObjectIdentifier{1, 3, 101, 112}
+)
+
+// pkcs11Signer is a Signer for a private key in a PKCS#11 token.
+type pkcs11Signer struct {
+	session p11.Session
+	key     p11.PrivateKey
+	pub     crypto.PublicKey
+}
+
+func newPKCS11Signer(keyURI string) (*pkcs11Signer, error) {
+	uri := pkcs11uri.New()
+	if err := uri.Parse(keyURI); err != nil {
+		return nil, fmt.Errorf("Bad PKCS#11 URI %q: %w", keyURI, err)
+	}
+	uri.SetModuleDirectories(pkcs11ModuleDirs)
+	uri.SetAllowAnyModule(true)
+
+	modulePath, err := uri.GetModule()
+	if err != nil {
+		modulePath = os.Getenv(PKCS11ModuleEnv)
+		if modulePath == "" {
+			return nil, fmt.Errorf("No PKCS#11 module for %q (set module-path in the URI or $%s): %w", keyURI, PKCS11ModuleEnv, err)
+		}
+	}
+	module, err := p11.OpenModule(modulePath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed loading PKCS#11 module %q: %w", modulePath, err)
+	}
+
+	slot, err := findPKCS11Slot(module, uri)
+	if err != nil {
+		return nil, fmt.Errorf("%w (%q)", err, keyURI)
+	}
+	session, err := slot.OpenSession()
+	if err != nil {
+		return nil, fmt.Errorf("Failed opening PKCS#11 session: %w", err)
+	}
+	s := &pkcs11Signer{session: session}
+
+	pin := os.Getenv(PKCS11PinEnv)
+	if uri.HasPIN() {
+		if pin, err = uri.GetPIN(); err != nil {
+			session.Close()
+			return nil, fmt.Errorf("Failed reading PKCS#11 PIN: %w", err)
+		}
+		pin = strings.TrimRight(pin, "\r\n")
+	}
+	if pin != "" {
+		err = session.Login(pin)
+		if err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+			session.Close()
+			return nil, fmt.Errorf("Failed logging in to PKCS#11 token: %w", err)
+		}
+	}
+
+	if err := s.findKey(uri); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("%w (%q)", err, keyURI)
+	}
+	return s, nil
+}
+
+// findPKCS11Slot returns the slot of @module whose token matches @uri.
+func findPKCS11Slot(module p11.Module, uri *pkcs11uri.Pkcs11URI) (p11.Slot, error) {
+	slots, err := module.Slots()
+	if err != nil {
+		return p11.Slot{}, fmt.Errorf("Failed listing PKCS#11 slots: %w", err)
+	}
+	var found []p11.Slot
+	for _, slot := range slots {
+		if v, ok := uri.GetPathAttribute("slot-id", false); ok {
+			if id, _ := strconv.ParseUint(v, 10, 0); uint(id) != slot.ID() {
+				continue
+			}
+		}
+		info, err := slot.TokenInfo()
+		if err != nil {
+			continue
+		}
+		attrs := map[string]string{
+			"token":        info.Label,
+			"serial":       info.SerialNumber,
+			"manufacturer": info.ManufacturerID,
+			"model":        info.Model,
+		}
+		match := true
+		for name, value := range attrs {
+			v, ok := uri.GetPathAttribute(name, false)
+			if ok && v != strings.TrimRight(value, " \x00") {
+				match = false
+			}
+		}
+		if match {
+			found = append(found, slot)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return p11.Slot{}, fmt.Errorf("No matching PKCS#11 token found")
+	case 1:
+		return found[0], nil
+	}
+	return p11.Slot{}, fmt.Errorf("%d PKCS#11 tokens match", len(found))
+}
+
+// objectTemplate returns the attributes matching objects of @class named
+// by @uri.
+func objectTemplate(uri *pkcs11uri.Pkcs11URI, class uint) []*pkcs11.Attribute {
+	template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, class)}
+	if v, ok := uri.GetPathAttribute("object", false); ok {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, v))
+	}
+	if v, ok := uri.GetPathAttribute("id", false); ok {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(v)))
+	}
+	return template
+}
+
+// findKey finds the private key named by @uri and its public key.
+func (s *pkcs11Signer) findKey(uri *pkcs11uri.Pkcs11URI) error {
+	_, hasObject := uri.GetPathAttribute("object", false)
+	_, hasId := uri.GetPathAttribute("id", false)
+	if !hasObject && !hasId {
+		return fmt.Errorf("PKCS#11 URI names no object or id")
+	}
+
+	obj, err := s.session.FindObject(objectTemplate(uri, pkcs11.CKO_PRIVATE_KEY))
+	if err != nil {
+		return fmt.Errorf("Failed finding PKCS#11 private key: %w", err)
+	}
+	s.key = p11.PrivateKey(obj)
+
+	if obj, err := s.session.FindObject(objectTemplate(uri, pkcs11.CKO_PUBLIC_KEY)); err == nil {
+		s.pub, err = pkcs11PublicKey(obj)
+		return err
+	}
+	if obj, err := s.session.FindObject(objectTemplate(uri, pkcs11.CKO_CERTIFICATE)); err == nil {
+		der, err := obj.Value()
+		if err != nil {
+			return fmt.Errorf("Failed reading PKCS#11 certificate: %w", err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("Failed parsing PKCS#11 certificate: %w", err)
+		}
+		s.pub = cert.PublicKey
+		return nil
+	}
+	// RSA private keys usually carry their public part.
+	if s.pub, err = pkcs11PublicKey(obj); err != nil {
+		return fmt.Errorf("No PKCS#11 public key or certificate found for the private key: %w", err)
+	}
+	return nil
+}
+
+// ulongAttribute reads the CK_ULONG attribute @attr of @obj.
+func ulongAttribute(obj p11.Object, attr uint) (uint64, error) {
+	b, err := obj.Attribute(attr)
+	if err != nil {
+		return 0, err
+	}
+	switch len(b) {
+	case 4:
+		return uint64(binary.NativeEndian.Uint32(b)), nil
+	case 8:
+		return binary.NativeEndian.Uint64(b), nil
+	}
+	return 0, fmt.Errorf("Bad PKCS#11 attribute length %d", len(b))
+}
+
+// pkcs11PublicKey reads the public key from the key object @obj.
+func pkcs11PublicKey(obj p11.Object) (crypto.PublicKey, error) {
+	keyType, err := ulongAttribute(obj, pkcs11.CKA_KEY_TYPE)
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading PKCS#11 key type: %w", err)
+	}
+
+	switch keyType {
+	case pkcs11.CKK_RSA:
+		n, err := obj.Attribute(pkcs11.CKA_MODULUS)
+		if err != nil {
+			return nil, err
+		}
+		e, err := obj.Attribute(pkcs11.CKA_PUBLIC_EXPONENT)
+		if err != nil {
+			return nil, err
+		}
+		if len(n) == 0 || len(e) == 0 {
+			return nil, fmt.Errorf("PKCS#11 RSA key has no public part")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case pkcs11.CKK_EC, ckkECEdwards:
+	default:
+		return nil, fmt.Errorf("Unsupported PKCS#11 key type %#x", keyType)
+	}
+
+	params, err := obj.Attribute(pkcs11.CKA_EC_PARAMS)
+	if err != nil {
+		return nil, err
+	}
+	point, err := obj.Attribute(pkcs11.CKA_EC_POINT)
+	if err != nil {
+		return nil, err
+	}
+	if len(point) == 0 {
+		return nil, fmt.Errorf("PKCS#11 key has no public part")
+	}
+	// The point should be a DER octet string, but some tokens give it
+	// bare.
+	var raw []byte
+	if rest, err := asn1.Unmarshal(point, &raw); err == nil && len(rest) == 0 {
+		point = raw
+	}
+
+	var oid asn1.ObjectIdentifier
+	var name string
+	if _, err := asn1.Unmarshal(params, &oid); err != nil {
+		// PKCS#11 3.0 lets Edwards curves be named by a printable string.
+		if _, err := asn1.Unmarshal(params, &name); err != nil {
+			return nil, fmt.Errorf("Bad PKCS#11 EC parameters: %w", err)
+		}
+	}
+
+	var curve elliptic.Curve
+	switch {
+	case oid.Equal(oidCurveP256):
+		curve = elliptic.P256()
+	case oid.Equal(oidCurveP384):
+		curve = elliptic.P384()
+	case oid.Equal(oidCurveEd25519), name == "edwards25519":
+		if len(point) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Bad PKCS#11 Ed25519 public key")
+		}
+		return ed25519.PublicKey(point), nil
+	default:
+		return nil, fmt.Errorf("Unsupported PKCS#11 EC curve %v%s", oid, name)
+	}
+	x, y := elliptic.Unmarshal(curve, point)
+	if x == nil {
+		return nil, fmt.Errorf("Bad PKCS#11 EC point")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.pub
+}
+
+// Sign signs @digest, or for Ed25519 the message, in the token.
+func (s *pkcs11Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	switch s.pub.(type) {
+	case *rsa.PublicKey:
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			return nil, fmt.Errorf("RSA-PSS signing is not supported for PKCS#11 keys")
+		}
+		prefix, ok := digestInfoPrefixes[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("Unsupported hash %v for PKCS#11 RSA signing", opts.HashFunc())
+		}
+		msg := append(append([]byte{}, prefix...), digest...)
+		return s.key.Sign(*pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil), msg)
+
+	case *ecdsa.PublicKey:
+		sig, err := s.key.Sign(*pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil), digest)
+		if err != nil {
+			return nil, err
+		}
+		// The token returns r || s; Go wants ASN.1.
+		if len(sig)%2 != 0 {
+			return nil, fmt.Errorf("Bad PKCS#11 ECDSA signature length %d", len(sig))
+		}
+		half := len(sig) / 2
+		return asn1.Marshal(struct{ R, S *big.Int }{
+			new(big.Int).SetBytes(sig[:half]),
+			new(big.Int).SetBytes(sig[half:]),
+		})
+
+	case ed25519.PublicKey:
+		if opts.HashFunc() != crypto.Hash(0) {
+			return nil, fmt.Errorf("Ed25519 signs the message, not a hash")
+		}
+		return s.key.Sign(*pkcs11.NewMechanism(ckmEdDSA, nil), digest)
+	}
+	return nil, fmt.Errorf("Unsupported public key type %T", s.pub)
+}
+
+func (s *pkcs11Signer) Close() error {
+	return s.session.Close()
+}
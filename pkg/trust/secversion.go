@@ -0,0 +1,158 @@
+package trust
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+
+	"github.com/apex/log"
+	"github.com/project-machine/mos/pkg/utils"
+)
+
+// The highest security version of install manifest which a host has
+// accepted is kept in a TPM NV counter, which can only go up, so that
+// it is not lost by restoring an old config partition or reinstalling.
+// A new counter starts at the highest value which any counter in the
+// TPM has had, so its value when it was defined at provisioning is
+// kept in TPM2IndexSecurityVersionBase, and the security version is the
+// difference.
+//
+// Anyone may read the counter, but raising it takes its auth value, a
+// random secret made at provisioning.  The secret is kept in
+// TPM2IndexSecurityVersionAuth, which, like the LUKS keys, can only be
+// read under the signed EA policy, so before the initrd extends PCR7.
+// The initrd puts it in root's keyring as securityVersionKey, for
+// mosctl to use.
+
+// securityVersionKey names the counter's auth value in the keyring.
+const securityVersionKey = "machine:secversion"
+
+// MaxSecurityVersionStep is the most which one install manifest may
+// raise the security version by.  The counter is raised one increment,
+// so one NV write, at a time, and a mistyped security version must not
+// wear it out.
+const MaxSecurityVersionStep = 100
+
+// defineSecurityVersion defines the security version counter, at 0,
+// with a new auth value, readable under the EA policy in
+// @policyDigestFile.
+func (c *tpm2V3Context) defineSecurityVersion(policyDigestFile string) error {
+	auth, err := genPassphrase(32)
+	if err != nil {
+		return err
+	}
+	cmd := []string{"tpm2_nvdefine", "--attributes=nt=counter|ownerread|authread|authwrite",
+		"--hierarchy-auth=" + c.adminPwd, "--index-auth=file:-", "--size=8", TPM2IndexSecurityVersion.String()}
+	stdout, stderr, rc := utils.RunWithStdinRC(auth, cmd...)
+	if rc != 0 {
+		return fmt.Errorf("Failed running %s [%d]\nError: %s\nOutput: %s\n", cmd, rc, stderr, stdout)
+	}
+
+	attributes := "ownerwrite|ownerread|policyread"
+	if err := c.Tpm2NVDefine(policyDigestFile, attributes, TPM2IndexSecurityVersionAuth, len(auth)); err != nil {
+		return err
+	}
+	if err := c.Tpm2NVWriteAsAdmin(TPM2IndexSecurityVersionAuth, auth); err != nil {
+		return err
+	}
+
+	// A counter cannot be read until it has been incremented.
+	if err := incrementSecurityVersion(auth); err != nil {
+		return err
+	}
+	base, err := readTPMCounter(TPM2IndexSecurityVersion)
+	if err != nil {
+		return err
+	}
+	return c.StorePublic(TPM2IndexSecurityVersionBase, fmt.Sprintf("%016x", base))
+}
+
+// loadSecurityVersionAuth puts the counter's auth value in root's
+// keyring.  It must be called while the EA policy in @signedPolicyPath
+// can be satisfied.
+func (c *tpm2V3Context) loadSecurityVersionAuth(signedPolicyPath string) error {
+	if _, err := Tpm2NVIndexLength(TPM2IndexSecurityVersionAuth); err != nil {
+		log.Debugf("No security version counter in TPM: %v", err)
+		return nil
+	}
+	auth, err := c.ReadSecret(TPM2IndexSecurityVersionAuth, signedPolicyPath)
+	if err != nil {
+		return fmt.Errorf("Failed reading security version auth from TPM: %w", err)
+	}
+	return addUserKey(securityVersionKey, auth)
+}
+
+func incrementSecurityVersion(auth string) error {
+	cmd := []string{"tpm2_nvincrement", "--auth=file:-", TPM2IndexSecurityVersion.String()}
+	stdout, stderr, rc := utils.RunWithStdinRC(auth, cmd...)
+	if rc != 0 {
+		return fmt.Errorf("Failed running %s [%d]\nError: %s\nOutput: %s\n", cmd, rc, stderr, stdout)
+	}
+	return nil
+}
+
+func readTPMCounter(idx NVIndex) (uint64, error) {
+	s, err := Tpm2Read(idx, 8)
+	if err != nil {
+		return 0, err
+	}
+	if len(s) != 8 {
+		return 0, fmt.Errorf("Bad counter value read from index %s", idx)
+	}
+	return binary.BigEndian.Uint64([]byte(s)), nil
+}
+
+// TPMSecurityVersion returns the security version recorded in the TPM.
+// It returns false if there is no TPM, or it was provisioned without a
+// security version counter.
+func TPMSecurityVersion() (uint64, bool, error) {
+	if !utils.PathExists("/dev/tpm0") {
+		return 0, false, nil
+	}
+	if _, err := Tpm2NVIndexLength(TPM2IndexSecurityVersionBase); err != nil {
+		log.Debugf("No security version counter in TPM: %v", err)
+		return 0, false, nil
+	}
+
+	s, err := Tpm2Read(TPM2IndexSecurityVersionBase, 16)
+	if err != nil {
+		return 0, false, err
+	}
+	base, err := strconv.ParseUint(s, 16, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("Bad security version base %q in TPM: %w", s, err)
+	}
+	count, err := readTPMCounter(TPM2IndexSecurityVersion)
+	if err != nil {
+		return 0, false, err
+	}
+	if count < base {
+		return 0, false, fmt.Errorf("TPM security version counter (%d) is below its base (%d)", count, base)
+	}
+	return count - base, true, nil
+}
+
+// RaiseTPMSecurityVersion raises the security version recorded in the
+// TPM to @v, if it is lower and the TPM has a security version counter.
+// It refuses to raise it by more than MaxSecurityVersionStep.  The
+// counter's auth value must be in root's keyring.
+func RaiseTPMSecurityVersion(v uint64) error {
+	cur, ok, err := TPMSecurityVersion()
+	if err != nil || !ok || cur >= v {
+		return err
+	}
+	if v-cur > MaxSecurityVersionStep {
+		return fmt.Errorf("Refusing to raise TPM security version from %d to %d, by more than %d",
+			cur, v, MaxSecurityVersionStep)
+	}
+	auth, err := utils.ReadKeyFromUserKeyring(securityVersionKey)
+	if err != nil {
+		return fmt.Errorf("Failed reading security version auth: %w", err)
+	}
+	for ; cur < v; cur++ {
+		if err := incrementSecurityVersion(auth); err != nil {
+			return fmt.Errorf("Failed raising TPM security version to %d: %w", v, err)
+		}
+	}
+	return nil
+}
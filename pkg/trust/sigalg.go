@@ -0,0 +1,179 @@
+package trust
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"strings"
+)
+
+// Manifest signing keys may be RSA, ECDSA on P-256 or P-384, or
+// Ed25519.  The signature is over the whole manifest:
+//
+//	rsa-pkcs1v15-sha256: RSA PKCS#1 v1.5 over its SHA-256
+//	ecdsa-sha256:        ASN.1 ECDSA over its SHA-256 (P-256 keys)
+//	ecdsa-sha384:        ASN.1 ECDSA over its SHA-384 (P-384 keys)
+//	ed25519:             pure Ed25519
+//
+// so that, as before, 'openssl dgst -sign' and 'openssl dgst -verify'
+// can make and check them (with -rawin for Ed25519).  The algorithm is
+// published alongside the signature.  If it is not known, as for
+// manifests signed before this was recorded, it is taken to be the one
+// above for the certificate's key.
+
+const (
+	KeyTypeRSA2048   = "rsa2048"
+	KeyTypeECDSAP256 = "ecdsa-p256"
+	KeyTypeECDSAP384 = "ecdsa-p384"
+	KeyTypeEd25519   = "ed25519"
+
+	DefaultKeyType = KeyTypeRSA2048
+)
+
+// KeyTypes are the key types which GenerateKey can create.
+var KeyTypes = []string{KeyTypeRSA2048, KeyTypeECDSAP256, KeyTypeECDSAP384, KeyTypeEd25519}
+
+const (
+	SigAlgRSASHA256   = "rsa-pkcs1v15-sha256"
+	SigAlgECDSASHA256 = "ecdsa-sha256"
+	SigAlgECDSASHA384 = "ecdsa-sha384"
+	SigAlgEd25519     = "ed25519"
+)
+
+// CheckKeyType returns an error if GenerateKey cannot create keys of
+// type @keyType.
+func CheckKeyType(keyType string) error {
+	for _, t := range KeyTypes {
+		if t == keyType {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unsupported key type %q (supported: %s)", keyType, strings.Join(KeyTypes, ", "))
+}
+
+// GenerateKey creates a new private key of type @keyType.
+func GenerateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeRSA2048:
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		if err := key.Validate(); err != nil {
+			return nil, err
+		}
+		return key, nil
+	case KeyTypeECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, CheckKeyType(keyType)
+}
+
+// KeyTypeOf returns the key type of public key @pub.
+func KeyTypeOf(pub crypto.PublicKey) (string, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return KeyTypeRSA2048, nil
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return KeyTypeECDSAP256, nil
+		case elliptic.P384():
+			return KeyTypeECDSAP384, nil
+		}
+		return "", fmt.Errorf("Unsupported ECDSA curve %s", k.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return KeyTypeEd25519, nil
+	}
+	return "", fmt.Errorf("Unsupported public key type %T", pub)
+}
+
+// SignatureAlgorithm returns the algorithm with which manifests are
+// signed by the key whose public part is @pub.
+func SignatureAlgorithm(pub crypto.PublicKey) (string, error) {
+	keyType, err := KeyTypeOf(pub)
+	if err != nil {
+		return "", err
+	}
+	switch keyType {
+	case KeyTypeECDSAP256:
+		return SigAlgECDSASHA256, nil
+	case KeyTypeECDSAP384:
+		return SigAlgECDSASHA384, nil
+	case KeyTypeEd25519:
+		return SigAlgEd25519, nil
+	}
+	return SigAlgRSASHA256, nil
+}
+
+// signBytes signs @msg with @key, returning the signature and its
+// algorithm.
+func signBytes(msg []byte, key crypto.Signer) ([]byte, string, error) {
+	alg, err := SignatureAlgorithm(key.Public())
+	if err != nil {
+		return nil, "", err
+	}
+	var sig []byte
+	switch alg {
+	case SigAlgEd25519:
+		sig, err = key.Sign(rand.Reader, msg, crypto.Hash(0))
+	case SigAlgECDSASHA384:
+		h := sha512.Sum384(msg)
+		sig, err = key.Sign(rand.Reader, h[:], crypto.SHA384)
+	default:
+		h := sha256.Sum256(msg)
+		sig, err = key.Sign(rand.Reader, h[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return sig, alg, nil
+}
+
+// verifyBytes checks that @sig is a signature of @msg by @pub using
+// @alg, or if @alg is "", the algorithm for @pub.
+func verifyBytes(msg, sig []byte, pub crypto.PublicKey, alg string) error {
+	want, err := SignatureAlgorithm(pub)
+	if err != nil {
+		return err
+	}
+	if alg == "" {
+		alg = want
+	}
+	if alg != want {
+		keyType, _ := KeyTypeOf(pub)
+		return fmt.Errorf("Signature algorithm %q cannot be used with a %s key", alg, keyType)
+	}
+
+	switch alg {
+	case SigAlgEd25519:
+		if !ed25519.Verify(pub.(ed25519.PublicKey), msg, sig) {
+			return fmt.Errorf("ed25519 signature does not match")
+		}
+	case SigAlgECDSASHA256:
+		h := sha256.Sum256(msg)
+		if !ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), h[:], sig) {
+			return fmt.Errorf("ECDSA signature does not match")
+		}
+	case SigAlgECDSASHA384:
+		h := sha512.Sum384(msg)
+		if !ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), h[:], sig) {
+			return fmt.Errorf("ECDSA signature does not match")
+		}
+	default:
+		h := sha256.Sum256(msg)
+		return rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, h[:], sig)
+	}
+	return nil
+}
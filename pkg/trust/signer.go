@@ -0,0 +1,103 @@
+package trust
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A signing key is named by a key reference, which is either the path
+// of a PEM encoded private key, or an RFC 7512 PKCS#11 URI naming a key
+// held in a token, e.g.
+//
+//	pkcs11:token=mos;object=manifest?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-source=/run/mos/pin
+//
+// so that production keys need never be written to disk.  A key
+// directory, such as that of a project, holds either the key itself in
+// privkey.pem or such a URI in privkey.uri.
+
+// A Signer signs with the private key named by a key reference.  It
+// must be closed when no longer needed.
+type Signer interface {
+	crypto.Signer
+	Close() error
+}
+
+// IsPKCS11URI returns true if @keyRef names a key in a PKCS#11 token.
+func IsPKCS11URI(keyRef string) bool {
+	return strings.HasPrefix(keyRef, "pkcs11:")
+}
+
+// NewSigner returns a Signer for the key named by @keyRef.
+func NewSigner(keyRef string) (Signer, error) {
+	if IsPKCS11URI(keyRef) {
+		return newPKCS11Signer(keyRef)
+	}
+	key, err := readSigningKey(keyRef)
+	if err != nil {
+		return nil, err
+	}
+	return fileSigner{key}, nil
+}
+
+// fileSigner is a Signer for a private key read from a file.
+type fileSigner struct {
+	crypto.Signer
+}
+
+func (fileSigner) Close() error {
+	return nil
+}
+
+// readSigningKey reads the PEM encoded private key at @keyPath.
+func readSigningKey(keyPath string) (crypto.Signer, error) {
+	privKey, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading (%q): %w", keyPath, err)
+	}
+	pemBlock, _ := pem.Decode(privKey)
+	if pemBlock == nil {
+		return nil, fmt.Errorf("Failed to decode key: (%q)", keyPath)
+	}
+
+	var key any
+	switch pemBlock.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(pemBlock.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(pemBlock.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed parsing key, (%q): %w", keyPath, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("Key (%q) cannot sign", keyPath)
+	}
+	return signer, nil
+}
+
+// KeyRef returns the reference to the private key kept in the key
+// directory @dir: privkey.pem, or if there is none, the key named by
+// the PKCS#11 URI in privkey.uri.
+func KeyRef(dir string) (string, error) {
+	keyPath := filepath.Join(dir, "privkey.pem")
+	if _, err := os.Stat(keyPath); err == nil {
+		return keyPath, nil
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "privkey.uri"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("No privkey.pem or privkey.uri in %q", dir)
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
@@ -620,6 +620,11 @@ func (t *tpm2V3Context) Provision(ctx *cli.Context) error {
 		return fmt.Errorf("Failed defining NVIndex for provisioned cert")
 	}
 
+	log.Debugf("Defining security version counter")
+	if err := t.defineSecurityVersion(policyDigestFile); err != nil {
+		return fmt.Errorf("Failed defining security version counter: %w", err)
+	}
+
 	attributes = attributes + "|policywrite"
 	log.Debugf("Defining and initializing osPassphrase index %s with attributes: %s", TPM2IndexOSKey, attributes)
 	err = t.Tpm2NVDefine(policyDigestFile, attributes, TPM2IndexOSKey, len(osPassphrase))
@@ -652,6 +657,16 @@ func (t *tpm2V3Context) Provision(ctx *cli.Context) error {
 
 // Called during signed initrd to extract information from TPM
 // and make it available for (signed) userspace.
+// TPMProvisioned returns true if this machine's TPM has been
+// provisioned, that is, holds a SUDI certificate.
+func TPMProvisioned() bool {
+	if !utils.PathExists("/dev/tpm0") {
+		return false
+	}
+	_, err := Tpm2NVIndexLength(TPM2IndexCert)
+	return err == nil
+}
+
 func (t *tpm2V3Context) InitrdSetup() error {
 	defer func() {
 		if err := t.ExtendPCR7(); err != nil {
@@ -696,28 +711,12 @@ func (t *tpm2V3Context) InitrdSetup() error {
 		return fmt.Errorf("Failed reading key from TPM: %w", err)
 	}
 
-	// see https://mjg59.dreamwidth.org/37333.html
-	keyring, err := keyctl.UserKeyring()
-	if err != nil {
-		return fmt.Errorf("Getting usersession keyring failed: %w", err)
-	}
-	session, err := keyctl.SessionKeyring()
-	if err != nil {
-		return fmt.Errorf("Getting session keyring failed: %w", err)
-	}
-	key, err := session.Add("machine:luks", []byte(osPassphrase))
-	if err != nil {
-		return fmt.Errorf("Adding key to keyring failed: %w", err)
+	if err := addUserKey("machine:luks", osPassphrase); err != nil {
+		return err
 	}
 
-	if err := keyctl.SetPerm(key, keyctl.PermUserAll|keyctl.PermProcessAll); err != nil {
-		return fmt.Errorf("Key permissions setting failed: %w", err)
-	}
-	if err := keyctl.Link(keyring, key); err != nil {
-		return fmt.Errorf("Key link failed: %w", err)
-	}
-	if err := keyctl.Unlink(session, key); err != nil {
-		return fmt.Errorf("Key unlink failed: %w", err)
+	if err := t.loadSecurityVersionAuth(signedPolicyPath); err != nil {
+		return err
 	}
 
 	err = utils.CopyFile("/manifestCA.pem", filepath.Join(dest, "manifestCA.pem"))
@@ -770,6 +769,16 @@ func (t *tpm2V3Context) PreInstall() error {
 		return fmt.Errorf("Failed writing initial atx passphrase to TPM: %w", err)
 	}
 
+	if err := addUserKey("machine:luks", osPassphrase); err != nil {
+		return err
+	}
+
+	signedPolicyPath := filepath.Join(t.dataDir, "tpm_luks.policy.signed")
+	return t.loadSecurityVersionAuth(signedPolicyPath)
+}
+
+// addUserKey adds @value to root's user keyring as @name.
+func addUserKey(name, value string) error {
 	// see https://mjg59.dreamwidth.org/37333.html
 	keyring, err := keyctl.UserKeyring()
 	if err != nil {
@@ -779,7 +788,7 @@ func (t *tpm2V3Context) PreInstall() error {
 	if err != nil {
 		return fmt.Errorf("Getting session keyring failed: %w", err)
 	}
-	key, err := session.Add("machine:luks", []byte(osPassphrase))
+	key, err := session.Add(name, []byte(value))
 	if err != nil {
 		return fmt.Errorf("Adding key to keyring failed: %w", err)
 	}
@@ -793,7 +802,6 @@ func (t *tpm2V3Context) PreInstall() error {
 	if err := keyctl.Unlink(session, key); err != nil {
 		return fmt.Errorf("Key unlink failed: %w", err)
 	}
-
 	return nil
 }
 
@@ -29,6 +29,60 @@ XXX
 EOF
 }
 
+@test "status of fs-only layer" {
+	good_install fsonly
+	export TMPD
+	./mosctl status -r $TMPD
+	[ "$(./mosctl status -r $TMPD --json | jq -r '.[] | select(.name == "hostfstarget").running_hash')" = "" ]
+	lxc-usernsexec -s -- << "EOF"
+unshare -m -- << "XXX"
+#!/bin/bash
+set -e
+./mosctl activate -r $TMPD -t hostfstarget -capath $TMPD/factory/secure/manifestCA.pem
+./mosctl status -r $TMPD
+./mosctl status -r $TMPD --json > $TMPD/status.json
+[ -n "$(jq -r '.[] | select(.name == "hostfstarget").running_hash' $TMPD/status.json)" ]
+[ "$(jq -r '.[] | select(.name == "hostfstarget").hash_mismatch' $TMPD/status.json)" = "false" ]
+[ "$(jq -r '.[] | select(.name == "hostfstarget").running_version' $TMPD/status.json)" = "1.0.0" ]
+[ -f $TMPD/scratch-writes/running/hostfstarget.json ]
+# Re-activating an unchanged target leaves it running
+./mosctl activate -r $TMPD -t hostfstarget -capath $TMPD/factory/secure/manifestCA.pem 2>&1 | grep "already running"
+[ -e $TMPD/mnt/atom/hostfstarget/etc ]
+killall squashfuse || true
+XXX
+EOF
+}
+
+@test "stop, restart and deactivate of fs-only layer" {
+	good_install fsonly
+	export TMPD
+	lxc-usernsexec -s -- << "EOF"
+unshare -m -- << "XXX"
+#!/bin/bash
+set -e
+CA=$TMPD/factory/secure/manifestCA.pem
+./mosctl activate -r $TMPD -t hostfstarget -capath $CA
+[ -e $TMPD/mnt/atom/hostfstarget/etc ]
+./mosctl stop -r $TMPD -capath $CA hostfstarget
+[ ! -e $TMPD/mnt/atom/hostfstarget/etc ]
+[ ! -f $TMPD/scratch-writes/running/hostfstarget.json ]
+./mosctl restart -r $TMPD -capath $CA hostfstarget
+[ -e $TMPD/mnt/atom/hostfstarget/etc ]
+./mosctl deactivate -r $TMPD -capath $CA hostfstarget
+[ ! -e $TMPD/mnt/atom/hostfstarget/etc ]
+[ -f $TMPD/config/deactivated/hostfstarget ]
+# restart refuses a deactivated target, activate re-enables it
+if ./mosctl restart -r $TMPD -capath $CA hostfstarget; then exit 1; fi
+./mosctl activate -r $TMPD -t hostfstarget -capath $CA
+[ -e $TMPD/mnt/atom/hostfstarget/etc ]
+[ ! -f $TMPD/config/deactivated/hostfstarget ]
+# hostfs cannot be stopped
+if ./mosctl stop -r $TMPD -capath $CA hostfs; then exit 1; fi
+killall squashfuse || true
+XXX
+EOF
+}
+
 # Just test install with container layer
 @test "activate of container layer" {
 	good_install containeronly
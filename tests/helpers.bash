@@ -33,7 +33,7 @@ function common_setup {
 	echo "ROOTFS_VERSION is ${ROOTFS_VERSION}"
 
 	if [ ! -d "${PWD}/zothub" ]; then
-		stacker --oci-dir zothub build --layer-type squashfs
+		stacker --oci-dir zothub build --layer-type squashfs --layer-type puzzlefs
 	fi
 
 	# set up test git
@@ -123,6 +123,53 @@ function common_teardown {
 	trust_teardown
 }
 
+# secure_zot_setup starts a second zot on port 5001, which serves https
+# with a self-signed certificate ($TMPD/secure-zot/ca.pem) and requires
+# basic auth as mosuser/mospass.
+function secure_zot_setup {
+	export SECURE_ZOT_PORT=5001
+	local d=$TMPD/secure-zot
+	mkdir -p $d
+	openssl req -x509 -newkey rsa:2048 -nodes -days 1 \
+		-subj "/CN=${ZOT_HOST}" -addext "subjectAltName=IP:${ZOT_HOST}" \
+		-keyout $d/key.pem -out $d/ca.pem
+	htpasswd -Bbn mosuser mospass > $d/htpasswd
+	cat > $d/config.json << EOF
+{
+  "distSpecVersion": "1.1.0-dev",
+  "storage": {
+    "rootDirectory": "$d/storage",
+    "gc": false
+  },
+  "http": {
+    "address": "$ZOT_HOST",
+    "port": "$SECURE_ZOT_PORT",
+    "tls": {
+      "cert": "$d/ca.pem",
+      "key": "$d/key.pem"
+    },
+    "auth": {
+      "htpasswd": {
+        "path": "$d/htpasswd"
+      }
+    }
+  },
+  "log": {
+    "level": "error"
+  }
+}
+EOF
+	zot serve $d/config.json &
+	count=5
+	while [[ $count -gt 0 ]]; do
+		curl -s --cacert $d/ca.pem -u mosuser:mospass -f https://$ZOT_HOST:$SECURE_ZOT_PORT/v2/ && return 0
+		sleep 1
+		count=$((count - 1))
+	done
+	echo "Timed out waiting for secure zot"
+	exit 1
+}
+
 function zot_teardown {
 	killall zot
 	rm -f $TMPD/zot-config.json
@@ -154,8 +201,10 @@ function manifest_size {
 
 function write_install_yaml {
 	spectype=$1
-	sum=$(manifest_shasum busybox-squashfs)
-	size=$(manifest_size busybox-squashfs)
+	# LAYER_TYPE=puzzlefs picks the images for puzzlefs storage
+	image="busybox-${LAYER_TYPE:-squashfs}"
+	sum=$(manifest_shasum $image)
+	size=$(manifest_size $image)
 	case "$spectype" in
 	  livecd)
 	    cat > $TMPD/manifest.yaml << EOF
@@ -164,7 +213,7 @@ product: de6c82c5-2e01-4c92-949b-a6545d30fc06
 update_type: complete
 targets:
   - service_name: livecd
-    source: oci:zothub:busybox-squashfs
+    source: oci:zothub:$image
     version: 1.0.0
     digest: sha256:$sum
     size: $size
@@ -182,7 +231,7 @@ product: de6c82c5-2e01-4c92-949b-a6545d30fc06
 update_type: complete
 targets:
   - service_name: hostfs
-    source: oci:zothub:busybox-squashfs
+    source: oci:zothub:$image
     version: 1.0.0
     digest: sha256:$sum
     size: $size
@@ -194,14 +243,14 @@ EOF
 	  ;;
 
 	  fsonly)
-	    sum=$(manifest_shasum busybox-squashfs)
+	    sum=$(manifest_shasum $image)
 	    cat > $TMPD/manifest.yaml << EOF
 version: 1
 product: de6c82c5-2e01-4c92-949b-a6545d30fc06
 update_type: complete
 targets:
   - service_name: hostfs
-    source: oci:zothub:busybox-squashfs
+    source: oci:zothub:$image
     version: 1.0.0
     digest: sha256:$sum
     size: $size
@@ -210,7 +259,7 @@ targets:
     network:
       type: host
   - service_name: hostfstarget
-    source: oci:zothub:busybox-squashfs
+    source: oci:zothub:$image
     version: 1.0.0
     digest: sha256:$sum
     size: $size
@@ -222,14 +271,14 @@ EOF
 	    ;;
 
 	  containeronly)
-	    sum=$(manifest_shasum busybox-squashfs)
+	    sum=$(manifest_shasum $image)
 	    cat > $TMPD/manifest.yaml << EOF
 version: 1
 product: de6c82c5-2e01-4c92-949b-a6545d30fc06
 update_type: complete
 targets:
   - service_name: hostfs
-    source: oci:zothub:busybox-squashfs
+    source: oci:zothub:$image
     version: 1.0.0
     digest: sha256:$sum
     size: $size
@@ -238,7 +287,7 @@ targets:
     network:
       type: host
   - service_name: hostfstarget
-    source: oci:zothub:busybox-squashfs
+    source: oci:zothub:$image
     version: 1.0.0
     digest: sha256:$sum
     size: $size
@@ -265,5 +314,6 @@ function good_install {
 	mkdir -p $TMPD/factory/secure
 	cp "$CA_PEM" "$TMPD/factory/secure/manifestCA.pem"
 	./mosctl --debug install --rfs "$TMPD" \
+	    --storage-type "${STORAGE_TYPE:-atomfs}" \
 	    ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.0
 }
@@ -109,6 +109,109 @@ EOF
 	[ $failed -eq 1 ]
 }
 
+@test "mos install with multiple signatures" {
+	sum=$(manifest_shasum busybox-squashfs)
+	size=$(manifest_size busybox-squashfs)
+	cat > $TMPD/install.json << EOF
+{
+  "version": 1,
+  "product": "de6c82c5-2e01-4c92-949b-a6545d30fc06",
+  "update_type": "complete",
+  "targets": [
+    {
+      "service_name": "hostfs",
+      "version": "1.0.0",
+      "digest": "sha256:$sum",
+      "size": $size,
+      "service_type": "hostfs",
+      "nsgroup": "",
+      "network": {
+        "type": "host"
+      }
+    }
+  ]
+}
+EOF
+
+	skopeo copy --dest-tls-verify=false oci:zothub:busybox-squashfs docker://$ZOT_HOST:$ZOT_PORT/mos:$sum
+  regctl artifact put --artifact-type application/vnd.machine.install -f "$TMPD/install.json" $ZOT_HOST:$ZOT_PORT/machine/install:1.0.0
+	echo "fooled ya" > "$TMPD/bad.signed"
+	openssl dgst -sha256 -sign "$M_KEY" \
+		-out "$TMPD/install.json.signed" "$TMPD/install.json"
+	# A stray certificate and signature alongside the good ones
+  regctl artifact put --artifact-type application/vnd.machine.pubkeycrt -f "$CA_PEM" --subject $ZOT_HOST:$ZOT_PORT/machine/install:1.0.0
+  regctl artifact put --artifact-type application/vnd.machine.signature -f "$TMPD/bad.signed" --subject $ZOT_HOST:$ZOT_PORT/machine/install:1.0.0
+  regctl artifact put --artifact-type application/vnd.machine.pubkeycrt -f "$M_CERT" --subject $ZOT_HOST:$ZOT_PORT/machine/install:1.0.0
+  regctl artifact put --artifact-type application/vnd.machine.signature -f "$TMPD/install.json.signed" --subject $ZOT_HOST:$ZOT_PORT/machine/install:1.0.0
+	mkdir -p "$TMPD/factory/secure"
+	cp "$CA_PEM" "$TMPD/factory/secure/manifestCA.pem"
+	./mosctl install --rfs $TMPD $ZOT_HOST:$ZOT_PORT/machine/install:1.0.0
+	[ -f $TMPD/atomfs-store/mos/index.json ]
+}
+
+@test "mos manifest publish and install with ecdsa and ed25519 keys" {
+	for keytype in ecdsa-p256 ecdsa-p384 ed25519; do
+		projdir=~/.local/share/machine/trust/keys/snakeoil/manifest/$keytype
+		rm -rf "$projdir"
+		trust project add --key-type $keytype snakeoil $keytype
+		openssl x509 -noout -text -in "$projdir/cert.pem" | grep -e "id-ecPublicKey" -e "ED25519"
+		write_install_yaml "hostfsonly"
+		./mosb manifest publish \
+			--repo ${ZOT_HOST}:${ZOT_PORT} --name puzzleos/install:$keytype \
+			--project snakeoil:$keytype --skip-bootkit $TMPD/manifest.yaml
+		rm -rf "$projdir"
+		regctl artifact list --filter-artifact-type application/vnd.machine.signature \
+			--format raw-body ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:$keytype > $TMPD/sigs
+		grep "vnd.machine.signature.algorithm" $TMPD/sigs
+		mkdir -p $TMPD/factory/secure
+		cp "$CA_PEM" "$TMPD/factory/secure/manifestCA.pem"
+		rm -rf $TMPD/config $TMPD/atomfs-store
+		./mosctl install --rfs "$TMPD" ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:$keytype
+		[ -f $TMPD/atomfs-store/mos/index.json ]
+	done
+}
+
+@test "mos manifest publish and sudi add with keys in a PKCS#11 token" {
+	export SOFTHSM2_CONF=$TMPD/softhsm2.conf
+	mkdir -p $TMPD/tokens
+	echo "directories.tokendir = $TMPD/tokens" > $SOFTHSM2_CONF
+	softhsm2-util --init-token --free --label mos --pin 1234 --so-pin 5678
+	openssl genpkey -algorithm EC -pkeyopt ec_paramgen_curve:P-256 -out $TMPD/manifest.key
+	softhsm2-util --import $TMPD/manifest.key --token mos --label manifest --id 01 --pin 1234
+	rm $TMPD/manifest.key
+	keysetdir=~/.local/share/machine/trust/keys/snakeoil
+	softhsm2-util --import $keysetdir/sudi-ca/privkey.pem --token mos --label sudi-ca --id 02 --pin 1234
+	export MOS_PKCS11_PIN=1234
+	uri="pkcs11:token=mos;object=manifest?module-name=libsofthsm2"
+
+	# Sign a file
+	echo hello > $TMPD/hello
+	trust sign file --key "$uri" --output $TMPD/hello.sig $TMPD/hello
+
+	# Certify the token's key for a new project, and publish with it
+	projdir=$keysetdir/manifest/hsm
+	rm -rf "$projdir"
+	trust project add --key "$uri" snakeoil hsm
+	[ ! -e "$projdir/privkey.pem" ]
+	grep "^pkcs11:" "$projdir/privkey.uri"
+	openssl dgst -sha256 -verify <(openssl x509 -pubkey -noout -in "$projdir/cert.pem") \
+		-signature $TMPD/hello.sig $TMPD/hello
+	write_install_yaml "hostfsonly"
+	./mosb manifest publish \
+		--repo ${ZOT_HOST}:${ZOT_PORT} --name puzzleos/install:1.0.0 \
+		--project snakeoil:hsm --skip-bootkit $TMPD/manifest.yaml
+
+	# Issue a SUDI with the SUDI CA key in the token
+	trust sudi add --ca-key "pkcs11:token=mos;object=sudi-ca?module-name=libsofthsm2" snakeoil hsm SN0001
+	openssl verify -CAfile $keysetdir/sudi-ca/cert.pem "$projdir/sudi/SN0001/cert.pem"
+	rm -rf "$projdir"
+
+	mkdir -p $TMPD/factory/secure
+	cp "$CA_PEM" "$TMPD/factory/secure/manifestCA.pem"
+	./mosctl install --rfs "$TMPD" ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.0
+	[ -f $TMPD/atomfs-store/mos/index.json ]
+}
+
 @test "mos install with bad version" {
 	sum=$(manifest_shasum busybox-squashfs)
 	size=$(manifest_size busybox-squashfs)
@@ -172,3 +275,84 @@ EOF
 	./mosctl install --rfs "$TMPD" $ZOT_HOST:$ZOT_PORT/machine/install:1.0.0 || failed=1
 	[ $failed -eq 1 ]
 }
+
+@test "mos manifest publish with dependency cycle" {
+	cat > $TMPD/manifest.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+targets:
+  - service_name: hostfs
+    source: oci:zothub:busybox-squashfs
+    version: 1.0.0
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: host
+  - service_name: one
+    source: oci:zothub:busybox-squashfs
+    version: 1.0.0
+    service_type: fs-only
+    nsgroup: ""
+    network:
+      type: host
+    depends_on: [two]
+  - service_name: two
+    source: oci:zothub:busybox-squashfs
+    version: 1.0.0
+    service_type: fs-only
+    nsgroup: ""
+    network:
+      type: host
+    after: [one]
+EOF
+	failed=0
+	./mosb manifest publish --product snakeoil:default \
+		--repo ${ZOT_HOST}:${ZOT_PORT} --name machine/install:1.0.0 \
+		--skip-bootkit $TMPD/manifest.yaml > $TMPD/out 2>&1 || failed=1
+	cat $TMPD/out
+	[ $failed -eq 1 ]
+	grep "Dependency cycle among targets: one, two" $TMPD/out
+}
+
+@test "mos install and update refuse manifests for another product" {
+	keysetdir=~/.local/share/machine/trust/keys/snakeoil
+	projdir=$keysetdir/manifest/prodcheck
+	rm -rf "$projdir" "$keysetdir/manifest/default/sudi/SN0003"
+	trust project add snakeoil prodcheck
+	trust sudi add snakeoil prodcheck SN0002
+	product=$(cat "$projdir/uuid")
+	mkdir -p $TMPD/factory/secure
+	cp "$CA_PEM" "$TMPD/factory/secure/manifestCA.pem"
+	cp "$projdir/sudi/SN0002/cert.pem" "$TMPD/factory/secure/server.crt"
+
+	# The manifest from write_install_yaml is for another product
+	write_install_yaml "hostfsonly"
+	./mosb manifest publish \
+		--repo ${ZOT_HOST}:${ZOT_PORT} --name puzzleos/install:other \
+		--project snakeoil:prodcheck --skip-bootkit $TMPD/manifest.yaml
+	failed=0
+	./mosctl install --rfs "$TMPD" ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:other || failed=1
+	[ $failed -eq 1 ]
+	[ ! -e $TMPD/config/manifest.git ]
+
+	sed -i "s/^product: .*/product: $product/" $TMPD/manifest.yaml
+	./mosb manifest publish \
+		--repo ${ZOT_HOST}:${ZOT_PORT} --name puzzleos/install:1.0.0 \
+		--project snakeoil:prodcheck --skip-bootkit $TMPD/manifest.yaml
+	./mosctl install --rfs "$TMPD" ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.0
+	[ -f $TMPD/atomfs-store/mos/index.json ]
+
+	failed=0
+	./mosctl update -r $TMPD ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:other || failed=1
+	[ $failed -eq 1 ]
+
+	# The installed manifest is not accepted by a machine provisioned
+	# for another product either
+	trust sudi add snakeoil default SN0003
+	cp "$keysetdir/manifest/default/sudi/SN0003/cert.pem" "$TMPD/factory/secure/server.crt"
+	rm -rf "$projdir" "$keysetdir/manifest/default/sudi/SN0003"
+	failed=0
+	./mosctl update -r $TMPD --dry-run ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.0 || failed=1
+	[ $failed -eq 1 ]
+}
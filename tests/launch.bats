@@ -42,7 +42,7 @@ EOF
 	  --project snakeoil:default \
 	  --repo 127.0.0.1:${ZOT_PORT} --name machine/install:1.0.0 \
 	  "${TMPD}/manifest.yaml"
-	trust launch --project=snakeoil:default ${VMNAME} 10.0.2.2:$ZOT_PORT/machine/install:1.0.0
+	trust launch --project=snakeoil:default ${VMNAME} http://10.0.2.2:$ZOT_PORT/machine/install:1.0.0
 	# Update machine to have network with our port forward
 	export VISUAL=${TOPDIR}/tools/machine_add_zotnet.py
 	timeout 10s machine edit "${VMNAME}"
@@ -0,0 +1,87 @@
+load helpers
+
+function setup() {
+	common_setup
+	zot_setup
+}
+
+function teardown() {
+	zot_teardown
+	common_teardown
+}
+
+# publish_to_layout publishes manifest.yaml as puzzleos/install:$1, and
+# then copies it, its referrers and its images into the oci layout $2.
+function publish_to_layout {
+	./mosb manifest publish \
+		--repo ${ZOT_HOST}:${ZOT_PORT} --name puzzleos/install:$1 \
+		--project snakeoil:default --skip-bootkit $TMPD/manifest.yaml
+	regctl image copy --referrers ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:$1 ocidir://$2:$1
+	for image in $(awk '/source:/ { print $2 }' $TMPD/manifest.yaml | sort -u); do
+		skopeo copy $image oci:$2:${image##*:}
+	done
+}
+
+@test "install and update from a local oci layout and bundle" {
+	write_install_yaml hostfsonly
+	publish_to_layout 1.0.0 $TMPD/usb
+
+	sum=$(manifest_shasum busyboxu1-squashfs)
+	size=$(manifest_size busyboxu1-squashfs)
+	cat > $TMPD/manifest.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+targets:
+  - service_name: hostfs
+    source: oci:zothub:busyboxu1-squashfs
+    version: 1.0.2
+    digest: sha256:$sum
+    size: $size
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: none
+EOF
+	publish_to_layout 1.0.2 $TMPD/usb2
+	tar -C $TMPD/usb2 -czf $TMPD/update.tar.gz .
+
+	# No registry from here on
+	killall zot
+
+	mkdir -p $TMPD/factory/secure
+	cp "$CA_PEM" "$TMPD/factory/secure/manifestCA.pem"
+	./mosctl --debug install --rfs "$TMPD" oci:$TMPD/usb:1.0.0
+	[ -f $TMPD/atomfs-store/mos/index.json ]
+
+	./mosctl update -r $TMPD --dry-run --json oci-archive:$TMPD/update.tar.gz:1.0.2 > $TMPD/plan.json
+	[ "$(jq -r '.replaced[0].new_digest' $TMPD/plan.json)" = "sha256:$sum" ]
+
+	./mosctl update -r $TMPD oci-archive:$TMPD/update.tar.gz:1.0.2
+	[ -f $TMPD/atomfs-store/mos/blobs/sha256/$sum ]
+	(cd $TMPD/config/manifest.git; git show HEAD:manifest.json) > $TMPD/sys.json
+	[ "$(jq -r '.targets[0].name' $TMPD/sys.json)" = "hostfs" ]
+
+	# A bad tag is refused
+	failed=0
+	./mosctl update -r $TMPD oci:$TMPD/usb:9.9.9 || failed=1
+	[ $failed -eq 1 ]
+
+	zot_setup
+}
+
+@test "layout without a signature is refused" {
+	write_install_yaml hostfsonly
+	./mosb manifest publish \
+		--repo ${ZOT_HOST}:${ZOT_PORT} --name puzzleos/install:1.0.0 \
+		--project snakeoil:default --skip-bootkit $TMPD/manifest.yaml
+	# Copy only the manifest, not its referrers
+	regctl image copy ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.0 ocidir://$TMPD/usb:1.0.0
+
+	mkdir -p $TMPD/factory/secure
+	cp "$CA_PEM" "$TMPD/factory/secure/manifestCA.pem"
+	failed=0
+	./mosctl install --rfs "$TMPD" oci:$TMPD/usb:1.0.0 || failed=1
+	[ $failed -eq 1 ]
+	[ ! -d $TMPD/config/manifest.git ]
+}
@@ -0,0 +1,131 @@
+load helpers
+
+function setup() {
+	common_setup
+	zot_setup
+	secure_zot_setup
+}
+
+function teardown() {
+	zot_teardown
+	common_teardown
+}
+
+@test "publish to and install from a registry with tls and auth" {
+	write_install_yaml hostfsonly
+	SECURE="https://${ZOT_HOST}:${SECURE_ZOT_PORT}"
+	CA=$TMPD/secure-zot/ca.pem
+
+	# Without credentials, publishing is refused
+	failed=0
+	./mosb --registry-ca $CA manifest publish \
+		--repo $SECURE --name puzzleos/install:1.0.0 \
+		--project snakeoil:default --skip-bootkit $TMPD/manifest.yaml || failed=1
+	[ $failed -eq 1 ]
+
+	# Without the CA, the registry is not trusted
+	failed=0
+	./mosb manifest publish --user mosuser --pass mospass \
+		--repo $SECURE --name puzzleos/install:1.0.0 \
+		--project snakeoil:default --skip-bootkit $TMPD/manifest.yaml || failed=1
+	[ $failed -eq 1 ]
+
+	# The password can be given on stdin
+	echo mospass | ./mosb --registry-ca $CA manifest publish --user mosuser \
+		--repo $SECURE --name puzzleos/install:1.0.0 \
+		--project snakeoil:default --skip-bootkit $TMPD/manifest.yaml
+
+	mkdir -p $TMPD/docker
+	cat > $TMPD/docker/config.json << EOF
+{
+  "auths": {
+    "${ZOT_HOST}:${SECURE_ZOT_PORT}": {
+      "auth": "$(echo -n mosuser:mospass | base64)"
+    }
+  }
+}
+EOF
+
+	mkdir -p $TMPD/factory/secure
+	cp "$CA_PEM" "$TMPD/factory/secure/manifestCA.pem"
+
+	# Without credentials, fetching is refused too
+	failed=0
+	./mosctl --registry-ca $CA install --rfs "$TMPD" $SECURE/puzzleos/install:1.0.0 || failed=1
+	[ $failed -eq 1 ]
+
+	./mosctl --debug --registry-ca $CA --registry-auth-file $TMPD/docker/config.json \
+		install --rfs "$TMPD" $SECURE/puzzleos/install:1.0.0
+	[ -f $TMPD/atomfs-store/mos/index.json ]
+	(cd $TMPD/config/manifest.git; git show HEAD:manifest.json) > $TMPD/sys.json
+	[ "$(jq -r '.targets[0].name' $TMPD/sys.json)" = "hostfs" ]
+}
+
+@test "install and update fall back between mirrors" {
+	write_install_yaml hostfsonly
+	./mosb manifest publish \
+		--repo ${ZOT_HOST}:${ZOT_PORT} --name puzzleos/install:1.0.0 \
+		--project snakeoil:default --skip-bootkit $TMPD/manifest.yaml
+
+	mkdir -p $TMPD/factory/secure
+	cp "$CA_PEM" "$TMPD/factory/secure/manifestCA.pem"
+
+	# Nothing listens on 5999.  The mirror list is tried first, so the
+	# registry in the url need not be up as long as a mirror is.
+	./mosctl --debug install --rfs "$TMPD" --mirror ${ZOT_HOST}:5999 --mirror ${ZOT_HOST}:${ZOT_PORT} \
+		${ZOT_HOST}:5999/puzzleos/install:1.0.0
+	[ -f $TMPD/atomfs-store/mos/index.json ]
+	grep 5999 $TMPD/config/registries.yaml
+
+	# The saved mirror list is used for updates
+	sum=$(manifest_shasum busyboxu1-squashfs)
+	size=$(manifest_size busyboxu1-squashfs)
+	cat > $TMPD/manifest.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+targets:
+  - service_name: hostfs
+    source: oci:zothub:busyboxu1-squashfs
+    version: 1.0.2
+    digest: sha256:$sum
+    size: $size
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: none
+EOF
+	./mosb manifest publish \
+		--repo ${ZOT_HOST}:${ZOT_PORT} --name puzzleos/install:1.0.2 \
+		--project snakeoil:default --skip-bootkit $TMPD/manifest.yaml
+	./mosctl update -r $TMPD ${ZOT_HOST}:5999/puzzleos/install:1.0.2
+	[ -f $TMPD/atomfs-store/mos/blobs/sha256/$sum ]
+
+	# With no mirror up, the update fails
+	cat > $TMPD/config/registries.yaml << EOF
+mirrors:
+  - ${ZOT_HOST}:5998
+retries: 1
+EOF
+	failed=0
+	./mosctl update -r $TMPD ${ZOT_HOST}:5999/puzzleos/install:1.0.2 || failed=1
+	[ $failed -eq 1 ]
+}
+
+@test "publish and install using the referrers tag schema" {
+	write_install_yaml hostfsonly
+	./mosb --referrers-tag manifest publish \
+		--repo ${ZOT_HOST}:${ZOT_PORT} --name puzzleos/install:1.0.0 \
+		--project snakeoil:default --skip-bootkit $TMPD/manifest.yaml
+
+	# The certificate and signature are listed in the sha256-<digest> index
+	d=$(regctl image digest ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.0)
+	regctl manifest get --format raw-body ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:${d/:/-} > $TMPD/referrers.json
+	[ "$(jq '.manifests | length' $TMPD/referrers.json)" = "2" ]
+	jq -r '.manifests[].artifactType' $TMPD/referrers.json | grep application/vnd.machine.signature
+
+	mkdir -p $TMPD/factory/secure
+	cp "$CA_PEM" "$TMPD/factory/secure/manifestCA.pem"
+	./mosctl --debug --referrers-tag install --rfs "$TMPD" ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.0
+	[ -f $TMPD/atomfs-store/mos/index.json ]
+}
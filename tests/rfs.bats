@@ -78,3 +78,67 @@ fi
 XXX
 EOF
 }
+
+@test "new hostfs falls back to previous after failed boots" {
+	good_install hostfsonly
+
+	sum=$(manifest_shasum busyboxu1-squashfs)
+	size=$(manifest_size busyboxu1-squashfs)
+	cat > $TMPD/manifest.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+targets:
+  - service_name: hostfs
+    source: oci:zothub:busyboxu1-squashfs
+    version: 1.0.2
+    digest: sha256:$sum
+    size: $size
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: none
+EOF
+	./mosb manifest publish \
+		--repo ${ZOT_HOST}:${ZOT_PORT} --name puzzleos/install:1.0.2 \
+		--project snakeoil:default --skip-bootkit $TMPD/manifest.yaml
+	./mosctl update -r $TMPD ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.2 | grep "reboot pending"
+
+	next=$(cd $TMPD/config/manifest.git; git rev-parse HEAD)
+	prev=$(cd $TMPD/config/manifest.git; git rev-parse HEAD~1)
+	[ "$(jq -r .next $TMPD/config/hostfs-boot.json)" = "$next" ]
+	[ "$(jq -r .previous $TMPD/config/hostfs-boot.json)" = "$prev" ]
+
+	mkdir -p "${TMPD}/mnt"
+	export TMPD
+	for i in 1 2 3 4; do
+		lxc-usernsexec -s -- << "EOF" > $TMPD/boot.out 2>&1
+unshare -m -- << "XXX"
+#!/bin/bash
+set -e
+./mosctl create-boot-fs --readonly --rfs "$TMPD" --dest $TMPD/mnt
+sleep 1s
+[ -e $TMPD/mnt/etc ]
+killall squashfuse || true
+XXX
+EOF
+		cat $TMPD/boot.out
+		if [ $i -le 3 ]; then
+			grep "Booting hostfs version 1.0.2" $TMPD/boot.out
+			[ "$(jq -r .fell_back $TMPD/config/hostfs-boot.json)" = "false" ]
+		else
+			grep "Booting hostfs version 1.0.0" $TMPD/boot.out
+			[ "$(jq -r .fell_back $TMPD/config/hostfs-boot.json)" = "true" ]
+		fi
+	done
+
+	# The manifest names the hostfs which booted
+	(cd $TMPD/config/manifest.git; git log -1 --format=%s) | grep "Fall back to the hostfs from revision $prev"
+	[ "$(cd $TMPD/config/manifest.git; git rev-parse HEAD~1)" = "$next" ]
+	(cd $TMPD/config/manifest.git; git show HEAD:manifest.json) > $TMPD/sys.json
+	(cd $TMPD/config/manifest.git; git show $prev:manifest.json) > $TMPD/prev.json
+	hostfs='.targets[] | select(.name == "hostfs").source'
+	[ "$(jq -r "$hostfs" $TMPD/sys.json)" = "$(jq -r "$hostfs" $TMPD/prev.json)" ]
+	./mosctl status -r $TMPD --json > $TMPD/status.json
+	[ "$(jq -r '.[] | select(.name == "hostfs").version' $TMPD/status.json)" = "1.0.0" ]
+}
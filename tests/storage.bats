@@ -0,0 +1,164 @@
+load helpers
+
+# Every storage backend must pass the same tests.  Each test below is
+# run once per backend, with STORAGE_TYPE selecting the backend and
+# LAYER_TYPE the matching image format.
+
+function setup() {
+	common_setup
+	zot_setup
+}
+
+function teardown() {
+	zot_teardown
+	common_teardown
+}
+
+function use_storage {
+	export STORAGE_TYPE=$1
+	case "$1" in
+	  atomfs) export LAYER_TYPE=squashfs ;;
+	  puzzlefs) export LAYER_TYPE=puzzlefs ;;
+	esac
+}
+
+function check_install {
+	use_storage $1
+	good_install hostfsonly
+	[ "$(cat $TMPD/config/storage-type)" = "$1" ]
+	[ -d $TMPD/atomfs-store/mos/blobs/sha256 ]
+}
+
+function check_mount_ro_rw {
+	use_storage $1
+	good_install hostfsonly
+	mkdir -p "${TMPD}/mnt" "${TMPD}/mntrw"
+	export TMPD
+	lxc-usernsexec -s -- << "EOF"
+unshare -m -- << "XXX"
+#!/bin/bash
+set -ex
+./mosctl --debug mount --rfs $TMPD --readonly --dest ${TMPD}/mnt
+[ -e $TMPD/mnt/etc ]
+failed=0
+echo testing > $TMPD/mnt/helloworld || failed=1
+[ $failed -eq 1 ]
+./mosctl --debug mount --rfs $TMPD --dest ${TMPD}/mntrw
+[ -e $TMPD/mntrw/etc ]
+echo testing > $TMPD/mntrw/helloworld
+[ -f $TMPD/mntrw/helloworld ]
+[ ! -e $TMPD/mnt/helloworld ]
+killall squashfuse puzzlefs || true
+XXX
+EOF
+}
+
+function check_activate_fsonly {
+	use_storage $1
+	good_install fsonly
+	export TMPD
+	lxc-usernsexec -s -- << "EOF"
+unshare -m -- << "XXX"
+#!/bin/bash
+set -e
+CA=$TMPD/factory/secure/manifestCA.pem
+./mosctl activate -r $TMPD -t hostfstarget -capath $CA
+[ -e $TMPD/mnt/atom/hostfstarget/etc ]
+./mosctl status -r $TMPD --json > $TMPD/status.json
+[ -n "$(jq -r '.[] | select(.name == "hostfstarget").running_hash' $TMPD/status.json)" ]
+[ "$(jq -r '.[] | select(.name == "hostfstarget").hash_mismatch' $TMPD/status.json)" = "false" ]
+./mosctl stop -r $TMPD -capath $CA hostfstarget
+[ ! -e $TMPD/mnt/atom/hostfstarget/etc ]
+./mosctl status -r $TMPD --json > $TMPD/status.json
+[ -z "$(jq -r '.[] | select(.name == "hostfstarget").running_hash' $TMPD/status.json)" ]
+./mosctl activate -r $TMPD -t hostfstarget -capath $CA
+[ -e $TMPD/mnt/atom/hostfstarget/etc ]
+killall squashfuse puzzlefs || true
+XXX
+EOF
+}
+
+@test "atomfs: install" {
+	check_install atomfs
+}
+
+@test "puzzlefs: install" {
+	check_install puzzlefs
+}
+
+@test "atomfs: mount readonly and writeable" {
+	check_mount_ro_rw atomfs
+}
+
+@test "puzzlefs: mount readonly and writeable" {
+	check_mount_ro_rw puzzlefs
+}
+
+@test "atomfs: activate, status and stop of fs-only layer" {
+	check_activate_fsonly atomfs
+}
+
+@test "puzzlefs: activate, status and stop of fs-only layer" {
+	check_activate_fsonly puzzlefs
+}
+
+@test "puzzlefs: images are tagged and mounted without the digest algorithm" {
+	use_storage puzzlefs
+	good_install hostfsonly
+	refs=$(jq -r '.manifests[].annotations["org.opencontainers.image.ref.name"]' $TMPD/atomfs-store/mos/index.json)
+	echo "$refs"
+	echo "$refs" | grep -E '^[0-9a-f]{64}$'
+	[ -z "$(echo "$refs" | grep ':')" ]
+	mkdir -p "${TMPD}/mnt"
+	export TMPD
+	lxc-usernsexec -s -- << "EOF"
+unshare -m -- << "XXX"
+#!/bin/bash
+set -ex
+./mosctl --debug mount --rfs $TMPD --readonly --dest ${TMPD}/mnt
+grep " ${TMPD}/mnt fuse" /proc/self/mounts
+[ -e $TMPD/mnt/etc ]
+killall puzzlefs || true
+XXX
+EOF
+}
+
+@test "puzzlefs: similar images share blobs" {
+	use_storage puzzlefs
+	# busybox and busyboxu1 differ only in /u1.  Importing both should
+	# cost little more than one of them.
+	good_install hostfsonly
+	before=$(du -sk $TMPD/atomfs-store/mos/blobs | cut -f 1)
+
+	sum=$(manifest_shasum busyboxu1-puzzlefs)
+	size=$(manifest_size busyboxu1-puzzlefs)
+	cat > $TMPD/manifest.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+targets:
+  - service_name: hostfs
+    source: oci:zothub:busyboxu1-puzzlefs
+    version: 1.0.1
+    digest: sha256:$sum
+    size: $size
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: none
+EOF
+	./mosb manifest publish \
+		--repo ${ZOT_HOST}:${ZOT_PORT} --name puzzleos/install:1.0.1 \
+		--project snakeoil:default --skip-bootkit $TMPD/manifest.yaml
+	./mosctl update -r $TMPD ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.1
+	after=$(du -sk $TMPD/atomfs-store/mos/blobs | cut -f 1)
+	echo "store grew from ${before}k to ${after}k"
+	[ $after -lt $((before + before / 10 + 64)) ]
+}
+
+@test "unknown storage type is refused" {
+	use_storage nosuchfs
+	failed=0
+	good_install hostfsonly || failed=1
+	[ $failed -eq 1 ]
+}
@@ -303,3 +303,572 @@ killall squashfuse || true
 XXX
 EOF
 }
+
+@test "rollback to the previous manifest" {
+	good_install hostfsonly
+
+	# Now update hostfs to the u1 layer
+	sum=$(manifest_shasum busyboxu1-squashfs)
+	size=$(manifest_size busyboxu1-squashfs)
+	cat > $TMPD/manifest.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+targets:
+  - service_name: hostfs
+    source: oci:zothub:busyboxu1-squashfs
+    version: 1.0.2
+    digest: sha256:$sum
+    size: $size
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: none
+EOF
+	./mosb manifest publish \
+		--repo ${ZOT_HOST}:${ZOT_PORT} --name puzzleos/install:1.0.2 \
+		--project snakeoil:default --skip-bootkit $TMPD/manifest.yaml
+	./mosctl update -r $TMPD ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.2
+
+	./mosctl rollback -r $TMPD --capath $TMPD/factory/secure/manifestCA.pem
+	(cd $TMPD/config/manifest.git; git log)
+	[ $(cd $TMPD/config/manifest.git; git rev-list --count HEAD) -eq 3 ]
+	(cd $TMPD/config/manifest.git; git diff --exit-code HEAD~2 HEAD -- manifest.json)
+
+	# Rolling back again by revision brings back the update
+	rev=$(cd $TMPD/config/manifest.git; git rev-parse HEAD~1)
+	./mosctl rollback -r $TMPD --capath $TMPD/factory/secure/manifestCA.pem --to $rev
+	(cd $TMPD/config/manifest.git; git diff --exit-code HEAD~2 HEAD -- manifest.json)
+}
+
+@test "failed update leaves the manifest alone" {
+	good_install hostfsonly
+	before=$(cd $TMPD/config/manifest.git; git rev-parse HEAD)
+
+	failed=0
+	./mosctl update -r $TMPD ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:9.9.9 || failed=1
+	[ $failed -eq 1 ]
+
+	[ "$(cd $TMPD/config/manifest.git; git rev-parse HEAD)" = "$before" ]
+	(cd $TMPD/config/manifest.git; git diff --exit-code)
+	[ "$(jq -r .success $TMPD/config/update-result.json)" = "false" ]
+	[ "$(jq -r .failed_step $TMPD/config/update-result.json)" = "fetch" ]
+	[ "$(jq -r .previous_revision $TMPD/config/update-result.json)" = "$before" ]
+}
+
+@test "history lists past manifests" {
+	good_install hostfsonly
+
+	sum=$(manifest_shasum busyboxu1-squashfs)
+	size=$(manifest_size busyboxu1-squashfs)
+	cat > $TMPD/manifest.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+targets:
+  - service_name: hostfs
+    source: oci:zothub:busyboxu1-squashfs
+    version: 1.0.2
+    digest: sha256:$sum
+    size: $size
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: none
+EOF
+	./mosb manifest publish \
+		--repo ${ZOT_HOST}:${ZOT_PORT} --name puzzleos/install:1.0.2 \
+		--project snakeoil:default --skip-bootkit $TMPD/manifest.yaml
+	./mosctl update -r $TMPD ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.2
+
+	msg=$(cd $TMPD/config/manifest.git; git log -1 --format=%B)
+	echo "$msg" | grep "Update product de6c82c5-2e01-4c92-949b-a6545d30fc06"
+	echo "$msg" | grep "hostfs: .* -> 1.0.2 (sha256:$sum)"
+
+	./mosctl history -r $TMPD
+	[ $(./mosctl history -r $TMPD --json | jq length) -eq 2 ]
+	./mosctl history -r $TMPD --json | jq -r '.[0].changes[0].new_digest' | grep "sha256:$sum"
+
+	./mosctl history show -r $TMPD
+	./mosctl history show -r $TMPD --json > $TMPD/show.json
+	[ "$(jq -r '.targets[0].version' $TMPD/show.json)" = "1.0.2" ]
+	[ "$(jq -r '.targets[0].product' $TMPD/show.json)" = "de6c82c5-2e01-4c92-949b-a6545d30fc06" ]
+	[ "$(jq -r '.targets[0].update_type' $TMPD/show.json)" = "complete" ]
+	jq -r '.targets[0].cert_subject' $TMPD/show.json | grep "CN=manifest PRODUCT:"
+	[ "$(jq -r '.changes[0].change' $TMPD/show.json)" = "changed" ]
+
+	first=$(cd $TMPD/config/manifest.git; git rev-parse HEAD~1)
+	./mosctl history show -r $TMPD --json $first > $TMPD/show.json
+	[ "$(jq -r '.changes[0].change' $TMPD/show.json)" = "added" ]
+}
+
+@test "gc removes images no longer in use" {
+	good_install hostfsonly
+	old=$(manifest_shasum busybox-squashfs)
+
+	sum=$(manifest_shasum busyboxu1-squashfs)
+	size=$(manifest_size busyboxu1-squashfs)
+	cat > $TMPD/manifest.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+targets:
+  - service_name: hostfs
+    source: oci:zothub:busyboxu1-squashfs
+    version: 1.0.2
+    digest: sha256:$sum
+    size: $size
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: none
+EOF
+	./mosb manifest publish \
+		--repo ${ZOT_HOST}:${ZOT_PORT} --name puzzleos/install:1.0.2 \
+		--project snakeoil:default --skip-bootkit $TMPD/manifest.yaml
+	./mosctl update -r $TMPD ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.2
+	jq -r '.manifests[].annotations["org.opencontainers.image.ref.name"]' $TMPD/atomfs-store/mos/index.json | grep "sha256:$old"
+
+	# The old hostfs is the fallback until the new one boots
+	./mosctl gc -r $TMPD --json > $TMPD/gc.json
+	[ "$(jq '.removed_tags | length' $TMPD/gc.json)" -eq 0 ]
+
+	# Pretend the new hostfs booted
+	rm $TMPD/config/hostfs-boot.json
+
+	./mosctl gc -r $TMPD --keep-history 1 --json > $TMPD/gc.json
+	[ "$(jq '.removed_tags | length' $TMPD/gc.json)" -eq 0 ]
+
+	./mosctl gc -r $TMPD --dry-run --json > $TMPD/gc.json
+	[ "$(jq -r '.removed_tags[0]' $TMPD/gc.json)" = "sha256:$old" ]
+	[ "$(jq '.reclaimed' $TMPD/gc.json)" -gt 0 ]
+	jq -r '.manifests[].annotations["org.opencontainers.image.ref.name"]' $TMPD/atomfs-store/mos/index.json | grep "sha256:$old"
+	[ -f $TMPD/atomfs-store/mos/blobs/sha256/$old ]
+
+	./mosctl gc -r $TMPD
+	failed=0
+	jq -r '.manifests[].annotations["org.opencontainers.image.ref.name"]' $TMPD/atomfs-store/mos/index.json | grep "sha256:$old" || failed=1
+	[ $failed -eq 1 ]
+	[ ! -f $TMPD/atomfs-store/mos/blobs/sha256/$old ]
+	[ -f $TMPD/atomfs-store/mos/blobs/sha256/$sum ]
+
+	# The current hostfs still mounts
+	mkdir -p "${TMPD}/mnt"
+	export TMPD
+	lxc-usernsexec -s -- << "EOF"
+unshare -m -- << "XXX"
+#!/bin/bash
+set -ex
+./mosctl --debug mount --rfs $TMPD --readonly --dest ${TMPD}/mnt
+[ -e $TMPD/mnt/u1 ]
+killall squashfuse || true
+XXX
+EOF
+}
+
+@test "update --dry-run shows the plan without updating" {
+	good_install hostfsonly
+	old=$(manifest_shasum busybox-squashfs)
+	before=$(cd $TMPD/config/manifest.git; git rev-parse HEAD)
+
+	sum=$(manifest_shasum busyboxu1-squashfs)
+	size=$(manifest_size busyboxu1-squashfs)
+	cat > $TMPD/manifest.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+targets:
+  - service_name: hostfs
+    source: oci:zothub:busyboxu1-squashfs
+    version: 1.0.2
+    digest: sha256:$sum
+    size: $size
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: none
+EOF
+	./mosb manifest publish \
+		--repo ${ZOT_HOST}:${ZOT_PORT} --name puzzleos/install:1.0.2 \
+		--project snakeoil:default --skip-bootkit $TMPD/manifest.yaml
+
+	./mosctl update -r $TMPD --dry-run ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.2
+	./mosctl update -r $TMPD --dry-run --json ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.2 > $TMPD/plan.json
+	[ "$(jq -r '.replaced[0].name' $TMPD/plan.json)" = "hostfs" ]
+	[ "$(jq -r '.replaced[0].old_digest' $TMPD/plan.json)" = "sha256:$old" ]
+	[ "$(jq -r '.replaced[0].new_digest' $TMPD/plan.json)" = "sha256:$sum" ]
+	[ "$(jq -r '.replaced[0].new_version' $TMPD/plan.json)" = "1.0.2" ]
+	[ "$(jq '.added | length' $TMPD/plan.json)" -eq 0 ]
+	[ "$(jq '.removed | length' $TMPD/plan.json)" -eq 0 ]
+	[ "$(jq -r '.reboot_needed' $TMPD/plan.json)" = "true" ]
+	[ "$(jq '.download_bytes' $TMPD/plan.json)" -gt 0 ]
+
+	# Nothing was changed or downloaded
+	[ "$(cd $TMPD/config/manifest.git; git rev-parse HEAD)" = "$before" ]
+	[ ! -f $TMPD/atomfs-store/mos/blobs/sha256/$sum ]
+	[ ! -f $TMPD/config/hostfs-boot.json ]
+}
+
+@test "staged update is applied without the registry" {
+	good_install hostfsonly
+	before=$(cd $TMPD/config/manifest.git; git rev-parse HEAD)
+
+	sum=$(manifest_shasum busyboxu1-squashfs)
+	size=$(manifest_size busyboxu1-squashfs)
+	cat > $TMPD/manifest.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+targets:
+  - service_name: hostfs
+    source: oci:zothub:busyboxu1-squashfs
+    version: 1.0.2
+    digest: sha256:$sum
+    size: $size
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: none
+EOF
+	./mosb manifest publish \
+		--repo ${ZOT_HOST}:${ZOT_PORT} --name puzzleos/install:1.0.2 \
+		--project snakeoil:default --skip-bootkit $TMPD/manifest.yaml
+
+	./mosctl update -r $TMPD --stage ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.2
+	[ "$(cd $TMPD/config/manifest.git; git rev-parse HEAD)" = "$before" ]
+	[ -f $TMPD/atomfs-store/mos/blobs/sha256/$sum ]
+	[ "$(jq -r '.targets[0]' $TMPD/config/staged-update/staged.json)" = "sha256:$sum" ]
+
+	# gc keeps the staged images
+	./mosctl gc -r $TMPD
+	[ -f $TMPD/atomfs-store/mos/blobs/sha256/$sum ]
+
+	# Apply with the registry gone
+	killall zot
+	./mosctl update -r $TMPD --apply
+	zot_setup
+
+	[ "$(cd $TMPD/config/manifest.git; git rev-parse HEAD~1)" = "$before" ]
+	[ "$(jq -r .success $TMPD/config/update-result.json)" = "true" ]
+	[ "$(jq -r .url $TMPD/config/update-result.json)" = "${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.2" ]
+	[ ! -e $TMPD/config/staged-update ]
+
+	# Nothing left to apply
+	failed=0
+	./mosctl update -r $TMPD --apply || failed=1
+	[ $failed -eq 1 ]
+}
+
+@test "staged update can be discarded" {
+	good_install hostfsonly
+	before=$(cd $TMPD/config/manifest.git; git rev-parse HEAD)
+
+	./mosctl update -r $TMPD --stage ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.0
+	[ -f $TMPD/config/staged-update/staged.json ]
+	./mosctl update -r $TMPD --discard
+	[ ! -e $TMPD/config/staged-update ]
+
+	failed=0
+	./mosctl update -r $TMPD --apply || failed=1
+	[ $failed -eq 1 ]
+	[ "$(cd $TMPD/config/manifest.git; git rev-parse HEAD)" = "$before" ]
+}
+
+@test "staged update is refused once the manifest has changed" {
+	good_install hostfsonly
+
+	sum=$(manifest_shasum busyboxu1-squashfs)
+	size=$(manifest_size busyboxu1-squashfs)
+	cat > $TMPD/manifest.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: partial
+targets:
+  - service_name: hostfstarget
+    source: oci:zothub:busyboxu1-squashfs
+    version: 1.0.2
+    digest: sha256:$sum
+    size: $size
+    service_type: fs-only
+    nsgroup: ""
+    network:
+      type: none
+EOF
+	./mosb manifest publish \
+		--repo ${ZOT_HOST}:${ZOT_PORT} --name puzzleos/install:1.0.2 \
+		--project snakeoil:default --skip-bootkit $TMPD/manifest.yaml
+
+	./mosctl update -r $TMPD --stage ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.2
+
+	# Something else updates the system in the meantime
+	sed -i 's/service_name: hostfstarget/service_name: othertarget/' $TMPD/manifest.yaml
+	./mosb manifest publish \
+		--repo ${ZOT_HOST}:${ZOT_PORT} --name puzzleos/install:1.0.3 \
+		--project snakeoil:default --skip-bootkit $TMPD/manifest.yaml
+	./mosctl update -r $TMPD ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.3
+	before=$(cd $TMPD/config/manifest.git; git rev-parse HEAD)
+
+	failed=0
+	./mosctl update -r $TMPD --apply || failed=1
+	[ $failed -eq 1 ]
+	[ "$(cd $TMPD/config/manifest.git; git rev-parse HEAD)" = "$before" ]
+	[ -f $TMPD/config/staged-update/staged.json ]
+
+	# Staged again, it applies
+	./mosctl update -r $TMPD --stage ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.2
+	./mosctl update -r $TMPD --apply
+	[ "$(cd $TMPD/config/manifest.git; git rev-parse HEAD~1)" = "$before" ]
+}
+
+@test "partial update removes targets and storage" {
+	good_install hostfsonly
+
+	sum=$(manifest_shasum busyboxu1-squashfs)
+	size=$(manifest_size busyboxu1-squashfs)
+	cat > $TMPD/manifest.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: partial
+storage:
+  - label: mostest-data
+    persistent: true
+    nsgroup: ""
+    size: 10
+targets:
+  - service_name: hostfstarget
+    source: oci:zothub:busyboxu1-squashfs
+    version: 1.0.2
+    digest: sha256:$sum
+    size: $size
+    service_type: fs-only
+    nsgroup: ""
+    network:
+      type: none
+EOF
+	./mosb manifest publish \
+		--repo ${ZOT_HOST}:${ZOT_PORT} --name puzzleos/install:1.0.2 \
+		--project snakeoil:default --skip-bootkit $TMPD/manifest.yaml
+	./mosctl update -r $TMPD ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.2
+	(cd $TMPD/config/manifest.git; git show HEAD:manifest.json) > $TMPD/sys.json
+	[ "$(jq '.targets | length' $TMPD/sys.json)" -eq 2 ]
+	[ "$(jq -r '.storage[0].label' $TMPD/sys.json)" = "mostest-data" ]
+
+	# A complete update without the storage does not delete it
+	hsum=$(manifest_shasum busybox-squashfs)
+	hsize=$(manifest_size busybox-squashfs)
+	cat > $TMPD/manifest.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+targets:
+  - service_name: hostfs
+    source: oci:zothub:busybox-squashfs
+    version: 1.0.0
+    digest: sha256:$hsum
+    size: $hsize
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: none
+EOF
+	./mosb manifest publish \
+		--repo ${ZOT_HOST}:${ZOT_PORT} --name puzzleos/install:1.0.5 \
+		--project snakeoil:default --skip-bootkit $TMPD/manifest.yaml
+	./mosctl update -r $TMPD --dry-run --json ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.5 > $TMPD/plan.json
+	[ "$(jq -r '.removed[0].name' $TMPD/plan.json)" = "hostfstarget" ]
+	[ "$(jq '.storage_deleted | length' $TMPD/plan.json)" -eq 0 ]
+
+	# hostfs cannot be removed
+	cat > $TMPD/manifest.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: partial
+remove_targets:
+  - hostfs
+EOF
+	failed=0
+	./mosb manifest publish \
+		--repo ${ZOT_HOST}:${ZOT_PORT} --name puzzleos/install:1.0.3 \
+		--project snakeoil:default --skip-bootkit $TMPD/manifest.yaml || failed=1
+	[ $failed -eq 1 ]
+
+	# Persistent storage is only removed when asked for explicitly
+	cat > $TMPD/manifest.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: partial
+remove_targets:
+  - hostfstarget
+remove_storage:
+  - label: mostest-data
+EOF
+	./mosb manifest publish \
+		--repo ${ZOT_HOST}:${ZOT_PORT} --name puzzleos/install:1.0.3 \
+		--project snakeoil:default --skip-bootkit $TMPD/manifest.yaml
+	before=$(cd $TMPD/config/manifest.git; git rev-parse HEAD)
+	failed=0
+	./mosctl update -r $TMPD ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.3 || failed=1
+	[ $failed -eq 1 ]
+	[ "$(cd $TMPD/config/manifest.git; git rev-parse HEAD)" = "$before" ]
+
+	cat > $TMPD/manifest.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: partial
+remove_targets:
+  - hostfstarget
+remove_storage:
+  - label: mostest-data
+    persistent: true
+EOF
+	./mosb manifest publish \
+		--repo ${ZOT_HOST}:${ZOT_PORT} --name puzzleos/install:1.0.4 \
+		--project snakeoil:default --skip-bootkit $TMPD/manifest.yaml
+	./mosctl update -r $TMPD --dry-run --json ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.4 > $TMPD/plan.json
+	[ "$(jq -r '.removed[0].name' $TMPD/plan.json)" = "hostfstarget" ]
+	[ "$(jq -r '.storage_deleted[0].label' $TMPD/plan.json)" = "mostest-data" ]
+
+	./mosctl update -r $TMPD ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.4
+	(cd $TMPD/config/manifest.git; git show HEAD:manifest.json) > $TMPD/sys.json
+	[ "$(jq '.targets | length' $TMPD/sys.json)" -eq 1 ]
+	[ "$(jq -r '.targets[0].name' $TMPD/sys.json)" = "hostfs" ]
+	[ "$(jq '.storage | length' $TMPD/sys.json)" -eq 0 ]
+}
+
+@test "mos update refuses manifests signed with a revoked key" {
+	keysetdir=~/.local/share/machine/trust/keys/snakeoil
+	projdir=$keysetdir/manifest/leaked
+	rm -rf "$projdir" "$keysetdir/manifest-ca/crl.pem"
+	trust project add snakeoil leaked
+	write_install_yaml "hostfsonly"
+	./mosb manifest publish \
+		--repo ${ZOT_HOST}:${ZOT_PORT} --name puzzleos/install:leaked \
+		--project snakeoil:leaked --skip-bootkit $TMPD/manifest.yaml
+
+	# A machine whose clock is wrong can check as of another time
+	mkdir -p $TMPD/factory/secure
+	cp "$CA_PEM" "$TMPD/factory/secure/manifestCA.pem"
+	failed=0
+	./mosctl --verify-time 2000-01-01 install --rfs "$TMPD" ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:leaked || failed=1
+	[ $failed -eq 1 ]
+
+	# Revoke the key, and publish a manifest carrying the CRL
+	trust project revoke snakeoil leaked
+	openssl crl -noout -CAfile "$CA_PEM" -in "$keysetdir/manifest-ca/crl.pem"
+	./mosb manifest publish \
+		--repo ${ZOT_HOST}:${ZOT_PORT} --name puzzleos/install:1.0.0 \
+		--project snakeoil:default --skip-bootkit $TMPD/manifest.yaml
+	rm -rf "$projdir" "$keysetdir/manifest-ca/crl.pem"
+	regctl artifact list --filter-artifact-type application/vnd.machine.crl \
+		${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.0 | grep vnd.machine.crl
+
+	# Installing it saves the CRL, so that updating to the manifest
+	# signed with the revoked key fails, although it has no CRL
+	./mosctl install --rfs "$TMPD" ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.0
+	ls $TMPD/config/crl/*.crl
+	failed=0
+	./mosctl update -r $TMPD ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:leaked || failed=1
+	[ $failed -eq 1 ]
+
+	# As does installing it with the CRL next to the CA
+	cp $TMPD/config/crl/*.crl "$TMPD/factory/secure/manifestCA.crl"
+	rm -rf $TMPD/config $TMPD/atomfs-store
+	mkdir -p $TMPD/config $TMPD/atomfs-store
+	failed=0
+	./mosctl install --rfs "$TMPD" ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:leaked || failed=1
+	[ $failed -eq 1 ]
+}
+
+@test "mos update refuses a lower security version without a downgrade token" {
+	good_install hostfsonly
+	[ "$(cat $TMPD/config/security-version)" = "0" ]
+
+	sum=$(manifest_shasum busyboxu1-squashfs)
+	size=$(manifest_size busyboxu1-squashfs)
+	cat > $TMPD/manifest.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+security_version: 2
+targets:
+  - service_name: hostfs
+    source: oci:zothub:busyboxu1-squashfs
+    version: 1.0.2
+    digest: sha256:$sum
+    size: $size
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: none
+EOF
+	./mosb manifest publish \
+		--repo ${ZOT_HOST}:${ZOT_PORT} --name puzzleos/install:1.0.2 \
+		--project snakeoil:default --skip-bootkit $TMPD/manifest.yaml
+	./mosctl update -r $TMPD ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.2
+	[ "$(cat $TMPD/config/security-version)" = "2" ]
+	before=$(cd $TMPD/config/manifest.git; git rev-parse HEAD)
+
+	# Going back to the first manifest needs a token
+	failed=0
+	./mosctl update -r $TMPD ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.0 || failed=1
+	[ $failed -eq 1 ]
+	[ "$(cd $TMPD/config/manifest.git; git rev-parse HEAD)" = "$before" ]
+
+	# A token for another manifest will not do
+	./mosb manifest downgrade-token --project snakeoil:default \
+		-o $TMPD/token.json ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.2
+	failed=0
+	./mosctl update -r $TMPD --downgrade-token $TMPD/token.json \
+		${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.0 || failed=1
+	[ $failed -eq 1 ]
+
+	./mosb manifest downgrade-token --project snakeoil:default \
+		-o $TMPD/token.json ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.0
+	./mosctl update -r $TMPD --downgrade-token $TMPD/token.json \
+		${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.0
+	[ "$(cd $TMPD/config/manifest.git; git rev-parse HEAD~1)" = "$before" ]
+
+	# The highest version accepted is still recorded
+	[ "$(cat $TMPD/config/security-version)" = "2" ]
+}
+
+@test "mos rollback refuses a lower security version without a downgrade token" {
+	good_install hostfsonly
+
+	sum=$(manifest_shasum busyboxu1-squashfs)
+	size=$(manifest_size busyboxu1-squashfs)
+	cat > $TMPD/manifest.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+security_version: 2
+targets:
+  - service_name: hostfs
+    source: oci:zothub:busyboxu1-squashfs
+    version: 1.0.2
+    digest: sha256:$sum
+    size: $size
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: none
+EOF
+	./mosb manifest publish \
+		--repo ${ZOT_HOST}:${ZOT_PORT} --name puzzleos/install:1.0.2 \
+		--project snakeoil:default --skip-bootkit $TMPD/manifest.yaml
+	./mosctl update -r $TMPD ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.2
+	before=$(cd $TMPD/config/manifest.git; git rev-parse HEAD)
+
+	# The first manifest was accepted before, but is below version 2
+	failed=0
+	./mosctl rollback -r $TMPD --capath $TMPD/factory/secure/manifestCA.pem || failed=1
+	[ $failed -eq 1 ]
+	[ "$(cd $TMPD/config/manifest.git; git rev-parse HEAD)" = "$before" ]
+
+	./mosb manifest downgrade-token --project snakeoil:default \
+		-o $TMPD/token.json ${ZOT_HOST}:${ZOT_PORT}/puzzleos/install:1.0.0
+	./mosctl rollback -r $TMPD --capath $TMPD/factory/secure/manifestCA.pem \
+		--downgrade-token $TMPD/token.json
+	[ "$(cd $TMPD/config/manifest.git; git rev-parse HEAD~1)" = "$before" ]
+	[ "$(cat $TMPD/config/security-version)" = "2" ]
+}
@@ -13,7 +13,7 @@ sudo apt-get -y install \
 	openssl pip pkgconf skopeo socat squashfuse swtpm jq \
 	uidmap umoci qemu-utils qemu-system-x86 xorriso \
 	ubuntu-dev-tools make gcc squashfs-tools sbsigntool \
-	python3-yaml
+	python3-yaml softhsm2
 sudo modprobe kvm
 sudo adduser $(whoami) kvm
 sudo chmod o+rw /dev/kvm